@@ -6,6 +6,12 @@ import (
 
 // PluginSpec defines the desired state of Plugin
 type PluginSpec struct {
+	// KrewName is the name the plugin is published under in the index,
+	// if it should differ from the name of the Plugin. It is used as the
+	// name of the Krew manifest and of its archives.
+	// +optional
+	KrewName string `json:"krewName,omitempty"`
+
 	// ShortDescription of the plugin.
 	// +required
 	ShortDescription string `json:"shortDescription"`
@@ -22,6 +28,16 @@ type PluginSpec struct {
 	// +optional
 	Homepage string `json:"homepage,omitempty"`
 
+	// Deprecated marks the plugin as deprecated. It is still published,
+	// the deprecation is surfaced to the users installing it.
+	// +optional
+	Deprecated bool `json:"deprecated,omitempty"`
+
+	// DeprecationMessage tells the users of a deprecated plugin why it is
+	// deprecated and what to use instead.
+	// +optional
+	DeprecationMessage string `json:"deprecationMessage,omitempty"`
+
 	// Version of the plugin.
 	// +required
 	Version string `json:"version"`
@@ -34,6 +50,9 @@ type PluginSpec struct {
 // PluginPlatform defines per-OS and per-Arch binaries for the given plugin.
 type PluginPlatform struct {
 	// Platform for the given binary (i.e. linux/amd64, darwin/amd64, windows/amd64).
+	// An optional variant can be given to select the image manifest (i.e. linux/arm/v7).
+	// "all" expands into the default platforms which are not listed explicitly, {os}
+	// and {arch} of its images and files being replaced with the ones of each platform.
 	// +required
 	Platform string `json:"platform"`
 
@@ -42,6 +61,7 @@ type PluginPlatform struct {
 	Image string `json:"image"`
 
 	// ImagePullSecret to use when connecting to an image registry that requires authentication.
+	// It is given in namespace/name format, or name format for the secrets in the operator namespace.
 	// +optional
 	ImagePullSecret string `json:"imagePullSecret,omitempty"`
 
@@ -58,27 +78,82 @@ type PluginPlatform struct {
 	// +optional
 	ProxyURL string `json:"proxyURL,omitempty"`
 
+	// ArtifactType is the media type of the layers containing the files when
+	// the image is an OCI artifact rather than a runnable image. Each matching layer
+	// blob is used as the file whose base name is equal to its
+	// org.opencontainers.image.title annotation, or as the only file if the annotation is missing.
+	// If not specified, files are looked up in the filesystem of the image.
+	// +optional
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// LayerDigest is the digest of the image layer containing the files, as a hint
+	// to extract them without walking every layer of large images. The other layers
+	// are still walked if some files are not found in it.
+	// +optional
+	LayerDigest string `json:"layerDigest,omitempty"`
+
 	// Bin specifies the path to the plugin executable.
 	// The path is relative to the root of the installation folder.
 	// The binary will be linked after all FileOperations are executed.
-	// If not specified, plugin name is set.
+	// If not specified, plugin name is set, suffixed with .exe for windows.
+	// It must be the installation path of one of the Files.
 	// +optional
 	Bin string `json:"bin"`
+
+	// Sha256 is the expected hex encoded sha256 checksum of the Bin. If it does not
+	// match the extracted Bin, the platform is not published.
+	// +optional
+	Sha256 string `json:"sha256,omitempty"`
+
+	// MatchExpressions are added to the Krew selector of the platform, along with
+	// its os and arch labels, to further restrict the clients it is installed on.
+	// Krew matches them against the os and arch labels of the client.
+	// +optional
+	MatchExpressions []metav1.LabelSelectorRequirement `json:"matchExpressions,omitempty"`
 }
 
 // FileLocation specifies a file copying operation from plugin archive to the
 // installation directory.
 type FileLocation struct {
-	// From is the absolute file path within the image to copy from.
-	// Directories, wildcards and symlinks are not supported.
-	// +required
-	From string `json:"from"`
+	// From is the absolute file path within the image to copy from,
+	// or its base name with FindByName.
+	// Directories, wildcards and symlinks are not supported, see FromDir.
+	// Either From or FromDir must be set.
+	// +optional
+	From string `json:"from,omitempty"`
+
+	// FromDir is the absolute path of a directory within the image whose whole
+	// tree is copied, i.e. /opt/tool for a binary shipped along with its assets.
+	// The directory is placed under To like a file, keeping the structure of its tree.
+	// Either From or FromDir must be set.
+	// +optional
+	FromDir string `json:"fromDir,omitempty"`
 
 	// To is the relative path within the root of the installation folder to place the file.
 	// Default is set to "." where points the default Krew directory.
 	// +required
 	// +kubebuilder:default:="."
 	To string `json:"to"`
+
+	// Image containing the file, when it is not the Image of the platform,
+	// i.e. for a helper shipped in another image than the main binary. It is
+	// pulled with the imagePullSecret, caBundle and proxyURL of the platform.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// FindByName searches the image for From as a base name rather than an
+	// absolute path, i.e. kubectl when its location in a third-party image is
+	// unknown. Matches in /usr/local/bin, /usr/bin and /bin are preferred, in
+	// this order, otherwise the first match walking the layers from the most
+	// recent one wins. The resolved path is reported in the status of the platform.
+	// +optional
+	FindByName bool `json:"findByName,omitempty"`
+
+	// Mode overrides the permissions the file is stored with in the image,
+	// in octal format, i.e. "0755" for a binary stored without the executable
+	// bits. The permissions of the image are kept if not set.
+	// +optional
+	Mode string `json:"mode,omitempty"`
 }
 
 // PluginStatus defines the observed state of Plugin.
@@ -89,6 +164,64 @@ type PluginStatus struct {
 	// +listMapKey=type
 	// +optional
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Platforms are the observed states of the platforms of the plugin
+	// when it was last reconciled.
+	// +listType=map
+	// +listMapKey=platform
+	// +optional
+	Platforms []PluginPlatformStatus `json:"platforms,omitempty"`
+
+	// ValidationErrors are the invalid fields of the spec when the plugin
+	// was last reconciled, along with the InvalidField condition.
+	// +optional
+	ValidationErrors []PluginValidationError `json:"validationErrors,omitempty"`
+}
+
+// PluginValidationError describes an invalid field of the spec of the plugin.
+type PluginValidationError struct {
+	// Field is the path of the invalid field, i.e. spec.platforms[1].platform.
+	// +required
+	Field string `json:"field"`
+
+	// Value is the invalid value of the field, empty if it is missing.
+	// +optional
+	Value string `json:"value,omitempty"`
+
+	// Reason is the type of the validation error, i.e. FieldValueInvalid
+	// or FieldValueRequired.
+	// +required
+	Reason string `json:"reason"`
+}
+
+// PluginPlatformStatus defines the observed state of a platform of the plugin.
+type PluginPlatformStatus struct {
+	// Platform of the plugin, i.e. linux/amd64.
+	// +required
+	Platform string `json:"platform"`
+
+	// Conditions describe whether the platform is served. The plugin is
+	// partially installed when only some of its platforms are.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ImageDigests are the digests of the images the files of the platform
+	// were last extracted from, keyed by the image reference. The images are
+	// not pulled again as long as their remote digests are unchanged.
+	// +optional
+	ImageDigests map[string]string `json:"imageDigests,omitempty"`
+
+	// ResolvedImage is the image of the platform pinned by the digest it was
+	// last extracted from, i.e. the digest the latest tag resolved to.
+	// +optional
+	ResolvedImage string `json:"resolvedImage,omitempty"`
+
+	// ResolvedFiles are the paths in the image of the files searched by name,
+	// keyed by their name, i.e. kubectl: /opt/tools/bin/kubectl.
+	// +optional
+	ResolvedFiles map[string]string `json:"resolvedFiles,omitempty"`
 }
 
 //+kubebuilder:object:root=true
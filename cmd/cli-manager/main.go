@@ -27,6 +27,11 @@ func NewCLIManagerCommand() *cobra.Command {
 
 	start := cli_manager.NewCLIManagerCommand("start", false)
 	cmd.AddCommand(start)
+	cmd.AddCommand(cli_manager.NewValidateCommand())
+	cmd.AddCommand(cli_manager.NewExportCommand())
+	cmd.AddCommand(cli_manager.NewImportCommand())
+	cmd.AddCommand(cli_manager.NewImportKrewCommand())
+	cmd.AddCommand(cli_manager.NewRenderCommand())
 
 	return cmd
 }
@@ -0,0 +1,206 @@
+// Package client is a Go client of the HTTP API of the plugin index, decoding
+// its responses into the types served by the git package.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/pkg/git"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+	"github.com/openshift/cli-manager/pkg/platform"
+)
+
+// Options configures how the client reaches the index.
+type Options struct {
+	// HTTPClient sends the requests, i.e. with the CA bundle of the cluster.
+	// Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// BearerToken is sent in the Authorization header if set, i.e. when the
+	// index is reached through the aggregation layer of the API server.
+	BearerToken string
+}
+
+// Client calls the endpoints of the index served at its base URL.
+type Client struct {
+	baseURL *url.URL
+	options Options
+}
+
+// Error is returned for the error responses of the index.
+type Error git.ErrorResponse
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+// IsNotFound reports whether err is an Error for an unknown plugin or platform.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Reason == metav1.StatusReasonNotFound
+}
+
+// New returns a client of the index served at baseURL, i.e.
+// https://cli-manager.apps.example.com or the aggregated API prefix
+// https://api.example.com:6443/apis/index.cli-manager.openshift.io/v1alpha1.
+func New(baseURL string, options Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %s error: %w", baseURL, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid base URL %s, should be in https://host format", baseURL)
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL: u,
+		options: options,
+	}, nil
+}
+
+// List returns the plugins of the index, only the ones matching labelSelector if it is not empty.
+func (c *Client) List(ctx context.Context, labelSelector string) (*git.PluginList, error) {
+	query := url.Values{}
+	if len(labelSelector) > 0 {
+		query.Set("labelSelector", labelSelector)
+	}
+	list := &git.PluginList{}
+	if err := c.getJSON(ctx, "plugins/list/", query, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Info returns the specification and the status of the plugin.
+func (c *Client) Info(ctx context.Context, name string) (*git.PluginInfo, error) {
+	info := &git.PluginInfo{}
+	if err := c.getJSON(ctx, "plugins/info/", url.Values{"name": {name}}, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Platforms returns the platforms of the plugin in os/arch[/variant] format.
+func (c *Client) Platforms(ctx context.Context, name string) ([]string, error) {
+	var platforms []string
+	if err := c.getJSON(ctx, "plugins/platforms/", url.Values{"name": {name}}, &platforms); err != nil {
+		return nil, err
+	}
+	return platforms, nil
+}
+
+// Manifest returns the Krew manifest of the plugin, as it is published in the index.
+func (c *Client) Manifest(ctx context.Context, name string) (*krew.Plugin, error) {
+	body, err := c.get(ctx, "plugins/manifest/", url.Values{"name": {name}})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest of plugin %s: %w", name, err)
+	}
+	manifest := &krew.Plugin{}
+	if err := yaml.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("decoding manifest of plugin %s: %w", name, err)
+	}
+	return manifest, nil
+}
+
+// Digest returns the sha256 of the archive of the plugin for the platform,
+// as it is advertised in its Krew manifest.
+func (c *Client) Digest(ctx context.Context, name, p string) (string, error) {
+	parsed, err := platform.Parse(p)
+	if err != nil {
+		return "", err
+	}
+	manifest, err := c.Manifest(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	for _, kp := range manifest.Spec.Platforms {
+		uri, err := url.Parse(kp.URI)
+		if err != nil {
+			continue
+		}
+		if uri.Query().Get("platform") == parsed.FileName() {
+			return kp.Sha256, nil
+		}
+	}
+	return "", &Error{
+		Code:    http.StatusNotFound,
+		Reason:  metav1.StatusReasonNotFound,
+		Message: fmt.Sprintf("plugin %s for platform %s not found", name, p),
+	}
+}
+
+// Download returns the archive of the plugin for the platform, the caller
+// must close it.
+func (c *Client) Download(ctx context.Context, name, p string) (io.ReadCloser, error) {
+	parsed, err := platform.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	return c.get(ctx, "plugins/download/", url.Values{"name": {name}, "platform": {parsed.FileName()}})
+}
+
+func (c *Client) getJSON(ctx context.Context, endpoint string, query url.Values, obj interface{}) error {
+	body, err := c.get(ctx, endpoint, query)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(obj); err != nil {
+		return fmt.Errorf("decoding response of %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// get requests the endpoint relative to the cli-manager path of the base URL.
+// Error responses are returned as Error.
+func (c *Client) get(ctx context.Context, endpoint string, query url.Values) (io.ReadCloser, error) {
+	u := *c.baseURL
+	prefix := "/cli-manager/"
+	if strings.Contains(u.Path, "/apis/") {
+		// the aggregated API serves the endpoints without the cli-manager prefix
+		prefix = "/"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + prefix + endpoint
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.options.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.options.BearerToken)
+	}
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	e := &Error{}
+	if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Code == 0 {
+		return nil, &Error{
+			Code:    resp.StatusCode,
+			Reason:  metav1.StatusReasonUnknown,
+			Message: fmt.Sprintf("unexpected response %s of %s", resp.Status, endpoint),
+		}
+	}
+	return nil, e
+}
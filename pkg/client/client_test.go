@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/git"
+	"github.com/openshift/cli-manager/pkg/image"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+)
+
+// newTestServer serves the index with the oc plugin published for linux/amd64
+// and returns its URL along with the content of the archive.
+func newTestServer(t *testing.T) (string, string) {
+	t.Helper()
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	t.Cleanup(func() {
+		image.TarballPath = tarballPath
+	})
+	content := "oc tarball"
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	sum := sha256.Sum256([]byte(content))
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	err = repo.Upsert("oc", &krew.Plugin{
+		ObjectMeta: metav1.ObjectMeta{Name: "oc"},
+		Spec: krew.PluginSpec{
+			Version: "v4.15.0",
+			Platforms: []krew.Platform{
+				{
+					URI:    "https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+					Sha256: hex.EncodeToString(sum[:]),
+					Bin:    "oc",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+
+	plugin := &v1alpha1.Plugin{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "Plugin",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "oc",
+			Labels: map[string]string{"team": "cli"},
+		},
+		Spec: v1alpha1.PluginSpec{
+			ShortDescription: "Binary for oc",
+			Version:          "v4.15.0",
+			Platforms: []v1alpha1.PluginPlatform{
+				{Platform: "linux/amd64", Image: "quay.io/openshift/origin-cli:latest", Bin: "oc"},
+			},
+		},
+	}
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(plugin)
+	if err != nil {
+		t.Fatalf("unexpected conversion error %v", err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(&unstructured.Unstructured{Object: u}); err != nil {
+		t.Fatalf("unexpected indexer error %v", err)
+	}
+	lister := cache.NewGenericLister(indexer, v1alpha1.GroupVersion.WithResource("plugins").GroupResource())
+
+	server := httptest.NewServer(git.PrepareGitServer(repo, lister, git.Timeouts{}))
+	t.Cleanup(server.Close)
+	return server.URL, content
+}
+
+func TestClient(t *testing.T) {
+	baseURL, content := newTestServer(t)
+	c, err := New(baseURL, Options{})
+	if err != nil {
+		t.Fatalf("unexpected client error %v", err)
+	}
+	ctx := context.Background()
+
+	list, err := c.List(ctx, "team=cli")
+	if err != nil {
+		t.Fatalf("unexpected list error %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Name != "oc" {
+		t.Fatalf("unexpected plugin list %+v", list.Items)
+	}
+	list, err = c.List(ctx, "team=other")
+	if err != nil {
+		t.Fatalf("unexpected list error %v", err)
+	}
+	if len(list.Items) != 0 {
+		t.Fatalf("expected no plugin matching the label selector, got %+v", list.Items)
+	}
+
+	info, err := c.Info(ctx, "oc")
+	if err != nil {
+		t.Fatalf("unexpected info error %v", err)
+	}
+	if info.Spec.Version != "v4.15.0" {
+		t.Fatalf("unexpected plugin info %+v", info)
+	}
+
+	platforms, err := c.Platforms(ctx, "oc")
+	if err != nil {
+		t.Fatalf("unexpected platforms error %v", err)
+	}
+	if len(platforms) != 1 || platforms[0] != "linux/amd64" {
+		t.Fatalf("unexpected platforms %v", platforms)
+	}
+
+	digest, err := c.Digest(ctx, "oc", "linux/amd64")
+	if err != nil {
+		t.Fatalf("unexpected digest error %v", err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	if digest != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected digest %s", digest)
+	}
+
+	archive, err := c.Download(ctx, "oc", "linux/amd64")
+	if err != nil {
+		t.Fatalf("unexpected download error %v", err)
+	}
+	defer archive.Close()
+	data, err := io.ReadAll(archive)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if string(data) != content {
+		t.Fatalf("unexpected archive content %q", data)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	baseURL, _ := newTestServer(t)
+	c, err := New(baseURL, Options{})
+	if err != nil {
+		t.Fatalf("unexpected client error %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := c.Info(ctx, "unknown"); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if _, err := c.Download(ctx, "oc", "darwin/arm64"); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if _, err := c.Digest(ctx, "oc", "darwin/arm64"); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	_, err = c.List(ctx, "team in (")
+	if e, ok := err.(*Error); !ok || e.Code != http.StatusBadRequest {
+		t.Fatalf("expected bad request error, got %v", err)
+	}
+}
+
+func TestClientAggregatedAPI(t *testing.T) {
+	baseURL, _ := newTestServer(t)
+	var authorization string
+	c, err := New(baseURL+git.AggregatedPrefix, Options{
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				authorization = req.Header.Get("Authorization")
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		},
+		BearerToken: "token",
+	})
+	if err != nil {
+		t.Fatalf("unexpected client error %v", err)
+	}
+
+	info, err := c.Info(context.Background(), "oc")
+	if err != nil {
+		t.Fatalf("unexpected info error %v", err)
+	}
+	if info.Name != "oc" {
+		t.Fatalf("unexpected plugin info %+v", info)
+	}
+	if authorization != "Bearer token" {
+		t.Fatalf("expected the bearer token to be sent, got %q", authorization)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
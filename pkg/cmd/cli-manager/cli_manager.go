@@ -5,12 +5,20 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 
@@ -19,6 +27,7 @@ import (
 
 	"github.com/openshift/cli-manager/pkg/controller"
 	"github.com/openshift/cli-manager/pkg/git"
+	"github.com/openshift/cli-manager/pkg/image"
 )
 
 const (
@@ -28,9 +37,103 @@ const (
 	tlsKey            = "/etc/secrets/tls.key"
 )
 
-var ServeArtifactAsHttp bool
+var (
+	ServeArtifactAsHttp bool
+	ImagePullTimeout    time.Duration
+	SyncTimeout         time.Duration
+	RegistryMirrors     map[string]string
+	ImagePullProxy      string
+	ImagePullNoProxy    []string
+	GitAuthorName       string
+	GitAuthorEmail      string
+	SecretNamespace     string
+	DownloadBaseURL     string
+	DownloadQuery       map[string]string
+	GitRequestTimeout   time.Duration
+	GitTransferTimeout  time.Duration
+	PluginSelector      string
+	SweepInterval       time.Duration
+	ResyncInterval      time.Duration
+	RequireDigestPinned bool
+	AllowedRegistries   []string
+	DefaultPlatforms    []string
+	ImageVariables      string
+	Workers             int
+	// MetricsInsecureAddr serves the metrics over plain HTTP on this address
+	// instead of over TLS, i.e. 127.0.0.1:60000 for a Prometheus sidecar.
+	MetricsInsecureAddr string
+	DownloadAuditLog    string
+	ManifestSigningKey  string
+	PluginAPIVersion    string
+	// APIPort serves the download and JSON API endpoints on a separate
+	// listener allowing HTTP/2, if it is not 0.
+	APIPort int
+	// ArchiveVerifyInterval verifies the served archives against the
+	// manifests of the index periodically, if it is not 0.
+	ArchiveVerifyInterval time.Duration
+	// ReadOnly freezes the index, which keeps serving the last published plugins.
+	ReadOnly bool
+	// ReadOnlyConfigMap freezes or unfreezes the index at runtime, if it is set.
+	ReadOnlyConfigMap string
+	// CompressionLevel is the compress/flate level of the plugin archives.
+	CompressionLevel int
+	// ZstdArchives writes a zstd compressed tarball along the tar.gz archives.
+	ZstdArchives bool
+	// ArchiveLayout is how the files are named in the plugin archives.
+	ArchiveLayout string
+	// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For
+	// header is trusted.
+	TrustedProxies []string
+)
 
 func RunCLIManager(ctx context.Context, controllerContext *controllercmd.ControllerContext) error {
+	if Workers < 1 {
+		return fmt.Errorf("invalid number of workers %d, should be at least 1", Workers)
+	}
+	var imagePullProxy *url.URL
+	if len(ImagePullProxy) > 0 {
+		var err error
+		imagePullProxy, err = url.Parse(ImagePullProxy)
+		if err != nil || len(imagePullProxy.Host) == 0 {
+			return fmt.Errorf("invalid image pull proxy %s, should be a URL i.e. https://proxy.example.com:3128", ImagePullProxy)
+		}
+		if imagePullProxy.Scheme == "http" {
+			return fmt.Errorf("http is not supported for image pull proxy %s", ImagePullProxy)
+		}
+	}
+	if ResyncInterval <= 0 {
+		return fmt.Errorf("invalid resync interval %s, should be positive", ResyncInterval)
+	}
+	if git.ClientRateLimit.QPS > 0 && git.ClientRateLimit.Burst < 1 {
+		return fmt.Errorf("invalid client rate limit burst %d, should be at least 1", git.ClientRateLimit.Burst)
+	}
+	for _, cidr := range TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s, should be a CIDR i.e. 10.128.0.0/14: %w", cidr, err)
+		}
+		git.TrustedProxies = append(git.TrustedProxies, network)
+	}
+	// the index is cloned by Krew through the git binary
+	if err := git.CheckGitBinary(); err != nil {
+		return err
+	}
+	if len(DownloadAuditLog) > 0 {
+		auditLog, err := openAuditLog(DownloadAuditLog)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		git.AuditLog = auditLog
+	}
+	if len(ManifestSigningKey) > 0 {
+		signingKey, err := git.LoadSigningKey(ManifestSigningKey)
+		if err != nil {
+			return err
+		}
+		git.SigningKey = signingKey
+	}
+
 	dynamicClient, err := dynamic.NewForConfig(controllerContext.KubeConfig)
 	if err != nil {
 		return err
@@ -46,26 +149,97 @@ func RunCLIManager(ctx context.Context, controllerContext *controllercmd.Control
 		return err
 	}
 
-	repo, err := git.PrepareLocalGit()
+	pluginAPIVersion, err := schema.ParseGroupVersion(PluginAPIVersion)
+	if err != nil || pluginAPIVersion.Empty() {
+		return fmt.Errorf("invalid plugin API version %q, should be in group/version format", PluginAPIVersion)
+	}
+	pluginResource := pluginAPIVersion.WithResource(controller.DefaultPluginResource.Resource)
+	if err := controller.CheckPluginResource(client.Discovery(), pluginResource); err != nil {
+		return err
+	}
+
+	var pluginSelector labels.Selector
+	if len(PluginSelector) > 0 {
+		pluginSelector, err = labels.Parse(PluginSelector)
+		if err != nil {
+			return fmt.Errorf("invalid plugin label selector %s: %w", PluginSelector, err)
+		}
+	}
+
+	extractOptions := image.ExtractOptions{
+		CompressionLevel: CompressionLevel,
+		Zstd:             ZstdArchives,
+		Layout:           ArchiveLayout,
+	}
+	options := controller.Options{
+		InsecureHTTP:            ServeArtifactAsHttp,
+		ImagePullTimeout:        ImagePullTimeout,
+		SyncTimeout:             SyncTimeout,
+		RegistryMirrors:         RegistryMirrors,
+		ImagePullProxy:          imagePullProxy,
+		ImagePullNoProxy:        ImagePullNoProxy,
+		SecretNamespace:         SecretNamespace,
+		DownloadBaseURL:         DownloadBaseURL,
+		DownloadQuery:           DownloadQuery,
+		LabelSelector:           pluginSelector,
+		RequireDigestPinned:     RequireDigestPinned,
+		AllowedRegistries:       AllowedRegistries,
+		DefaultPlatforms:        DefaultPlatforms,
+		ImageVariablesConfigMap: ImageVariables,
+		PluginResource:          pluginResource,
+		Extract:                 &extractOptions,
+		ReadOnly:                ReadOnly,
+		ReadOnlyConfigMap:       ReadOnlyConfigMap,
+	}
+
+	readOnly, err := controller.InitialReadOnly(ctx, client, options)
+	if err != nil {
+		return err
+	}
+	repo, err := prepareRepo(git.GitRepoPath, readOnly, git.Author{
+		Name:  GitAuthorName,
+		Email: GitAuthorEmail,
+	})
 	if err != nil {
 		return err
 	}
 
-	informers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
-	cliSyncController, err := controller.NewCLISyncController(repo, informers, client, dynamicClient, route, ServeArtifactAsHttp, controllerContext.EventRecorder)
+	// Plugins are cluster-scoped, they can only be watched cluster-wide and
+	// are restricted by --plugin-label-selector instead of namespaces.
+	informers := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, metav1.NamespaceAll, nil)
+	// the image pull secrets may be referenced in any namespace
+	kubeInformers := kubeinformers.NewSharedInformerFactory(client, 0)
+	cliSyncController, err := controller.NewCLISyncController(repo, informers, kubeInformers, client, dynamicClient, route, options, controllerContext.EventRecorder)
 	if err != nil {
 		return err
 	}
 
+	// HTTP endpoints share the informer of the controller so that they serve
+	// exactly the same Plugin resources which are published in the index.
+	lister := informers.ForResource(pluginResource).Lister()
+	if pluginSelector != nil {
+		lister = git.SelectedLister(lister, pluginSelector)
+	}
+
 	informers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
 	informers.WaitForCacheSync(ctx.Done())
+	kubeInformers.WaitForCacheSync(ctx.Done())
+	if err := cliSyncController.ExpectInitialSync(); err != nil {
+		return err
+	}
 
-	mux := git.PrepareGitServer()
+	mux := git.PrepareGitServer(repo, lister, git.Timeouts{
+		Request:  GitRequestTimeout,
+		Transfer: GitTransferTimeout,
+	})
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", PortNumber),
-		Handler:      mux,
-		ReadTimeout:  5 * time.Minute,
-		WriteTimeout: 15 * time.Minute,
+		Addr:    fmt.Sprintf(":%d", PortNumber),
+		Handler: mux,
+		// read and write deadlines are set by each endpoint
+		// according to the size of what it serves.
+		ReadHeaderTimeout: time.Minute,
+		IdleTimeout:       5 * time.Minute,
 		// 1MB size should be sufficient
 		MaxHeaderBytes: 1 << 20,
 		TLSNextProto:   map[string]func(*http.Server, *tls.Conn, http.Handler){}, // disable HTTP/2
@@ -77,20 +251,123 @@ func RunCLIManager(ctx context.Context, controllerContext *controllercmd.Control
 		}
 	}()
 
-	metricsMux := http.NewServeMux()
-	metricsMux.Handle("/metrics", promhttp.Handler())
-	metricsServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", MetricsPortNumber),
-		Handler: metricsMux,
+	if APIPort > 0 {
+		apiListener, err := net.Listen("tcp", fmt.Sprintf(":%d", APIPort))
+		if err != nil {
+			return fmt.Errorf("listening for the API on port %d: %w", APIPort, err)
+		}
+		certFile, keyFile := tlsCRT, tlsKey
+		if ServeArtifactAsHttp {
+			certFile, keyFile = "", ""
+		}
+		go func() {
+			if err := serveAPI(apiListener, mux, certFile, keyFile); !errors.Is(err, http.ErrServerClosed) {
+				klog.Errorf("API server exited with error %s", err.Error())
+			}
+		}()
 	}
 
+	metricsAddr := fmt.Sprintf(":%d", MetricsPortNumber)
+	insecureMetrics := len(MetricsInsecureAddr) > 0
+	if insecureMetrics {
+		metricsAddr = MetricsInsecureAddr
+	}
+	metricsListener, err := net.Listen("tcp", metricsAddr)
+	if err != nil {
+		return fmt.Errorf("listening for metrics on %s: %w", metricsAddr, err)
+	}
 	go func() {
-		if err := metricsServer.ListenAndServeTLS(tlsCRT, tlsKey); !errors.Is(err, http.ErrServerClosed) {
+		if err := serveMetrics(metricsListener, insecureMetrics); !errors.Is(err, http.ErrServerClosed) {
 			klog.Errorf("metrics server exited with error %s", err.Error())
 		}
 	}()
 
-	go cliSyncController.Run(ctx, 1)
+	// the workers reconcile different Plugins concurrently, the commits
+	// in the index are serialized by the repo.
+	go cliSyncController.Run(ctx, Workers)
+	go cliSyncController.RunSweeper(ctx, SweepInterval)
+	go cliSyncController.RunResync(ctx, ResyncInterval)
+	if ArchiveVerifyInterval > 0 {
+		go repo.RunVerifier(ctx, ArchiveVerifyInterval)
+	}
 	<-ctx.Done()
 	return nil
 }
+
+// prepareRepo returns the git index at path, which is the one of the previous
+// run if the index is read-only on start so that its plugins are still served,
+// and a new empty index otherwise. A read-only index is ready right away, as
+// none of the plugins is published until it is writable.
+func prepareRepo(path string, readOnly bool, author git.Author) (*git.Repo, error) {
+	if !readOnly {
+		return git.PrepareLocalGit(path, author)
+	}
+	repo, err := git.OpenLocalGit(path, author)
+	if err == nil {
+		klog.InfoS("Index is read-only, the index of the previous run is served", "path", path)
+	} else {
+		klog.ErrorS(err, "Index is read-only but the index of the previous run can not be opened, an empty index is served", "path", path)
+		repo, err = git.PrepareLocalGit(path, author)
+		if err != nil {
+			return nil, err
+		}
+	}
+	repo.SetReady()
+	return repo, nil
+}
+
+// serveMetrics serves the metrics on l, over plain HTTP if insecure and over
+// TLS with the mounted certificate otherwise.
+func serveMetrics(l net.Listener, insecure bool) error {
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsServer := &http.Server{
+		Handler: metricsMux,
+	}
+	if insecure {
+		klog.Warningf("serving metrics over plain HTTP on %s", l.Addr())
+		return metricsServer.Serve(l)
+	}
+	return metricsServer.ServeTLS(l, tlsCRT, tlsKey)
+}
+
+// serveAPI serves the download and JSON API endpoints of mux on l, over TLS
+// with the certificate and key files if they are set. Clients negotiate
+// HTTP/2 over TLS, to download many plugins concurrently over the same
+// connection. Plain HTTP is only served over HTTP/1.1.
+func serveAPI(l net.Listener, mux http.Handler, certFile, keyFile string) error {
+	apiServer := &http.Server{
+		Handler: git.APIHandler(mux),
+		// read and write deadlines are set by each endpoint
+		// according to the size of what it serves.
+		ReadHeaderTimeout: time.Minute,
+		IdleTimeout:       5 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+	}
+	if len(certFile) == 0 {
+		klog.Warningf("serving the API over plain HTTP/1.1 on %s", l.Addr())
+		return apiServer.Serve(l)
+	}
+	return apiServer.ServeTLS(l, certFile, keyFile)
+}
+
+// openAuditLog opens the file the download audit records are appended to,
+// - being the standard output.
+func openAuditLog(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening download audit log %s: %w", path, err)
+	}
+	return f, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
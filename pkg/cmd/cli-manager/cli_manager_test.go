@@ -0,0 +1,203 @@
+package cli_manager
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/cli-manager/pkg/controller"
+	"github.com/openshift/cli-manager/pkg/git"
+	"github.com/openshift/cli-manager/pkg/image"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+)
+
+func TestServeMetricsInsecure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen error %v", err)
+	}
+	defer l.Close()
+	go serveMetrics(l, true)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected get error %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if !strings.Contains(string(data), "# TYPE") {
+		t.Fatalf("expected metrics, got %s", data)
+	}
+}
+
+func TestServeMetricsTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen error %v", err)
+	}
+	defer l.Close()
+	// the certificate is not mounted, metrics are never served over plain HTTP
+	if err := serveMetrics(l, false); err == nil || err == http.ErrServerClosed {
+		t.Fatalf("expected the missing certificate to be reported, got %v", err)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate of 127.0.0.1
+// and its key, and returns their paths along with the certificate pool.
+func writeTestCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected key error %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cli-manager"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected certificate error %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected key marshal error %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected parse error %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeAPIHTTP2(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	// larger than the flow control windows of HTTP/2
+	content := bytes.Repeat([]byte("oc archive "), 4<<20)
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), content, 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "git"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected git error %v", err)
+	}
+	lister := cache.NewGenericLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}), controller.DefaultPluginResource.GroupResource())
+	mux := git.PrepareGitServer(repo, lister, git.Timeouts{})
+
+	certFile, keyFile, pool := writeTestCertificate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected listen error %v", err)
+	}
+	defer l.Close()
+	go serveAPI(l, mux, certFile, keyFile)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	baseURL := "https://" + l.Addr().String()
+	resp, err := client.Get(baseURL + "/cli-manager/plugins/download/?name=oc&platform=linux_amd64")
+	if err != nil {
+		t.Fatalf("unexpected download error %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("expected %d over HTTP/2, got %d over %s", http.StatusOK, resp.StatusCode, resp.Proto)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("expected %d bytes of the archive, got %d", len(content), len(data))
+	}
+
+	// the index is only cloned from the git listener
+	resp, err = client.Get(baseURL + "/cli-manager/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatalf("unexpected get error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestPrepareRepoReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cli-manager")
+	// there is no index of a previous run yet
+	repo, err := prepareRepo(path, true, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	// the empty index is still served while it is read-only
+	if !repo.Ready() {
+		t.Fatal("expected the empty read-only index to be ready")
+	}
+	if err := repo.Upsert("oc", &krew.Plugin{}); err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+
+	// the index of the previous run is served while it is read-only
+	repo, err = prepareRepo(path, true, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	if names, err := repo.List(); err != nil || len(names) != 1 || names[0] != "oc" {
+		t.Fatalf("expected the published plugin to be kept, got %v error %v", names, err)
+	}
+	if !repo.Ready() {
+		t.Fatal("expected the index of the previous run to be ready")
+	}
+
+	repo, err = prepareRepo(path, false, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	if names, err := repo.List(); err != nil || len(names) != 0 {
+		t.Fatalf("expected a new empty index, got %v error %v", names, err)
+	}
+}
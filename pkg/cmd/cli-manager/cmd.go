@@ -3,11 +3,16 @@ package cli_manager
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/openshift/library-go/pkg/controller/controllercmd"
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
 
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/controller"
+	"github.com/openshift/cli-manager/pkg/git"
+	"github.com/openshift/cli-manager/pkg/image"
 	"github.com/openshift/cli-manager/pkg/version"
 )
 
@@ -27,6 +32,43 @@ func NewCLIManagerCommand(name string, supportHttp bool) *cobra.Command {
 	cmd.Use = name
 	cmd.Short = "Start the CLI manager controllers"
 
+	cmd.Flags().DurationVar(&ImagePullTimeout, "image-pull-timeout", 10*time.Minute, "Maximum duration of pulling and extracting the image of a single plugin platform. Zero means no deadline.")
+	cmd.Flags().DurationVar(&SyncTimeout, "sync-timeout", 30*time.Minute, "Maximum duration of reconciling a single plugin. Zero means no deadline.")
+	cmd.Flags().StringToStringVar(&RegistryMirrors, "registry-mirror", nil, "Mirrors images are pulled from instead of their source registries or repositories, in source=mirror format (i.e. quay.io/openshift=mirror.example.com:5000/openshift). The most specific source takes precedence.")
+	cmd.Flags().StringVar(&ImagePullProxy, "image-pull-proxy", "", "Proxy the images of the plugins are pulled through (i.e. https://proxy.example.com:3128), unless their platform sets a proxyURL. Defaults to the proxy of the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.")
+	cmd.Flags().StringSliceVar(&ImagePullNoProxy, "image-pull-no-proxy", nil, "Registries pulled from directly instead of through --image-pull-proxy or the proxyURL of the platform, as hosts, domains matching their subdomains (i.e. .example.com), IP addresses, CIDRs or * for every registry.")
+	cmd.Flags().StringVar(&SecretNamespace, "image-pull-secret-namespace", getNamespace(), "Namespace of the image pull secrets referenced without namespace by the plugins. Defaults to the namespace of the operator.")
+	cmd.Flags().StringVar(&DownloadBaseURL, "download-base-url", "", "Base URL of the plugin downloads advertised in the index, i.e. https://cli-manager.example.com for clusters behind an external load balancer. Defaults to the host of the openshift-cli-manager route.")
+	cmd.Flags().StringToStringVar(&DownloadQuery, "download-query-param", nil, "Query parameters added to the URI of the plugin archives advertised in the index in key=value format, i.e. token=... for a CDN in front of the downloads. name and platform can not be overridden.")
+	cmd.Flags().BoolVar(&RequireDigestPinned, "require-digest-pinned", false, "Reject the plugin platforms whose images are not pinned by digest (i.e. image@sha256:...), as mutable tags can silently change the published plugins. Mutable tags are only warned about otherwise.")
+	cmd.Flags().StringSliceVar(&AllowedRegistries, "allowed-registry", nil, "Registries the images of the plugins may be pulled from (i.e. quay.io,registry.example.com:5000), the platforms whose images are in other registries are rejected before pulling. Defaults to every registry.")
+	cmd.Flags().StringSliceVar(&DefaultPlatforms, "default-platforms", controller.DefaultPlatforms, "Platforms the \"all\" platform of the plugins expands into, the platforms listed explicitly in a plugin take precedence.")
+	cmd.Flags().StringVar(&ImageVariables, "image-variables-configmap", "", "ConfigMap in the namespace of the operator whose keys are the variables expanded in the images of the plugins, i.e. REGISTRY for ${REGISTRY}/openshift/origin-cli:4.15. Images with any other variable are rejected.")
+	cmd.Flags().StringVar(&PluginAPIVersion, "plugin-api-version", v1alpha1.GroupVersion.String(), "Group and version the Plugins are read from, i.e. to follow the promotion of the Plugin API to another version. It should be served by the API server with the same schema.")
+	cmd.Flags().StringVar(&PluginSelector, "plugin-label-selector", "", "Label selector of the plugins published in the index (i.e. team=cli), the others are not served. Defaults to every plugin.")
+	cmd.Flags().IntVar(&Workers, "workers", 1, "Number of plugins reconciled concurrently, so that a slow image pull does not block the other plugins. Should be at least 1.")
+	cmd.Flags().DurationVar(&ResyncInterval, "resync-interval", 10*time.Minute, "Interval of re-listing every plugin from the API server and reconciling the drift of the index, in case the events of some plugins were missed. Plugins which are already published are not extracted again.")
+	cmd.Flags().DurationVar(&ArchiveVerifyInterval, "archive-verify-interval", 0, "Interval of verifying that the sha256 of the served plugin archives still match the manifests of the index, reported by the cli_manager_plugin_archive_mismatches metric. Zero disables the periodic verification, the archives are still verified on demand by the verify endpoint.")
+	cmd.Flags().BoolVar(&ReadOnly, "read-only", false, "Freeze the index during a maintenance, the plugins are neither published, updated nor removed while the index and the archives already published are still served. Plugins are reconciled once it is writable again.")
+	cmd.Flags().StringVar(&ReadOnlyConfigMap, "read-only-configmap", "", "ConfigMap in --image-pull-secret-namespace whose readOnly key set to true or false freezes or unfreezes the index at runtime, overriding --read-only while it is set.")
+	cmd.Flags().DurationVar(&SweepInterval, "orphan-sweep-interval", 10*time.Minute, "Interval of removing the plugins of the index whose Plugin no longer exists, in addition to the removal on Plugin deletion.")
+	cmd.Flags().Int64Var(&image.MaxFileSize, "max-extracted-file-size", image.MaxFileSize, "Maximum size in bytes of a single file extracted from a plugin image.")
+	cmd.Flags().Int64Var(&image.MaxExtractSize, "max-extracted-size", image.MaxExtractSize, "Maximum size in bytes of all the files extracted for a plugin platform.")
+	cmd.Flags().IntVar(&CompressionLevel, "archive-compression-level", image.DefaultExtractOptions.CompressionLevel, "Compression level of the plugin archives, from 0 storing the files uncompressed to 9 for the best compression. -1 is the default level of gzip.")
+	cmd.Flags().StringVar(&ArchiveLayout, "archive-layout", image.DefaultExtractOptions.Layout, "Layout of the files in the plugin archives: image keeps their paths in the image (i.e. usr/bin/oc), flat keeps their base names (i.e. oc) and prefixed puts their paths in the image under the name of the plugin (i.e. oc/usr/bin/oc). Their installation paths are the same in every layout.")
+	cmd.Flags().BoolVar(&ZstdArchives, "zstd-archives", image.DefaultExtractOptions.Zstd, "Write a zstd compressed tarball along the tar.gz archive of the plugins, served to the clients accepting the zstd encoding. Windows archives stay zip.")
+	cmd.Flags().StringVar(&GitAuthorName, "git-author-name", git.DefaultAuthor.Name, "Name of the author of the commits in the plugin index.")
+	cmd.Flags().StringVar(&GitAuthorEmail, "git-author-email", git.DefaultAuthor.Email, "Email of the author of the commits in the plugin index.")
+	cmd.Flags().StringVar(&MetricsInsecureAddr, "metrics-insecure-bind-address", "", "Address to serve the metrics on over plain HTTP instead of over TLS, i.e. 127.0.0.1:60000 for a Prometheus sidecar scraping localhost. Defaults to serving them over TLS on port 60000.")
+	cmd.Flags().IntVar(&APIPort, "api-port", 0, "Port of a separate listener serving the plugin downloads and the JSON API endpoints over TLS with HTTP/2, i.e. for a passthrough route in front of many concurrent downloads. The git index is only cloned from port 9449 over HTTP/1.1. Disabled if 0.")
+	cmd.Flags().Float64Var(&git.ClientRateLimit.QPS, "client-rate-limit-qps", 20, "Git and plugin download requests per second each client IP is refilled with. Zero disables the rate limiting.")
+	cmd.Flags().IntVar(&git.ClientRateLimit.Burst, "client-rate-limit-burst", 100, "Git and plugin download requests each client IP may send at once. Should be at least 1 if the rate limiting is enabled.")
+	cmd.Flags().StringSliceVar(&TrustedProxies, "trusted-proxies", nil, "CIDRs of the routers in front of the Route (i.e. 10.128.0.0/14), whose X-Forwarded-For header is trusted as the client IP of the rate limiting and the download audit log. Defaults to trusting no proxy, the client IP being the remote address of the connection.")
+	cmd.Flags().StringVar(&DownloadAuditLog, "download-audit-log", "", "File the audit records of the plugin downloads are appended to as JSON lines, - for the standard output. Downloads are not audited by default.")
+	cmd.Flags().StringVar(&ManifestSigningKey, "manifest-signing-key", "", "PEM encoded PKCS #8 Ed25519 private key signing the Krew manifests of the index (i.e. generated with openssl genpkey -algorithm ed25519). The detached signatures are committed next to the manifests and served by the signature endpoint. Manifests are not signed by default.")
+	cmd.Flags().DurationVar(&GitRequestTimeout, "git-request-timeout", time.Minute, "Maximum duration of serving small requests such as the git advertisement and the plugin metadata. Zero means no deadline.")
+	cmd.Flags().DurationVar(&GitTransferTimeout, "git-transfer-timeout", 30*time.Minute, "Maximum duration of serving git clones and fetches and the plugin downloads. Zero means no deadline.")
+
 	if supportHttp {
 		cmd.Flags().BoolVar(&ServeArtifactAsHttp, "serve-artifacts-in-http", false, "serving artifact in HTTP instead of HTTPS. That is used for testing purposes only. Using the flag in production is at your own risk. This flag is not supported.")
 		cmd.Flags().MarkHidden("serve-artifacts-in-http")
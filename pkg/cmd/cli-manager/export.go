@@ -0,0 +1,411 @@
+package cli_manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/pkg/git"
+	"github.com/openshift/cli-manager/pkg/image"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+	"github.com/openshift/cli-manager/pkg/platform"
+)
+
+const (
+	// exportManifestName is the entry of the exported archive listing the
+	// checksums of the other entries. It is written last.
+	exportManifestName = "manifest.yaml"
+	// exportPluginsDir is the directory of the Krew manifests in the exported archive.
+	exportPluginsDir = "plugins"
+	// exportArchivesDir is the directory of the plugin archives in the exported archive.
+	exportArchivesDir = "archives"
+)
+
+// safeExportNameRegexp matches the file names which are restored by import.
+var safeExportNameRegexp = regexp.MustCompile(`^[\w.-]+$`)
+
+// exportManifest lists the files of an exported index with their checksums.
+type exportManifest struct {
+	Files []exportFile `json:"files"`
+}
+
+type exportFile struct {
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256"`
+}
+
+type exportOptions struct {
+	fileName    string
+	gitRepoPath string
+	tarballPath string
+
+	out io.Writer
+}
+
+// NewExportCommand creates a command bundling the Krew index and the plugin
+// archives into a single archive, to be carried into disconnected environments.
+func NewExportCommand() *cobra.Command {
+	o := &exportOptions{
+		out: os.Stdout,
+	}
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the Krew index and the plugin archives into a single archive",
+		Long: "Export the Krew index and the plugin archives into a single tar.gz archive.\n" +
+			"The archive is restored into another instance with the import command, i.e. in a disconnected environment.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run()
+		},
+	}
+	cmd.Flags().StringVarP(&o.fileName, "filename", "f", "", "Archive file to export to.")
+	cmd.Flags().StringVar(&o.gitRepoPath, "git-repo-path", git.GitRepoPath, "Path of the git repository of the Krew index.")
+	cmd.Flags().StringVar(&o.tarballPath, "tarball-path", image.TarballPath, "Directory of the plugin archives.")
+	cmd.MarkFlagRequired("filename")
+	return cmd
+}
+
+func (o *exportOptions) run() error {
+	manifests, err := filepath.Glob(filepath.Join(o.gitRepoPath, exportPluginsDir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	var archives []string
+	for _, pattern := range []string{"*.tar.gz", "*.zip"} {
+		matches, err := filepath.Glob(filepath.Join(o.tarballPath, pattern))
+		if err != nil {
+			return err
+		}
+		archives = append(archives, matches...)
+	}
+	sort.Strings(archives)
+
+	f, err := os.Create(o.fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	manifest := exportManifest{}
+	for _, m := range manifests {
+		file, err := writeExportFile(tw, m, path.Join(exportPluginsDir, filepath.Base(m)))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	for _, a := range archives {
+		file, err := writeExportFile(tw, a, path.Join(exportArchivesDir, filepath.Base(a)))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     exportManifestName,
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(o.out, "exported %d plugins and %d archives to %s\n", len(manifests), len(archives), o.fileName)
+	return nil
+}
+
+// writeExportFile writes the file at src into the archive as name
+// and returns its checksum.
+func writeExportFile(tw *tar.Writer, src, name string) (exportFile, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return exportFile{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return exportFile{}, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}); err != nil {
+		return exportFile{}, fmt.Errorf("writing tar header of %s: %v", name, err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, hash), f); err != nil {
+		return exportFile{}, fmt.Errorf("writing tar contents of %s: %v", name, err)
+	}
+	return exportFile{
+		Path:   name,
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+type importOptions struct {
+	fileName    string
+	gitRepoPath string
+	tarballPath string
+
+	out io.Writer
+}
+
+// NewImportCommand creates a command restoring an archive created by the
+// export command into the Krew index and the plugin archives.
+func NewImportCommand() *cobra.Command {
+	o := &importOptions{
+		out: os.Stdout,
+	}
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import the Krew index and the plugin archives exported by the export command",
+		Long: "Import the Krew index and the plugin archives exported by the export command.\n" +
+			"The checksums of the files are verified before anything is restored. The Krew manifests are committed " +
+			"to the git repository, which is created if it does not exist.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run()
+		},
+	}
+	cmd.Flags().StringVarP(&o.fileName, "filename", "f", "", "Archive file created by the export command.")
+	cmd.Flags().StringVar(&o.gitRepoPath, "git-repo-path", git.GitRepoPath, "Path of the git repository of the Krew index.")
+	cmd.Flags().StringVar(&o.tarballPath, "tarball-path", image.TarballPath, "Directory of the plugin archives.")
+	cmd.MarkFlagRequired("filename")
+	return cmd
+}
+
+func (o *importOptions) run() error {
+	dir, err := os.MkdirTemp("", "cli-manager-import")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// files are staged and verified before anything is restored,
+	// so that a corrupted archive does not leave a partial index.
+	checksums, manifest, err := stageImportFiles(o.fileName, dir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("%s is not found in %s", exportManifestName, o.fileName)
+	}
+	if len(manifest.Files) != len(checksums) {
+		return fmt.Errorf("%s lists %d files, %s contains %d", exportManifestName, len(manifest.Files), o.fileName, len(checksums))
+	}
+	for _, file := range manifest.Files {
+		checksum, ok := checksums[file.Path]
+		if !ok {
+			return fmt.Errorf("%s is not found in %s", file.Path, o.fileName)
+		}
+		if checksum != file.Sha256 {
+			return fmt.Errorf("checksum mismatch of %s: expected sha256 %s, got %s", file.Path, file.Sha256, checksum)
+		}
+	}
+
+	plugins := map[string]*krew.Plugin{}
+	manifests, err := filepath.Glob(filepath.Join(dir, exportPluginsDir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	for _, m := range manifests {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			return err
+		}
+		plugin := &krew.Plugin{}
+		if err := yaml.UnmarshalStrict(data, plugin); err != nil {
+			return fmt.Errorf("invalid plugin manifest %s: %w", filepath.Base(m), err)
+		}
+		// the checksums advertised to Krew must still match the archives
+		for _, p := range plugin.Spec.Platforms {
+			uri, err := url.Parse(p.URI)
+			if err != nil {
+				return fmt.Errorf("invalid uri %s of plugin manifest %s: %w", p.URI, filepath.Base(m), err)
+			}
+			parsed, err := platform.Parse(uri.Query().Get("platform"))
+			if err != nil {
+				return fmt.Errorf("invalid uri %s of plugin manifest %s: %w", p.URI, filepath.Base(m), err)
+			}
+			archive := path.Join(exportArchivesDir, image.ArchiveName(uri.Query().Get("name"), parsed))
+			checksum, ok := checksums[archive]
+			if !ok {
+				return fmt.Errorf("%s of plugin manifest %s is not found in %s", archive, filepath.Base(m), o.fileName)
+			}
+			if checksum != p.Sha256 {
+				return fmt.Errorf("checksum mismatch of %s: plugin manifest %s expects sha256 %s, got %s", archive, filepath.Base(m), p.Sha256, checksum)
+			}
+		}
+		plugins[strings.TrimSuffix(filepath.Base(m), ".yaml")] = plugin
+	}
+
+	var repo *git.Repo
+	if _, err := os.Stat(filepath.Join(o.gitRepoPath, ".git")); os.IsNotExist(err) {
+		repo, err = git.PrepareLocalGit(o.gitRepoPath, git.Author{})
+		if err != nil {
+			return err
+		}
+	} else {
+		repo, err = git.OpenLocalGit(o.gitRepoPath, git.Author{})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(o.tarballPath, 0755); err != nil {
+		return err
+	}
+	archives, err := os.ReadDir(filepath.Join(dir, exportArchivesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, a := range archives {
+		if err := copyFile(filepath.Join(dir, exportArchivesDir, a.Name()), filepath.Join(o.tarballPath, a.Name())); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// manifests already in the index are not committed again
+		existing, err := repo.Manifest(name)
+		if err == nil {
+			if data, err := yaml.Marshal(plugins[name]); err == nil && bytes.Equal(existing, data) {
+				continue
+			}
+		}
+		if err := repo.Upsert(name, plugins[name]); err != nil {
+			return fmt.Errorf("committing plugin %s: %w", name, err)
+		}
+	}
+
+	fmt.Fprintf(o.out, "imported %d plugins and %d archives from %s\n", len(plugins), len(archives), o.fileName)
+	return nil
+}
+
+// stageImportFiles extracts the files of the exported archive into dir and
+// returns their checksums keyed by their path in the archive, along with
+// the manifest of the archive.
+func stageImportFiles(fileName, dir string) (map[string]string, *exportManifest, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", fileName, err)
+	}
+	defer gr.Close()
+
+	checksums := map[string]string{}
+	var manifest *exportManifest
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %w", fileName, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, nil, fmt.Errorf("unexpected entry %s in %s", header.Name, fileName)
+		}
+
+		if header.Name == exportManifestName {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			manifest = &exportManifest{}
+			if err := yaml.UnmarshalStrict(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %w", exportManifestName, err)
+			}
+			continue
+		}
+
+		// only the files written by export are restored, names
+		// must not escape the directories they are restored into.
+		entryDir, name := path.Split(header.Name)
+		entryDir = strings.TrimSuffix(entryDir, "/")
+		if (entryDir != exportPluginsDir && entryDir != exportArchivesDir) || !safeExportNameRegexp.MatchString(name) || name == "." || name == ".." {
+			return nil, nil, fmt.Errorf("unexpected entry %s in %s", header.Name, fileName)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, entryDir), 0755); err != nil {
+			return nil, nil, err
+		}
+		out, err := os.Create(filepath.Join(dir, entryDir, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, hash), tr)
+		out.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s from %s: %w", header.Name, fileName, err)
+		}
+		checksums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+	return checksums, manifest, nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// dest may be a link to a blob shared with other archives,
+	// it is replaced rather than written through.
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
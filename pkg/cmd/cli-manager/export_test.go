@@ -0,0 +1,191 @@
+package cli_manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openshift/cli-manager/pkg/git"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+)
+
+// newTestIndex prepares a git index and a tarball directory holding
+// the archive of the oc plugin for linux/amd64.
+func newTestIndex(t *testing.T) (string, string) {
+	t.Helper()
+	gitRepoPath := filepath.Join(t.TempDir(), "git")
+	tarballPath := t.TempDir()
+
+	archive := []byte("oc archive")
+	if err := os.WriteFile(filepath.Join(tarballPath, "oc_linux_amd64.tar.gz"), archive, 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	sum := sha256.Sum256(archive)
+
+	repo, err := git.PrepareLocalGit(gitRepoPath, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected git error %v", err)
+	}
+	err = repo.Upsert("oc", &krew.Plugin{
+		Spec: krew.PluginSpec{
+			Version: "v4.15.0",
+			Platforms: []krew.Platform{
+				{
+					URI:    "https://cli-manager.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+					Sha256: hex.EncodeToString(sum[:]),
+					Files:  []krew.FileOperation{{From: "usr/bin/oc", To: "."}},
+					Bin:    "oc",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+	return gitRepoPath, tarballPath
+}
+
+func TestExportImport(t *testing.T) {
+	gitRepoPath, tarballPath := newTestIndex(t)
+	fileName := filepath.Join(t.TempDir(), "index.tar.gz")
+
+	export := &exportOptions{
+		fileName:    fileName,
+		gitRepoPath: gitRepoPath,
+		tarballPath: tarballPath,
+		out:         io.Discard,
+	}
+	if err := export.run(); err != nil {
+		t.Fatalf("unexpected export error %v", err)
+	}
+
+	restoredGitRepoPath := filepath.Join(t.TempDir(), "git")
+	restoredTarballPath := filepath.Join(t.TempDir(), "plugins")
+	out := &bytes.Buffer{}
+	imp := &importOptions{
+		fileName:    fileName,
+		gitRepoPath: restoredGitRepoPath,
+		tarballPath: restoredTarballPath,
+		out:         out,
+	}
+	if err := imp.run(); err != nil {
+		t.Fatalf("unexpected import error %v", err)
+	}
+	if !strings.Contains(out.String(), "imported 1 plugins and 1 archives") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	for _, f := range []string{
+		filepath.Join("plugins", "oc.yaml"),
+	} {
+		expected, _ := os.ReadFile(filepath.Join(gitRepoPath, f))
+		restored, err := os.ReadFile(filepath.Join(restoredGitRepoPath, f))
+		if err != nil || !bytes.Equal(expected, restored) {
+			t.Fatalf("expected %s to be restored, got %q error %v", f, restored, err)
+		}
+	}
+	restored, err := os.ReadFile(filepath.Join(restoredTarballPath, "oc_linux_amd64.tar.gz"))
+	if err != nil || string(restored) != "oc archive" {
+		t.Fatalf("expected archive to be restored, got %q error %v", restored, err)
+	}
+
+	// the restored index is committed, so that it is served to Krew
+	repo, err := git.OpenLocalGit(restoredGitRepoPath, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected open error %v", err)
+	}
+	if _, err := repo.Manifest("oc"); err != nil {
+		t.Fatalf("unexpected manifest error %v", err)
+	}
+
+	// importing again into the same instance updates it
+	if err := imp.run(); err != nil {
+		t.Fatalf("unexpected import error %v", err)
+	}
+}
+
+func TestImportChecksumMismatch(t *testing.T) {
+	gitRepoPath, tarballPath := newTestIndex(t)
+	fileName := filepath.Join(t.TempDir(), "index.tar.gz")
+	export := &exportOptions{
+		fileName:    fileName,
+		gitRepoPath: gitRepoPath,
+		tarballPath: tarballPath,
+		out:         io.Discard,
+	}
+	if err := export.run(); err != nil {
+		t.Fatalf("unexpected export error %v", err)
+	}
+
+	// tamper with the archive of the plugin in the exported file
+	tampered := filepath.Join(t.TempDir(), "tampered.tar.gz")
+	rewriteExport(t, fileName, tampered, func(name string, data []byte) []byte {
+		if name == "archives/oc_linux_amd64.tar.gz" {
+			return []byte("tampered archive")
+		}
+		return data
+	})
+
+	restoredTarballPath := t.TempDir()
+	imp := &importOptions{
+		fileName:    tampered,
+		gitRepoPath: filepath.Join(t.TempDir(), "git"),
+		tarballPath: restoredTarballPath,
+		out:         io.Discard,
+	}
+	err := imp.run()
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(restoredTarballPath); len(entries) != 0 {
+		t.Fatalf("expected nothing to be restored, got %v", entries)
+	}
+}
+
+// rewriteExport copies the exported archive src into dest, replacing
+// the contents of its entries by the ones returned by rewrite.
+func rewriteExport(t *testing.T, src, dest string, rewrite func(name string, data []byte) []byte) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("unexpected open error %v", err)
+	}
+	defer in.Close()
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("unexpected gzip error %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected tar error %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		data = rewrite(header.Name, data)
+		header.Size = int64(len(data))
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("unexpected tar error %v", err)
+		}
+		tw.Write(data)
+	}
+	tw.Close()
+	gw.Close()
+	if err := os.WriteFile(dest, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package cli_manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/controller"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+)
+
+type importKrewOptions struct {
+	source   string
+	images   map[string]string
+	fileName string
+
+	out    io.Writer
+	errOut io.Writer
+}
+
+// NewImportKrewCommand creates a command generating the Plugins of the
+// manifests of an existing Krew index, to migrate it to the cli-manager.
+func NewImportKrewCommand() *cobra.Command {
+	o := &importKrewOptions{
+		out:    os.Stdout,
+		errOut: os.Stderr,
+	}
+	cmd := &cobra.Command{
+		Use:   "import-krew",
+		Short: "Generate the Plugins of the manifests of an existing Krew index",
+		Long: "Generate the Plugins of the manifests of an existing Krew index, read from a directory or cloned from a git URL.\n" +
+			"Krew downloads the plugins from archive URIs whereas Plugins extract them from images, the image of every " +
+			"platform must be given with --image. The files are expected at the same paths in the images as in the archives. " +
+			"The fields which can not be mapped are reported on the standard error.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run(cmd.Context())
+		},
+	}
+	cmd.Flags().StringVar(&o.source, "source", "", "Directory or git URL of the Krew index, the manifests are read from its plugins directory.")
+	cmd.Flags().StringToStringVar(&o.images, "image", nil, "Images of the plugins in name=image format (i.e. oc=quay.io/openshift/origin-cli:4.15), "+
+		"or name/os/arch=image for a single platform (i.e. oc/windows/amd64=quay.io/openshift/origin-cli-windows:4.15), which takes precedence.")
+	cmd.Flags().StringVarP(&o.fileName, "filename", "f", "", "File to write the Plugins to. Defaults to the standard output.")
+	cmd.MarkFlagRequired("source")
+	return cmd
+}
+
+func (o *importKrewOptions) run(ctx context.Context) error {
+	dir := o.source
+	if isGitURL(o.source) {
+		tmp, err := os.MkdirTemp("", "cli-manager-import-krew")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if _, err := gogit.PlainCloneContext(ctx, tmp, false, &gogit.CloneOptions{URL: o.source, Depth: 1}); err != nil {
+			return fmt.Errorf("cloning %s: %w", o.source, err)
+		}
+		dir = tmp
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(dir, "plugins", "*.yaml"))
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		// the plugins directory itself may be given
+		if manifests, err = filepath.Glob(filepath.Join(dir, "*.yaml")); err != nil {
+			return err
+		}
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("no Krew manifest found in %s", o.source)
+	}
+	sort.Strings(manifests)
+
+	var plugins []*v1alpha1.Plugin
+	var missing []string
+	for _, m := range manifests {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			return err
+		}
+		k := &krew.Plugin{}
+		if err := yaml.Unmarshal(data, k); err != nil {
+			return fmt.Errorf("invalid Krew manifest %s: %w", m, err)
+		}
+		if len(k.Name) == 0 {
+			// the manifests of the index are named after their plugin
+			k.Name = strings.TrimSuffix(filepath.Base(m), ".yaml")
+		}
+		plugin, notes, platformsMissing := convertFromKrew(k, o.images)
+		for _, note := range notes {
+			fmt.Fprintf(o.errOut, "plugin %s: %s\n", k.Name, note)
+		}
+		missing = append(missing, platformsMissing...)
+		plugins = append(plugins, plugin)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing --image for %s", strings.Join(missing, ", "))
+	}
+
+	out := o.out
+	if len(o.fileName) > 0 {
+		f, err := os.Create(o.fileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	for i, plugin := range plugins {
+		if newCondition := controller.ValidatePlugin(plugin); newCondition != nil {
+			fmt.Fprintf(o.errOut, "plugin %s: %s: %s\n", plugin.Name, newCondition.Reason, newCondition.Message)
+		}
+		data, err := yaml.Marshal(plugin)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(out, "---")
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertFromKrew returns the Plugin of the Krew manifest with the images of
+// its platforms looked up in images. It also returns the notes about the fields
+// which can not be mapped and the platforms whose image is missing.
+func convertFromKrew(k *krew.Plugin, images map[string]string) (*v1alpha1.Plugin, []string, []string) {
+	plugin := &v1alpha1.Plugin{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "Plugin",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: k.Name,
+		},
+		Spec: v1alpha1.PluginSpec{
+			ShortDescription: k.Spec.ShortDescription,
+			Description:      k.Spec.Description,
+			Caveats:          k.Spec.Caveats,
+			Homepage:         k.Spec.Homepage,
+			Version:          k.Spec.Version,
+		},
+	}
+	var notes, missing []string
+	for i, kp := range k.Spec.Platforms {
+		if kp.Selector == nil || len(kp.Selector.MatchLabels["os"]) == 0 || len(kp.Selector.MatchLabels["arch"]) == 0 {
+			notes = append(notes, fmt.Sprintf("platforms[%d] is skipped, its selector does not match a single os and arch", i))
+			continue
+		}
+		p := v1alpha1.PluginPlatform{
+			Platform:         kp.Selector.MatchLabels["os"] + "/" + kp.Selector.MatchLabels["arch"],
+			MatchExpressions: kp.Selector.MatchExpressions,
+			Bin:              kp.Bin,
+		}
+		if len(kp.Selector.MatchLabels) > 2 {
+			notes = append(notes, fmt.Sprintf("platform %s only keeps the os and arch labels of its selector", p.Platform))
+		}
+		p.Image = images[k.Name+"/"+p.Platform]
+		if len(p.Image) == 0 {
+			p.Image = images[k.Name]
+		}
+		if len(p.Image) == 0 {
+			missing = append(missing, k.Name+"/"+p.Platform)
+		}
+		notes = append(notes, fmt.Sprintf("platform %s was downloaded from %s, its files are expected at the same paths in image %q", p.Platform, kp.URI, p.Image))
+		for _, f := range kp.Files {
+			if strings.ContainsAny(f.From, "*?[") {
+				notes = append(notes, fmt.Sprintf("file %s of platform %s is skipped, wildcards are not supported", f.From, p.Platform))
+				continue
+			}
+			p.Files = append(p.Files, v1alpha1.FileLocation{
+				From: path.Join("/", f.From),
+				To:   f.To,
+			})
+		}
+		plugin.Spec.Platforms = append(plugin.Spec.Platforms, p)
+	}
+	return plugin, notes, missing
+}
+
+// isGitURL reports whether source is a git URL rather than a local directory.
+func isGitURL(source string) bool {
+	return strings.Contains(source, "://") || strings.HasPrefix(source, "git@")
+}
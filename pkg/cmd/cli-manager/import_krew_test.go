@@ -0,0 +1,180 @@
+package cli_manager
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+)
+
+const testKrewManifest = `apiVersion: krew.googlecontainertools.github.com/v1alpha2
+kind: Plugin
+metadata:
+  name: oc
+spec:
+  version: v4.15.0
+  shortDescription: OpenShift CLI
+  homepage: https://github.com/openshift/oc
+  platforms:
+  - uri: https://example.com/oc_linux_amd64.tar.gz
+    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+    selector:
+      matchLabels:
+        os: linux
+        arch: amd64
+    files:
+    - from: oc
+      to: .
+    - from: LICENSE
+      to: .
+    bin: oc
+  - uri: https://example.com/oc_windows_amd64.zip
+    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+    selector:
+      matchLabels:
+        os: windows
+        arch: amd64
+    files:
+    - from: "*.exe"
+      to: .
+    - from: bin/oc.exe
+      to: .
+    bin: oc.exe
+  - uri: https://example.com/oc_any.tar.gz
+    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+    selector:
+      matchExpressions:
+      - key: os
+        operator: In
+        values: [darwin]
+    files:
+    - from: oc
+      to: .
+    bin: oc
+`
+
+func TestImportKrew(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "plugins"), 0755); err != nil {
+		t.Fatalf("unexpected mkdir error %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "plugins", "oc.yaml"), []byte(testKrewManifest), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	o := &importKrewOptions{
+		source: dir,
+		images: map[string]string{
+			"oc":               "quay.io/openshift/origin-cli:4.15",
+			"oc/windows/amd64": "quay.io/openshift/origin-cli-windows:4.15",
+		},
+		out:    out,
+		errOut: errOut,
+	}
+	if err := o.run(context.Background()); err != nil {
+		t.Fatalf("unexpected import error %v", err)
+	}
+
+	plugin := &v1alpha1.Plugin{}
+	if err := yaml.UnmarshalStrict(out.Bytes(), plugin); err != nil {
+		t.Fatalf("unexpected decoding error %v\n%s", err, out)
+	}
+	expected := &v1alpha1.Plugin{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "Plugin",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "oc",
+		},
+		Spec: v1alpha1.PluginSpec{
+			ShortDescription: "OpenShift CLI",
+			Homepage:         "https://github.com/openshift/oc",
+			Version:          "v4.15.0",
+			Platforms: []v1alpha1.PluginPlatform{
+				{
+					Platform: "linux/amd64",
+					Image:    "quay.io/openshift/origin-cli:4.15",
+					Files: []v1alpha1.FileLocation{
+						{From: "/oc", To: "."},
+						{From: "/LICENSE", To: "."},
+					},
+					Bin: "oc",
+				},
+				{
+					Platform: "windows/amd64",
+					Image:    "quay.io/openshift/origin-cli-windows:4.15",
+					Files: []v1alpha1.FileLocation{
+						{From: "/bin/oc.exe", To: "."},
+					},
+					Bin: "oc.exe",
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(plugin, expected) {
+		t.Fatalf("unexpected plugin\n%s", out)
+	}
+	for _, note := range []string{
+		"platforms[2] is skipped",
+		"file *.exe of platform windows/amd64 is skipped",
+		"platform linux/amd64 was downloaded from https://example.com/oc_linux_amd64.tar.gz",
+	} {
+		if !strings.Contains(errOut.String(), note) {
+			t.Fatalf("expected note %q, got\n%s", note, errOut)
+		}
+	}
+}
+
+func TestImportKrewMissingImage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "oc.yaml"), []byte(testKrewManifest), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	o := &importKrewOptions{
+		source: dir,
+		images: map[string]string{"oc/linux/amd64": "quay.io/openshift/origin-cli:4.15"},
+		out:    out,
+		errOut: &bytes.Buffer{},
+	}
+	err := o.run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "missing --image for oc/windows/amd64") {
+		t.Fatalf("expected missing image error, got %v", err)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("expected no plugin to be written, got\n%s", out)
+	}
+}
+
+func TestImportKrewGitURL(t *testing.T) {
+	gitRepoPath, _ := newTestIndex(t)
+
+	out := &bytes.Buffer{}
+	o := &importKrewOptions{
+		source: "file://" + gitRepoPath,
+		images: map[string]string{"oc": "quay.io/openshift/origin-cli:4.15"},
+		out:    out,
+		errOut: &bytes.Buffer{},
+	}
+	if err := o.run(context.Background()); err != nil {
+		t.Fatalf("unexpected import error %v", err)
+	}
+	plugin := &v1alpha1.Plugin{}
+	if err := yaml.UnmarshalStrict(out.Bytes(), plugin); err != nil {
+		t.Fatalf("unexpected decoding error %v\n%s", err, out)
+	}
+	if plugin.Name != "oc" || plugin.Spec.Version != "v4.15.0" {
+		t.Fatalf("unexpected plugin\n%s", out)
+	}
+}
@@ -0,0 +1,127 @@
+package cli_manager
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/controller"
+	"github.com/openshift/cli-manager/pkg/image"
+	"github.com/openshift/cli-manager/pkg/platform"
+)
+
+type renderOptions struct {
+	fileName         string
+	host             string
+	checksums        map[string]string
+	imagePullTimeout time.Duration
+
+	out io.Writer
+}
+
+// NewRenderCommand creates a command printing the Krew manifest the index
+// would publish for a Plugin, without a cluster.
+func NewRenderCommand() *cobra.Command {
+	o := &renderOptions{
+		out: os.Stdout,
+	}
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "Print the Krew manifest published for a Plugin",
+		Long: "Print the Krew manifest published in the index for a Plugin, i.e. to compare it with a golden manifest.\n" +
+			"The images of the platforms whose checksum is given with --checksum are not pulled, their files are expected to be found. " +
+			"The images of the other platforms are pulled with the credentials available locally to compute the checksums of their archives.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run()
+		},
+	}
+	cmd.Flags().StringVar(&o.fileName, "plugin", "", "Plugin YAML file to render.")
+	cmd.Flags().StringVar(&o.host, "host", "", "Host the plugins are downloaded from (i.e. cli-manager.apps.example.com), or its base URL.")
+	cmd.Flags().StringToStringVar(&o.checksums, "checksum", nil, "sha256 of the archive of a platform in platform=sha256 format (i.e. linux/amd64=9f86d0...).")
+	cmd.Flags().DurationVar(&o.imagePullTimeout, "image-pull-timeout", 10*time.Minute, "Maximum duration of pulling and extracting the image of a platform without checksum.")
+	cmd.MarkFlagRequired("plugin")
+	cmd.MarkFlagRequired("host")
+	return cmd
+}
+
+func (o *renderOptions) run() error {
+	data, err := os.ReadFile(o.fileName)
+	if err != nil {
+		return err
+	}
+
+	plugin := &v1alpha1.Plugin{}
+	if err := yaml.UnmarshalStrict(data, plugin); err != nil {
+		return fmt.Errorf("invalid plugin %s: %w", o.fileName, err)
+	}
+
+	plugin = controller.ExpandAllPlatforms(plugin, controller.DefaultPlatforms)
+	if newCondition := controller.ValidatePlugin(plugin); newCondition != nil {
+		return fmt.Errorf("invalid plugin %s: %s: %s", plugin.Name, newCondition.Reason, newCondition.Message)
+	}
+
+	var unknown []string
+	for p, checksum := range o.checksums {
+		if !slices.ContainsFunc(plugin.Spec.Platforms, func(pp v1alpha1.PluginPlatform) bool { return pp.Platform == p }) {
+			unknown = append(unknown, p)
+		}
+		if sum, err := hex.DecodeString(checksum); err != nil || len(sum) != 32 {
+			return fmt.Errorf("invalid checksum %s of platform %s, should be a hex encoded sha256", checksum, p)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("plugin %s has no platform %s", plugin.Name, strings.Join(unknown, ", "))
+	}
+
+	baseURL := strings.TrimSuffix(o.host, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+
+	var dir string
+	options := controller.Options{}
+	k := controller.NewKrewPlugin(plugin, options)
+	for _, p := range plugin.Spec.Platforms {
+		p.Bin = controller.DefaultBin(plugin, p)
+		files, checksum := p.Files, strings.ToLower(o.checksums[p.Platform])
+		if len(checksum) == 0 {
+			if len(dir) == 0 {
+				if dir, err = os.MkdirTemp("", "cli-manager-render"); err != nil {
+					return err
+				}
+				defer os.RemoveAll(dir)
+			}
+			// platforms are already validated
+			parsed, _ := platform.Parse(p.Platform)
+			destinationFileName := filepath.Join(dir, image.ArchiveName(plugin.Name, parsed))
+			ctx, cancel := context.WithTimeout(context.Background(), o.imagePullTimeout)
+			var newCondition *metav1.Condition
+			files, checksum, newCondition = controller.ExtractPlatform(ctx, p, image.PullOptions{}, image.DefaultExtractOptions, destinationFileName)
+			cancel()
+			if newCondition != nil {
+				return fmt.Errorf("plugin %s platform %s: %s: %s", plugin.Name, p.Platform, newCondition.Reason, newCondition.Message)
+			}
+		}
+		k.Spec.Platforms = append(k.Spec.Platforms, controller.KrewPlatform(k, p, baseURL, checksum, files, options))
+	}
+
+	data, err = yaml.Marshal(k)
+	if err != nil {
+		return err
+	}
+	_, err = o.out.Write(data)
+	return err
+}
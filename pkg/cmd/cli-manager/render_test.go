@@ -0,0 +1,130 @@
+package cli_manager
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRenderPlugin = `apiVersion: config.openshift.io/v1alpha1
+kind: Plugin
+metadata:
+  name: oc
+spec:
+  shortDescription: OpenShift CLI
+  homepage: https://github.com/openshift/oc
+  version: v4.15.0
+  platforms:
+  - platform: linux/amd64
+    image: quay.io/openshift/origin-cli:4.15
+    files:
+    - from: /usr/bin/oc
+      to: "."
+    - from: /usr/share/licenses/LICENSE
+      to: "."
+  - platform: windows/amd64
+    image: quay.io/openshift/origin-cli-windows:4.15
+    files:
+    - from: /usr/bin/oc.exe
+      to: "."
+`
+
+// testRenderManifest is the golden Krew manifest of testRenderPlugin.
+const testRenderManifest = `apiVersion: krew.googlecontainertools.github.com/v1alpha2
+kind: Plugin
+metadata:
+  annotations:
+    cli-manager.openshift.io/spec-hash: 05ea723966d3e2f5d3efa235a1cfd17a916e7911840ed58686675cfc4f27f4cc
+  creationTimestamp: null
+  name: oc
+spec:
+  homepage: https://github.com/openshift/oc
+  platforms:
+  - bin: oc
+    files:
+    - from: /usr/bin/oc
+      to: .
+    - from: /usr/share/licenses/LICENSE
+      to: .
+    selector:
+      matchLabels:
+        arch: amd64
+        os: linux
+    sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+    uri: https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64
+  - bin: oc.exe
+    files:
+    - from: /usr/bin/oc.exe
+      to: .
+    selector:
+      matchLabels:
+        arch: amd64
+        os: windows
+    sha256: 60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752
+    uri: https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=oc&platform=windows_amd64
+  shortDescription: OpenShift CLI
+  version: v4.15.0
+`
+
+func TestRender(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "oc.yaml")
+	if err := os.WriteFile(fileName, []byte(testRenderPlugin), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	o := &renderOptions{
+		fileName: fileName,
+		host:     "cli-manager.apps.example.com",
+		checksums: map[string]string{
+			"linux/amd64":   "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			"windows/amd64": "60303AE22B998861BCE3B28F33EEC1BE758A213C86C93C076DBE9F558C11C752",
+		},
+		out: out,
+	}
+	if err := o.run(); err != nil {
+		t.Fatalf("unexpected render error %v", err)
+	}
+	if out.String() != testRenderManifest {
+		t.Fatalf("unexpected manifest\n%s\nexpected\n%s", out, testRenderManifest)
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	tests := []struct {
+		name          string
+		checksums     map[string]string
+		expectedError string
+	}{
+		{
+			name:          "unknown platform",
+			checksums:     map[string]string{"darwin/arm64": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+			expectedError: "plugin oc has no platform darwin/arm64",
+		},
+		{
+			name:          "invalid checksum",
+			checksums:     map[string]string{"linux/amd64": "9f86d0"},
+			expectedError: "invalid checksum 9f86d0 of platform linux/amd64",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "oc.yaml")
+			if err := os.WriteFile(fileName, []byte(testRenderPlugin), 0644); err != nil {
+				t.Fatalf("unexpected write error %v", err)
+			}
+			o := &renderOptions{
+				fileName:  fileName,
+				host:      "https://cli-manager.apps.example.com/",
+				checksums: test.checksums,
+				out:       &bytes.Buffer{},
+			}
+			err := o.run()
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Fatalf("expected error %q, got %v", test.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package cli_manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/controller"
+	"github.com/openshift/cli-manager/pkg/image"
+	"github.com/openshift/cli-manager/pkg/platform"
+)
+
+type validateOptions struct {
+	fileName         string
+	platforms        []string
+	imagePullTimeout time.Duration
+
+	out io.Writer
+}
+
+// NewValidateCommand creates a command validating that a Plugin produces
+// extractable binaries without publishing it to the index.
+func NewValidateCommand() *cobra.Command {
+	o := &validateOptions{
+		out: os.Stdout,
+	}
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate a Plugin by pulling its images and extracting its files locally",
+		Long: "Validate a Plugin by pulling its images and extracting its files locally.\n" +
+			"Neither the index nor the Plugin status is updated. Image pull secrets are not resolved, " +
+			"images are pulled with the credentials available locally.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.run()
+		},
+	}
+	cmd.Flags().StringVarP(&o.fileName, "filename", "f", "", "Plugin YAML file to validate.")
+	cmd.Flags().StringSliceVar(&o.platforms, "platform", nil, "Platforms to validate (i.e. linux/amd64). All platforms of the plugin are validated, if not specified.")
+	cmd.Flags().DurationVar(&o.imagePullTimeout, "image-pull-timeout", 10*time.Minute, "Maximum duration of pulling and extracting the image of a platform.")
+	cmd.MarkFlagRequired("filename")
+	return cmd
+}
+
+func (o *validateOptions) run() error {
+	data, err := os.ReadFile(o.fileName)
+	if err != nil {
+		return err
+	}
+
+	plugin := &v1alpha1.Plugin{}
+	if err := yaml.UnmarshalStrict(data, plugin); err != nil {
+		return fmt.Errorf("invalid plugin %s: %w", o.fileName, err)
+	}
+
+	plugin = controller.ExpandAllPlatforms(plugin, controller.DefaultPlatforms)
+	if newCondition := controller.ValidatePlugin(plugin); newCondition != nil {
+		return fmt.Errorf("invalid plugin %s: %s: %s", plugin.Name, newCondition.Reason, newCondition.Message)
+	}
+
+	dir, err := os.MkdirTemp("", "cli-manager-validate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	validated, failed := 0, 0
+	for _, p := range plugin.Spec.Platforms {
+		if len(o.platforms) > 0 && !contains(o.platforms, p.Platform) {
+			continue
+		}
+		validated++
+
+		p.Bin = controller.DefaultBin(plugin, p)
+		fmt.Fprintf(o.out, "platform: %s\n", p.Platform)
+		// platforms are already validated
+		parsed, _ := platform.Parse(p.Platform)
+		destinationFileName := filepath.Join(dir, image.ArchiveName(plugin.Name, parsed))
+		ctx, cancel := context.WithTimeout(context.Background(), o.imagePullTimeout)
+		files, checksum, newCondition := controller.ExtractPlatform(ctx, p, image.PullOptions{}, image.DefaultExtractOptions, destinationFileName)
+		cancel()
+		if newCondition != nil {
+			failed++
+			fmt.Fprintf(o.out, "  error: %s: %s\n", newCondition.Reason, newCondition.Message)
+			continue
+		}
+		for _, f := range files {
+			fmt.Fprintf(o.out, "  file: %s\n", image.SourcePath(f))
+		}
+		fmt.Fprintf(o.out, "  sha256: %s\n", checksum)
+	}
+
+	if validated == 0 {
+		return fmt.Errorf("plugin %s has no platform matching %s", plugin.Name, strings.Join(o.platforms, ","))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d platforms of plugin %s failed", failed, validated, plugin.Name)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
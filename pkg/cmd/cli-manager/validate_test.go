@@ -0,0 +1,111 @@
+package cli_manager
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		plugin        string
+		platforms     []string
+		expectedError string
+	}{
+		{
+			name:          "malformed yaml",
+			plugin:        "spec: [",
+			expectedError: "invalid plugin",
+		},
+		{
+			name: "unknown field",
+			plugin: `apiVersion: config.openshift.io/v1alpha1
+kind: Plugin
+metadata:
+  name: oc
+spec:
+  shortDescription: oc
+  version: v4.15.0
+  unknown: field
+`,
+			expectedError: "unknown field",
+		},
+		{
+			name: "invalid version",
+			plugin: `apiVersion: config.openshift.io/v1alpha1
+kind: Plugin
+metadata:
+  name: oc
+spec:
+  shortDescription: oc
+  version: 4.15.0
+  platforms:
+  - platform: linux/amd64
+    image: quay.io/openshift/origin-cli
+    files:
+    - from: /usr/bin/oc
+      to: "."
+`,
+			expectedError: "InvalidField: invalid version 4.15.0",
+		},
+		{
+			name: "invalid platform",
+			plugin: `apiVersion: config.openshift.io/v1alpha1
+kind: Plugin
+metadata:
+  name: oc
+spec:
+  shortDescription: oc
+  version: v4.15.0
+  platforms:
+  - platform: linux_amd64
+    image: quay.io/openshift/origin-cli
+    files:
+    - from: /usr/bin/oc
+      to: "."
+`,
+			expectedError: "InvalidField: invalid platform linux_amd64",
+		},
+		{
+			name: "valid plugin without the requested platform",
+			plugin: `apiVersion: config.openshift.io/v1alpha1
+kind: Plugin
+metadata:
+  name: oc
+spec:
+  shortDescription: oc
+  version: v4.15.0
+  platforms:
+  - platform: linux/amd64
+    image: quay.io/openshift/origin-cli
+    files:
+    - from: /usr/bin/oc
+      to: "."
+`,
+			platforms:     []string{"darwin/arm64"},
+			expectedError: "plugin oc has no platform matching darwin/arm64",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "plugin.yaml")
+			if err := os.WriteFile(fileName, []byte(tc.plugin), 0644); err != nil {
+				t.Fatalf("unexpected write error %v", err)
+			}
+			out := &bytes.Buffer{}
+			o := &validateOptions{
+				fileName:  fileName,
+				platforms: tc.platforms,
+				out:       out,
+			}
+			err := o.run()
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
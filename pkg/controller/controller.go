@@ -5,41 +5,92 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	routev1 "github.com/openshift/api/route/v1"
 	routeclient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
 	"github.com/openshift/library-go/pkg/controller/factory"
 	"github.com/openshift/library-go/pkg/operator/events"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	k8sver "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
 
 	"github.com/openshift/cli-manager/api/v1alpha1"
 	"github.com/openshift/cli-manager/pkg/git"
 	"github.com/openshift/cli-manager/pkg/image"
 	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+	"github.com/openshift/cli-manager/pkg/platform"
 )
 
+// pluginFinalizer blocks the removal of a Plugin until it is deleted from the index.
+const pluginFinalizer = "cli-manager.openshift.io/cleanup"
+
+// specHashAnnotation is set on the Krew manifests to the hash of the Plugin they
+// are published from, so that unchanged Plugins are not extracted again.
+const specHashAnnotation = "cli-manager.openshift.io/spec-hash"
+
+// pausedAnnotation pauses the reconciliation of the Plugin when it is set to "true".
+const pausedAnnotation = "cli-manager.openshift.io/paused"
+
+// deprecatedAnnotation is set on the Krew manifests of the deprecated Plugins
+// to their deprecation message.
+const deprecatedAnnotation = "cli-manager.openshift.io/deprecated"
+
+// pluginAnnotation is set on the Krew manifests published under the
+// spec.krewName of a Plugin to the name of the Plugin.
+const pluginAnnotation = "cli-manager.openshift.io/plugin"
+
+// refreshAnnotation forces the images of the Plugin to be pulled and extracted
+// again whenever its value, i.e. a timestamp, changes.
+const refreshAnnotation = "cli-manager.openshift.io/refresh"
+
 var (
-	platformRegex = regexp.MustCompile("^(linux|darwin|windows)/(arm64|amd64|ppc64le|s390x)$")
+	sha256Regex = regexp.MustCompile("^[a-fA-F0-9]{64}$")
+
+	// retryableReasons are the reasons of transient failures. Plugins failing
+	// with these reasons are requeued with backoff, whereas the others are
+	// terminal until the Plugin is changed.
+	retryableReasons = sets.New[string]("ImagePullError", "Timeout")
 )
 
 type DockerConfigJson struct {
@@ -52,24 +103,218 @@ type DockerConfigEntry struct {
 	Auth string `json:"auth"`
 }
 
+// Options configures how the controller reconciles Plugins.
+type Options struct {
+	// InsecureHTTP serves the artifacts in HTTP instead of HTTPS.
+	InsecureHTTP bool
+	// ImagePullTimeout is the deadline of pulling and extracting the image of
+	// a single platform. Zero means no deadline.
+	ImagePullTimeout time.Duration
+	// SyncTimeout is the deadline of reconciling a single Plugin. Zero means no deadline.
+	SyncTimeout time.Duration
+	// DownloadBaseURL replaces the scheme and the host of the route in the
+	// URI of the plugin archives, i.e. https://cli-manager.example.com.
+	DownloadBaseURL string
+	// DownloadQuery are the query parameters added to the URI of the plugin
+	// archives, i.e. the token of a CDN in front of the downloads.
+	DownloadQuery map[string]string
+	// SecretNamespace is the namespace of the image pull secrets
+	// which are referenced without namespace.
+	SecretNamespace string
+	// RegistryMirrors maps source registries or repositories to the mirrors
+	// images are pulled from instead.
+	RegistryMirrors map[string]string
+	// ImagePullProxy is the proxy the images are pulled through, unless the
+	// platform sets its own proxyURL. The proxy of the HTTPS_PROXY, HTTP_PROXY
+	// and NO_PROXY environment variables is used if neither is set.
+	ImagePullProxy *url.URL
+	// ImagePullNoProxy are the registries pulled from directly instead of
+	// through ImagePullProxy or the proxyURL of the platform.
+	ImagePullNoProxy []string
+	// LabelSelector selects the Plugins which are published in the index,
+	// the others are removed from it. Nil selects every Plugin.
+	LabelSelector labels.Selector
+	// RequireDigestPinned rejects the platforms whose images are referenced
+	// by a mutable tag instead of a digest.
+	RequireDigestPinned bool
+	// AllowedRegistries are the only registries the images of the Plugins
+	// may be pulled from, i.e. quay.io or registry.example.com:5000. Empty
+	// allows every registry.
+	AllowedRegistries []string
+	// ImageVariablesConfigMap is the ConfigMap in SecretNamespace whose data
+	// are the only variables expanded in the images of the Plugins,
+	// i.e. REGISTRY for ${REGISTRY}/openshift/origin-cli:4.15.
+	ImageVariablesConfigMap string
+	// PluginResource is the group, version and resource the Plugins are read
+	// from. Defaults to DefaultPluginResource.
+	PluginResource schema.GroupVersionResource
+	// DefaultPlatforms are the platforms the "all" platform of the Plugins
+	// expands into. Defaults to DefaultPlatforms.
+	DefaultPlatforms []string
+	// Extract configures how the archives of the platforms are written.
+	// Defaults to image.DefaultExtractOptions.
+	Extract *image.ExtractOptions
+	// ReadOnly freezes the index, the Plugins are not published, updated
+	// nor removed until SetReadOnly(false) is called.
+	ReadOnly bool
+	// ReadOnlyConfigMap is the ConfigMap in SecretNamespace whose ReadOnlyKey
+	// freezes or unfreezes the index at runtime, overriding ReadOnly while
+	// it is set.
+	ReadOnlyConfigMap string
+}
+
+// ReadOnlyKey is the key of the Options.ReadOnlyConfigMap set to true
+// or false to freeze or unfreeze the index.
+const ReadOnlyKey = "readOnly"
+
+// allPlatforms is the platform of the PluginPlatforms expanded into every
+// default platform, which are not listed explicitly in the Plugin.
+const allPlatforms = "all"
+
+// DefaultPlatforms are the platforms the "all" platform expands into by default.
+var DefaultPlatforms = []string{"linux/amd64", "linux/arm64", "darwin/amd64", "darwin/arm64", "windows/amd64"}
+
+// routeNamespace and routeName are the route the plugins are downloaded from,
+// unless Options.DownloadBaseURL is set.
+const (
+	routeNamespace = "openshift-cli-manager-operator"
+	routeName      = "openshift-cli-manager"
+)
+
+// DefaultPluginResource is the resource of the Plugins defined by api/v1alpha1.
+var DefaultPluginResource = v1alpha1.GroupVersion.WithResource("plugins")
+
+// resource returns the resource the Plugins are read from.
+func (o Options) resource() schema.GroupVersionResource {
+	if o.PluginResource.Empty() {
+		return DefaultPluginResource
+	}
+	return o.PluginResource
+}
+
+// defaultPlatforms returns the platforms the "all" platform expands into.
+func (o Options) defaultPlatforms() []string {
+	if len(o.DefaultPlatforms) == 0 {
+		return DefaultPlatforms
+	}
+	return o.DefaultPlatforms
+}
+
+// pullContext returns the context of pulling the image of a single platform,
+// which is cancelled after ImagePullTimeout if it is set.
+func (o Options) pullContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.ImagePullTimeout > 0 {
+		return context.WithTimeout(ctx, o.ImagePullTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// extractOptions returns the options the archives are written with.
+func (o Options) extractOptions() image.ExtractOptions {
+	if o.Extract == nil {
+		return image.DefaultExtractOptions
+	}
+	return *o.Extract
+}
+
+// resourceOf returns the resource of the version the plugin was read in, so
+// that it is updated in the same version.
+func resourceOf(plugin *v1alpha1.Plugin) schema.GroupVersionResource {
+	gv, err := schema.ParseGroupVersion(plugin.APIVersion)
+	if err != nil || gv.Empty() {
+		return DefaultPluginResource
+	}
+	return gv.WithResource(DefaultPluginResource.Resource)
+}
+
+// CheckPluginResource ensures that the API server serves the Plugins at gvr,
+// as a Plugin missing from an unserved resource would be removed from the index.
+func CheckPluginResource(client discovery.DiscoveryInterface, gvr schema.GroupVersionResource) error {
+	resources, err := client.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return fmt.Errorf("plugin API version %s is not served: %w", gvr.GroupVersion(), err)
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return nil
+		}
+	}
+	return fmt.Errorf("plugin API version %s does not serve the %s resource", gvr.GroupVersion(), gvr.Resource)
+}
+
 type Controller struct {
 	factory.Controller
 	lister        cache.GenericLister
 	repo          *git.Repo
-	client        *kubernetes.Clientset
-	dynamicClient *dynamic.DynamicClient
+	client        kubernetes.Interface
+	dynamicClient dynamic.Interface
 	route         routeclient.RouteV1Interface
+	// queue is the queue of the Plugins to reconcile, which the resync fills.
+	queue workqueue.RateLimitingInterface
+
+	options Options
+
+	// pendingMu guards pending, the Plugins existing at start which are not
+	// reconciled yet. The index is ready once all of them are reconciled.
+	pendingMu sync.Mutex
+	pending   sets.Set[string]
+
+	// readOnly freezes the index, which keeps serving the last published plugins.
+	readOnly atomic.Bool
+	// readOnlyConfigMaps watches the Options.ReadOnlyConfigMap toggling
+	// readOnly, nil if it is not set.
+	readOnlyConfigMaps cache.SharedIndexInformer
 
-	insecureHTTP bool
+	// routes watches the route the plugins are downloaded from, nil if
+	// Options.DownloadBaseURL is set. routeHost is its last observed host.
+	routes    cache.SharedIndexInformer
+	routeHost atomic.Pointer[string]
 }
 
-// NewCLISyncController creates CLI Sync Controller to react changes in Plugin resource
-func NewCLISyncController(repo *git.Repo, informers dynamicinformer.DynamicSharedInformerFactory, client *kubernetes.Clientset, dynamicClient *dynamic.DynamicClient, route routeclient.RouteV1Interface, insecureHTTP bool, eventRecorder events.Recorder) (*Controller, error) {
-	informer := informers.ForResource(schema.GroupVersionResource{
-		Group:    v1alpha1.GroupVersion.Group,
-		Version:  v1alpha1.GroupVersion.Version,
-		Resource: "plugins",
-	})
+// NewCLISyncController creates CLI Sync Controller to react changes in Plugin resource,
+// and in the image pull secrets of kubeInformers the Plugins reference.
+func NewCLISyncController(repo *git.Repo, informers dynamicinformer.DynamicSharedInformerFactory, kubeInformers kubeinformers.SharedInformerFactory, client kubernetes.Interface, dynamicClient dynamic.Interface, route routeclient.RouteV1Interface, options Options, eventRecorder events.Recorder) (*Controller, error) {
+	if options.ImagePullTimeout < 0 {
+		return nil, fmt.Errorf("invalid image pull timeout %s, should be positive or zero for no deadline", options.ImagePullTimeout)
+	}
+	if len(options.DownloadBaseURL) > 0 {
+		u, err := url.Parse(options.DownloadBaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download base URL %s error: %w", options.DownloadBaseURL, err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid download base URL %s, should be in https://host format", options.DownloadBaseURL)
+		}
+	}
+	for key := range options.DownloadQuery {
+		if key == "name" || key == "platform" || len(key) == 0 {
+			return nil, fmt.Errorf("invalid download query parameter %q, name and platform are set by the index", key)
+		}
+	}
+
+	for _, registry := range options.AllowedRegistries {
+		if _, err := name.NewRegistry(registry); err != nil || strings.Contains(registry, "/") {
+			return nil, fmt.Errorf("invalid allowed registry %q, should be a registry host like quay.io", registry)
+		}
+	}
+
+	for _, p := range options.DefaultPlatforms {
+		if parsed, err := platform.Parse(p); err != nil || parsed.String() != p {
+			return nil, fmt.Errorf("invalid default platform %s, should be in linux/amd64 or linux/arm/v7 format", p)
+		}
+	}
+
+	if err := options.extractOptions().Validate(); err != nil {
+		return nil, err
+	}
+
+	informer := informers.ForResource(options.resource())
+	secrets := kubeInformers.Core().V1().Secrets().Informer()
+	// only the references to the secrets are looked up in the cache,
+	// their data is read from the API server when the image is pulled.
+	if err := secrets.SetTransform(stripSecretData); err != nil {
+		return nil, fmt.Errorf("caching the image pull secrets: %w", err)
+	}
 
 	c := &Controller{
 		lister:        informer.Lister(),
@@ -77,12 +322,44 @@ func NewCLISyncController(repo *git.Repo, informers dynamicinformer.DynamicShare
 		client:        client,
 		dynamicClient: dynamicClient,
 		route:         route,
-		insecureHTTP:  insecureHTTP,
+		options:       options,
+	}
+	c.readOnly.Store(options.ReadOnly)
+	syncContext := factory.NewSyncContext("CLIManager", eventRecorder)
+	c.queue = syncContext.Queue()
+
+	controllerFactory := factory.New()
+	if len(options.DownloadBaseURL) == 0 {
+		// the URIs of the published plugins embed the host of the route
+		c.routes = cache.NewSharedIndexInformer(&cache.ListWatch{
+			ListFunc: func(listOptions metav1.ListOptions) (runtime.Object, error) {
+				listOptions.FieldSelector = fields.OneTermEqualSelector("metadata.name", routeName).String()
+				return route.Routes(routeNamespace).List(context.TODO(), listOptions)
+			},
+			WatchFunc: func(listOptions metav1.ListOptions) (watch.Interface, error) {
+				listOptions.FieldSelector = fields.OneTermEqualSelector("metadata.name", routeName).String()
+				return route.Routes(routeNamespace).Watch(context.TODO(), listOptions)
+			},
+		}, &routev1.Route{}, 0, cache.Indexers{})
+		controllerFactory = controllerFactory.WithInformersQueueKeysFunc(c.pluginsOfRoute, c.routes)
+	}
+	if len(options.ReadOnlyConfigMap) > 0 {
+		c.readOnlyConfigMaps = cache.NewSharedIndexInformer(&cache.ListWatch{
+			ListFunc: func(listOptions metav1.ListOptions) (runtime.Object, error) {
+				listOptions.FieldSelector = fields.OneTermEqualSelector("metadata.name", options.ReadOnlyConfigMap).String()
+				return client.CoreV1().ConfigMaps(options.SecretNamespace).List(context.TODO(), listOptions)
+			},
+			WatchFunc: func(listOptions metav1.ListOptions) (watch.Interface, error) {
+				listOptions.FieldSelector = fields.OneTermEqualSelector("metadata.name", options.ReadOnlyConfigMap).String()
+				return client.CoreV1().ConfigMaps(options.SecretNamespace).Watch(context.TODO(), listOptions)
+			},
+		}, &corev1.ConfigMap{}, 0, cache.Indexers{})
 	}
 
-	c.Controller = factory.New().
+	c.Controller = controllerFactory.
+		WithSyncContext(syncContext).
 		WithInformersQueueKeyFunc(func(obj runtime.Object) string {
-			klog.V(4).Infof("Plugin object cought by event %v", obj)
+			klog.V(4).InfoS("Plugin object caught by event", "object", obj)
 			if obj == nil || reflect.ValueOf(obj).IsNil() {
 				return ""
 			}
@@ -94,61 +371,314 @@ func NewCLISyncController(repo *git.Repo, informers dynamicinformer.DynamicShare
 			plugin := &v1alpha1.Plugin{}
 			err = runtime.DefaultUnstructuredConverter.FromUnstructured(u, plugin)
 			if err != nil {
-				klog.V(2).Infof("invalid object's %v key extraction is ignored", obj)
+				klog.V(2).InfoS("Invalid object key extraction is ignored", "object", obj)
 				return ""
 			}
 			return plugin.Name
 		}, informer.Informer()).
+		// a Plugin which failed on a missing or invalid secret is reconciled
+		// again once the secret is created or rotated.
+		WithInformersQueueKeysFunc(c.pluginsReferencingSecret, secrets).
 		WithSync(c.sync).
 		ToController("CLIManager", eventRecorder)
 	return c, nil
 }
 
-func (c *Controller) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+// Run starts watching the route and the read-only ConfigMap, and reconciles
+// the Plugins with workers until ctx is done.
+func (c *Controller) Run(ctx context.Context, workers int) {
+	if c.routes != nil {
+		go c.routes.Run(ctx.Done())
+	}
+	if c.readOnlyConfigMaps != nil {
+		// every event toggles the index according to the cached ConfigMap
+		c.readOnlyConfigMaps.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { c.syncReadOnly(ctx) },
+			UpdateFunc: func(interface{}, interface{}) { c.syncReadOnly(ctx) },
+			DeleteFunc: func(interface{}) { c.syncReadOnly(ctx) },
+		})
+		go c.readOnlyConfigMaps.Run(ctx.Done())
+		// the Plugins are not reconciled before the index is known to be writable
+		if !cache.WaitForCacheSync(ctx.Done(), c.readOnlyConfigMaps.HasSynced) {
+			return
+		}
+		c.syncReadOnly(ctx)
+	}
+	c.Controller.Run(ctx, workers)
+}
+
+// syncReadOnly freezes or unfreezes the index according to the cached
+// read-only ConfigMap. An invalid value leaves the index as it is.
+func (c *Controller) syncReadOnly(ctx context.Context) {
+	var cm *corev1.ConfigMap
+	obj, exists, err := c.readOnlyConfigMaps.GetStore().GetByKey(cache.NewObjectName(c.options.SecretNamespace, c.options.ReadOnlyConfigMap).String())
+	if err != nil {
+		klog.ErrorS(err, "Getting the read-only ConfigMap failed")
+		return
+	}
+	if exists {
+		cm, _ = obj.(*corev1.ConfigMap)
+	}
+	readOnly, err := readOnlyOf(cm, c.options)
+	if err != nil {
+		klog.ErrorS(err, "Index is left as it is")
+		return
+	}
+	if err := c.SetReadOnly(ctx, readOnly); err != nil && ctx.Err() == nil {
+		klog.ErrorS(err, "Unfreezing the index failed")
+	}
+}
+
+// InitialReadOnly returns whether the index is read-only on start, according
+// to the Options.ReadOnlyConfigMap if it exists and Options.ReadOnly otherwise.
+func InitialReadOnly(ctx context.Context, client kubernetes.Interface, options Options) (bool, error) {
+	if len(options.ReadOnlyConfigMap) == 0 {
+		return options.ReadOnly, nil
+	}
+	cm, err := client.CoreV1().ConfigMaps(options.SecretNamespace).Get(ctx, options.ReadOnlyConfigMap, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return options.ReadOnly, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting the read-only ConfigMap %s in namespace %s: %w", options.ReadOnlyConfigMap, options.SecretNamespace, err)
+	}
+	return readOnlyOf(cm, options)
+}
+
+// readOnlyOf returns whether the index is read-only according to the
+// ReadOnlyKey of cm, or Options.ReadOnly if cm is nil or does not set it.
+func readOnlyOf(cm *corev1.ConfigMap, options Options) (bool, error) {
+	if cm == nil {
+		return options.ReadOnly, nil
+	}
+	value, ok := cm.Data[ReadOnlyKey]
+	if !ok {
+		return options.ReadOnly, nil
+	}
+	readOnly, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q in the read-only ConfigMap %s in namespace %s, should be true or false", ReadOnlyKey, value, cm.Name, cm.Namespace)
+	}
+	return readOnly, nil
+}
+
+// pluginsOfRoute returns the names of every Plugin once the host of the
+// route changes, so that their URIs are published again with the new host,
+// i.e. after a migration of the cluster domain.
+func (c *Controller) pluginsOfRoute(obj runtime.Object) []string {
+	r, ok := obj.(*routev1.Route)
+	if !ok {
+		return nil
+	}
+	host := r.Spec.Host
+	if previous := c.routeHost.Swap(&host); previous == nil || *previous == host {
+		// the plugins are all reconciled on start
+		return nil
+	}
+	objs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		klog.V(2).InfoS("Plugins of the route can not be listed", "route", klog.KObj(r), "err", err)
+		return nil
+	}
+	klog.InfoS("Route host is changed, plugins are published again", "route", klog.KObj(r), "host", host)
+	var names []string
+	for _, obj := range objs {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			continue
+		}
+		names = append(names, accessor.GetName())
+	}
+	return names
+}
+
+// routeChanged reports whether the plugin is published with the URIs of
+// another host than the last observed host of the route.
+func (c *Controller) routeChanged(plugin *v1alpha1.Plugin) bool {
+	host := c.routeHost.Load()
+	if host == nil || len(*host) == 0 {
+		return false
+	}
+	manifest, err := c.repo.Manifest(krewName(plugin))
+	if err != nil {
+		return false
+	}
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		return false
+	}
+	for _, p := range k.Spec.Platforms {
+		if u, err := url.Parse(p.URI); err != nil || u.Host != *host {
+			return true
+		}
+	}
+	return false
+}
+
+// stripSecretData removes the data of the secrets cached by the informer.
+func stripSecretData(obj interface{}) (interface{}, error) {
+	if secret, ok := obj.(*corev1.Secret); ok {
+		secret.Data = nil
+		secret.StringData = nil
+	}
+	return obj, nil
+}
+
+// pluginsReferencingSecret returns the names of the Plugins whose platforms
+// reference the secret as image pull secret.
+func (c *Controller) pluginsReferencingSecret(obj runtime.Object) []string {
+	secret, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
+	}
+	objs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		klog.V(2).InfoS("Plugins referencing the secret can not be listed", "secret", klog.KObj(secret), "err", err)
+		return nil
+	}
+	var names []string
+	for _, obj := range objs {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			continue
+		}
+		plugin := &v1alpha1.Plugin{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u, plugin); err != nil {
+			continue
+		}
+		if slices.ContainsFunc(plugin.Spec.Platforms, func(p v1alpha1.PluginPlatform) bool {
+			if len(p.ImagePullSecret) == 0 {
+				return false
+			}
+			namespace, name := parseImagePullSecret(p.ImagePullSecret, c.options.SecretNamespace)
+			return namespace == secret.GetNamespace() && name == secret.GetName()
+		}) {
+			klog.V(4).InfoS("Plugin referencing the secret is requeued", "plugin", plugin.Name, "secret", klog.KObj(secret))
+			names = append(names, plugin.Name)
+		}
+	}
+	return names
+}
+
+func (c *Controller) sync(ctx context.Context, syncCtx factory.SyncContext) (err error) {
 	pluginName := syncCtx.QueueKey()
-	klog.V(4).Infof("CLI Manager sync is triggered for the key %s", pluginName)
-	obj, err := c.dynamicClient.Resource(schema.GroupVersionResource{
-		Group:    "config.openshift.io",
-		Version:  "v1alpha1",
-		Resource: "plugins"}).Get(ctx, pluginName, metav1.GetOptions{})
+	if c.readOnly.Load() {
+		klog.InfoS("Index is read-only, plugin is reconciled once it is writable", "plugin", pluginName)
+		// the frozen index is still served as it is, i.e. during a maintenance
+		c.initialSynced(pluginName)
+		return nil
+	}
+	defer func() {
+		c.repo.RecordError(pluginName, err)
+		// a failed reconcile is retried on its own, it does not hold the
+		// other plugins back from being served.
+		c.initialSynced(pluginName)
+	}()
+	klog.V(4).InfoS("CLI Manager sync is triggered", "plugin", pluginName)
+	if c.options.SyncTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.SyncTimeout)
+		defer cancel()
+	}
+	obj, err := c.dynamicClient.Resource(c.options.resource()).Get(ctx, pluginName, metav1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) {
-			err = DeletePlugin(pluginName, c.repo)
+			// a plugin published under its spec.krewName is left to the sweep
+			err = unpublishPlugin(pluginName, pluginName, c.repo)
 			if err != nil {
 				return err
 			}
-			klog.Infof("plugin %s is successfully deleted", pluginName)
+			klog.InfoS("Plugin is successfully deleted", "plugin", pluginName)
 			return nil
 		} else {
-			klog.Warningf("plugin %s retrieval from cache error %v", pluginName, err)
+			klog.ErrorS(err, "Plugin retrieval failed", "plugin", pluginName)
 			return err
 		}
 	}
 
 	if obj == nil || reflect.ValueOf(obj).IsNil() {
-		klog.V(2).Infof("invalid nil object is ignored")
+		klog.V(2).InfoS("Invalid nil object is ignored", "plugin", pluginName)
 		return nil
 	}
 
 	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
 	if err != nil {
-		klog.V(2).Infof("invalid object %v is ignored", obj)
+		klog.V(2).InfoS("Invalid object is ignored", "plugin", pluginName, "object", obj)
 		return nil
 	}
 
 	plugin := &v1alpha1.Plugin{}
 	err = runtime.DefaultUnstructuredConverter.FromUnstructured(u, plugin)
 	if err != nil {
-		klog.V(2).Infof("ignore unexpected types %+v for key %s", obj, pluginName)
+		klog.V(2).InfoS("Unexpected type is ignored", "plugin", pluginName, "object", obj)
 		return nil
 	}
 
-	err = DeletePlugin(pluginName, c.repo)
+	if plugin.DeletionTimestamp != nil {
+		if !slices.Contains(plugin.Finalizers, pluginFinalizer) {
+			return nil
+		}
+		err = unpublishPlugin(pluginName, krewName(plugin), c.repo)
+		if err != nil {
+			return err
+		}
+		klog.InfoS("Plugin is successfully deleted", "plugin", pluginName)
+		return c.setFinalizer(ctx, plugin, false)
+	}
+	// the finalizer blocks the removal of the plugin until it is deleted from
+	// the index, even if the controller is not running when it is deleted.
+	if !slices.Contains(plugin.Finalizers, pluginFinalizer) {
+		err = c.setFinalizer(ctx, plugin, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.options.LabelSelector != nil && !c.options.LabelSelector.Matches(labels.Set(plugin.Labels)) {
+		klog.V(2).InfoS("Plugin does not match the label selector, it is not published", "plugin", pluginName, "selector", c.options.LabelSelector.String())
+		return unpublishPlugin(pluginName, krewName(plugin), c.repo)
+	}
+
+	if plugin.Annotations[pausedAnnotation] == "true" {
+		klog.V(2).InfoS("Plugin reconciliation is paused", "plugin", pluginName)
+		return updateStatusCondition(ctx, plugin, c.dynamicClient, metav1.Condition{
+			Type:    "Paused",
+			Status:  metav1.ConditionTrue,
+			Reason:  "Paused",
+			Message: fmt.Sprintf("plugin %s is paused by the %s annotation, the published plugin is left untouched", pluginName, pausedAnnotation),
+		})
+	}
+	if meta.IsStatusConditionTrue(plugin.Status.Conditions, "Paused") {
+		err = updateStatusCondition(ctx, plugin, c.dynamicClient, metav1.Condition{
+			Type:    "Paused",
+			Status:  metav1.ConditionFalse,
+			Reason:  "Resumed",
+			Message: fmt.Sprintf("plugin %s is resumed", pluginName),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// the images are expanded before anything is pulled, the published
+	// plugin and its status only see the expanded references.
+	plugin, newCondition, err := expandPluginImages(ctx, plugin, c.client, c.options)
 	if err != nil {
-		klog.V(2).Infof("plugin %s can not be deleted", pluginName)
+		return err
+	}
+	if newCondition != nil {
+		if err := unpublishPlugin(pluginName, krewName(plugin), c.repo); err != nil {
+			return err
+		}
+		return updateStatusCondition(ctx, plugin, c.dynamicClient, *newCondition)
+	}
+
+	if isPublished(plugin, c.repo, c.options) && !c.routeChanged(plugin) && c.imagesUnchanged(ctx, plugin) {
+		klog.V(4).InfoS("Plugin is unchanged since it is published", "plugin", pluginName)
+		return nil
 	}
 
-	err = UpsertPlugin(plugin, c.repo, c.client, c.dynamicClient, c.route, c.insecureHTTP)
+	err = UpsertPlugin(ctx, plugin, c.repo, c.client, c.dynamicClient, c.route, c.options)
 	if err != nil {
 		return err
 	}
@@ -156,107 +686,434 @@ func (c *Controller) sync(ctx context.Context, syncCtx factory.SyncContext) erro
 	return nil
 }
 
+// specHash returns the hash of what the Krew manifest and the archives
+// of the plugin are built from. The refresh annotation is part of it, so
+// that changing it publishes the plugin again from freshly pulled images.
+func specHash(plugin *v1alpha1.Plugin, options Options) string {
+	data, _ := json.Marshal(struct {
+		Spec            v1alpha1.PluginSpec `json:"spec"`
+		DownloadBaseURL string              `json:"downloadBaseURL"`
+		DownloadQuery   map[string]string   `json:"downloadQuery,omitempty"`
+		InsecureHTTP    bool                `json:"insecureHTTP"`
+		Refresh         string              `json:"refresh,omitempty"`
+		// the published platforms are checked again once the allowed registries change
+		AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+		// the all platform is expanded again once the default platforms change
+		DefaultPlatforms []string `json:"defaultPlatforms,omitempty"`
+		// the manifest refers to the files by their name in the archives
+		ArchiveLayout string `json:"archiveLayout,omitempty"`
+	}{
+		Spec:              plugin.Spec,
+		DownloadBaseURL:   options.DownloadBaseURL,
+		DownloadQuery:     options.DownloadQuery,
+		InsecureHTTP:      options.InsecureHTTP,
+		Refresh:           plugin.Annotations[refreshAnnotation],
+		AllowedRegistries: options.AllowedRegistries,
+		DefaultPlatforms:  defaultPlatformsOf(plugin, options),
+		ArchiveLayout:     archiveLayout(options.extractOptions()),
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isPublished reports whether the plugin is already published in the index
+// from its current spec, along with the archives of all its platforms.
+func isPublished(plugin *v1alpha1.Plugin, repo *git.Repo, options Options) bool {
+	manifest, err := repo.Manifest(krewName(plugin))
+	if err != nil {
+		return false
+	}
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		return false
+	}
+	if k.Annotations[specHashAnnotation] != specHash(plugin, options) {
+		return false
+	}
+	expanded, _ := expandAllPlatforms(plugin, options.defaultPlatforms())
+	for _, p := range expanded.Spec.Platforms {
+		parsed, err := platform.Parse(p.Platform)
+		if err != nil {
+			return false
+		}
+		if _, err := os.Stat(filepath.Join(image.TarballPath, image.ArchiveName(krewName(plugin), parsed))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// imagesUnchanged reports whether the remote digests of the images of the
+// plugin are the ones recorded in its status when it was last published, so
+// that mutable tags are extracted again once they point to another image.
+// Images whose digest can not be resolved are considered unchanged, the
+// published plugin is kept rather than removed on a transient registry failure.
+func (c *Controller) imagesUnchanged(ctx context.Context, plugin *v1alpha1.Plugin) bool {
+	expanded, _ := expandAllPlatforms(plugin, c.options.defaultPlatforms())
+	for _, p := range expanded.Spec.Platforms {
+		i := slices.IndexFunc(plugin.Status.Platforms, func(status v1alpha1.PluginPlatformStatus) bool {
+			return status.Platform == p.Platform
+		})
+		if i < 0 || len(plugin.Status.Platforms[i].ImageDigests) == 0 {
+			return false
+		}
+		imageAuth, newCondition := imagePullAuth(ctx, c.client, p, c.options)
+		if newCondition != nil {
+			return false
+		}
+
+		pullCtx, cancel := c.options.pullContext(ctx)
+		digests, err := resolveDigests(pullCtx, p, image.PullOptions{
+			Auth:    imageAuth,
+			Mirrors: c.options.RegistryMirrors,
+			Proxy:   c.options.ImagePullProxy,
+			NoProxy: c.options.ImagePullNoProxy,
+		})
+		cancel()
+		if err != nil {
+			klog.V(2).InfoS("Plugin platform image digests can not be resolved, the published plugin is kept", "plugin", plugin.Name, "platform", p.Platform, "err", err)
+			continue
+		}
+		if !maps.Equal(digests, plugin.Status.Platforms[i].ImageDigests) {
+			klog.V(2).InfoS("Plugin platform images are changed", "plugin", plugin.Name, "platform", p.Platform)
+			return false
+		}
+	}
+	return true
+}
+
 // DeletePlugin deletes the plugin from git repository and removes
-// the actuall plugin tarball from local.
+// the actuall plugin archives from local.
 func DeletePlugin(name string, repo *git.Repo) error {
-	err := repo.Delete(name)
+	// the archives are those of the platforms of the removed manifest,
+	// the names of other plugins may start with name_.
+	platforms, err := publishedPlatforms(name, repo)
 	if err != nil {
 		return err
 	}
-
-	files, err := filepath.Glob(fmt.Sprintf("%s/%s_*.tar.gz", image.TarballPath, name))
+	err = repo.Delete(name)
 	if err != nil {
 		return err
 	}
 
-	for _, file := range files {
-		os.Remove(file)
+	for _, p := range platforms {
+		os.Remove(filepath.Join(image.TarballPath, image.ArchiveName(name, p)))
+		os.Remove(filepath.Join(image.TarballPath, image.ZstdArchiveName(name, p)))
 	}
-	return nil
+	return image.PruneBlobs()
+}
+
+// publishedPlatforms returns the platforms of the manifest of the plugin
+// published under name, parsed from the platform of their download uri.
+func publishedPlatforms(name string, repo *git.Repo) ([]platform.Platform, error) {
+	manifest, err := repo.Manifest(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest of plugin %s: %w", name, err)
+	}
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		return nil, fmt.Errorf("decoding manifest of plugin %s: %w", name, err)
+	}
+	var platforms []platform.Platform
+	for _, p := range k.Spec.Platforms {
+		uri, err := url.Parse(p.URI)
+		if err != nil {
+			continue
+		}
+		parsed, err := platform.Parse(uri.Query().Get("platform"))
+		if err != nil {
+			continue
+		}
+		platforms = append(platforms, parsed)
+	}
+	return platforms, nil
 }
 
-func UpsertPlugin(plugin *v1alpha1.Plugin, repo *git.Repo, client *kubernetes.Clientset, dynamicClient *dynamic.DynamicClient, route routeclient.RouteV1Interface, insecureHTTP bool) error {
-	k, success, err := convertKrewPlugin(plugin, client, dynamicClient, route, insecureHTTP)
+// unpublishPlugin deletes the plugin published under publishedName by the
+// Plugin name, it is left untouched if another Plugin publishes it.
+func unpublishPlugin(name, publishedName string, repo *git.Repo) error {
+	owner, err := publishedBy(publishedName, repo)
 	if err != nil {
 		return err
 	}
-	if !success {
+	if len(owner) > 0 && owner != name {
+		klog.V(2).InfoS("Plugin is published by another Plugin, it is not deleted", "plugin", name, "krewName", publishedName, "owner", owner)
 		return nil
 	}
-	err = repo.Upsert(plugin.Name, k)
+	return DeletePlugin(publishedName, repo)
+}
+
+// publishedBy returns the name of the Plugin the plugin of the index
+// published under name is published from, or an empty string if it is not published.
+func publishedBy(name string, repo *git.Repo) (string, error) {
+	manifest, err := repo.Manifest(name)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
 	if err != nil {
-		return err
+		return "", fmt.Errorf("getting manifest of plugin %s: %w", name, err)
 	}
-	return nil
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		return "", fmt.Errorf("decoding manifest of plugin %s: %w", name, err)
+	}
+	if owner, ok := k.Annotations[pluginAnnotation]; ok {
+		return owner, nil
+	}
+	return k.Name, nil
 }
 
-func convertKrewPlugin(plugin *v1alpha1.Plugin, client *kubernetes.Clientset, dynamicClient *dynamic.DynamicClient, route routeclient.RouteV1Interface, insecureHTTP bool) (*krew.Plugin, bool, error) {
-	if plugin == nil {
-		return nil, false, nil
+// krewName returns the name the plugin is published under in the index,
+// its spec.krewName if set, its name otherwise.
+func krewName(plugin *v1alpha1.Plugin) string {
+	if len(plugin.Spec.KrewName) > 0 {
+		return plugin.Spec.KrewName
 	}
-	ctx := context.Background()
-	safePluginRegexp := regexp.MustCompile(`^[\w-]+$`)
-	if !safePluginRegexp.MatchString(plugin.Name) {
-		newCondition := metav1.Condition{
+	return plugin.Name
+}
+
+// UpsertPlugin publishes the plugin in the index, replacing the previous
+// version in a single commit. Only the platforms which can be extracted are
+// published. The plugin is only removed from the index if its spec can not be
+// published at all, a transient failure keeps the published plugin and is
+// returned to be retried.
+func UpsertPlugin(ctx context.Context, plugin *v1alpha1.Plugin, repo *git.Repo, client kubernetes.Interface, dynamicClient dynamic.Interface, route routeclient.RouteV1Interface, options Options) error {
+	name := krewName(plugin)
+	conflict, err := nameConflict(plugin.Name, name, repo)
+	if err != nil {
+		return err
+	}
+	if len(conflict) > 0 {
+		// the plugin is not deleted from the index, as it would remove
+		// the manifest of the conflicting plugin on case-insensitive filesystems.
+		return updateStatusCondition(ctx, plugin, dynamicClient, metav1.Condition{
 			Status:  metav1.ConditionFalse,
-			Reason:  "InvalidField",
-			Message: fmt.Sprintf("invalid plugin name %s", plugin.Name),
-		}
-		err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
+			Reason:  "NameConflict",
+			Message: fmt.Sprintf("plugin %s conflicts with the published plugin %s, plugin names must be unique regardless of case", name, conflict),
+		})
+	}
+
+	k, success, err := convertKrewPlugin(ctx, plugin, client, dynamicClient, route, options)
+	if !success {
 		if err != nil {
-			return nil, false, err
+			// i.e. the API server or the registry is unavailable, the
+			// published manifest and archives are still valid meanwhile.
+			klog.V(2).InfoS("Plugin can not be published, the published plugin is kept", "plugin", plugin.Name, "err", err)
+			return err
 		}
-		return nil, false, nil
+		if deleteErr := DeletePlugin(name, repo); deleteErr != nil {
+			klog.V(2).InfoS("Plugin can not be deleted", "plugin", plugin.Name, "err", deleteErr)
+		}
+		return nil
+	}
+	if upsertErr := repo.Upsert(name, k); upsertErr != nil {
+		return upsertErr
 	}
+	// the archives of the failed platforms are served until the manifest
+	// advertising them is replaced
+	if removeErr := removeFailedArchives(name, plugin.Status.Platforms); removeErr != nil {
+		klog.V(2).InfoS("Archives of the failed platforms can not be removed", "plugin", plugin.Name, "err", removeErr)
+	}
+	// every platform is extracted and the manifest is committed
+	if installed := meta.FindStatusCondition(plugin.Status.Conditions, "PluginInstalled"); installed != nil && installed.Reason == "Installed" {
+		readyErr := updateStatusCondition(ctx, plugin, dynamicClient, metav1.Condition{
+			Type:    readyConditionType,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Published",
+			Message: fmt.Sprintf("plugin %s is published in the index", plugin.Name),
+		})
+		if readyErr != nil {
+			return readyErr
+		}
+	}
+	// err reports the platforms which failed and are retried
+	return err
+}
 
-	if !strings.HasPrefix(plugin.Spec.Version, "v") {
-		newCondition := metav1.Condition{
-			Status:  metav1.ConditionFalse,
-			Reason:  "InvalidField",
-			Message: fmt.Sprintf("invalid version %s, should start with v like v0.0.0", plugin.Spec.Version),
+// removeFailedArchives removes the archives of the platforms of the plugin
+// published under name which are not installed.
+func removeFailedArchives(name string, platforms []v1alpha1.PluginPlatformStatus) error {
+	for _, status := range platforms {
+		if meta.IsStatusConditionTrue(status.Conditions, "PlatformInstalled") {
+			continue
 		}
-		err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
+		parsed, err := platform.Parse(status.Platform)
 		if err != nil {
-			return nil, false, err
+			continue
 		}
-		return nil, false, nil
+		os.Remove(filepath.Join(image.TarballPath, image.ArchiveName(name, parsed)))
+		os.Remove(filepath.Join(image.TarballPath, image.ZstdArchiveName(name, parsed)))
 	}
-	_, err := k8sver.ParseSemantic(plugin.Spec.Version)
+	return image.PruneBlobs()
+}
+
+// nameConflict returns the plugin of the index whose name only differs from
+// name by case, whose manifest path would collide on case-insensitive filesystems,
+// or which is published under name by another Plugin than owner.
+func nameConflict(owner, name string, repo *git.Repo) (string, error) {
+	published, err := repo.List()
 	if err != nil {
-		newCondition := metav1.Condition{
-			Status:  metav1.ConditionFalse,
-			Reason:  "InvalidField",
-			Message: fmt.Sprintf("invalid version %s, should be in v0.0.0 format", plugin.Spec.Version),
+		return "", fmt.Errorf("listing the plugins of the index: %w", err)
+	}
+	normalized := make(map[string]string, len(published))
+	for _, p := range published {
+		normalized[strings.ToLower(p)] = p
+	}
+	conflict, ok := normalized[strings.ToLower(name)]
+	if !ok {
+		return "", nil
+	}
+	if conflict != name {
+		return conflict, nil
+	}
+	publisher, err := publishedBy(name, repo)
+	if err != nil {
+		return "", err
+	}
+	if len(publisher) > 0 && publisher != owner {
+		return fmt.Sprintf("%s of Plugin %s", conflict, publisher), nil
+	}
+	return "", nil
+}
+
+// convertKrewPlugin extracts the platforms of the plugin and returns the Krew
+// manifest of the ones which are extracted, and whether there is any. The
+// error reports the failures which are retried, i.e. a failed status update or
+// image pull. Without manifest nor error, the plugin can not be published from
+// its spec until it is changed.
+func convertKrewPlugin(ctx context.Context, plugin *v1alpha1.Plugin, client kubernetes.Interface, dynamicClient dynamic.Interface, route routeclient.RouteV1Interface, options Options) (*krew.Plugin, bool, error) {
+	if plugin == nil {
+		return nil, false, nil
+	}
+	// the platforms are expanded and validated, whereas the manifest and
+	// the status are still the ones of the plugin.
+	expanded, fromAll := expandAllPlatforms(plugin, options.defaultPlatforms())
+	platformPath := specPlatformPath
+	if fromAll != nil {
+		// the errors of the expanded platforms are reported on the all platform
+		platformPath = func(i int) *field.Path {
+			return specPlatformPath(specPlatformIndex(plugin, expanded.Spec.Platforms[i].Platform))
 		}
-		err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
+	}
+	if errs := validatePlugin(expanded, platformPath); len(errs) > 0 {
+		err := updateStatus(ctx, plugin, dynamicClient, *invalidFieldCondition(errs), func(status *v1alpha1.PluginStatus) bool {
+			status.ValidationErrors = validationErrors(errs)
+			return false
+		})
 		if err != nil {
 			return nil, false, err
 		}
 		return nil, false, nil
 	}
 
-	for _, p := range plugin.Spec.Platforms {
-		if !platformRegex.MatchString(p.Platform) {
-			newCondition := metav1.Condition{
-				Status:  metav1.ConditionFalse,
-				Reason:  "InvalidField",
-				Message: fmt.Sprintf("invalid platform %s, please ensure that OS (linux/darwin/windows) and arch (arm64/amd64/ppc64le/s390x) are supported and in linux/amd64 format", p.Platform),
+	k := NewKrewPlugin(plugin, options)
+	baseURL := strings.TrimSuffix(options.DownloadBaseURL, "/")
+	var platforms []v1alpha1.PluginPlatformStatus
+	var failed []string
+	var firstFailure *metav1.Condition
+	var retryErr error
+	for _, p := range expanded.Spec.Platforms {
+		// platforms are already validated
+		parsed, _ := platform.Parse(p.Platform)
+
+		p.Bin = DefaultBin(plugin, p)
+		destinationFileName := filepath.Join(image.TarballPath, image.ArchiveName(k.Name, parsed))
+		files, checksum, digests, newCondition := extractPluginPlatform(ctx, plugin, p, client, options, destinationFileName, fromAll.Has(p.Platform))
+		if newCondition != nil {
+			// the other platforms are still published, a single broken
+			// platform does not block the plugin for all of them.
+			klog.InfoS("Plugin platform can not be extracted", "plugin", plugin.Name, "platform", p.Platform, "image", p.Image, "reason", newCondition.Reason, "message", newCondition.Message)
+			platforms = append(platforms, platformStatus(plugin, p, nil, *newCondition))
+			failed = append(failed, p.Platform)
+			if firstFailure == nil {
+				firstFailure = newCondition
 			}
-			err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-			if err != nil {
-				return nil, false, err
+			if retryableReasons.Has(newCondition.Reason) && retryErr == nil {
+				retryErr = fmt.Errorf("plugin %s platform %s will be retried: %s", plugin.Name, p.Platform, newCondition.Message)
 			}
-			return nil, false, nil
+			continue
+		}
+		if err := image.Deduplicate(destinationFileName, checksum); err != nil {
+			return nil, false, fmt.Errorf("storing the archive of plugin %s platform %s: %w", plugin.Name, p.Platform, err)
 		}
-	}
 
-	k := &krew.Plugin{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "krew.googlecontainertools.github.com/v1alpha2",
+		// the route is only fetched once per reconcile, as it is the same for every platform
+		if len(baseURL) == 0 {
+			r, err := route.Routes(routeNamespace).Get(ctx, routeName, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				return nil, false, fmt.Errorf("route openshift-cli-manager is not found in openshift-cli-manager-operator namespace, plugins can not be advertised without it or --download-base-url: %w", err)
+			}
+			if err != nil {
+				return nil, false, fmt.Errorf("could not get the route openshift-cli-manager in openshift-cli-manager-operator namespace err: %w", err)
+			}
+			baseURL = fmt.Sprintf("https://%s", r.Spec.Host)
+			if options.InsecureHTTP {
+				baseURL = fmt.Sprintf("http://%s", r.Spec.Host)
+			}
+		}
+
+		k.Spec.Platforms = append(k.Spec.Platforms, KrewPlatform(k, p, baseURL, checksum, files, options))
+		status := platformStatus(plugin, p, digests, metav1.Condition{
+			Status:  metav1.ConditionTrue,
+			Reason:  "Installed",
+			Message: fmt.Sprintf("platform %s is ready to be served", p.Platform),
+		})
+		status.ResolvedFiles = resolvedFiles(files)
+		platforms = append(platforms, status)
+	}
+
+	newCondition := metav1.Condition{
+		Status:  metav1.ConditionTrue,
+		Reason:  "Installed",
+		Message: fmt.Sprintf("plugin %s is ready to be served", plugin.Name),
+	}
+	switch {
+	case len(failed) == 0:
+		klog.InfoS("Plugin is ready to be served", "plugin", plugin.Name)
+	case len(k.Spec.Platforms) == 0:
+		newCondition = *firstFailure
+	default:
+		klog.InfoS("Plugin is partially ready to be served", "plugin", plugin.Name, "failed", failed)
+		newCondition = metav1.Condition{
+			Status:  metav1.ConditionTrue,
+			Reason:  "PartiallyInstalled",
+			Message: fmt.Sprintf("plugin %s is ready to be served except for platforms %s, see the conditions of the platforms", plugin.Name, strings.Join(failed, ", ")),
+		}
+	}
+	err := updateStatus(ctx, plugin, dynamicClient, newCondition, func(status *v1alpha1.PluginStatus) bool {
+		if reflect.DeepEqual(status.Platforms, platforms) {
+			return false
+		}
+		status.Platforms = platforms
+		return true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(k.Spec.Platforms) == 0 {
+		// the last published manifest is kept while the failures are retried
+		return nil, false, retryErr
+	}
+	// the failed platforms are retried, the others are published meanwhile
+	return k, true, retryErr
+}
+
+// NewKrewPlugin returns the Krew manifest of the plugin without any platform,
+// which are added with KrewPlatform once their archives are extracted.
+func NewKrewPlugin(plugin *v1alpha1.Plugin, options Options) *krew.Plugin {
+	k := &krew.Plugin{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "krew.googlecontainertools.github.com/v1alpha2",
 			Kind:       "Plugin",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: plugin.Name,
+			Name: krewName(plugin),
+			Annotations: map[string]string{
+				specHashAnnotation: specHash(plugin, options),
+			},
 		},
 		Spec: krew.PluginSpec{
 			Version:          plugin.Spec.Version,
@@ -266,260 +1123,1150 @@ func convertKrewPlugin(plugin *v1alpha1.Plugin, client *kubernetes.Clientset, dy
 			Homepage:         plugin.Spec.Homepage,
 		},
 	}
-	for _, p := range plugin.Spec.Platforms {
-		fields := strings.SplitN(p.Platform, "/", 2)
-		var proxyURL *url.URL
-		if p.ProxyURL != "" {
-			proxyURL, err = url.Parse(p.ProxyURL)
-			if err != nil {
-				newCondition := metav1.Condition{
-					Status:  metav1.ConditionFalse,
-					Reason:  "InvalidField",
-					Message: fmt.Sprintf("invalid proxy URL %s error: %s", p.ProxyURL, err),
-				}
-				err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-				if err != nil {
-					return nil, false, err
-				}
-				return nil, false, nil
-			}
-			if proxyURL.Scheme == "http" {
-				newCondition := metav1.Condition{
-					Status:  metav1.ConditionFalse,
-					Reason:  "InvalidField",
-					Message: fmt.Sprintf("http is not supported for proxy url %s", p.ProxyURL),
-				}
-				err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-				if err != nil {
-					return nil, false, err
-				}
-				return nil, false, nil
-			}
-		}
-
-		var imageAuth string
-		if len(p.ImagePullSecret) > 0 {
-			secrets := strings.SplitN(p.ImagePullSecret, "/", 2)
-			var namespace, secret string
-			if len(secrets) > 1 {
-				namespace = secrets[0]
-				secret = secrets[1]
-			} else {
-				secret = secrets[0]
+	if len(plugin.Spec.KrewName) > 0 {
+		k.Annotations[pluginAnnotation] = plugin.Name
+	}
+	if plugin.Spec.Deprecated {
+		// Krew prints the caveats once the plugin is installed
+		message := deprecationMessage(plugin)
+		k.Annotations[deprecatedAnnotation] = message
+		k.Spec.Caveats = strings.TrimSpace(message + "\n\n" + plugin.Spec.Caveats)
+	}
+	return k
+}
+
+// KrewPlatform returns the platform of the Krew manifest k downloading the
+// archive of p from baseURL, which contains the files and whose sha256 is checksum.
+func KrewPlatform(k *krew.Plugin, p v1alpha1.PluginPlatform, baseURL, checksum string, files []v1alpha1.FileLocation, options Options) krew.Platform {
+	// the platform is validated along with the plugin
+	parsed, _ := platform.Parse(p.Platform)
+	artifactURI := fmt.Sprintf("%s/cli-manager/plugins/download/?name=%s&platform=%s", baseURL, k.Name, parsed.FileName())
+	if len(options.DownloadQuery) > 0 {
+		// the archive is still verified against its sha256 by Krew
+		query := url.Values{}
+		for key, value := range options.DownloadQuery {
+			query.Set(key, value)
+		}
+		artifactURI += "&" + query.Encode()
+	}
+
+	kp := krew.Platform{
+		URI:    artifactURI,
+		Sha256: checksum,
+		Selector: &metav1.LabelSelector{
+			// Krew only matches os and arch, variant is
+			// only used while selecting the image manifest.
+			MatchLabels: map[string]string{
+				"os":   parsed.OS,
+				"arch": parsed.Arch,
+			},
+			MatchExpressions: p.MatchExpressions,
+		},
+		Files: []krew.FileOperation{},
+		Bin:   p.Bin,
+	}
+
+	for _, f := range files {
+		kp.Files = append(kp.Files, krew.FileOperation{
+			// Krew moves the directories along with their tree
+			From: options.extractOptions().EntryName(k.Name, f),
+			To:   f.To,
+		})
+	}
+	return kp
+}
+
+// extractPluginPlatform extracts the files of the platform of the plugin into
+// the archive at destination, and returns them along with the sha256 of the
+// archive and the digests of its images. It returns the condition describing
+// why the platform can not be served instead if it fails. If skipMissing, the
+// platform is skipped without pulling if its images do not exist.
+func extractPluginPlatform(ctx context.Context, plugin *v1alpha1.Plugin, p v1alpha1.PluginPlatform, client kubernetes.Interface, options Options, destination string, skipMissing bool) ([]v1alpha1.FileLocation, string, map[string]string, *metav1.Condition) {
+	if newCondition := validateDigestPinned(plugin, p, options); newCondition != nil {
+		return nil, "", nil, newCondition
+	}
+	if newCondition := validateRegistryAllowed(p, options); newCondition != nil {
+		return nil, "", nil, newCondition
+	}
+
+	imageAuth, newCondition := imagePullAuth(ctx, client, p, options)
+	if newCondition != nil {
+		return nil, "", nil, newCondition
+	}
+
+	klog.V(4).InfoS("Extracting plugin platform", "plugin", plugin.Name, "platform", p.Platform, "image", p.Image)
+	pullCtx, cancel := options.pullContext(ctx)
+	defer cancel()
+	pullOptions := image.PullOptions{
+		Auth:    imageAuth,
+		Mirrors: options.RegistryMirrors,
+		Proxy:   options.ImagePullProxy,
+		NoProxy: options.ImagePullNoProxy,
+	}
+	// the digests are resolved before pulling, so that an image changed
+	// meanwhile is extracted again on the next reconcile.
+	digests, err := resolveDigests(pullCtx, p, pullOptions)
+	if err != nil {
+		var terr *transport.Error
+		if skipMissing && stderrors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return nil, "", nil, &metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "ImageNotFound",
+				Message: fmt.Sprintf("platform %s expanded from the all platform is skipped: %s", p.Platform, err),
 			}
-			// if an imagePullSecret is defined for the binary, retrieve the Secret for it
-			imagePullSecret, err := client.CoreV1().Secrets(namespace).Get(ctx, secret, metav1.GetOptions{})
-			if err != nil {
-				newCondition := metav1.Condition{
-					Status:  metav1.ConditionFalse,
-					Reason:  "InvalidField",
-					Message: fmt.Sprintf("error occurred %s while getting the secret %s", err, secret),
-				}
-				if errors.IsNotFound(err) {
-					newCondition.Message = fmt.Sprintf("secret %s is not found. If secret is in another namespace, please prepend namespace as anotherns/secret_name format", secret)
-				}
-				err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-				if err != nil {
-					return nil, false, err
-				}
-				return nil, false, nil
-			}
-
-			// ensure the Secret is of the expected type
-			if imagePullSecret.Type != corev1.SecretTypeDockercfg && imagePullSecret.Type != corev1.SecretTypeDockerConfigJson {
-				newCondition := metav1.Condition{
-					Status:  metav1.ConditionFalse,
-					Reason:  "InvalidSecretType",
-					Message: fmt.Sprintf("image pull secret type %s is not supported, only kubernetes.io/dockercfg and kubernetes.io/dockerconfigjson are supported", imagePullSecret.Type),
-				}
-				err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-				if err != nil {
-					return nil, false, err
-				}
-				return nil, false, nil
-			}
-
-			if imagePullSecret.Type == corev1.SecretTypeDockercfg {
-				// set the .dockercfg auth information for the image puller
-				imageAuth = string(imagePullSecret.Data[corev1.DockerConfigKey])
-			} else if imagePullSecret.Type == corev1.SecretTypeDockerConfigJson {
-				var dcr *DockerConfigJson
-				err = json.Unmarshal(imagePullSecret.Data[corev1.DockerConfigJsonKey], &dcr)
-				if err != nil || dcr == nil {
-					newCondition := metav1.Condition{
-						Status:  metav1.ConditionFalse,
-						Reason:  "InvalidField",
-						Message: fmt.Sprintf("unable to parse dockerjson %s to json", imagePullSecret.Name),
-					}
-					err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-					if err != nil {
-						return nil, false, err
-					}
-					return nil, false, nil
-				}
-				for key, val := range dcr.Auths {
-					if strings.Contains(p.Image, key+"/") {
-						imageAuth = val.Auth
-					}
-				}
-			}
-		}
-
-		osStr := fields[0]
-		archStr := fields[1]
-		if osStr == "windows" || osStr == "darwin" {
-			// if the binary is either windows or darwin,
-			// try to get it from linux/amd64 image
-			osStr = "linux"
-			archStr = "amd64"
-		}
-		// attempt to pull the image down locally
-		img, err := image.Pull(p.Image, imageAuth, &v1.Platform{
-			Architecture: archStr,
-			OS:           osStr,
-		}, p.CABundle, proxyURL)
+		}
+		klog.V(2).InfoS("Plugin platform image digests can not be resolved", "plugin", plugin.Name, "platform", p.Platform, "err", err)
+	}
+	// the same images are not extracted again into the same archive
+	var key string
+	if err == nil {
+		key = extractionKey(plugin, p, digests, options.extractOptions())
+		if files, checksum, ok := image.CachedExtraction(key, destination); ok {
+			klog.V(4).InfoS("Plugin platform is already extracted from the same images", "plugin", plugin.Name, "platform", p.Platform)
+			return files, checksum, digests, nil
+		}
+	}
+	files, checksum, newCondition := ExtractPlatform(pullCtx, p, pullOptions, options.extractOptions(), destination)
+	if newCondition != nil {
+		return nil, "", nil, newCondition
+	}
+	if len(key) > 0 {
+		if err := image.RecordExtraction(key, checksum, files); err != nil {
+			klog.V(2).InfoS("Plugin platform extraction can not be recorded", "plugin", plugin.Name, "platform", p.Platform, "err", err)
+		}
+	}
+	return files, checksum, digests, nil
+}
+
+// extractionKey returns the hash of what the archive of the platform is built
+// from: the platform, the resolved digests of its images and the options the
+// archive is written with. The refresh annotation is part of it, so that
+// changing it extracts the images again.
+func extractionKey(plugin *v1alpha1.Plugin, p v1alpha1.PluginPlatform, digests map[string]string, extractOptions image.ExtractOptions) string {
+	data, _ := json.Marshal(struct {
+		Platform         v1alpha1.PluginPlatform `json:"platform"`
+		Digests          map[string]string       `json:"digests"`
+		CompressionLevel int                     `json:"compressionLevel"`
+		ZstdArchives     bool                    `json:"zstdArchives"`
+		Refresh          string                  `json:"refresh,omitempty"`
+		ArchiveLayout    string                  `json:"archiveLayout,omitempty"`
+	}{
+		Platform:         p,
+		Digests:          digests,
+		CompressionLevel: extractOptions.CompressionLevel,
+		ZstdArchives:     extractOptions.Zstd,
+		Refresh:          plugin.Annotations[refreshAnnotation],
+		ArchiveLayout:    archiveLayout(extractOptions),
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// archiveLayout returns the layout of the archives hashed along the plugins,
+// which is empty for the default layout so that the hashes of the plugins
+// published before the layout could be changed stay the same.
+func archiveLayout(extractOptions image.ExtractOptions) string {
+	if extractOptions.Layout == image.ArchiveLayoutImage {
+		return ""
+	}
+	return extractOptions.Layout
+}
+
+// platformStatus returns the status of the platform of the plugin with the
+// condition set, retaining the transition time of its previous condition.
+func platformStatus(plugin *v1alpha1.Plugin, p v1alpha1.PluginPlatform, digests map[string]string, condition metav1.Condition) v1alpha1.PluginPlatformStatus {
+	status := v1alpha1.PluginPlatformStatus{
+		Platform:      p.Platform,
+		ImageDigests:  digests,
+		ResolvedImage: resolvedImage(p.Image, digests[p.Image]),
+	}
+	if i := slices.IndexFunc(plugin.Status.Platforms, func(status v1alpha1.PluginPlatformStatus) bool {
+		return status.Platform == p.Platform
+	}); i >= 0 {
+		status.Conditions = slices.Clone(plugin.Status.Platforms[i].Conditions)
+	}
+	condition.Type = "PlatformInstalled"
+	condition.ObservedGeneration = plugin.Generation
+	meta.SetStatusCondition(&status.Conditions, condition)
+	return status
+}
+
+// resolvedFiles returns the paths in the image of the extracted files which
+// were searched by name, keyed by their name, or nil if there is none.
+func resolvedFiles(files []v1alpha1.FileLocation) map[string]string {
+	var resolved map[string]string
+	for _, f := range files {
+		if !f.FindByName {
+			continue
+		}
+		if resolved == nil {
+			resolved = map[string]string{}
+		}
+		resolved[path.Base(f.From)] = f.From
+	}
+	return resolved
+}
+
+// resolvedImage returns the reference of the image pinned by its digest,
+// i.e. quay.io/openshift/origin-cli@sha256:... for quay.io/openshift/origin-cli:latest.
+// It returns an empty string if the digest is not resolved.
+func resolvedImage(ref, digest string) string {
+	if len(digest) == 0 {
+		return ""
+	}
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return ""
+	}
+	return parsed.Context().Name() + "@" + digest
+}
+
+// deprecationMessage returns the message surfaced to the users of the deprecated plugin.
+func deprecationMessage(plugin *v1alpha1.Plugin) string {
+	if len(plugin.Spec.DeprecationMessage) > 0 {
+		return fmt.Sprintf("plugin %s is deprecated: %s", plugin.Name, plugin.Spec.DeprecationMessage)
+	}
+	return fmt.Sprintf("plugin %s is deprecated", plugin.Name)
+}
+
+// validateDigestPinned rejects the images of the platform referenced by a
+// mutable tag if RequireDigestPinned is set, which can silently change the
+// published plugin. They are only warned about otherwise.
+func validateDigestPinned(plugin *v1alpha1.Plugin, p v1alpha1.PluginPlatform, options Options) *metav1.Condition {
+	for _, ref := range image.FileImages(p) {
+		parsed, err := name.ParseReference(ref)
 		if err != nil {
-			newCondition := metav1.Condition{
+			return &metav1.Condition{
 				Status:  metav1.ConditionFalse,
-				Reason:  "ImagePullError",
-				Message: fmt.Sprintf("failed to pull the image error %s", err),
+				Reason:  "InvalidField",
+				Message: fmt.Sprintf("invalid image %s of platform %s error: %s", ref, p.Platform, err),
 			}
-			err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-			if err != nil {
-				return nil, false, err
+		}
+		if _, ok := parsed.(name.Digest); ok {
+			continue
+		}
+		if options.RequireDigestPinned {
+			return &metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "MutableImageRejected",
+				Message: fmt.Sprintf("image %s of platform %s is not pinned by digest, which is required by the cluster policy", ref, p.Platform),
 			}
-			return nil, false, nil
 		}
+		klog.InfoS("Plugin platform image is referenced by a mutable tag, it should be pinned by digest", "plugin", plugin.Name, "platform", p.Platform, "image", ref)
+	}
+	return nil
+}
+
+// imageVariableRegex matches the variables of the images, i.e. ${REGISTRY}.
+var imageVariableRegex = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
 
-		destinationFileName := fmt.Sprintf("%s/%s_%s.tar.gz", image.TarballPath, plugin.Name, strings.ReplaceAll(p.Platform, "/", "_"))
-		files, err := image.Extract(img, p, destinationFileName)
+// validateRegistryAllowed rejects the images of the platform whose registry
+// is not in AllowedRegistries, if it is set. The registry of the reference is
+// checked, regardless of the mirror the image is pulled from.
+func validateRegistryAllowed(p v1alpha1.PluginPlatform, options Options) *metav1.Condition {
+	if len(options.AllowedRegistries) == 0 {
+		return nil
+	}
+	for _, ref := range image.FileImages(p) {
+		parsed, err := name.ParseReference(ref)
 		if err != nil {
-			newCondition := metav1.Condition{
+			return &metav1.Condition{
 				Status:  metav1.ConditionFalse,
-				Reason:  "ExtractFromImageError",
-				Message: fmt.Sprintf("failed to extract the binary from image error %s", err),
+				Reason:  "InvalidField",
+				Message: fmt.Sprintf("invalid image %s of platform %s error: %s", ref, p.Platform, err),
 			}
-			err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-			if err != nil {
-				return nil, false, err
+		}
+		registry := parsed.Context().RegistryStr()
+		if !slices.ContainsFunc(options.AllowedRegistries, func(allowed string) bool {
+			// docker.io is normalized like the registry of the reference
+			r, err := name.NewRegistry(allowed)
+			return err == nil && r.RegistryStr() == registry
+		}) {
+			return &metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "RegistryNotAllowed",
+				Message: fmt.Sprintf("image %s of platform %s is not pulled, registry %s is not allowed by the cluster policy", ref, p.Platform, registry),
 			}
-			return nil, false, nil
 		}
+	}
+	return nil
+}
 
-		if len(files) == 0 {
-			newCondition := metav1.Condition{
-				Status:  metav1.ConditionFalse,
-				Reason:  "BinaryNotFound",
-				Message: fmt.Sprintf("failed to find the binary from image, path should not be directory, symlink"),
+// ExpandAllPlatforms returns a copy of the plugin whose "all" platform is
+// expanded into the platforms which are not listed explicitly. The {os} and
+// {arch} of its images, files and bin are replaced with the ones of each
+// platform, i.e. quay.io/example/tool:v1.0.0-{os}-{arch}, and {exe} with the
+// .exe suffix of the Windows executables. The plugin is returned as is if it
+// has no "all" platform.
+func ExpandAllPlatforms(plugin *v1alpha1.Plugin, platforms []string) *v1alpha1.Plugin {
+	expanded, _ := expandAllPlatforms(plugin, platforms)
+	return expanded
+}
+
+// expandAllPlatforms expands the plugin like ExpandAllPlatforms and also
+// returns the platforms expanded from the "all" platform.
+func expandAllPlatforms(plugin *v1alpha1.Plugin, platforms []string) (*v1alpha1.Plugin, sets.Set[string]) {
+	if !hasAllPlatforms(plugin) {
+		return plugin, nil
+	}
+	expanded := plugin.DeepCopy()
+	expanded.Spec.Platforms = nil
+	listed := sets.New[string]()
+	for _, p := range plugin.Spec.Platforms {
+		if p.Platform != allPlatforms {
+			expanded.Spec.Platforms = append(expanded.Spec.Platforms, *p.DeepCopy())
+			listed.Insert(p.Platform)
+		}
+	}
+	fromAll := sets.New[string]()
+	for _, p := range plugin.Spec.Platforms {
+		if p.Platform != allPlatforms {
+			continue
+		}
+		for _, name := range platforms {
+			if listed.Has(name) {
+				continue
 			}
-			err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-			if err != nil {
-				return nil, false, err
+			listed.Insert(name)
+			fromAll.Insert(name)
+			parsed, _ := platform.Parse(name)
+			exe := ""
+			if parsed.IsWindows() {
+				exe = ".exe"
+			}
+			replacer := strings.NewReplacer("{os}", parsed.OS, "{arch}", parsed.Arch, "{exe}", exe)
+			ep := *p.DeepCopy()
+			ep.Platform = name
+			ep.Image = replacer.Replace(ep.Image)
+			ep.Bin = replacer.Replace(ep.Bin)
+			for i := range ep.Files {
+				ep.Files[i].Image = replacer.Replace(ep.Files[i].Image)
+				ep.Files[i].From = replacer.Replace(ep.Files[i].From)
+				ep.Files[i].FromDir = replacer.Replace(ep.Files[i].FromDir)
+				ep.Files[i].To = replacer.Replace(ep.Files[i].To)
 			}
-			return nil, false, nil
+			expanded.Spec.Platforms = append(expanded.Spec.Platforms, ep)
 		}
+	}
+	return expanded, fromAll
+}
 
-		dest, err := os.Open(destinationFileName)
+// specPlatformIndex returns the index of the platform in the spec of the
+// plugin, which is the one of the all platform if it is not listed explicitly.
+func specPlatformIndex(plugin *v1alpha1.Plugin, name string) int {
+	if i := slices.IndexFunc(plugin.Spec.Platforms, func(p v1alpha1.PluginPlatform) bool { return p.Platform == name }); i >= 0 {
+		return i
+	}
+	return slices.IndexFunc(plugin.Spec.Platforms, func(p v1alpha1.PluginPlatform) bool { return p.Platform == allPlatforms })
+}
+
+func hasAllPlatforms(plugin *v1alpha1.Plugin) bool {
+	return slices.ContainsFunc(plugin.Spec.Platforms, func(p v1alpha1.PluginPlatform) bool {
+		return p.Platform == allPlatforms
+	})
+}
+
+// defaultPlatformsOf returns the platforms the "all" platform of the plugin
+// expands into, or nil if it has none.
+func defaultPlatformsOf(plugin *v1alpha1.Plugin, options Options) []string {
+	if !hasAllPlatforms(plugin) {
+		return nil
+	}
+	return options.defaultPlatforms()
+}
+
+// expandPluginImages returns a copy of the plugin whose images and file images
+// have their ${VARIABLE} expanded from the data of the ImageVariablesConfigMap.
+// The plugin is returned as is if none of its images has a variable. The
+// condition describes the variables which can not be expanded, the error the
+// failures of retrieving the ConfigMap which are retried.
+func expandPluginImages(ctx context.Context, plugin *v1alpha1.Plugin, client kubernetes.Interface, options Options) (*v1alpha1.Plugin, *metav1.Condition, error) {
+	hasVariables := false
+	for _, p := range plugin.Spec.Platforms {
+		hasVariables = hasVariables || strings.Contains(p.Image, "$")
+		for _, f := range p.Files {
+			hasVariables = hasVariables || strings.Contains(f.Image, "$")
+		}
+	}
+	if !hasVariables {
+		return plugin, nil, nil
+	}
+
+	variables := map[string]string{}
+	if len(options.ImageVariablesConfigMap) > 0 {
+		cm, err := client.CoreV1().ConfigMaps(options.SecretNamespace).Get(ctx, options.ImageVariablesConfigMap, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, nil, fmt.Errorf("getting the image variables ConfigMap %s in namespace %s: %w", options.ImageVariablesConfigMap, options.SecretNamespace, err)
+		}
+		if err == nil {
+			variables = cm.Data
+		}
+	}
+
+	expanded := plugin.DeepCopy()
+	var err error
+	for i, p := range expanded.Spec.Platforms {
+		if expanded.Spec.Platforms[i].Image, err = expandImage(p.Image, variables); err != nil {
+			break
+		}
+		for j, f := range p.Files {
+			if len(f.Image) == 0 {
+				continue
+			}
+			if expanded.Spec.Platforms[i].Files[j].Image, err = expandImage(f.Image, variables); err != nil {
+				break
+			}
+		}
 		if err != nil {
-			newCondition := metav1.Condition{
-				Status:  metav1.ConditionFalse,
-				Reason:  "BinaryNotFound",
-				Message: fmt.Sprintf("failed to open the extracted binary %s", err),
+			break
+		}
+	}
+	if err != nil {
+		return plugin, &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidImageVariable",
+			Message: fmt.Sprintf("%v, the variables of the images are the keys of the ConfigMap %s in namespace %s", err, options.ImageVariablesConfigMap, options.SecretNamespace),
+		}, nil
+	}
+	return expanded, nil, nil
+}
+
+// expandImage replaces the ${VARIABLE} of ref with their value in variables,
+// $$ being a literal $. Unknown variables and any other $ are rejected, the
+// values are not expanded again.
+func expandImage(ref string, variables map[string]string) (string, error) {
+	var expanded strings.Builder
+	for i := 0; i < len(ref); i++ {
+		if ref[i] != '$' {
+			expanded.WriteByte(ref[i])
+			continue
+		}
+		if strings.HasPrefix(ref[i:], "$$") {
+			expanded.WriteByte('$')
+			i++
+			continue
+		}
+		match := imageVariableRegex.FindStringSubmatch(ref[i:])
+		if match == nil {
+			return "", fmt.Errorf("invalid $ in image %s, variables should be in ${VARIABLE} format and $$ is a literal $", ref)
+		}
+		value, ok := variables[match[1]]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %s in image %s", match[1], ref)
+		}
+		expanded.WriteString(value)
+		i += len(match[0]) - 1
+	}
+	return expanded.String(), nil
+}
+
+// imagePullAuth returns the auth of the image of the platform found in its
+// imagePullSecret, or the condition describing why it can not be used.
+func imagePullAuth(ctx context.Context, client kubernetes.Interface, p v1alpha1.PluginPlatform, options Options) (string, *metav1.Condition) {
+	if len(p.ImagePullSecret) == 0 {
+		return "", nil
+	}
+	namespace, secret := parseImagePullSecret(p.ImagePullSecret, options.SecretNamespace)
+	// if an imagePullSecret is defined for the binary, retrieve the Secret for it
+	imagePullSecret, err := client.CoreV1().Secrets(namespace).Get(ctx, secret, metav1.GetOptions{})
+	if err != nil {
+		newCondition := &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidField",
+			Message: fmt.Sprintf("error occurred %s while getting the secret %s in namespace %s", err, secret, namespace),
+		}
+		if errors.IsNotFound(err) {
+			newCondition.Message = fmt.Sprintf("secret %s is not found in namespace %s. If secret is in another namespace, please prepend namespace as anotherns/secret_name format", secret, namespace)
+		}
+		return "", newCondition
+	}
+
+	// ensure the Secret is of the expected type
+	if imagePullSecret.Type != corev1.SecretTypeDockercfg && imagePullSecret.Type != corev1.SecretTypeDockerConfigJson {
+		return "", &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidSecretType",
+			Message: fmt.Sprintf("image pull secret type %s is not supported, only kubernetes.io/dockercfg and kubernetes.io/dockerconfigjson are supported", imagePullSecret.Type),
+		}
+	}
+
+	if imagePullSecret.Type == corev1.SecretTypeDockercfg {
+		// set the .dockercfg auth information for the image puller
+		return string(imagePullSecret.Data[corev1.DockerConfigKey]), nil
+	}
+	var dcr *DockerConfigJson
+	err = json.Unmarshal(imagePullSecret.Data[corev1.DockerConfigJsonKey], &dcr)
+	if err != nil || dcr == nil {
+		return "", &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidField",
+			Message: fmt.Sprintf("unable to parse dockerjson %s to json", imagePullSecret.Name),
+		}
+	}
+	var imageAuth string
+	for key, val := range dcr.Auths {
+		if strings.Contains(p.Image, key+"/") {
+			imageAuth = val.Auth
+		}
+	}
+	return imageAuth, nil
+}
+
+// ExpectInitialSync marks the index as ready once the Plugins existing in the
+// synced cache of the controller are reconciled once, or right away if there
+// are none.
+func (c *Controller) ExpectInitialSync() error {
+	objs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("listing plugins: %w", err)
+	}
+	pending := sets.New[string]()
+	for _, obj := range objs {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			continue
+		}
+		pending.Insert(accessor.GetName())
+	}
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if pending.Len() == 0 {
+		c.repo.SetReady()
+		return nil
+	}
+	c.pending = pending
+	return nil
+}
+
+func (c *Controller) initialSynced(name string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.pending == nil {
+		return
+	}
+	c.pending.Delete(name)
+	if c.pending.Len() == 0 {
+		klog.InfoS("Plugins existing at start are reconciled, the index is ready")
+		c.pending = nil
+		c.repo.SetReady()
+	}
+}
+
+// RunResync re-lists the Plugins from the API server every interval until ctx
+// is done and reconciles them, so that the changes of Plugins whose events were
+// missed by the informer are eventually published. The Plugins which are
+// already published are not extracted again.
+func (c *Controller) RunResync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.resync(ctx); err != nil && ctx.Err() == nil {
+				klog.ErrorS(err, "Plugin resync failed")
 			}
-			err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-			if err != nil {
-				return nil, false, err
+		}
+	}
+}
+
+// resync enqueues every Plugin for reconciliation and removes the plugins of
+// the index whose Plugin no longer exists.
+func (c *Controller) resync(ctx context.Context) error {
+	list, err := c.dynamicClient.Resource(c.options.resource()).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing plugins: %w", err)
+	}
+	objs := make([]runtime.Object, 0, len(list.Items))
+	for i := range list.Items {
+		objs = append(objs, &list.Items[i])
+	}
+	if err := c.deleteOrphans(ctx, objs); err != nil {
+		return err
+	}
+	for _, obj := range list.Items {
+		c.queue.Add(obj.GetName())
+	}
+	klog.V(2).InfoS("Plugins are resynced", "count", len(list.Items))
+	return nil
+}
+
+// SetReadOnly freezes or unfreezes the index. While it is read-only, the
+// Plugins are neither published nor removed, and the index keeps serving
+// the last published plugins. Unfreezing it reconciles every Plugin, so
+// that the changes made meanwhile are published.
+func (c *Controller) SetReadOnly(ctx context.Context, readOnly bool) error {
+	if c.readOnly.Swap(readOnly) == readOnly {
+		return nil
+	}
+	if readOnly {
+		klog.InfoS("Index is read-only")
+		return nil
+	}
+	klog.InfoS("Index is writable, plugins are reconciled")
+	return c.resync(ctx)
+}
+
+// RunSweeper sweeps the index on start and then every interval until ctx is done.
+func (c *Controller) RunSweeper(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := c.sweep(ctx); err != nil {
+			klog.ErrorS(err, "Index sweep failed")
+		}
+	}, interval)
+}
+
+// sweep removes the plugins of the index which have no Plugin to be published from
+// anymore, i.e. deleted while the controller was not running. It complements the
+// reconciliation of the Plugins, which only sees the Plugins which still exist.
+func (c *Controller) sweep(ctx context.Context) error {
+	objs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("listing plugins: %w", err)
+	}
+	return c.deleteOrphans(ctx, objs)
+}
+
+// deleteOrphans removes the plugins of the index which are not published from any of objs.
+func (c *Controller) deleteOrphans(ctx context.Context, objs []runtime.Object) error {
+	if c.readOnly.Load() {
+		klog.V(2).InfoS("Index is read-only, orphan plugins are not removed")
+		return nil
+	}
+	published, err := c.repo.List()
+	if err != nil {
+		return fmt.Errorf("listing the plugins of the index: %w", err)
+	}
+
+	existing := sets.New[string]()
+	for _, obj := range objs {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			continue
+		}
+		if c.options.LabelSelector != nil && !c.options.LabelSelector.Matches(labels.Set(accessor.GetLabels())) {
+			continue
+		}
+		name := accessor.GetName()
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			if krewName, _, _ := unstructured.NestedString(u.Object, "spec", "krewName"); len(krewName) > 0 {
+				name = krewName
 			}
-			return nil, false, nil
 		}
-		hash := sha256.New()
-		if _, err := io.Copy(hash, dest); err != nil {
-			dest.Close()
-			newCondition := metav1.Condition{
-				Status:  metav1.ConditionFalse,
-				Reason:  "Sha256ChecksumError",
-				Message: fmt.Sprintf("could not calculate sha256 checksum"),
+		existing.Insert(name)
+	}
+
+	for _, name := range published {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if existing.Has(name) {
+			continue
+		}
+		if err := DeletePlugin(name, c.repo); err != nil {
+			return fmt.Errorf("deleting orphaned plugin %s: %w", name, err)
+		}
+		klog.InfoS("Orphaned plugin is deleted from the index", "plugin", name)
+	}
+	return nil
+}
+
+// setFinalizer adds the finalizer to the plugin if present is true,
+// removes it otherwise. It is a no-op if the plugin is already as expected.
+func (c *Controller) setFinalizer(ctx context.Context, plugin *v1alpha1.Plugin, present bool) error {
+	resource := c.dynamicClient.Resource(resourceOf(plugin))
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := resource.Get(ctx, plugin.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		finalizers := obj.GetFinalizers()
+		if slices.Contains(finalizers, pluginFinalizer) != present {
+			if present {
+				finalizers = append(finalizers, pluginFinalizer)
+			} else {
+				finalizers = slices.DeleteFunc(finalizers, func(f string) bool {
+					return f == pluginFinalizer
+				})
 			}
-			err := updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
+			obj.SetFinalizers(finalizers)
+			obj, err = resource.Update(ctx, obj, metav1.UpdateOptions{})
 			if err != nil {
-				return nil, false, err
+				return err
 			}
-			return nil, false, nil
 		}
+		plugin.Finalizers = obj.GetFinalizers()
+		plugin.ResourceVersion = obj.GetResourceVersion()
+		return nil
+	})
+}
 
-		checksum := hex.EncodeToString(hash.Sum(nil))
+// ValidatePlugin validates the fields of the plugin which can be checked
+// without pulling its images. It returns the condition describing the
+// first invalid field, or nil if the plugin is valid.
+func ValidatePlugin(plugin *v1alpha1.Plugin) *metav1.Condition {
+	return invalidFieldCondition(validatePlugin(plugin, specPlatformPath))
+}
 
-		r, err := route.Routes("openshift-cli-manager-operator").Get(ctx, "openshift-cli-manager", metav1.GetOptions{})
-		if err != nil {
-			return nil, false, fmt.Errorf("could not get the route openshift-cli-manager in openshift-cli-manager-operator namespace err: %w", err)
+// specPlatformPath returns the path of the i-th platform of the spec.
+func specPlatformPath(i int) *field.Path {
+	return field.NewPath("spec", "platforms").Index(i)
+}
+
+// invalidFieldCondition returns the InvalidField condition describing the
+// first error of errs, or nil if there is none.
+func invalidFieldCondition(errs field.ErrorList) *metav1.Condition {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &metav1.Condition{
+		Status:  metav1.ConditionFalse,
+		Reason:  "InvalidField",
+		Message: errs[0].Detail,
+	}
+}
+
+// validationErrors returns the ValidationErrors of the status of errs.
+func validationErrors(errs field.ErrorList) []v1alpha1.PluginValidationError {
+	var validationErrors []v1alpha1.PluginValidationError
+	for _, err := range errs {
+		validationError := v1alpha1.PluginValidationError{
+			Field:  err.Field,
+			Reason: string(err.Type),
+		}
+		if err.BadValue != nil {
+			validationError.Value = fmt.Sprint(err.BadValue)
+		}
+		validationErrors = append(validationErrors, validationError)
+	}
+	return validationErrors
+}
+
+// validatePlugin validates the plugin like ValidatePlugin, and returns the
+// errors of every invalid field, whose Detail is the message of the condition.
+// The paths of the platforms are returned by platformPath.
+func validatePlugin(plugin *v1alpha1.Plugin, platformPath func(i int) *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	safePluginRegexp := regexp.MustCompile(`^[\w-]+$`)
+	if !safePluginRegexp.MatchString(plugin.Name) {
+		errs = append(errs, field.Invalid(field.NewPath("metadata", "name"), plugin.Name, fmt.Sprintf("invalid plugin name %s", plugin.Name)))
+	}
+	specPath := field.NewPath("spec")
+	if len(plugin.Spec.KrewName) > 0 && !safePluginRegexp.MatchString(plugin.Spec.KrewName) {
+		errs = append(errs, field.Invalid(specPath.Child("krewName"), plugin.Spec.KrewName, fmt.Sprintf("invalid krewName %s", plugin.Spec.KrewName)))
+	}
+
+	if !strings.HasPrefix(plugin.Spec.Version, "v") {
+		errs = append(errs, field.Invalid(specPath.Child("version"), plugin.Spec.Version, fmt.Sprintf("invalid version %s, should start with v like v0.0.0", plugin.Spec.Version)))
+	} else if _, err := k8sver.ParseSemantic(plugin.Spec.Version); err != nil {
+		errs = append(errs, field.Invalid(specPath.Child("version"), plugin.Spec.Version, fmt.Sprintf("invalid version %s, should be in v0.0.0 format", plugin.Spec.Version)))
+	}
+
+	for i, p := range plugin.Spec.Platforms {
+		fldPath := platformPath(i)
+		// an empty or incomplete platform is rejected rather than skipped,
+		// so that the plugin never silently has fewer platforms than declared.
+		if len(p.Platform) == 0 {
+			errs = append(errs, field.Required(fldPath.Child("platform"), fmt.Sprintf("missing platform in platforms[%d] of image %s, it should be in linux/amd64 or linux/arm/v7 format", i, p.Image)))
+			continue
+		}
+		// platforms are given in their canonical os/arch[/variant] form
+		if parsed, err := platform.Parse(p.Platform); err != nil || parsed.String() != p.Platform {
+			errs = append(errs, field.Invalid(fldPath.Child("platform"), p.Platform, fmt.Sprintf("invalid platform %s in platforms[%d], please ensure that OS (linux/darwin/windows) and arch (arm64/amd64/ppc64le/s390x/arm) are supported and in linux/amd64 or linux/arm/v7 format", p.Platform, i)))
+			continue
 		}
 
-		artifactURI := fmt.Sprintf("https://%s/cli-manager/plugins/download/?name=%s&platform=%s", r.Spec.Host, plugin.Name, strings.ReplaceAll(p.Platform, "/", "_"))
-		if insecureHTTP {
-			artifactURI = fmt.Sprintf("http://%s/cli-manager/plugins/download/?name=%s&platform=%s", r.Spec.Host, plugin.Name, strings.ReplaceAll(p.Platform, "/", "_"))
+		if len(p.LayerDigest) > 0 {
+			if _, err := v1.NewHash(p.LayerDigest); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("layerDigest"), p.LayerDigest, fmt.Sprintf("invalid layer digest %s error: %s", p.LayerDigest, err)))
+			}
 		}
 
-		kp := krew.Platform{
-			URI:    artifactURI,
-			Sha256: checksum,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"os":   fields[0],
-					"arch": fields[1],
-				},
-			},
-			Files: []krew.FileOperation{},
-			Bin:   p.Bin,
+		if len(p.MatchExpressions) > 0 {
+			if _, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{MatchExpressions: p.MatchExpressions}); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("matchExpressions"), p.MatchExpressions, fmt.Sprintf("invalid matchExpressions of platform %s error: %s", p.Platform, err)))
+			}
 		}
 
-		for _, f := range files {
-			kp.Files = append(kp.Files, krew.FileOperation{
-				From: f.From,
-				To:   f.To,
-			})
+		if len(p.Sha256) > 0 && !sha256Regex.MatchString(p.Sha256) {
+			errs = append(errs, field.Invalid(fldPath.Child("sha256"), p.Sha256, fmt.Sprintf("invalid sha256 %s, it must be 64 hex characters", p.Sha256)))
 		}
-		if len(kp.Bin) == 0 {
-			kp.Bin = plugin.Name
+
+		if fileErrs := validateFiles(p, fldPath); len(fileErrs) > 0 {
+			errs = append(errs, fileErrs...)
+		} else if err := validateBin(plugin, p, fldPath); err != nil {
+			// the bin is only looked up in valid files
+			errs = append(errs, err)
+		}
+
+		if p.ProxyURL != "" {
+			proxyURL, err := url.Parse(p.ProxyURL)
+			if err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("proxyURL"), p.ProxyURL, fmt.Sprintf("invalid proxy URL %s error: %s", p.ProxyURL, err)))
+			} else if proxyURL.Scheme == "http" {
+				errs = append(errs, field.Invalid(fldPath.Child("proxyURL"), p.ProxyURL, fmt.Sprintf("http is not supported for proxy url %s", p.ProxyURL)))
+			}
 		}
-		k.Spec.Platforms = append(k.Spec.Platforms, kp)
 	}
+	return errs
+}
 
-	klog.Infof("plugin %s is ready to be served", plugin.Name)
-	newCondition := metav1.Condition{
-		Status:  metav1.ConditionTrue,
-		Reason:  "Installed",
-		Message: fmt.Sprintf("plugin %s is ready to be served", plugin.Name),
+// parseImagePullSecret returns the namespace and the name of the image pull
+// secret given in namespace/name or name format. As Plugins are cluster-scoped,
+// secrets without namespace are looked up in defaultNamespace.
+func parseImagePullSecret(imagePullSecret, defaultNamespace string) (string, string) {
+	if namespace, name, ok := strings.Cut(imagePullSecret, "/"); ok {
+		return namespace, name
 	}
-	err = updateStatusCondition(ctx, plugin, dynamicClient, newCondition)
-	if err != nil {
-		return nil, false, err
+	return defaultNamespace, imagePullSecret
+}
+
+// DefaultBin returns the Bin of the platform, which is the plugin name
+// if not set. Windows executables are suffixed with .exe.
+func DefaultBin(plugin *v1alpha1.Plugin, p v1alpha1.PluginPlatform) string {
+	if len(p.Bin) > 0 {
+		return p.Bin
+	}
+	if parsed, err := platform.Parse(p.Platform); err == nil && parsed.IsWindows() {
+		return plugin.Name + ".exe"
 	}
-	return k, true, nil
+	return plugin.Name
 }
 
-func updateStatusCondition(ctx context.Context, plugin *v1alpha1.Plugin, dynamic *dynamic.DynamicClient, condition metav1.Condition) error {
-	condition.Type = "PluginInstalled"
-	condition.LastTransitionTime = metav1.NewTime(time.Now())
-	for _, conds := range plugin.Status.Conditions {
-		if conds.Reason == condition.Reason && conds.Status == condition.Status && conds.Message == condition.Message {
-			// No need to update again
+// validateFiles ensures that the files of the platform are copied from
+// absolute paths of the image, which can not traverse its root with "..",
+// to relative paths which can not escape the installation directory.
+func validateFiles(p v1alpha1.PluginPlatform, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, f := range p.Files {
+		if err := validateFile(p, f, fldPath.Child("files").Index(i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// validateFile returns the error of the first invalid field of the file f of
+// the platform, or nil if it is valid.
+func validateFile(p v1alpha1.PluginPlatform, f v1alpha1.FileLocation, fldPath *field.Path) *field.Error {
+	if path.IsAbs(f.To) || strings.HasPrefix(f.To, `\`) || (len(f.To) > 1 && f.To[1] == ':') {
+		return field.Invalid(fldPath.Child("to"), f.To, fmt.Sprintf("invalid file destination %s of platform %s, to should be relative to the installation directory", f.To, p.Platform))
+	}
+	if slices.Contains(strings.FieldsFunc(f.To, isPathSeparator), "..") {
+		return field.Invalid(fldPath.Child("to"), f.To, fmt.Sprintf("invalid file destination %s of platform %s, to should not contain .. elements", f.To, p.Platform))
+	}
+	if (len(f.From) == 0) == (len(f.FromDir) == 0) {
+		return field.Required(fldPath.Child("from"), fmt.Sprintf("invalid file of platform %s, either from or fromDir should be set", p.Platform))
+	}
+	from := image.SourcePath(f)
+	fromPath := fldPath.Child("from")
+	if len(f.FromDir) > 0 {
+		fromPath = fldPath.Child("fromDir")
+	}
+	if f.FindByName {
+		if len(f.From) == 0 {
+			return field.Required(fldPath.Child("from"), fmt.Sprintf("invalid file of platform %s, from should be set to the name searched with findByName", p.Platform))
+		}
+		if strings.ContainsFunc(f.From, isPathSeparator) || f.From == "." || f.From == ".." {
+			return field.Invalid(fromPath, f.From, fmt.Sprintf("invalid file %s of platform %s, from should be a base name like oc with findByName", f.From, p.Platform))
+		}
+		if len(p.ArtifactType) > 0 {
+			return field.Invalid(fldPath.Child("findByName"), f.FindByName, fmt.Sprintf("invalid file %s of platform %s, the files of artifacts are already matched by name", f.From, p.Platform))
+		}
+	} else if !path.IsAbs(from) {
+		return field.Invalid(fromPath, from, fmt.Sprintf("invalid file %s of platform %s, from should be an absolute path in the image like /usr/bin/oc", from, p.Platform))
+	}
+	if slices.Contains(strings.Split(from, "/"), "..") {
+		return field.Invalid(fromPath, from, fmt.Sprintf("invalid file %s of platform %s, from should not contain .. elements", from, p.Platform))
+	}
+	if len(f.FromDir) > 0 && path.Clean(f.FromDir) == "/" {
+		return field.Invalid(fromPath, f.FromDir, fmt.Sprintf("invalid directory %s of platform %s, the root of the image can not be extracted", f.FromDir, p.Platform))
+	}
+	if len(f.FromDir) > 0 && len(p.ArtifactType) > 0 {
+		return field.Invalid(fromPath, f.FromDir, fmt.Sprintf("invalid directory %s of platform %s, directories can not be extracted from artifacts", f.FromDir, p.Platform))
+	}
+	if len(f.Mode) > 0 {
+		if _, err := image.ParseMode(f.Mode); err != nil {
+			return field.Invalid(fldPath.Child("mode"), f.Mode, fmt.Sprintf("invalid file %s of platform %s: %v", from, p.Platform, err))
+		}
+	}
+	return nil
+}
+
+// isPathSeparator reports whether r separates the elements of a path on any
+// platform, as the same destination is installed by Krew on Windows.
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// validateBin ensures that the Bin of the platform, defaulting to the plugin
+// name, is one of the files installed by Krew so that it can be linked.
+func validateBin(plugin *v1alpha1.Plugin, p v1alpha1.PluginPlatform, fldPath *field.Path) *field.Error {
+	bin := DefaultBin(plugin, p)
+
+	var installed []string
+	for _, f := range p.Files {
+		if image.InstallPath(f) == filepath.Clean(bin) {
+			return nil
+		}
+		// the tree of a directory is only known once it is extracted
+		if len(f.FromDir) > 0 && strings.HasPrefix(filepath.Clean(bin), image.InstallPath(f)+string(filepath.Separator)) {
 			return nil
 		}
+		installed = append(installed, image.InstallPath(f))
+	}
+	return field.Invalid(fldPath.Child("bin"), bin, fmt.Sprintf("bin %s of platform %s is not installed by any file, should be one of [%s]", bin, p.Platform, strings.Join(installed, ", ")))
+}
+
+// platformPullOptions completes pullOptions with the proxy, the CA bundle and
+// the image platform of the platform, or returns the condition describing
+// why they are invalid.
+func platformPullOptions(p v1alpha1.PluginPlatform, pullOptions image.PullOptions) (image.PullOptions, *metav1.Condition) {
+	if p.ProxyURL != "" {
+		var err error
+		pullOptions.Proxy, err = url.Parse(p.ProxyURL)
+		if err != nil {
+			return pullOptions, &metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "InvalidField",
+				Message: fmt.Sprintf("invalid proxy URL %s error: %s", p.ProxyURL, err),
+			}
+		}
+	}
+
+	parsed, err := platform.Parse(p.Platform)
+	if err != nil {
+		return pullOptions, &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidField",
+			Message: err.Error(),
+		}
+	}
+	if parsed.OS == "windows" || parsed.OS == "darwin" {
+		// if the binary is either windows or darwin,
+		// try to get it from linux/amd64 image
+		parsed = platform.Platform{OS: "linux", Arch: "amd64"}
+	}
+	pullOptions.Platform = &v1.Platform{
+		Architecture: parsed.Arch,
+		OS:           parsed.OS,
+		Variant:      parsed.Variant,
+	}
+	pullOptions.CABundle = p.CABundle
+	return pullOptions, nil
+}
+
+// resolveDigests resolves the digests of the images of the platform
+// without pulling them, keyed by the image reference.
+func resolveDigests(ctx context.Context, p v1alpha1.PluginPlatform, pullOptions image.PullOptions) (map[string]string, error) {
+	pullOptions, newCondition := platformPullOptions(p, pullOptions)
+	if newCondition != nil {
+		return nil, fmt.Errorf("%s", newCondition.Message)
+	}
+	digests := map[string]string{}
+	for _, ref := range image.FileImages(p) {
+		digest, err := image.Digest(ctx, ref, pullOptions)
+		if err != nil {
+			return nil, fmt.Errorf("resolving the digest of image %s: %w", ref, err)
+		}
+		digests[ref] = digest
+	}
+	return digests, nil
+}
+
+// ExtractPlatform pulls the image of the platform by using pullOptions and
+// extracts its files into the destinationFileName archive written with
+// extractOptions. It returns the extracted
+// files and the sha256 checksum of the archive, or the condition describing
+// why the platform could not be extracted. Pulling and extracting are cancelled
+// once ctx is done.
+func ExtractPlatform(ctx context.Context, p v1alpha1.PluginPlatform, pullOptions image.PullOptions, extractOptions image.ExtractOptions, destinationFileName string) ([]v1alpha1.FileLocation, string, *metav1.Condition) {
+	pullOptions, newCondition := platformPullOptions(p, pullOptions)
+	if newCondition != nil {
+		return nil, "", newCondition
+	}
+
+	// attempt to pull the images of the files down locally
+	images := map[string]v1.Image{}
+	for _, ref := range image.FileImages(p) {
+		img, err := image.Pull(ctx, ref, pullOptions)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, "", timeoutCondition(ref)
+			}
+			return nil, "", &metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "ImagePullError",
+				Message: fmt.Sprintf("failed to pull the image %s error %s", ref, err),
+			}
+		}
+		images[ref] = img
+	}
+
+	files, err := image.ExtractImages(ctx, images, p, destinationFileName, extractOptions)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, "", timeoutCondition(p.Image)
+		}
+		if stderrors.Is(err, image.ErrChecksumMismatch) {
+			return nil, "", &metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "ChecksumMismatch",
+				Message: fmt.Sprintf("refusing to publish the binary of image %s: %s", p.Image, err),
+			}
+		}
+		if stderrors.Is(err, image.ErrTooLarge) {
+			return nil, "", &metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "BinaryTooLarge",
+				Message: fmt.Sprintf("refusing to extract the files of image %s: %s", p.Image, err),
+			}
+		}
+		return nil, "", &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "ExtractFromImageError",
+			Message: fmt.Sprintf("failed to extract the binary from image error %s", err),
+		}
 	}
-	plugin.Status.Conditions = []metav1.Condition{condition}
-	unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(plugin)
-	unObj := &unstructured.Unstructured{
-		Object: unstructuredMap,
+
+	if len(files) == 0 {
+		return nil, "", &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "BinaryNotFound",
+			Message: fmt.Sprintf("failed to find the binary from image, path should not be directory, symlink"),
+		}
 	}
+
+	dest, err := os.Open(destinationFileName)
 	if err != nil {
-		return fmt.Errorf("unexpected object decoding error %w", err)
+		return nil, "", &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "BinaryNotFound",
+			Message: fmt.Sprintf("failed to open the extracted binary %s", err),
+		}
+	}
+	defer dest.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, dest); err != nil {
+		return nil, "", &metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  "Sha256ChecksumError",
+			Message: fmt.Sprintf("could not calculate sha256 checksum"),
+		}
+	}
+
+	return files, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func timeoutCondition(image string) *metav1.Condition {
+	return &metav1.Condition{
+		Status:  metav1.ConditionFalse,
+		Reason:  "Timeout",
+		Message: fmt.Sprintf("pulling and extracting the image %s did not complete in time", image),
+	}
+}
+
+// readyConditionType is the condition aggregating the other conditions of the
+// Plugin, it is only True once every platform is extracted and the manifest
+// of the Plugin is committed in the index.
+const readyConditionType = "Ready"
+
+// notReadyCondition returns the Ready condition pointing at the condition
+// if it reports a failure, or nil if it does not change the readiness.
+func notReadyCondition(condition metav1.Condition) *metav1.Condition {
+	if condition.Type != "PluginInstalled" {
+		return nil
+	}
+	if condition.Status == metav1.ConditionTrue && condition.Reason != "PartiallyInstalled" {
+		return nil
+	}
+	return &metav1.Condition{
+		Type:    readyConditionType,
+		Status:  metav1.ConditionFalse,
+		Reason:  condition.Reason,
+		Message: fmt.Sprintf("condition %s is %s with reason %s: %s", condition.Type, condition.Status, condition.Reason, condition.Message),
 	}
-	_, err = dynamic.Resource(schema.GroupVersionResource{
-		Group:    "config.openshift.io",
-		Version:  "v1alpha1",
-		Resource: "plugins"}).UpdateStatus(ctx, unObj, metav1.UpdateOptions{})
+}
+
+func updateStatusCondition(ctx context.Context, plugin *v1alpha1.Plugin, dynamic dynamic.Interface, condition metav1.Condition) error {
+	return updateStatus(ctx, plugin, dynamic, condition, nil)
+}
+
+// updateStatus sets the condition like updateStatusCondition along with the
+// changes of mutate, which reports whether it changed the status, in a single update.
+func updateStatus(ctx context.Context, plugin *v1alpha1.Plugin, dynamic dynamic.Interface, condition metav1.Condition, mutate func(status *v1alpha1.PluginStatus) bool) error {
+	// the condition is still reported when the reconcile deadline is exceeded
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	if len(condition.Type) == 0 {
+		condition.Type = "PluginInstalled"
+	}
+	resource := dynamic.Resource(resourceOf(plugin))
+
+	current := plugin
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if current == nil {
+			// the cached plugin is stale, apply the condition on the latest one
+			obj, err := resource.Get(ctx, plugin.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			current = &v1alpha1.Plugin{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, current); err != nil {
+				return fmt.Errorf("unexpected object decoding error %w", err)
+			}
+		}
+		updated := current.DeepCopy()
+		condition.ObservedGeneration = updated.Generation
+		// conditions of other types are retained, and the transition
+		// time is only updated when the status of the condition changes.
+		changed := meta.SetStatusCondition(&updated.Status.Conditions, condition)
+		if ready := notReadyCondition(condition); ready != nil {
+			ready.ObservedGeneration = updated.Generation
+			if meta.SetStatusCondition(&updated.Status.Conditions, *ready) {
+				changed = true
+			}
+		}
+		// the validation errors only describe the PluginInstalled condition
+		// they are reported with, mutate sets them again if they still apply.
+		validationErrors := updated.Status.ValidationErrors
+		if condition.Type == "PluginInstalled" {
+			updated.Status.ValidationErrors = nil
+		}
+		if mutate != nil && mutate(&updated.Status) {
+			changed = true
+		}
+		if !reflect.DeepEqual(validationErrors, updated.Status.ValidationErrors) {
+			changed = true
+		}
+		if !changed {
+			// No need to update again
+			return nil
+		}
+		unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(updated)
+		if err != nil {
+			return fmt.Errorf("unexpected object decoding error %w", err)
+		}
+		_, err = resource.UpdateStatus(ctx, &unstructured.Unstructured{Object: unstructuredMap}, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			klog.V(4).InfoS("Plugin status update conflict is retried", "plugin", plugin.Name, "reason", condition.Reason)
+			current = nil
+		}
+		if err == nil {
+			current = updated
+		}
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("plugin condition update error %w", err)
 	}
+	klog.V(2).InfoS("Plugin condition is reported", "plugin", plugin.Name, "status", condition.Status, "reason", condition.Reason)
+	plugin.Status = current.Status
 	return nil
 }
@@ -0,0 +1,3306 @@
+package controller
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	routev1 "github.com/openshift/api/route/v1"
+	routeclient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubeinformers "k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/git"
+	"github.com/openshift/cli-manager/pkg/image"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+)
+
+var pluginsGVR = v1alpha1.GroupVersion.WithResource("plugins")
+
+type fakeRouteV1 struct {
+	routeclient.RouteV1Interface
+	host string
+	gets int
+	// err fails the gets of the route, if it is set
+	err error
+
+	mu sync.Mutex
+	// watcher is the watch of the route informer, once it is started
+	watcher *watch.FakeWatcher
+}
+
+// setHost changes the host of the route and notifies the route informer.
+func (f *fakeRouteV1) setHost(host string) {
+	f.mu.Lock()
+	f.host = host
+	watcher := f.watcher
+	f.mu.Unlock()
+	if watcher != nil {
+		watcher.Modify(f.route(routeName))
+	}
+}
+
+func (f *fakeRouteV1) route(name string) *routev1.Route {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &routev1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       routeNamespace,
+			ResourceVersion: "1",
+		},
+		Spec: routev1.RouteSpec{
+			Host: f.host,
+		},
+	}
+}
+
+func (f *fakeRouteV1) Routes(namespace string) routeclient.RouteInterface {
+	return &fakeRoutes{parent: f}
+}
+
+type fakeRoutes struct {
+	routeclient.RouteInterface
+	parent *fakeRouteV1
+}
+
+func (f *fakeRoutes) Get(ctx context.Context, name string, opts metav1.GetOptions) (*routev1.Route, error) {
+	f.parent.gets++
+	if f.parent.err != nil {
+		return nil, f.parent.err
+	}
+	return f.parent.route(name), nil
+}
+
+func (f *fakeRoutes) List(ctx context.Context, opts metav1.ListOptions) (*routev1.RouteList, error) {
+	return &routev1.RouteList{
+		ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+		Items:    []routev1.Route{*f.parent.route(routeName)},
+	}, nil
+}
+
+func (f *fakeRoutes) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	f.parent.mu.Lock()
+	defer f.parent.mu.Unlock()
+	f.parent.watcher = watch.NewFakeWithChanSize(10, false)
+	return f.parent.watcher, nil
+}
+
+func newTestDynamicClient(t *testing.T, plugins ...*v1alpha1.Plugin) *dynamicfake.FakeDynamicClient {
+	t.Helper()
+	objs := []runtime.Object{}
+	for _, p := range plugins {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+		if err != nil {
+			t.Fatalf("unexpected conversion error %v", err)
+		}
+		objs = append(objs, &unstructured.Unstructured{Object: u})
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		pluginsGVR: "PluginList",
+	}, objs...)
+}
+
+func getTestPlugin(t *testing.T, client *dynamicfake.FakeDynamicClient, name string) *v1alpha1.Plugin {
+	t.Helper()
+	obj, err := client.Resource(pluginsGVR).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected get error %v", err)
+	}
+	plugin := &v1alpha1.Plugin{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, plugin); err != nil {
+		t.Fatalf("unexpected conversion error %v", err)
+	}
+	return plugin
+}
+
+func newTestPlugin(name string, platforms ...string) *v1alpha1.Plugin {
+	p := &v1alpha1.Plugin{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "Plugin",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1alpha1.PluginSpec{
+			ShortDescription: "Binary for " + name,
+			Version:          "v4.15.0",
+		},
+	}
+	for _, platform := range platforms {
+		bin := name
+		if strings.HasPrefix(platform, "windows/") {
+			bin += ".exe"
+		}
+		p.Spec.Platforms = append(p.Spec.Platforms, v1alpha1.PluginPlatform{
+			Platform: platform,
+			Image:    "quay.io/openshift/origin-cli",
+			Files: []v1alpha1.FileLocation{
+				{From: "/usr/bin/" + bin, To: "."},
+			},
+		})
+	}
+	return p
+}
+
+func TestValidatePlugin(t *testing.T) {
+	tests := []struct {
+		name            string
+		plugin          *v1alpha1.Plugin
+		expectedReason  string
+		expectedMessage string
+	}{
+		{
+			name:   "valid plugin",
+			plugin: newTestPlugin("oc", "linux/amd64", "darwin/arm64", "windows/amd64"),
+		},
+		{
+			name:   "arm variants",
+			plugin: newTestPlugin("oc", "linux/arm/v7", "linux/arm64", "linux/arm64/v8"),
+		},
+		{
+			name:           "invalid name",
+			plugin:         newTestPlugin("oc.exe", "linux/amd64"),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "invalid krewName",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.KrewName = "team.oc"
+				return p
+			}(),
+			expectedReason:  "InvalidField",
+			expectedMessage: "invalid krewName team.oc",
+		},
+		{
+			name: "invalid file mode",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0].Mode = "rwxr-xr-x"
+				return p
+			}(),
+			expectedReason:  "InvalidField",
+			expectedMessage: `invalid file /usr/bin/oc of platform linux/amd64: invalid mode "rwxr-xr-x"`,
+		},
+		{
+			name: "bin in a directory",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "tool/bin/oc"
+				p.Spec.Platforms[0].Files = []v1alpha1.FileLocation{{FromDir: "/opt/tool", To: "."}}
+				return p
+			}(),
+		},
+		{
+			name: "file with from and fromDir",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0].FromDir = "/usr/bin"
+				return p
+			}(),
+			expectedReason:  "InvalidField",
+			expectedMessage: "invalid file of platform linux/amd64, either from or fromDir should be set",
+		},
+		{
+			name: "file found by name",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0] = v1alpha1.FileLocation{From: "oc", FindByName: true, To: "."}
+				return p
+			}(),
+		},
+		{
+			name: "path found by name",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0].FindByName = true
+				return p
+			}(),
+			expectedReason:  "InvalidField",
+			expectedMessage: "invalid file /usr/bin/oc of platform linux/amd64, from should be a base name like oc with findByName",
+		},
+		{
+			name: "root directory",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "oc"
+				p.Spec.Platforms[0].Files = []v1alpha1.FileLocation{{FromDir: "/", To: "oc/"}}
+				return p
+			}(),
+			expectedReason:  "InvalidField",
+			expectedMessage: "invalid directory / of platform linux/amd64, the root of the image can not be extracted",
+		},
+		{
+			name: "bin outside of the directory",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "toolbox/oc"
+				p.Spec.Platforms[0].Files = []v1alpha1.FileLocation{{FromDir: "/opt/tool", To: "."}}
+				return p
+			}(),
+			expectedReason:  "InvalidField",
+			expectedMessage: "bin toolbox/oc of platform linux/amd64 is not installed by any file",
+		},
+		{
+			name: "invalid version",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Version = "v4.15"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name:           "invalid platform",
+			plugin:         newTestPlugin("oc", "linux_amd64"),
+			expectedReason: "InvalidField",
+		},
+		{
+			name:            "empty platform",
+			plugin:          newTestPlugin("oc", "linux/amd64", ""),
+			expectedReason:  "InvalidField",
+			expectedMessage: "missing platform in platforms[1]",
+		},
+		{
+			name:            "platform without arch",
+			plugin:          newTestPlugin("oc", "linux/amd64", "darwin"),
+			expectedReason:  "InvalidField",
+			expectedMessage: "invalid platform darwin in platforms[1]",
+		},
+		{
+			name:           "invalid variant",
+			plugin:         newTestPlugin("oc", "linux/arm/v9"),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "bin renamed by file",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "bin/oc-4.15"
+				p.Spec.Platforms[0].Files[0].To = "bin/oc-4.15"
+				return p
+			}(),
+		},
+		{
+			name: "bin in installation subfolder",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "./bin/oc"
+				p.Spec.Platforms[0].Files[0].To = "bin/"
+				return p
+			}(),
+		},
+		{
+			name: "bin not installed",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "oc"
+				p.Spec.Platforms[0].Files[0].To = "oc-4.15"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "default bin not installed",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0].From = "/usr/bin/kubectl"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "windows bin without exe",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "windows/amd64")
+				p.Spec.Platforms[0].Files[0].From = "/usr/bin/oc"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "relative file path",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0].From = "./usr/bin/oc"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "file path traversal",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0].From = "/usr/bin/../../etc/oc"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "absolute file path",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Files[0].From = "/usr//bin/./oc"
+				return p
+			}(),
+		},
+		{
+			name: "absolute file destination",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "/usr/local/bin/oc"
+				p.Spec.Platforms[0].Files[0].To = "/usr/local/bin/oc"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "file destination traversal",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Bin = "../../oc"
+				p.Spec.Platforms[0].Files[0].To = "../../oc"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "windows file destination traversal",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "windows/amd64")
+				p.Spec.Platforms[0].Bin = `..\oc.exe`
+				p.Spec.Platforms[0].Files[0].To = `..\oc.exe`
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "invalid match expressions",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].MatchExpressions = []metav1.LabelSelectorRequirement{
+					{Key: "arch", Operator: "Unknown"},
+				}
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "invalid sha256",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].Sha256 = "not-a-checksum"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "invalid layer digest",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].LayerDigest = "sha256:1234"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+		{
+			name: "http proxy",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Platforms[0].ProxyURL = "http://proxy.example.com"
+				return p
+			}(),
+			expectedReason: "InvalidField",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cond := ValidatePlugin(tc.plugin)
+			if len(tc.expectedMessage) > 0 && (cond == nil || !strings.Contains(cond.Message, tc.expectedMessage)) {
+				t.Fatalf("expected condition message to contain %q, got %+v", tc.expectedMessage, cond)
+			}
+			if len(tc.expectedReason) == 0 {
+				if cond != nil {
+					t.Fatalf("unexpected condition %+v", cond)
+				}
+				return
+			}
+			if cond == nil || cond.Reason != tc.expectedReason {
+				t.Fatalf("expected condition reason %s, got %+v", tc.expectedReason, cond)
+			}
+		})
+	}
+}
+
+func TestExtractPlatformTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	// registry stub which never answers in time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer server.Close()
+
+	p := newTestPlugin("oc", "linux/amd64").Spec.Platforms[0]
+	p.Image = strings.TrimPrefix(server.URL, "http://") + "/openshift/origin-cli:latest"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, cond := ExtractPlatform(ctx, p, image.PullOptions{}, image.DefaultExtractOptions, filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz"))
+	if cond == nil || cond.Reason != "Timeout" {
+		t.Fatalf("expected Timeout condition, got %+v", cond)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("pull is not cancelled in time, took %s", elapsed)
+	}
+}
+
+func TestPullContext(t *testing.T) {
+	ctx, cancel := Options{}.pullContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("expected no deadline without image pull timeout")
+	}
+	ctx, cancel = Options{ImagePullTimeout: time.Minute}.pullContext(context.Background())
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Fatalf("expected a deadline within the image pull timeout, got %s", deadline)
+	}
+}
+
+func TestConvertKrewPluginRetry(t *testing.T) {
+	// registry which is not reachable anymore
+	server := httptest.NewServer(http.NotFoundHandler())
+	registry := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	unreachable := newTestPlugin("oc", "linux/amd64")
+	unreachable.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	invalid := newTestPlugin("oc.exe", "linux/amd64")
+
+	tests := []struct {
+		name           string
+		plugin         *v1alpha1.Plugin
+		expectedRetry  bool
+		expectedReason string
+	}{
+		{
+			name:           "transient image pull failure is retried",
+			plugin:         unreachable,
+			expectedRetry:  true,
+			expectedReason: "ImagePullError",
+		},
+		{
+			name:           "invalid name is terminal",
+			plugin:         invalid,
+			expectedRetry:  false,
+			expectedReason: "InvalidField",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dynamicClient := newTestDynamicClient(t, tc.plugin)
+			route := &fakeRouteV1{host: "cli-manager.example.com"}
+			_, success, err := convertKrewPlugin(context.Background(), tc.plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, route, Options{
+				ImagePullTimeout: time.Minute,
+			})
+			if success {
+				t.Fatalf("unexpected success")
+			}
+			if tc.expectedRetry != (err != nil) {
+				t.Fatalf("expected retry %t, got error %v", tc.expectedRetry, err)
+			}
+
+			plugin := getTestPlugin(t, dynamicClient, tc.plugin.Name)
+			if len(plugin.Status.Conditions) != 2 || plugin.Status.Conditions[0].Reason != tc.expectedReason {
+				t.Fatalf("expected condition reason %s, got %+v", tc.expectedReason, plugin.Status.Conditions)
+			}
+		})
+	}
+}
+
+func TestConvertKrewPluginValidationErrors(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	tests := []struct {
+		name     string
+		plugin   func() *v1alpha1.Plugin
+		expected []v1alpha1.PluginValidationError
+	}{
+		{
+			name: "bad version",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64")
+				p.Spec.Version = "4.15"
+				return p
+			},
+			expected: []v1alpha1.PluginValidationError{
+				{Field: "spec.version", Value: "4.15", Reason: "FieldValueInvalid"},
+			},
+		},
+		{
+			name: "bad platform",
+			plugin: func() *v1alpha1.Plugin {
+				return newTestPlugin("oc", "linux/amd64", "darwin")
+			},
+			expected: []v1alpha1.PluginValidationError{
+				{Field: "spec.platforms[1].platform", Value: "darwin", Reason: "FieldValueInvalid"},
+			},
+		},
+		{
+			name: "every invalid field is reported",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64", "")
+				p.Spec.Version = "v4.15"
+				p.Spec.Platforms[0].Files[0].To = "../bin"
+				return p
+			},
+			expected: []v1alpha1.PluginValidationError{
+				{Field: "spec.version", Value: "v4.15", Reason: "FieldValueInvalid"},
+				{Field: "spec.platforms[0].files[0].to", Value: "../bin", Reason: "FieldValueInvalid"},
+				{Field: "spec.platforms[1].platform", Reason: "FieldValueRequired"},
+			},
+		},
+		{
+			name: "expanded platform is reported on the all platform",
+			plugin: func() *v1alpha1.Plugin {
+				p := newTestPlugin("oc", "linux/amd64", "all")
+				p.Spec.Platforms[1].Bin = "oc-{os}"
+				return p
+			},
+			expected: []v1alpha1.PluginValidationError{
+				{Field: "spec.platforms[1].bin", Value: "oc-darwin", Reason: "FieldValueInvalid"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := tc.plugin()
+			dynamicClient := newTestDynamicClient(t, plugin)
+			options := Options{
+				ImagePullTimeout: time.Minute,
+				DefaultPlatforms: []string{"darwin/arm64"},
+			}
+			_, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, options)
+			if success || err != nil {
+				t.Fatalf("expected the invalid plugin not to be published, got success %t error %v", success, err)
+			}
+			status := getTestPlugin(t, dynamicClient, plugin.Name).Status
+			if installed := meta.FindStatusCondition(status.Conditions, "PluginInstalled"); installed == nil || installed.Reason != "InvalidField" {
+				t.Fatalf("expected InvalidField condition, got %+v", status.Conditions)
+			}
+			if !reflect.DeepEqual(status.ValidationErrors, tc.expected) {
+				t.Fatalf("expected validation errors %+v, got %+v", tc.expected, status.ValidationErrors)
+			}
+
+			// the validation errors are cleared once the plugin is fixed
+			fixed := newTestPlugin("oc", "linux/amd64")
+			fixed.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+			fixed.Status = getTestPlugin(t, dynamicClient, plugin.Name).Status
+			if _, success, err := convertKrewPlugin(context.Background(), fixed, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, options); !success || err != nil {
+				t.Fatalf("expected the fixed plugin to be published, got success %t error %v", success, err)
+			}
+			if status := getTestPlugin(t, dynamicClient, plugin.Name).Status; len(status.ValidationErrors) != 0 {
+				t.Fatalf("expected the validation errors to be cleared, got %+v", status.ValidationErrors)
+			}
+		})
+	}
+}
+
+func TestConvertKrewPluginImagePullSecret(t *testing.T) {
+	// registry which is not reachable anymore, so that plugins
+	// whose secret is found fail while pulling the image
+	server := httptest.NewServer(http.NotFoundHandler())
+	registry := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	newSecret := func(namespace, name string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + registry + `":{"auth":"dXNlcjpwYXNz"}}}`),
+			},
+		}
+	}
+	client := kubefake.NewSimpleClientset(newSecret("openshift-cli-manager-operator", "pull-secret"), newSecret("other", "other-secret"))
+
+	tests := []struct {
+		name            string
+		imagePullSecret string
+		expectedReason  string
+		expectedMessage string
+	}{
+		{
+			name:            "secret in the default namespace",
+			imagePullSecret: "pull-secret",
+			expectedReason:  "ImagePullError",
+		},
+		{
+			name:            "secret in another namespace",
+			imagePullSecret: "other/other-secret",
+			expectedReason:  "ImagePullError",
+		},
+		{
+			name:            "secret missing in the default namespace",
+			imagePullSecret: "other-secret",
+			expectedReason:  "InvalidField",
+			expectedMessage: "secret other-secret is not found in namespace openshift-cli-manager-operator",
+		},
+		{
+			name:            "secret missing in another namespace",
+			imagePullSecret: "other/pull-secret",
+			expectedReason:  "InvalidField",
+			expectedMessage: "secret pull-secret is not found in namespace other",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := newTestPlugin("oc", "linux/amd64")
+			plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+			plugin.Spec.Platforms[0].ImagePullSecret = tc.imagePullSecret
+			dynamicClient := newTestDynamicClient(t, plugin)
+			route := &fakeRouteV1{host: "cli-manager.example.com"}
+			convertKrewPlugin(context.Background(), plugin.DeepCopy(), client, dynamicClient, route, Options{
+				ImagePullTimeout: time.Minute,
+				SecretNamespace:  "openshift-cli-manager-operator",
+			})
+
+			plugin = getTestPlugin(t, dynamicClient, plugin.Name)
+			if len(plugin.Status.Conditions) != 2 || plugin.Status.Conditions[0].Reason != tc.expectedReason {
+				t.Fatalf("expected condition reason %s, got %+v", tc.expectedReason, plugin.Status.Conditions)
+			}
+			if !strings.HasPrefix(plugin.Status.Conditions[0].Message, tc.expectedMessage) {
+				t.Fatalf("expected condition message %s, got %s", tc.expectedMessage, plugin.Status.Conditions[0].Message)
+			}
+		})
+	}
+}
+
+func TestUpdateStatusConditionConflict(t *testing.T) {
+	plugin := newTestPlugin("oc", "linux/amd64")
+	dynamicClient := newTestDynamicClient(t, plugin)
+	conflicts := 0
+	dynamicClient.PrependReactor("update", "plugins", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" || conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, apierrors.NewConflict(pluginsGVR.GroupResource(), plugin.Name, fmt.Errorf("the object has been modified"))
+	})
+
+	err := updateStatusCondition(context.Background(), plugin.DeepCopy(), dynamicClient, metav1.Condition{
+		Status:  metav1.ConditionTrue,
+		Reason:  "Installed",
+		Message: "plugin oc is ready to be served",
+	})
+	if err != nil {
+		t.Fatalf("unexpected update error %v", err)
+	}
+	if conflicts != 1 {
+		t.Fatalf("expected 1 conflict, got %d", conflicts)
+	}
+
+	persisted := getTestPlugin(t, dynamicClient, plugin.Name)
+	if len(persisted.Status.Conditions) != 1 || persisted.Status.Conditions[0].Reason != "Installed" {
+		t.Fatalf("expected condition to be persisted, got %+v", persisted.Status.Conditions)
+	}
+}
+
+func TestUpdateStatusConditionTransitions(t *testing.T) {
+	before := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Status.Conditions = []metav1.Condition{
+		{
+			Type:               "ImageVerified",
+			Status:             metav1.ConditionTrue,
+			Reason:             "Verified",
+			LastTransitionTime: before,
+		},
+		{
+			Type:               "PluginInstalled",
+			Status:             metav1.ConditionFalse,
+			Reason:             "ImagePullError",
+			Message:            "failed to pull the image",
+			LastTransitionTime: before,
+		},
+	}
+	dynamicClient := newTestDynamicClient(t, plugin)
+	updates := func() int {
+		count := 0
+		for _, action := range dynamicClient.Actions() {
+			if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+				count++
+			}
+		}
+		return count
+	}
+
+	tests := []struct {
+		name               string
+		condition          metav1.Condition
+		expectedUpdates    int
+		expectedTransition bool
+	}{
+		{
+			name: "same status with another reason",
+			condition: metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "BinaryNotFound",
+				Message: "binary is not found",
+			},
+			expectedUpdates: 1,
+		},
+		{
+			name: "identical condition",
+			condition: metav1.Condition{
+				Status:  metav1.ConditionFalse,
+				Reason:  "BinaryNotFound",
+				Message: "binary is not found",
+			},
+			expectedUpdates: 1,
+		},
+		{
+			name: "status transition",
+			condition: metav1.Condition{
+				Status:  metav1.ConditionTrue,
+				Reason:  "Installed",
+				Message: "plugin oc is ready to be served",
+			},
+			expectedUpdates:    2,
+			expectedTransition: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			current := getTestPlugin(t, dynamicClient, plugin.Name)
+			if err := updateStatusCondition(context.Background(), current, dynamicClient, tc.condition); err != nil {
+				t.Fatalf("unexpected update error %v", err)
+			}
+			if updates() != tc.expectedUpdates {
+				t.Fatalf("expected %d status updates, got %d", tc.expectedUpdates, updates())
+			}
+
+			persisted := getTestPlugin(t, dynamicClient, plugin.Name)
+			// the Ready condition is reported along with the failure
+			if len(persisted.Status.Conditions) != 3 {
+				t.Fatalf("expected unrelated conditions to be retained, got %+v", persisted.Status.Conditions)
+			}
+			verified := meta.FindStatusCondition(persisted.Status.Conditions, "ImageVerified")
+			if verified == nil || !verified.LastTransitionTime.Equal(&before) {
+				t.Fatalf("unexpected unrelated condition %+v", verified)
+			}
+			installed := meta.FindStatusCondition(persisted.Status.Conditions, "PluginInstalled")
+			if installed == nil || installed.Reason != tc.condition.Reason || installed.Status != tc.condition.Status {
+				t.Fatalf("unexpected condition %+v", installed)
+			}
+			if transitioned := !installed.LastTransitionTime.Equal(&before); transitioned != tc.expectedTransition {
+				t.Fatalf("expected transition %t, got last transition time %v", tc.expectedTransition, installed.LastTransitionTime)
+			}
+		})
+	}
+}
+
+// newTestRegistry serves an image containing the given files under every
+// repository and tag of a registry, and returns the host of the registry.
+func newTestRegistry(t *testing.T, files map[string]string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("unexpected tar header error %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("unexpected tar write error %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected tar close error %v", err)
+	}
+	layer, err := tarball.LayerFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected layer error %v", err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatalf("unexpected append layer error %v", err)
+	}
+	manifest, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("unexpected manifest error %v", err)
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		t.Fatalf("unexpected media type error %v", err)
+	}
+	blobs := map[string]func() (io.ReadCloser, error){}
+	configName, err := img.ConfigName()
+	if err != nil {
+		t.Fatalf("unexpected config name error %v", err)
+	}
+	blobs[configName.String()] = func() (io.ReadCloser, error) {
+		config, err := img.RawConfigFile()
+		return io.NopCloser(bytes.NewReader(config)), err
+	}
+	layerDigest, err := layer.Digest()
+	if err != nil {
+		t.Fatalf("unexpected layer digest error %v", err)
+	}
+	blobs[layerDigest.String()] = layer.Compressed
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", string(mediaType))
+			w.Write(manifest)
+			return
+		}
+		_, digest, _ := strings.Cut(r.URL.Path, "/blobs/")
+		blob, ok := blobs[digest]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		rc, err := blob()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+		io.Copy(w, rc)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestConvertKrewPluginDownloadURI(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	tests := []struct {
+		name        string
+		options     Options
+		expectedURI string
+	}{
+		{
+			name:        "route host",
+			expectedURI: "https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+		},
+		{
+			name: "route host in http",
+			options: Options{
+				InsecureHTTP: true,
+			},
+			expectedURI: "http://cli-manager.apps.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+		},
+		{
+			name: "download base URL",
+			options: Options{
+				DownloadBaseURL: "https://plugins.example.com/",
+			},
+			expectedURI: "https://plugins.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+		},
+		{
+			name: "download base URL in http",
+			options: Options{
+				InsecureHTTP:    true,
+				DownloadBaseURL: "http://plugins.example.com:8080",
+			},
+			expectedURI: "http://plugins.example.com:8080/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+		},
+		{
+			name: "download query",
+			options: Options{
+				DownloadBaseURL: "https://cdn.example.com",
+				DownloadQuery:   map[string]string{"token": "a b&c", "expires": "1700000000"},
+			},
+			expectedURI: "https://cdn.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64&expires=1700000000&token=a+b%26c",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := newTestPlugin("oc", "linux/amd64")
+			plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+			dynamicClient := newTestDynamicClient(t, plugin)
+			route := &fakeRouteV1{host: "cli-manager.apps.example.com"}
+			tc.options.ImagePullTimeout = time.Minute
+			k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, route, tc.options)
+			if err != nil || !success {
+				t.Fatalf("unexpected failure %v conditions %+v", err, getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions)
+			}
+			if len(k.Spec.Platforms) != 1 || k.Spec.Platforms[0].URI != tc.expectedURI {
+				t.Fatalf("expected URI %s, got %+v", tc.expectedURI, k.Spec.Platforms)
+			}
+			if len(tc.options.DownloadBaseURL) > 0 && route.gets != 0 {
+				t.Fatalf("expected route not to be fetched, got %d gets", route.gets)
+			}
+		})
+	}
+}
+
+func TestConvertKrewPluginChecksumMismatch(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	plugin.Spec.Platforms[0].Sha256 = strings.Repeat("0", 64)
+	dynamicClient := newTestDynamicClient(t, plugin)
+	k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+	})
+	if err != nil || success || k != nil {
+		t.Fatalf("expected plugin not to be published, got success %t error %v", success, err)
+	}
+	conditions := getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions
+	if len(conditions) != 2 || conditions[0].Reason != "ChecksumMismatch" {
+		t.Fatalf("expected ChecksumMismatch condition, got %+v", conditions)
+	}
+}
+
+func TestConvertKrewPluginBinaryTooLarge(t *testing.T) {
+	tarballPath, maxFileSize := image.TarballPath, image.MaxFileSize
+	image.TarballPath, image.MaxFileSize = t.TempDir(), 4
+	defer func() {
+		image.TarballPath, image.MaxFileSize = tarballPath, maxFileSize
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+	})
+	if err != nil || success || k != nil {
+		t.Fatalf("expected plugin not to be published, got success %t error %v", success, err)
+	}
+	conditions := getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions
+	if len(conditions) != 2 || conditions[0].Reason != "BinaryTooLarge" {
+		t.Fatalf("expected BinaryTooLarge condition, got %+v", conditions)
+	}
+	if _, err := os.Stat(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz")); !os.IsNotExist(err) {
+		t.Fatalf("expected partial archive to be removed, got %v", err)
+	}
+}
+
+func TestConvertKrewPluginDeduplicate(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	// both plugins extract the same binary from the same image
+	var plugins []*v1alpha1.Plugin
+	for _, name := range []string{"oc", "origin-cli"} {
+		plugin := newTestPlugin(name, "linux/amd64")
+		plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+		plugin.Spec.Platforms[0].Bin = "oc"
+		plugin.Spec.Platforms[0].Files = []v1alpha1.FileLocation{{From: "/usr/bin/oc", To: "."}}
+		plugins = append(plugins, plugin)
+	}
+	dynamicClient := newTestDynamicClient(t, plugins...)
+	for _, plugin := range plugins {
+		k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+			ImagePullTimeout: time.Minute,
+		})
+		if err != nil || !success {
+			t.Fatalf("expected plugin %s to be published, got success %t error %v", plugin.Name, success, err)
+		}
+		if err := repo.Upsert(plugin.Name, k); err != nil {
+			t.Fatalf("unexpected upsert error %v", err)
+		}
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(image.TarballPath, "blobs"))
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if len(blobs) != 1 {
+		t.Fatalf("expected a single blob for identical archives, got %d", len(blobs))
+	}
+	for _, name := range []string{"oc_linux_amd64.tar.gz", "origin-cli_linux_amd64.tar.gz"} {
+		archive := filepath.Join(image.TarballPath, name)
+		if info, err := os.Lstat(archive); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("expected archive %s to link to the blob, got %v", name, err)
+		}
+		if _, err := os.Stat(archive); err != nil {
+			t.Fatalf("expected archive %s to resolve, got %v", name, err)
+		}
+	}
+
+	// the blob is kept as long as an archive links to it
+	if err := DeletePlugin("oc", repo); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(image.TarballPath, "origin-cli_linux_amd64.tar.gz")); err != nil {
+		t.Fatalf("expected archive of the other plugin to resolve, got %v", err)
+	}
+	if err := DeletePlugin("origin-cli", repo); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	if blobs, _ := os.ReadDir(filepath.Join(image.TarballPath, "blobs")); len(blobs) != 0 {
+		t.Fatalf("expected unlinked blob to be removed, got %d blobs", len(blobs))
+	}
+}
+
+func TestConvertKrewPluginRequireDigestPinned(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	digest, err := image.Digest(context.Background(), registry+"/openshift/origin-cli:latest", image.PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected digest error %v", err)
+	}
+
+	tests := []struct {
+		name                string
+		image               string
+		requireDigestPinned bool
+		expectedReason      string
+	}{
+		{
+			name:                "digest pinned image under the policy",
+			image:               registry + "/openshift/origin-cli@" + digest,
+			requireDigestPinned: true,
+			expectedReason:      "Installed",
+		},
+		{
+			name:                "mutable tag under the policy",
+			image:               registry + "/openshift/origin-cli:latest",
+			requireDigestPinned: true,
+			expectedReason:      "MutableImageRejected",
+		},
+		{
+			name:           "mutable tag without the policy",
+			image:          registry + "/openshift/origin-cli:latest",
+			expectedReason: "Installed",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := newTestPlugin("oc", "linux/amd64")
+			plugin.Spec.Platforms[0].Image = tc.image
+			dynamicClient := newTestDynamicClient(t, plugin)
+			_, _, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+				ImagePullTimeout:    time.Minute,
+				RequireDigestPinned: tc.requireDigestPinned,
+			})
+			if err != nil {
+				t.Fatalf("unexpected convert error %v", err)
+			}
+			conditions := getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions
+			if installed := meta.FindStatusCondition(conditions, "PluginInstalled"); installed == nil || installed.Reason != tc.expectedReason {
+				t.Fatalf("expected %s condition, got %+v", tc.expectedReason, conditions)
+			}
+		})
+	}
+}
+
+func TestConvertKrewPluginAllowedRegistries(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	tests := []struct {
+		name              string
+		image             string
+		allowedRegistries []string
+		expectedReason    string
+	}{
+		{
+			name:              "allowed registry",
+			image:             registry + "/openshift/origin-cli:latest",
+			allowedRegistries: []string{"quay.io", registry},
+			expectedReason:    "Installed",
+		},
+		{
+			// the image would fail to be pulled from the unresolvable registry otherwise
+			name:              "disallowed registry is rejected before pulling",
+			image:             "registry.invalid/openshift/origin-cli:latest",
+			allowedRegistries: []string{registry},
+			expectedReason:    "RegistryNotAllowed",
+		},
+		{
+			name:           "every registry is allowed without the policy",
+			image:          registry + "/openshift/origin-cli:latest",
+			expectedReason: "Installed",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := newTestPlugin("oc", "linux/amd64")
+			plugin.Spec.Platforms[0].Image = tc.image
+			dynamicClient := newTestDynamicClient(t, plugin)
+			_, _, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+				ImagePullTimeout:  time.Minute,
+				AllowedRegistries: tc.allowedRegistries,
+			})
+			if err != nil {
+				t.Fatalf("unexpected convert error %v", err)
+			}
+			conditions := getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions
+			if installed := meta.FindStatusCondition(conditions, "PluginInstalled"); installed == nil || installed.Reason != tc.expectedReason {
+				t.Fatalf("expected %s condition, got %+v", tc.expectedReason, conditions)
+			}
+		})
+	}
+}
+
+func TestUpsertPluginFindByName(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"opt/vendor/tools/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	plugin.Spec.Platforms[0].Files[0] = v1alpha1.FileLocation{From: "oc", FindByName: true, To: "."}
+	dynamicClient := newTestDynamicClient(t, plugin)
+	err = UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	manifest, err := repo.Manifest("oc")
+	if err != nil {
+		t.Fatalf("expected the plugin to be published, got error %v", err)
+	}
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if files := k.Spec.Platforms[0].Files; len(files) != 1 || files[0].From != "/opt/vendor/tools/oc" {
+		t.Fatalf("expected the resolved path in the manifest, got %+v", files)
+	}
+	status := getTestPlugin(t, dynamicClient, "oc").Status
+	if len(status.Platforms) != 1 || status.Platforms[0].ResolvedFiles["oc"] != "/opt/vendor/tools/oc" {
+		t.Fatalf("expected the resolved path in the status, got %+v", status.Platforms)
+	}
+}
+
+func TestUpsertPluginAllPlatforms(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	target := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	// the windows image of the plugin is not published
+	var pulled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			pulled = append(pulled, path.Base(r.URL.Path))
+			if strings.Contains(r.URL.Path, "windows") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		http.Redirect(w, r, "http://"+target+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64", "all")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	plugin.Spec.Platforms[1].Image = registry + "/openshift/origin-cli:{os}-{arch}"
+	plugin.Spec.Platforms[1].Files[0].From = "/usr/bin/oc{exe}"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	err = UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+		DefaultPlatforms: []string{"linux/amd64", "linux/arm64", "windows/amd64"},
+	})
+	if err != nil {
+		t.Fatalf("expected the missing image not to be retried, got %v", err)
+	}
+	// the explicit linux/amd64 platform takes precedence over the expanded one
+	if slices.Contains(pulled, "linux-amd64") || !slices.Contains(pulled, "latest") || !slices.Contains(pulled, "linux-arm64") {
+		t.Fatalf("unexpected pulled images %v", pulled)
+	}
+
+	manifest, err := repo.Manifest("oc")
+	if err != nil {
+		t.Fatalf("expected the plugin to be published, got error %v", err)
+	}
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	served := []string{}
+	for _, p := range k.Spec.Platforms {
+		served = append(served, p.Selector.MatchLabels["os"]+"/"+p.Selector.MatchLabels["arch"])
+	}
+	if !slices.Equal(served, []string{"linux/amd64", "linux/arm64"}) {
+		t.Fatalf("expected the existing images to be served, got %v", served)
+	}
+
+	status := getTestPlugin(t, dynamicClient, "oc").Status
+	if installed := meta.FindStatusCondition(status.Conditions, "PluginInstalled"); installed == nil || installed.Reason != "PartiallyInstalled" {
+		t.Fatalf("expected PartiallyInstalled condition, got %+v", status.Conditions)
+	}
+	if len(status.Platforms) != 3 {
+		t.Fatalf("expected the status of the 3 expanded platforms, got %+v", status.Platforms)
+	}
+	for _, p := range status.Platforms {
+		installed := meta.FindStatusCondition(p.Conditions, "PlatformInstalled")
+		if p.Platform == "windows/amd64" {
+			if installed == nil || installed.Status != metav1.ConditionFalse || installed.Reason != "ImageNotFound" {
+				t.Fatalf("expected the missing image to be skipped, got %+v", p.Conditions)
+			}
+		} else if installed == nil || installed.Status != metav1.ConditionTrue {
+			t.Fatalf("unexpected conditions of platform %s %+v", p.Platform, p.Conditions)
+		}
+	}
+}
+
+func TestExpandAllPlatforms(t *testing.T) {
+	plugin := newTestPlugin("oc", "darwin/arm64", "all")
+	plugin.Spec.Platforms[1].Image = "quay.io/openshift/origin-cli:{os}-{arch}"
+	plugin.Spec.Platforms[1].Files[0].From = "/usr/bin/{os}/oc{exe}"
+	plugin.Spec.Platforms[1].Files = append(plugin.Spec.Platforms[1].Files, v1alpha1.FileLocation{
+		Image: "quay.io/openshift/origin-docs:{os}",
+		From:  "/usr/share/doc/oc",
+		To:    "doc",
+	})
+
+	expanded := ExpandAllPlatforms(plugin, []string{"linux/amd64", "darwin/arm64", "windows/amd64"})
+	platforms := []string{}
+	for _, p := range expanded.Spec.Platforms {
+		platforms = append(platforms, p.Platform+" "+p.Image+" "+p.Files[0].From+" "+p.Files[len(p.Files)-1].Image)
+	}
+	expected := []string{
+		"darwin/arm64 quay.io/openshift/origin-cli /usr/bin/oc ",
+		"linux/amd64 quay.io/openshift/origin-cli:linux-amd64 /usr/bin/linux/oc quay.io/openshift/origin-docs:linux",
+		"windows/amd64 quay.io/openshift/origin-cli:windows-amd64 /usr/bin/windows/oc.exe quay.io/openshift/origin-docs:windows",
+	}
+	if !slices.Equal(platforms, expected) {
+		t.Fatalf("expected %v, got %v", expected, platforms)
+	}
+	if plugin.Spec.Platforms[1].Platform != "all" {
+		t.Fatalf("expected the plugin not to be modified, got %+v", plugin.Spec.Platforms)
+	}
+	if newCondition := ValidatePlugin(expanded); newCondition != nil {
+		t.Fatalf("unexpected validation error %+v", newCondition)
+	}
+
+	plugin = newTestPlugin("oc", "linux/amd64")
+	if ExpandAllPlatforms(plugin, DefaultPlatforms) != plugin {
+		t.Fatalf("expected the plugin without all platform to be returned as is")
+	}
+}
+
+func TestConvertKrewPluginMatchExpressions(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	tests := []struct {
+		name             string
+		matchExpressions []metav1.LabelSelectorRequirement
+		expected         bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "set",
+			matchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "arch", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"arm"}},
+			},
+			expected: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := newTestPlugin("oc", "linux/amd64")
+			plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+			plugin.Spec.Platforms[0].MatchExpressions = tc.matchExpressions
+			dynamicClient := newTestDynamicClient(t, plugin)
+			k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+				ImagePullTimeout: time.Minute,
+			})
+			if err != nil || !success {
+				t.Fatalf("unexpected failure %v conditions %+v", err, getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions)
+			}
+			manifest, err := yaml.Marshal(k)
+			if err != nil {
+				t.Fatalf("unexpected marshal error %v", err)
+			}
+			if strings.Contains(string(manifest), "matchExpressions") != tc.expected {
+				t.Fatalf("expected matchExpressions in manifest %t, got\n%s", tc.expected, manifest)
+			}
+			selector := k.Spec.Platforms[0].Selector
+			if selector.MatchLabels["os"] != "linux" || selector.MatchLabels["arch"] != "amd64" || len(selector.MatchExpressions) != len(tc.matchExpressions) {
+				t.Fatalf("unexpected selector %+v", selector)
+			}
+		})
+	}
+}
+
+func TestConvertKrewPluginDeprecated(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	tests := []struct {
+		name               string
+		deprecated         bool
+		deprecationMessage string
+		expectedCaveats    string
+	}{
+		{
+			name:            "not deprecated",
+			expectedCaveats: "Requires a cluster.",
+		},
+		{
+			name:            "deprecated",
+			deprecated:      true,
+			expectedCaveats: "plugin oc is deprecated\n\nRequires a cluster.",
+		},
+		{
+			name:               "deprecated with message",
+			deprecated:         true,
+			deprecationMessage: "use kubectl instead",
+			expectedCaveats:    "plugin oc is deprecated: use kubectl instead\n\nRequires a cluster.",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plugin := newTestPlugin("oc", "linux/amd64")
+			plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+			plugin.Spec.Caveats = "Requires a cluster."
+			plugin.Spec.Deprecated = tc.deprecated
+			plugin.Spec.DeprecationMessage = tc.deprecationMessage
+			dynamicClient := newTestDynamicClient(t, plugin)
+			k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+				ImagePullTimeout: time.Minute,
+			})
+			if err != nil || !success {
+				t.Fatalf("unexpected failure %v conditions %+v", err, getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions)
+			}
+			if k.Spec.Caveats != tc.expectedCaveats {
+				t.Fatalf("expected caveats %q, got %q", tc.expectedCaveats, k.Spec.Caveats)
+			}
+			message, ok := k.Annotations[deprecatedAnnotation]
+			if ok != tc.deprecated || (tc.deprecated && !strings.HasPrefix(tc.expectedCaveats, message)) {
+				t.Fatalf("unexpected deprecated annotation %q", message)
+			}
+		})
+	}
+}
+
+func TestConvertKrewPluginDefaultBin(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{
+		"usr/bin/oc":     "oc binary",
+		"usr/bin/oc.exe": "oc windows binary",
+		"usr/bin/tool":   "tool binary",
+	})
+
+	plugin := newTestPlugin("oc", "linux/amd64", "windows/amd64", "windows/arm64")
+	for i := range plugin.Spec.Platforms {
+		plugin.Spec.Platforms[i].Image = registry + "/openshift/origin-cli:latest"
+	}
+	// explicit bins are kept as is, even without the .exe suffix
+	plugin.Spec.Platforms[2].Bin = "tool"
+	plugin.Spec.Platforms[2].Files = []v1alpha1.FileLocation{{From: "/usr/bin/tool", To: "."}}
+	dynamicClient := newTestDynamicClient(t, plugin)
+	k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+	})
+	if err != nil || !success {
+		t.Fatalf("unexpected failure %v conditions %+v", err, getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions)
+	}
+	bins := []string{}
+	for _, p := range k.Spec.Platforms {
+		bins = append(bins, p.Bin)
+	}
+	if expected := []string{"oc", "oc.exe", "tool"}; !reflect.DeepEqual(bins, expected) {
+		t.Fatalf("expected bins %v, got %v", expected, bins)
+	}
+}
+
+func TestConvertKrewPluginRouteLookup(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	plugin := newTestPlugin("oc", "linux/amd64", "linux/arm64", "darwin/arm64")
+	for i := range plugin.Spec.Platforms {
+		plugin.Spec.Platforms[i].Image = registry + "/openshift/origin-cli:latest"
+	}
+	dynamicClient := newTestDynamicClient(t, plugin)
+	route := &fakeRouteV1{host: "cli-manager.apps.example.com"}
+	k, success, err := convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, route, Options{
+		ImagePullTimeout: time.Minute,
+	})
+	if err != nil || !success {
+		t.Fatalf("unexpected failure %v conditions %+v", err, getTestPlugin(t, dynamicClient, plugin.Name).Status.Conditions)
+	}
+	if len(k.Spec.Platforms) != 3 {
+		t.Fatalf("expected 3 platforms, got %d", len(k.Spec.Platforms))
+	}
+	if route.gets != 1 {
+		t.Fatalf("expected route to be fetched once, got %d gets", route.gets)
+	}
+}
+
+func TestConvertKrewPluginStructuredLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	klog.SetLogger(textlogger.NewLogger(textlogger.NewConfig(textlogger.Output(buf))))
+	defer klog.ClearLogger()
+
+	// registry which is not reachable anymore
+	server := httptest.NewServer(http.NotFoundHandler())
+	registry := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	convertKrewPlugin(context.Background(), plugin.DeepCopy(), kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{}, Options{
+		ImagePullTimeout: time.Minute,
+	})
+	klog.Flush()
+
+	for _, field := range []string{
+		`"Plugin platform can not be extracted"`,
+		`plugin="oc"`,
+		`platform="linux/amd64"`,
+		`image="` + plugin.Spec.Platforms[0].Image + `"`,
+		`reason="ImagePullError"`,
+	} {
+		if !strings.Contains(buf.String(), field) {
+			t.Fatalf("expected %s in logs, got %s", field, buf.String())
+		}
+	}
+}
+
+type fakeSyncContext struct {
+	factory.SyncContext
+	key string
+}
+
+func (f fakeSyncContext) QueueKey() string {
+	return f.key
+}
+
+func TestSyncPaused(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	published := &krew.Plugin{
+		ObjectMeta: metav1.ObjectMeta{Name: "oc"},
+		Spec:       krew.PluginSpec{Version: "v4.14.0"},
+	}
+	if err := repo.Upsert("oc", published); err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Annotations = map[string]string{pausedAnnotation: "true"}
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	c := &Controller{
+		repo:          repo,
+		client:        kubefake.NewSimpleClientset(),
+		dynamicClient: dynamicClient,
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout: time.Minute,
+		},
+	}
+	manifestVersion := func() string {
+		manifest, err := repo.Manifest("oc")
+		if err != nil {
+			t.Fatalf("unexpected manifest error %v", err)
+		}
+		k := &krew.Plugin{}
+		if err := yaml.Unmarshal(manifest, k); err != nil {
+			t.Fatalf("unexpected manifest decoding error %v", err)
+		}
+		return k.Spec.Version
+	}
+
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if version := manifestVersion(); version != "v4.14.0" {
+		t.Fatalf("expected paused plugin to be left untouched, got version %s", version)
+	}
+	paused := getTestPlugin(t, dynamicClient, "oc")
+	if !meta.IsStatusConditionTrue(paused.Status.Conditions, "Paused") || meta.FindStatusCondition(paused.Status.Conditions, "PluginInstalled") != nil {
+		t.Fatalf("unexpected conditions of paused plugin %+v", paused.Status.Conditions)
+	}
+
+	// removing the annotation resumes the reconciliation
+	paused.Annotations = nil
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(paused)
+	if err != nil {
+		t.Fatalf("unexpected conversion error %v", err)
+	}
+	if _, err := dynamicClient.Resource(pluginsGVR).Update(context.Background(), &unstructured.Unstructured{Object: u}, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected update error %v", err)
+	}
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if version := manifestVersion(); version != "v4.15.0" {
+		t.Fatalf("expected resumed plugin to be published, got version %s", version)
+	}
+	resumed := getTestPlugin(t, dynamicClient, "oc")
+	if meta.IsStatusConditionTrue(resumed.Status.Conditions, "Paused") || !meta.IsStatusConditionTrue(resumed.Status.Conditions, "PluginInstalled") {
+		t.Fatalf("unexpected conditions of resumed plugin %+v", resumed.Status.Conditions)
+	}
+}
+
+func TestSyncFinalizer(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	newController := func() *Controller {
+		return &Controller{
+			repo:          repo,
+			client:        kubefake.NewSimpleClientset(),
+			dynamicClient: dynamicClient,
+			route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+			options: Options{
+				ImagePullTimeout: time.Minute,
+			},
+		}
+	}
+	archive := filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz")
+
+	c := newController()
+	for i := 0; i < 2; i++ {
+		if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+			t.Fatalf("unexpected sync error %v", err)
+		}
+		if finalizers := getTestPlugin(t, dynamicClient, "oc").Finalizers; len(finalizers) != 1 || finalizers[0] != pluginFinalizer {
+			t.Fatalf("expected finalizer to be added once, got %v", finalizers)
+		}
+	}
+	if _, err := repo.Manifest("oc"); err != nil {
+		t.Fatalf("expected plugin to be published, got %v", err)
+	}
+	if _, err := os.Stat(archive); err != nil {
+		t.Fatalf("expected plugin archive, got %v", err)
+	}
+
+	// the plugin is deleted while the controller is not running
+	deleted := getTestPlugin(t, dynamicClient, "oc")
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deleted)
+	if err != nil {
+		t.Fatalf("unexpected conversion error %v", err)
+	}
+	if _, err := dynamicClient.Resource(pluginsGVR).Update(context.Background(), &unstructured.Unstructured{Object: u}, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected update error %v", err)
+	}
+
+	c = newController()
+	for i := 0; i < 2; i++ {
+		if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+			t.Fatalf("unexpected sync error %v", err)
+		}
+	}
+	if _, err := repo.Manifest("oc"); !os.IsNotExist(err) {
+		t.Fatalf("expected plugin to be removed from the index, got %v", err)
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Fatalf("expected plugin archive to be removed, got %v", err)
+	}
+	if finalizers := getTestPlugin(t, dynamicClient, "oc").Finalizers; len(finalizers) != 0 {
+		t.Fatalf("expected finalizer to be removed, got %v", finalizers)
+	}
+}
+
+func TestSyncLabelSelector(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary", "usr/bin/kubectl": "kubectl binary"})
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	oc := newTestPlugin("oc", "linux/amd64")
+	oc.Labels = map[string]string{"team": "cli"}
+	oc.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	kubectl := newTestPlugin("kubectl", "linux/amd64")
+	kubectl.Labels = map[string]string{"team": "storage"}
+	kubectl.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	// kubectl is published before the selector excludes it
+	if err := repo.Upsert("kubectl", &krew.Plugin{ObjectMeta: metav1.ObjectMeta{Name: "kubectl"}}); err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+
+	selector, err := labels.Parse("team=cli")
+	if err != nil {
+		t.Fatalf("unexpected selector error %v", err)
+	}
+	c := &Controller{
+		repo:          repo,
+		client:        kubefake.NewSimpleClientset(),
+		dynamicClient: newTestDynamicClient(t, oc, kubectl),
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout: time.Minute,
+			LabelSelector:    selector,
+		},
+	}
+	for _, name := range []string{"oc", "kubectl"} {
+		if err := c.sync(context.Background(), fakeSyncContext{key: name}); err != nil {
+			t.Fatalf("unexpected sync error of %s %v", name, err)
+		}
+	}
+
+	if _, err := repo.Manifest("oc"); err != nil {
+		t.Fatalf("expected matching plugin to be published, got error %v", err)
+	}
+	if _, err := repo.Manifest("kubectl"); !os.IsNotExist(err) {
+		t.Fatalf("expected plugin not matching to be removed from the index, got error %v", err)
+	}
+}
+
+func TestSyncUnchanged(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	repoPath := filepath.Join(t.TempDir(), "cli-manager")
+	repo, err := git.PrepareLocalGit(repoPath, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	commits := func() int {
+		r, err := gogit.PlainOpen(repoPath)
+		if err != nil {
+			t.Fatalf("unexpected open error %v", err)
+		}
+		iter, err := r.Log(&gogit.LogOptions{})
+		if err != nil {
+			t.Fatalf("unexpected log error %v", err)
+		}
+		count := 0
+		iter.ForEach(func(*object.Commit) error {
+			count++
+			return nil
+		})
+		return count
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	c := &Controller{
+		repo:          repo,
+		client:        kubefake.NewSimpleClientset(),
+		dynamicClient: dynamicClient,
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout: time.Minute,
+		},
+	}
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	published := commits()
+
+	// images can not be pulled anymore, an unchanged plugin must not pull them
+	c.options.RegistryMirrors = map[string]string{registry: "127.0.0.1:1"}
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if count := commits(); count != published {
+		t.Fatalf("expected no commit for unchanged plugin, got %d new commits", count-published)
+	}
+	if !meta.IsStatusConditionTrue(getTestPlugin(t, dynamicClient, "oc").Status.Conditions, "PluginInstalled") {
+		t.Fatalf("expected unchanged plugin to stay installed")
+	}
+
+	// a changed plugin is extracted again and replaced in a single commit
+	c.options.RegistryMirrors = nil
+	changed := getTestPlugin(t, dynamicClient, "oc")
+	changed.Spec.Version = "v4.16.0"
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(changed)
+	if err != nil {
+		t.Fatalf("unexpected conversion error %v", err)
+	}
+	if _, err := dynamicClient.Resource(pluginsGVR).Update(context.Background(), &unstructured.Unstructured{Object: u}, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected update error %v", err)
+	}
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if count := commits(); count != published+1 {
+		t.Fatalf("expected a single commit for changed plugin, got %d new commits", count-published)
+	}
+}
+
+func TestUpsertPluginNameConflict(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	oc := newTestPlugin("oc", "linux/amd64")
+	oc.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	variant := newTestPlugin("Oc", "linux/amd64")
+	variant.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	variant.Spec.Platforms[0].Bin = "oc"
+	variant.Spec.Platforms[0].Files = []v1alpha1.FileLocation{{From: "/usr/bin/oc", To: "."}}
+	dynamicClient := newTestDynamicClient(t, oc, variant)
+	for _, plugin := range []*v1alpha1.Plugin{oc, variant} {
+		err := UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+			ImagePullTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unexpected upsert error of %s %v", plugin.Name, err)
+		}
+	}
+
+	conditions := getTestPlugin(t, dynamicClient, "Oc").Status.Conditions
+	if len(conditions) != 2 || conditions[0].Reason != "NameConflict" {
+		t.Fatalf("expected NameConflict condition, got %+v", conditions)
+	}
+	names, err := repo.List()
+	if err != nil {
+		t.Fatalf("unexpected list error %v", err)
+	}
+	if len(names) != 1 || names[0] != "oc" {
+		t.Fatalf("expected only the first plugin to be published, got %v", names)
+	}
+}
+
+func TestUpsertPluginKrewName(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	oc := newTestPlugin("oc", "linux/amd64")
+	oc.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	oc.Spec.KrewName = "team_oc"
+	// conflicts with the krewName of oc
+	other := newTestPlugin("other", "linux/amd64")
+	other.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	other.Spec.Platforms[0].Bin = "oc"
+	other.Spec.KrewName = "team_oc"
+	dynamicClient := newTestDynamicClient(t, oc, other)
+	for _, plugin := range []*v1alpha1.Plugin{oc, other} {
+		err := UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+			ImagePullTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unexpected upsert error of %s %v", plugin.Name, err)
+		}
+	}
+
+	names, err := repo.List()
+	if err != nil {
+		t.Fatalf("unexpected list error %v", err)
+	}
+	if len(names) != 1 || names[0] != "team_oc" {
+		t.Fatalf("expected oc to be published as team_oc, got %v", names)
+	}
+	manifest, err := repo.Manifest("team_oc")
+	if err != nil {
+		t.Fatalf("unexpected manifest error %v", err)
+	}
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if k.Name != "team_oc" || k.Annotations[pluginAnnotation] != "oc" {
+		t.Fatalf("unexpected manifest metadata %+v", k.ObjectMeta)
+	}
+	expectedURI := "https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=team_oc&platform=linux_amd64"
+	if len(k.Spec.Platforms) != 1 || k.Spec.Platforms[0].URI != expectedURI {
+		t.Fatalf("unexpected platforms %+v", k.Spec.Platforms)
+	}
+	if _, err := os.Stat(filepath.Join(image.TarballPath, "team_oc_linux_amd64.tar.gz")); err != nil {
+		t.Fatalf("expected the archive to be named after krewName, got error %v", err)
+	}
+
+	conditions := getTestPlugin(t, dynamicClient, "other").Status.Conditions
+	if len(conditions) != 2 || conditions[0].Reason != "NameConflict" {
+		t.Fatalf("expected NameConflict condition, got %+v", conditions)
+	}
+
+	// the deletion of other leaves the plugin of oc published
+	if err := unpublishPlugin("other", "team_oc", repo); err != nil {
+		t.Fatalf("unexpected unpublish error %v", err)
+	}
+	if _, err := repo.Manifest("team_oc"); err != nil {
+		t.Fatalf("expected team_oc to be kept, got error %v", err)
+	}
+	if err := unpublishPlugin("oc", "team_oc", repo); err != nil {
+		t.Fatalf("unexpected unpublish error %v", err)
+	}
+	if _, err := repo.Manifest("team_oc"); !os.IsNotExist(err) {
+		t.Fatalf("expected team_oc to be deleted, got error %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	for _, name := range []string{"oc", "stale", "team_kubectl"} {
+		published := &krew.Plugin{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: krew.PluginSpec{
+				Platforms: []krew.Platform{{URI: "https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=" + name + "&platform=linux_amd64"}},
+			},
+		}
+		if err := repo.Upsert(name, published); err != nil {
+			t.Fatalf("unexpected upsert error %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(image.TarballPath, name+"_linux_amd64.tar.gz"), []byte(name), 0644); err != nil {
+			t.Fatalf("unexpected write error %v", err)
+		}
+	}
+
+	// only oc and team_kubectl still have a Plugin, stale was deleted while the controller was not running
+	kubectl := newTestPlugin("kubectl", "linux/amd64")
+	kubectl.Spec.KrewName = "team_kubectl"
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, plugin := range []*v1alpha1.Plugin{newTestPlugin("oc", "linux/amd64"), kubectl} {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(plugin)
+		if err != nil {
+			t.Fatalf("unexpected conversion error %v", err)
+		}
+		if err := indexer.Add(&unstructured.Unstructured{Object: u}); err != nil {
+			t.Fatalf("unexpected indexer error %v", err)
+		}
+	}
+	c := &Controller{
+		lister: cache.NewGenericLister(indexer, pluginsGVR.GroupResource()),
+		repo:   repo,
+	}
+	if err := c.sweep(context.Background()); err != nil {
+		t.Fatalf("unexpected sweep error %v", err)
+	}
+
+	names, err := repo.List()
+	if err != nil {
+		t.Fatalf("unexpected list error %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"oc", "team_kubectl"}) {
+		t.Fatalf("expected only oc and team_kubectl to be left in the index, got %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(image.TarballPath, "stale_linux_amd64.tar.gz")); !os.IsNotExist(err) {
+		t.Fatalf("expected the archive of the orphaned plugin to be removed, got error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz")); err != nil {
+		t.Fatalf("expected the archive of oc to be kept, got error %v", err)
+	}
+}
+
+func TestDeletePluginPrefix(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	// the archives of foo_bar start with the name of foo
+	for _, name := range []string{"foo", "foo_bar"} {
+		published := &krew.Plugin{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		for _, p := range []string{"linux_amd64", "windows_amd64"} {
+			published.Spec.Platforms = append(published.Spec.Platforms, krew.Platform{
+				URI: "https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=" + name + "&platform=" + p,
+			})
+		}
+		if err := repo.Upsert(name, published); err != nil {
+			t.Fatalf("unexpected upsert error %v", err)
+		}
+		for _, archive := range []string{name + "_linux_amd64.tar.gz", name + "_linux_amd64.tar.zst", name + "_windows_amd64.zip"} {
+			if err := os.WriteFile(filepath.Join(image.TarballPath, archive), []byte(name), 0644); err != nil {
+				t.Fatalf("unexpected write error %v", err)
+			}
+		}
+	}
+
+	if err := DeletePlugin("foo", repo); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	for _, archive := range []string{"foo_linux_amd64.tar.gz", "foo_linux_amd64.tar.zst", "foo_windows_amd64.zip"} {
+		if _, err := os.Stat(filepath.Join(image.TarballPath, archive)); !os.IsNotExist(err) {
+			t.Fatalf("expected archive %s to be removed, got error %v", archive, err)
+		}
+	}
+	for _, archive := range []string{"foo_bar_linux_amd64.tar.gz", "foo_bar_linux_amd64.tar.zst", "foo_bar_windows_amd64.zip"} {
+		if _, err := os.Stat(filepath.Join(image.TarballPath, archive)); err != nil {
+			t.Fatalf("expected archive %s of foo_bar to be kept, got error %v", archive, err)
+		}
+	}
+}
+
+func TestSyncImageDigest(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registries := []string{
+		newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"}),
+		newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary rebuilt"}),
+	}
+	// the tag is served by the first registry, then moved to the second one
+	target := registries[0]
+	var blobs int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			blobs++
+		}
+		http.Redirect(w, r, "http://"+target+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	c := &Controller{
+		repo:          repo,
+		client:        kubefake.NewSimpleClientset(),
+		dynamicClient: dynamicClient,
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout: time.Minute,
+		},
+	}
+	digest := func() string {
+		platforms := getTestPlugin(t, dynamicClient, "oc").Status.Platforms
+		if len(platforms) != 1 || platforms[0].Platform != "linux/amd64" {
+			t.Fatalf("unexpected platform status %+v", platforms)
+		}
+		return platforms[0].ImageDigests[plugin.Spec.Platforms[0].Image]
+	}
+	// archiveSha256 returns the sha256 of the archive advertised in the index
+	archiveSha256 := func() string {
+		manifest, err := repo.Manifest("oc")
+		if err != nil {
+			t.Fatalf("unexpected manifest error %v", err)
+		}
+		k := &krew.Plugin{}
+		if err := yaml.Unmarshal(manifest, k); err != nil {
+			t.Fatalf("unexpected unmarshal error %v", err)
+		}
+		return k.Spec.Platforms[0].Sha256
+	}
+
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	first := digest()
+	firstSha256 := archiveSha256()
+	if !strings.HasPrefix(first, "sha256:") {
+		t.Fatalf("expected image digest to be recorded, got %q", first)
+	}
+
+	// the remote digest matches the recorded one, the image is not pulled
+	blobs = 0
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if blobs != 0 {
+		t.Fatalf("expected no pull of an unchanged image, got %d blob requests", blobs)
+	}
+
+	// the tag points to another image, it is pulled and extracted again
+	target = registries[1]
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if blobs == 0 {
+		t.Fatalf("expected changed image to be pulled")
+	}
+	if second := digest(); second == first {
+		t.Fatalf("expected new image digest to be recorded, got %s", second)
+	}
+	// the sha256 of the archive is computed again rather than reused
+	if sha := archiveSha256(); sha == firstSha256 {
+		t.Fatalf("expected the sha256 of the new archive to be published, got %s", sha)
+	}
+}
+
+func TestUpsertPluginExtractionCache(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	target := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	var blobs int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			blobs++
+		}
+		http.Redirect(w, r, "http://"+target+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	upsert := func(plugin *v1alpha1.Plugin) {
+		t.Helper()
+		blobs = 0
+		err := UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+			ImagePullTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("unexpected upsert error %v", err)
+		}
+	}
+
+	upsert(plugin)
+	if blobs == 0 {
+		t.Fatalf("expected the image to be pulled")
+	}
+	archive := filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz")
+	first, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+
+	// the description does not change the archive, it is not extracted again
+	plugin.Spec.Description = "The OpenShift CLI"
+	upsert(plugin)
+	if blobs != 0 {
+		t.Fatalf("expected no pull of an already extracted image, got %d blob requests", blobs)
+	}
+	second, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("expected the archive to be kept")
+	}
+
+	// the refresh annotation extracts the images again
+	plugin.Annotations = map[string]string{refreshAnnotation: "2024-10-01T12:00:00Z"}
+	upsert(plugin)
+	if blobs == 0 {
+		t.Fatalf("expected the image to be pulled again on refresh")
+	}
+
+	// the record of a removed archive is not used
+	if err := DeletePlugin("oc", repo); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	upsert(plugin)
+	if blobs == 0 {
+		t.Fatalf("expected the image to be pulled again once its archive is removed")
+	}
+}
+
+func TestSyncPluginResource(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	// the Plugins are served in another version than api/v1alpha1
+	gvr := schema.GroupVersionResource{Group: "config.openshift.io", Version: "v1", Resource: "plugins"}
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.APIVersion = gvr.GroupVersion().String()
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(plugin)
+	if err != nil {
+		t.Fatalf("unexpected conversion error %v", err)
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gvr: "PluginList",
+	}, &unstructured.Unstructured{Object: u})
+	c := &Controller{
+		repo:          repo,
+		client:        kubefake.NewSimpleClientset(),
+		dynamicClient: dynamicClient,
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout: time.Minute,
+			PluginResource:   gvr,
+		},
+	}
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if _, err := repo.Manifest("oc"); err != nil {
+		t.Fatalf("expected plugin to be published, got %v", err)
+	}
+	obj, err := dynamicClient.Resource(gvr).Get(context.Background(), "oc", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected get error %v", err)
+	}
+	persisted := &v1alpha1.Plugin{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, persisted); err != nil {
+		t.Fatalf("unexpected conversion error %v", err)
+	}
+	if !meta.IsStatusConditionTrue(persisted.Status.Conditions, "Ready") || !slices.Contains(persisted.Finalizers, pluginFinalizer) {
+		t.Fatalf("expected the plugin to be updated in version %s, got %+v", gvr.Version, persisted)
+	}
+}
+
+func TestCheckPluginResource(t *testing.T) {
+	client := kubefake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: v1alpha1.GroupVersion.String(),
+			APIResources: []metav1.APIResource{{Name: "plugins", Kind: "Plugin"}},
+		},
+	}
+	if err := CheckPluginResource(client.Discovery(), DefaultPluginResource); err != nil {
+		t.Fatalf("unexpected check error %v", err)
+	}
+	err := CheckPluginResource(client.Discovery(), schema.GroupVersionResource{Group: "config.openshift.io", Version: "v1", Resource: "plugins"})
+	if err == nil || !strings.Contains(err.Error(), "plugin API version config.openshift.io/v1 is not served") {
+		t.Fatalf("expected unserved version error, got %v", err)
+	}
+	err = CheckPluginResource(client.Discovery(), v1alpha1.GroupVersion.WithResource("tools"))
+	if err == nil || !strings.Contains(err.Error(), "does not serve the tools resource") {
+		t.Fatalf("expected missing resource error, got %v", err)
+	}
+}
+
+func TestSyncResolvedImage(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	plugin := newTestPlugin("oc", "linux/amd64", "darwin/arm64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	// the second platform can not be pulled, its image is not resolved
+	plugin.Spec.Platforms[1].Image = "127.0.0.1:1/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	c := &Controller{
+		repo:          repo,
+		client:        kubefake.NewSimpleClientset(),
+		dynamicClient: dynamicClient,
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout: time.Minute,
+		},
+	}
+	c.sync(context.Background(), fakeSyncContext{key: "oc"})
+
+	platforms := getTestPlugin(t, dynamicClient, "oc").Status.Platforms
+	if len(platforms) != 2 {
+		t.Fatalf("unexpected platform status %+v", platforms)
+	}
+	digest := platforms[0].ImageDigests[plugin.Spec.Platforms[0].Image]
+	if !strings.HasPrefix(digest, "sha256:") {
+		t.Fatalf("expected image digest to be recorded, got %q", digest)
+	}
+	expected := registry + "/openshift/origin-cli@" + digest
+	if platforms[0].ResolvedImage != expected {
+		t.Fatalf("expected resolved image %s, got %q", expected, platforms[0].ResolvedImage)
+	}
+	if len(platforms[1].ResolvedImage) > 0 {
+		t.Fatalf("expected no resolved image for a failed platform, got %q", platforms[1].ResolvedImage)
+	}
+}
+
+func TestExpandImage(t *testing.T) {
+	variables := map[string]string{"REGISTRY": "quay.io", "TAG": "4.15", "NESTED": "${REGISTRY}"}
+	for _, tc := range []struct {
+		ref      string
+		expected string
+		err      string
+	}{
+		{ref: "quay.io/openshift/origin-cli:latest", expected: "quay.io/openshift/origin-cli:latest"},
+		{ref: "${REGISTRY}/openshift/origin-cli:${TAG}", expected: "quay.io/openshift/origin-cli:4.15"},
+		{ref: "$${REGISTRY}/oc", expected: "${REGISTRY}/oc"},
+		// the values are not expanded again
+		{ref: "${NESTED}/oc", expected: "${REGISTRY}/oc"},
+		{ref: "${MIRROR}/oc", err: "undefined variable MIRROR"},
+		{ref: "$REGISTRY/oc", err: "invalid $"},
+		{ref: "${REGISTRY/oc", err: "invalid $"},
+		{ref: "quay.io/oc$", err: "invalid $"},
+	} {
+		expanded, err := expandImage(tc.ref, variables)
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error %q for %s, got %v", tc.err, tc.ref, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected expand error %v for %s", err, tc.ref)
+		}
+		if expanded != tc.expected {
+			t.Fatalf("expected %s to be expanded to %s, got %s", tc.ref, tc.expected, expanded)
+		}
+	}
+}
+
+func TestSyncImageVariables(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	oc := newTestPlugin("oc", "linux/amd64")
+	oc.Spec.Platforms[0].Image = "${REGISTRY}/openshift/origin-cli:latest"
+	kubectl := newTestPlugin("kubectl", "linux/amd64")
+	kubectl.Spec.Platforms[0].Image = "${MIRROR}/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, oc, kubectl)
+	c := &Controller{
+		repo: repo,
+		client: kubefake.NewSimpleClientset(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "image-variables", Namespace: "openshift-cli-manager-operator"},
+			Data:       map[string]string{"REGISTRY": registry},
+		}),
+		dynamicClient: dynamicClient,
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout:        time.Minute,
+			SecretNamespace:         "openshift-cli-manager-operator",
+			ImageVariablesConfigMap: "image-variables",
+		},
+	}
+
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if _, err := repo.Manifest("oc"); err != nil {
+		t.Fatalf("expected plugin with an expanded image to be published, got %v", err)
+	}
+	status := getTestPlugin(t, dynamicClient, "oc").Status
+	if len(status.Platforms) != 1 {
+		t.Fatalf("unexpected platform status %+v", status.Platforms)
+	}
+	expanded := registry + "/openshift/origin-cli:latest"
+	if _, ok := status.Platforms[0].ImageDigests[expanded]; !ok {
+		t.Fatalf("expected the digest of the expanded image %s to be recorded, got %v", expanded, status.Platforms[0].ImageDigests)
+	}
+
+	if err := c.sync(context.Background(), fakeSyncContext{key: "kubectl"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if _, err := repo.Manifest("kubectl"); err == nil {
+		t.Fatalf("expected plugin with an undefined variable not to be published")
+	}
+	conditions := getTestPlugin(t, dynamicClient, "kubectl").Status.Conditions
+	if len(conditions) != 2 || conditions[0].Reason != "InvalidImageVariable" || !strings.Contains(conditions[0].Message, "undefined variable MIRROR") {
+		t.Fatalf("unexpected conditions %+v", conditions)
+	}
+}
+
+func TestExpectInitialSync(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range []string{"oc", "kubectl"} {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(newTestPlugin(name, "linux/amd64"))
+		if err != nil {
+			t.Fatalf("unexpected conversion error %v", err)
+		}
+		if err := indexer.Add(&unstructured.Unstructured{Object: u}); err != nil {
+			t.Fatalf("unexpected indexer error %v", err)
+		}
+	}
+	// the plugins are deleted meanwhile, which still reconciles them
+	c := &Controller{
+		repo:          repo,
+		dynamicClient: newTestDynamicClient(t),
+		lister:        cache.NewGenericLister(indexer, pluginsGVR.GroupResource()),
+	}
+	if err := c.ExpectInitialSync(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if repo.Ready() {
+		t.Fatalf("expected the index not to be ready before the first reconcile")
+	}
+
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if repo.Ready() {
+		t.Fatalf("expected the index not to be ready until every plugin is reconciled")
+	}
+	if err := c.sync(context.Background(), fakeSyncContext{key: "kubectl"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+	if !repo.Ready() {
+		t.Fatalf("expected the index to be ready once every plugin is reconciled")
+	}
+}
+
+func TestExpectInitialSyncNoPlugins(t *testing.T) {
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	c := &Controller{
+		repo:   repo,
+		lister: cache.NewGenericLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}), pluginsGVR.GroupResource()),
+	}
+	if err := c.ExpectInitialSync(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !repo.Ready() {
+		t.Fatalf("expected the index to be ready without plugins")
+	}
+}
+
+func TestUpsertPluginReady(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary", "usr/bin/partial": "partial binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	oc := newTestPlugin("oc", "linux/amd64", "linux/arm64")
+	oc.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	oc.Spec.Platforms[1].Image = registry + "/openshift/origin-cli:latest"
+	partial := newTestPlugin("partial", "linux/amd64", "darwin/amd64")
+	partial.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	partial.Spec.Platforms[1].Image = "127.0.0.1:1/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, oc, partial)
+	for _, plugin := range []*v1alpha1.Plugin{oc, partial} {
+		UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+			ImagePullTimeout: time.Minute,
+		})
+	}
+
+	ready := meta.FindStatusCondition(getTestPlugin(t, dynamicClient, "oc").Status.Conditions, "Ready")
+	if ready == nil || ready.Status != metav1.ConditionTrue || ready.Reason != "Published" {
+		t.Fatalf("expected Ready condition once every platform is published, got %+v", ready)
+	}
+
+	// the Ready condition points at the failing condition
+	ready = meta.FindStatusCondition(getTestPlugin(t, dynamicClient, "partial").Status.Conditions, "Ready")
+	if ready == nil || ready.Status != metav1.ConditionFalse || ready.Reason != "PartiallyInstalled" || !strings.HasPrefix(ready.Message, "condition PluginInstalled is True with reason PartiallyInstalled") {
+		t.Fatalf("expected not Ready condition of a partially installed plugin, got %+v", ready)
+	}
+}
+
+func TestUpsertPluginTransientFailure(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	route := &fakeRouteV1{host: "cli-manager.apps.example.com"}
+	options := Options{ImagePullTimeout: time.Minute}
+	if err := UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, route, options); err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+
+	// the API server is unavailable while the plugin is published again
+	route.err = apierrors.NewServiceUnavailable("etcd is unavailable")
+	if err := UpsertPlugin(context.Background(), getTestPlugin(t, dynamicClient, "oc"), repo, kubefake.NewSimpleClientset(), dynamicClient, route, options); err == nil {
+		t.Fatal("expected the transient failure to be returned to be retried")
+	}
+	if !isPublished(plugin, repo, options) {
+		t.Fatal("expected the published plugin and its archives to be kept on a transient failure")
+	}
+}
+
+func TestUpsertPluginImageUnavailable(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registryURL, err := url.Parse("http://" + newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"}))
+	if err != nil {
+		t.Fatalf("unexpected parse error %v", err)
+	}
+	// the registry is pulled through a proxy which becomes unreachable
+	proxy := httptest.NewServer(httputil.NewSingleHostReverseProxy(registryURL))
+	defer proxy.Close()
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = strings.TrimPrefix(proxy.URL, "http://") + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	route := &fakeRouteV1{host: "cli-manager.apps.example.com"}
+	options := Options{ImagePullTimeout: time.Minute}
+	if err := UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, route, options); err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+	published, err := repo.Manifest("oc")
+	if err != nil {
+		t.Fatalf("expected the plugin to be published, got error %v", err)
+	}
+
+	// the plugin is extracted again, i.e. after its refresh annotation changed
+	proxy.Close()
+	if err := UpsertPlugin(context.Background(), getTestPlugin(t, dynamicClient, "oc"), repo, kubefake.NewSimpleClientset(), dynamicClient, route, options); err == nil {
+		t.Fatal("expected the image pull failure to be retried")
+	}
+	manifest, err := repo.Manifest("oc")
+	if err != nil {
+		t.Fatalf("expected the plugin to stay in the index, got error %v", err)
+	}
+	if !bytes.Equal(manifest, published) {
+		t.Fatalf("expected the last published manifest to be kept, got %s", manifest)
+	}
+	if !isPublished(plugin, repo, options) {
+		t.Fatal("expected the archives of the plugin to be kept")
+	}
+	installed := meta.FindStatusCondition(getTestPlugin(t, dynamicClient, "oc").Status.Conditions, "PluginInstalled")
+	if installed == nil || installed.Reason != "ImagePullError" {
+		t.Fatalf("expected the image pull failure to be reported, got %+v", installed)
+	}
+}
+
+func TestUpsertPluginPartiallyInstalled(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64", "linux/arm64", "darwin/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	plugin.Spec.Platforms[1].Image = registry + "/openshift/origin-cli:latest"
+	plugin.Spec.Platforms[2].Image = "127.0.0.1:1/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	err = UpsertPlugin(context.Background(), plugin.DeepCopy(), repo, kubefake.NewSimpleClientset(), dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+	})
+	if err == nil {
+		t.Fatalf("expected the unpullable platform to be retried")
+	}
+
+	manifest, err := repo.Manifest("oc")
+	if err != nil {
+		t.Fatalf("expected the plugin to be published, got error %v", err)
+	}
+	k := &krew.Plugin{}
+	if err := yaml.Unmarshal(manifest, k); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	served := []string{}
+	for _, p := range k.Spec.Platforms {
+		served = append(served, p.Selector.MatchLabels["os"]+"/"+p.Selector.MatchLabels["arch"])
+	}
+	if !slices.Equal(served, []string{"linux/amd64", "linux/arm64"}) {
+		t.Fatalf("expected the pullable platforms to be served, got %v", served)
+	}
+	for _, archive := range []string{"oc_linux_amd64.tar.gz", "oc_linux_arm64.tar.gz"} {
+		if _, err := os.Stat(filepath.Join(image.TarballPath, archive)); err != nil {
+			t.Fatalf("expected archive %s to be served, got error %v", archive, err)
+		}
+	}
+
+	status := getTestPlugin(t, dynamicClient, "oc").Status
+	if len(status.Conditions) != 2 || status.Conditions[0].Reason != "PartiallyInstalled" || status.Conditions[0].Status != metav1.ConditionTrue {
+		t.Fatalf("expected PartiallyInstalled condition, got %+v", status.Conditions)
+	}
+	if len(status.Platforms) != 3 {
+		t.Fatalf("expected the status of the 3 platforms, got %+v", status.Platforms)
+	}
+	for _, p := range status.Platforms {
+		installed := meta.IsStatusConditionTrue(p.Conditions, "PlatformInstalled")
+		if installed != (p.Platform != "darwin/amd64") {
+			t.Fatalf("unexpected conditions of platform %s %+v", p.Platform, p.Conditions)
+		}
+	}
+}
+
+func TestRunWorkers(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repoPath := filepath.Join(t.TempDir(), "cli-manager")
+	repo, err := git.PrepareLocalGit(repoPath, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugins := []*v1alpha1.Plugin{}
+	for i := 0; i < 12; i++ {
+		plugin := newTestPlugin(fmt.Sprintf("plugin-%d", i), "linux/amd64", "darwin/arm64")
+		for j := range plugin.Spec.Platforms {
+			plugin.Spec.Platforms[j].Image = registry + "/openshift/origin-cli:latest"
+			plugin.Spec.Platforms[j].Bin = "oc"
+			plugin.Spec.Platforms[j].Files = []v1alpha1.FileLocation{{From: "/usr/bin/oc", To: "."}}
+		}
+		plugins = append(plugins, plugin)
+	}
+	dynamicClient := newTestDynamicClient(t, plugins...)
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	client := kubefake.NewSimpleClientset()
+	kubeInformers := kubeinformers.NewSharedInformerFactory(client, 0)
+	c, err := NewCLISyncController(repo, informers, kubeInformers, client, dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+	}, events.NewInMemoryRecorder("cli-manager"))
+	if err != nil {
+		t.Fatalf("unexpected controller error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
+	informers.WaitForCacheSync(ctx.Done())
+	kubeInformers.WaitForCacheSync(ctx.Done())
+	if err := c.ExpectInitialSync(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, 4)
+	}()
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return repo.Ready(), nil
+	})
+	cancel()
+	<-done
+	if err != nil {
+		t.Fatalf("plugins are not reconciled: %v", err)
+	}
+
+	names, err := repo.List()
+	if err != nil {
+		t.Fatalf("unexpected list error %v", err)
+	}
+	if len(names) != len(plugins) {
+		t.Fatalf("expected %d plugins to be published, got %v", len(plugins), names)
+	}
+	r, err := gogit.PlainOpen(repoPath)
+	if err != nil {
+		t.Fatalf("unexpected open error %v", err)
+	}
+	worktree, err := r.Worktree()
+	if err != nil {
+		t.Fatalf("unexpected worktree error %v", err)
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		t.Fatalf("unexpected status error %v", err)
+	}
+	if !status.IsClean() {
+		t.Fatalf("expected every plugin to be committed, got %s", status)
+	}
+	for _, plugin := range plugins {
+		if !isPublished(plugin, repo, Options{}) {
+			t.Fatalf("expected plugin %s to be published along with its archives", plugin.Name)
+		}
+	}
+}
+
+func TestRunSecretCreated(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	plugin.Spec.Platforms[0].ImagePullSecret = "other/pull-secret"
+	other := newTestPlugin("kubectl", "linux/amd64")
+	other.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	other.Spec.Platforms[0].ImagePullSecret = "pull-secret"
+	dynamicClient := newTestDynamicClient(t, plugin, other)
+	client := kubefake.NewSimpleClientset()
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	kubeInformers := kubeinformers.NewSharedInformerFactory(client, 0)
+	c, err := NewCLISyncController(repo, informers, kubeInformers, client, dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+		SecretNamespace:  "openshift-cli-manager-operator",
+	}, events.NewInMemoryRecorder("cli-manager"))
+	if err != nil {
+		t.Fatalf("unexpected controller error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
+	informers.WaitForCacheSync(ctx.Done())
+	kubeInformers.WaitForCacheSync(ctx.Done())
+	if err := c.ExpectInitialSync(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	reason := func(name string) string {
+		installed := meta.FindStatusCondition(getTestPlugin(t, dynamicClient, name).Status.Conditions, "PluginInstalled")
+		if installed == nil {
+			return ""
+		}
+		return installed.Reason
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return repo.Ready(), nil
+	})
+	if err != nil {
+		t.Fatalf("plugins are not reconciled: %v", err)
+	}
+	if reason("oc") != "InvalidField" || reason("kubectl") != "InvalidField" {
+		t.Fatalf("expected the plugins to fail on the missing secrets, got %s and %s", reason("oc"), reason("kubectl"))
+	}
+
+	// the secret is created without any event of the Plugins
+	_, err = client.CoreV1().Secrets("other").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "other",
+			Name:      "pull-secret",
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + registry + `":{"auth":"dXNlcjpwYXNz"}}}`),
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected create error %v", err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return reason("oc") == "Installed", nil
+	})
+	if err != nil {
+		t.Fatalf("expected the plugin referencing the secret to be reconciled, got %s: %v", reason("oc"), err)
+	}
+	if _, err := repo.Manifest("oc"); err != nil {
+		t.Fatalf("expected the plugin to be published, got error %v", err)
+	}
+	// the secret of the same name in another namespace is not the one of kubectl
+	if reason("kubectl") != "InvalidField" {
+		t.Fatalf("expected the plugin referencing another secret not to be reconciled, got %s", reason("kubectl"))
+	}
+}
+
+func TestRunResync(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	client := kubefake.NewSimpleClientset()
+	kubeInformers := kubeinformers.NewSharedInformerFactory(client, 0)
+	c, err := NewCLISyncController(repo, informers, kubeInformers, client, dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, Options{
+		ImagePullTimeout: time.Minute,
+	}, events.NewInMemoryRecorder("cli-manager"))
+	if err != nil {
+		t.Fatalf("unexpected controller error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
+	informers.WaitForCacheSync(ctx.Done())
+	kubeInformers.WaitForCacheSync(ctx.Done())
+	if err := c.ExpectInitialSync(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return repo.Ready(), nil
+	})
+	if err != nil {
+		t.Fatalf("plugins are not reconciled: %v", err)
+	}
+
+	// the plugin is deleted out-of-band, without any event of the Plugin
+	if err := repo.Delete("oc"); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	go c.RunResync(ctx, 10*time.Millisecond)
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return isPublished(plugin, repo, Options{}), nil
+	})
+	if err != nil {
+		t.Fatalf("expected the resync to publish the plugin again: %v", err)
+	}
+}
+
+func TestRunRouteHostChanged(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	client := kubefake.NewSimpleClientset()
+	kubeInformers := kubeinformers.NewSharedInformerFactory(client, 0)
+	route := &fakeRouteV1{host: "cli-manager.apps.example.com"}
+	c, err := NewCLISyncController(repo, informers, kubeInformers, client, dynamicClient, route, Options{
+		ImagePullTimeout: time.Minute,
+	}, events.NewInMemoryRecorder("cli-manager"))
+	if err != nil {
+		t.Fatalf("unexpected controller error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
+	informers.WaitForCacheSync(ctx.Done())
+	kubeInformers.WaitForCacheSync(ctx.Done())
+	if err := c.ExpectInitialSync(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	publishedHost := func() string {
+		manifest, err := repo.Manifest("oc")
+		if err != nil {
+			return ""
+		}
+		k := &krew.Plugin{}
+		if err := yaml.Unmarshal(manifest, k); err != nil || len(k.Spec.Platforms) == 0 {
+			return ""
+		}
+		u, err := url.Parse(k.Spec.Platforms[0].URI)
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		route.mu.Lock()
+		defer route.mu.Unlock()
+		return publishedHost() == "cli-manager.apps.example.com" && route.watcher != nil, nil
+	})
+	if err != nil {
+		t.Fatalf("plugin is not published: %v", err)
+	}
+
+	// the cluster domain is migrated
+	route.setHost("cli-manager.apps.migrated.example.com")
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return publishedHost() == "cli-manager.apps.migrated.example.com", nil
+	})
+	if err != nil {
+		t.Fatalf("expected the plugin to be published with the new host, got %s: %v", publishedHost(), err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	registry := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	repoPath := filepath.Join(t.TempDir(), "cli-manager")
+	repo, err := git.PrepareLocalGit(repoPath, git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	commits := func() int {
+		r, err := gogit.PlainOpen(repoPath)
+		if err != nil {
+			t.Fatalf("unexpected open error %v", err)
+		}
+		iter, err := r.Log(&gogit.LogOptions{})
+		if err != nil {
+			t.Fatalf("unexpected log error %v", err)
+		}
+		count := 0
+		iter.ForEach(func(*object.Commit) error {
+			count++
+			return nil
+		})
+		return count
+	}
+	initialCommits := commits()
+
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	informers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	client := kubefake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "openshift-cli-manager-operator",
+			Name:      "read-only",
+		},
+		Data: map[string]string{ReadOnlyKey: "true"},
+	})
+	kubeInformers := kubeinformers.NewSharedInformerFactory(client, 0)
+	options := Options{
+		ImagePullTimeout:  time.Minute,
+		SecretNamespace:   "openshift-cli-manager-operator",
+		ReadOnlyConfigMap: "read-only",
+	}
+	c, err := NewCLISyncController(repo, informers, kubeInformers, client, dynamicClient, &fakeRouteV1{host: "cli-manager.apps.example.com"}, options, events.NewInMemoryRecorder("cli-manager"))
+	if err != nil {
+		t.Fatalf("unexpected controller error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	readOnly, err := InitialReadOnly(ctx, client, options)
+	if err != nil || !readOnly {
+		t.Fatalf("expected the index to be read-only on start, got %v error %v", readOnly, err)
+	}
+	informers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
+	informers.WaitForCacheSync(ctx.Done())
+	kubeInformers.WaitForCacheSync(ctx.Done())
+	if err := c.ExpectInitialSync(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	setReadOnly := func(value string) {
+		t.Helper()
+		_, err := client.CoreV1().ConfigMaps(options.SecretNamespace).Update(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: options.SecretNamespace,
+				Name:      options.ReadOnlyConfigMap,
+			},
+			Data: map[string]string{ReadOnlyKey: value},
+		}, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatalf("unexpected update error %v", err)
+		}
+	}
+
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return c.readOnly.Load() && repo.Ready(), nil
+	})
+	// the frozen index is still served
+	if err != nil {
+		t.Fatalf("expected the read-only index to be ready: %v", err)
+	}
+	if err := c.resync(ctx); err != nil {
+		t.Fatalf("unexpected resync error %v", err)
+	}
+	if err := c.sweep(ctx); err != nil {
+		t.Fatalf("unexpected sweep error %v", err)
+	}
+	if got := commits(); got != initialCommits {
+		t.Fatalf("expected no commit while the index is read-only, got %d commits instead of %d", got, initialCommits)
+	}
+	if isPublished(plugin, repo, Options{}) {
+		t.Fatal("expected the plugin not to be published while the index is read-only")
+	}
+
+	setReadOnly("false")
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return isPublished(plugin, repo, Options{}) && repo.Ready(), nil
+	})
+	if err != nil {
+		t.Fatalf("expected the plugin to be published once the index is writable: %v", err)
+	}
+
+	// an invalid value leaves the index writable
+	setReadOnly("maybe")
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		obj, exists, err := c.readOnlyConfigMaps.GetStore().GetByKey(options.SecretNamespace + "/" + options.ReadOnlyConfigMap)
+		return err == nil && exists && obj.(*corev1.ConfigMap).Data[ReadOnlyKey] == "maybe", nil
+	})
+	if err != nil {
+		t.Fatalf("expected the invalid value to be observed: %v", err)
+	}
+	c.syncReadOnly(ctx)
+	if c.readOnly.Load() {
+		t.Fatal("expected the invalid value to leave the index writable")
+	}
+	setReadOnly("true")
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		return c.readOnly.Load(), nil
+	})
+	if err != nil {
+		t.Fatalf("expected the index to be read-only again: %v", err)
+	}
+	if err := dynamicClient.Resource(pluginsGVR).Delete(ctx, plugin.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	if err := c.resync(ctx); err != nil {
+		t.Fatalf("unexpected resync error %v", err)
+	}
+	if _, err := repo.Manifest("oc"); err != nil {
+		t.Fatalf("expected the deleted plugin to be served while the index is read-only, got error %v", err)
+	}
+
+	// the index falls back to Options.ReadOnly once the ConfigMap is deleted
+	if err := client.CoreV1().ConfigMaps(options.SecretNamespace).Delete(ctx, options.ReadOnlyConfigMap, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, time.Minute, true, func(context.Context) (bool, error) {
+		names, err := repo.List()
+		return err == nil && len(names) == 0, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the deleted plugin to be removed once the index is writable: %v", err)
+	}
+}
+
+func TestReadOnlyOf(t *testing.T) {
+	configMap := func(data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "openshift-cli-manager-operator", Name: "read-only"},
+			Data:       data,
+		}
+	}
+	tests := []struct {
+		name        string
+		cm          *corev1.ConfigMap
+		readOnly    bool
+		expected    bool
+		expectedErr bool
+	}{
+		{name: "missing ConfigMap", readOnly: true, expected: true},
+		{name: "missing key", cm: configMap(nil), readOnly: true, expected: true},
+		{name: "read-only", cm: configMap(map[string]string{ReadOnlyKey: "true"}), expected: true},
+		{name: "writable", cm: configMap(map[string]string{ReadOnlyKey: "false"}), readOnly: true},
+		{name: "invalid value", cm: configMap(map[string]string{ReadOnlyKey: "maybe"}), expectedErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			readOnly, err := readOnlyOf(tc.cm, Options{ReadOnly: tc.readOnly})
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if readOnly != tc.expected {
+				t.Fatalf("expected read-only %v, got %v", tc.expected, readOnly)
+			}
+		})
+	}
+}
+
+func TestSyncRefresh(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	target := newTestRegistry(t, map[string]string{"usr/bin/oc": "oc binary"})
+	var blobs int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			blobs++
+		}
+		http.Redirect(w, r, "http://"+target+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	repo, err := git.PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), git.Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	plugin := newTestPlugin("oc", "linux/amd64")
+	plugin.Spec.Platforms[0].Image = registry + "/openshift/origin-cli:latest"
+	dynamicClient := newTestDynamicClient(t, plugin)
+	c := &Controller{
+		repo:          repo,
+		client:        kubefake.NewSimpleClientset(),
+		dynamicClient: dynamicClient,
+		route:         &fakeRouteV1{host: "cli-manager.apps.example.com"},
+		options: Options{
+			ImagePullTimeout: time.Minute,
+		},
+	}
+	if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+		t.Fatalf("unexpected sync error %v", err)
+	}
+
+	for _, refresh := range []string{"2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z"} {
+		refreshed := getTestPlugin(t, dynamicClient, "oc")
+		refreshed.Annotations = map[string]string{refreshAnnotation: refresh}
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(refreshed)
+		if err != nil {
+			t.Fatalf("unexpected conversion error %v", err)
+		}
+		if _, err := dynamicClient.Resource(pluginsGVR).Update(context.Background(), &unstructured.Unstructured{Object: u}, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("unexpected update error %v", err)
+		}
+
+		// the spec and the image are unchanged, the refresh pulls it anyway
+		blobs = 0
+		if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+			t.Fatalf("unexpected sync error %v", err)
+		}
+		if blobs == 0 {
+			t.Fatalf("expected the image to be pulled again on refresh %s", refresh)
+		}
+
+		// the refresh is only done once per value
+		blobs = 0
+		if err := c.sync(context.Background(), fakeSyncContext{key: "oc"}); err != nil {
+			t.Fatalf("unexpected sync error %v", err)
+		}
+		if blobs != 0 {
+			t.Fatalf("expected no pull for an unchanged refresh %s, got %d blob requests", refresh, blobs)
+		}
+	}
+}
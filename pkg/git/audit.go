@@ -0,0 +1,112 @@
+package git
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// AuditLog receives a JSON line per plugin download if it is set, recording
+// who downloaded which plugin. Downloads are not audited by default.
+var AuditLog io.Writer
+
+// auditMu serializes the records written to AuditLog.
+var auditMu sync.Mutex
+
+// DownloadAuditRecord is the audit record of a plugin download.
+type DownloadAuditRecord struct {
+	Time time.Time `json:"time"`
+	// User is the user authenticated by the API server, only known for the
+	// downloads through the aggregated API.
+	User string `json:"user,omitempty"`
+	// RemoteAddr is the address of the client, as forwarded by the router
+	// if the download went through the Route from a trusted proxy.
+	RemoteAddr string `json:"remoteAddr"`
+	Name       string `json:"name"`
+	Platform   string `json:"platform"`
+	Code       int    `json:"code"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// auditDownload writes the audit record of the download to AuditLog, if set.
+func auditDownload(r *http.Request, name, platform string, code int, bytes int64) {
+	if AuditLog == nil {
+		return
+	}
+	record := DownloadAuditRecord{
+		Time:       time.Now().UTC(),
+		RemoteAddr: remoteAddr(r),
+		Name:       name,
+		Platform:   platform,
+		Code:       code,
+		Bytes:      bytes,
+	}
+	// the API server authenticates the requests of the aggregated API
+	// and forwards the user in the X-Remote-User header.
+	if strings.HasPrefix(r.URL.Path, AggregatedPrefix+"/") {
+		record.User = r.Header.Get("X-Remote-User")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		klog.Errorf("encoding audit record of plugin %s download: %v", name, err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := AuditLog.Write(append(data, '\n')); err != nil {
+		klog.Errorf("writing audit record of plugin %s download: %v", name, err)
+	}
+}
+
+// TrustedProxies are the networks of the proxies whose X-Forwarded-For
+// header is trusted, i.e. the routers in front of the Route. The header is
+// ignored for the connections from any other address, so that the clients
+// can not pick their own address. Empty trusts no proxy.
+var TrustedProxies []*net.IPNet
+
+// remoteAddr returns the address of the client of the request. It is the
+// remote address of the connection, unless it is a trusted proxy: then it
+// is the last X-Forwarded-For address not appended by a trusted proxy, as
+// the addresses ahead of it are sent by the client and can not be trusted.
+func remoteAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr = host
+	}
+	if !trustedProxy(addr) {
+		return addr
+	}
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if client := strings.TrimSpace(forwarded[i]); len(client) > 0 {
+			addr = client
+			if !trustedProxy(addr) {
+				break
+			}
+		}
+	}
+	return addr
+}
+
+// trustedProxy returns whether addr is in TrustedProxies.
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,16 +2,22 @@ package git
 
 import (
 	"bytes"
-	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -20,6 +26,9 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/component-base/metrics"
 	"k8s.io/component-base/metrics/legacyregistry"
 	"k8s.io/klog/v2"
@@ -27,6 +36,7 @@ import (
 
 	"github.com/openshift/cli-manager/pkg/image"
 	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+	"github.com/openshift/cli-manager/pkg/platform"
 )
 
 const GitRepoPath = "/var/run/git/cli-manager"
@@ -41,21 +51,179 @@ var (
 		},
 		[]string{"name"},
 	)
+	// plugin download metrics are only incremented once a tarball is served,
+	// so that their labels are bounded by the plugins and platforms published.
+	pluginDownloadCounts = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           "cli_manager_plugin_download_total",
+			Help:           "Total counts of plugin downloads",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"name", "platform"},
+	)
+	pluginDownloadBytes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           "cli_manager_plugin_download_bytes_total",
+			Help:           "Total bytes of plugin downloads",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"name", "platform"},
+	)
 )
 
 func init() {
 	registerControllerMetrics.Do(func() {
 		legacyregistry.MustRegister(gitAPIRequestCounts)
+		legacyregistry.MustRegister(pluginDownloadCounts)
+		legacyregistry.MustRegister(pluginDownloadBytes)
+		legacyregistry.MustRegister(archiveMismatches)
 	})
 }
 
+// countingResponseWriter records the status code and the number of bytes
+// of the body written to the response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (c *countingResponseWriter) WriteHeader(code int) {
+	c.code = code
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	if c.code == 0 {
+		c.code = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// Author is the identity the commits of the git index are authored with.
+type Author struct {
+	Name  string
+	Email string
+}
+
+// DefaultAuthor is the commit author used when none is configured.
+var DefaultAuthor = Author{
+	Name:  "OpenShift CLI Manager",
+	Email: "info@redhat.com",
+}
+
 type Repo struct {
-	repo *git.Repository
+	// mu guards the worktree against concurrent commits and reads
+	mu     sync.RWMutex
+	repo   *git.Repository
+	path   string
+	author Author
+	// names are the sorted names of the plugins committed in the worktree,
+	// so that they are looked up by prefix without reading it. Guarded by mu.
+	names []string
+
+	// errorsMu guards lastErrors, which is not part of the worktree
+	errorsMu   sync.Mutex
+	lastErrors map[string]ReconcileError
+
+	// ready reports whether the Plugins existing at start are reconciled,
+	// so that the index is not cloned before they are published.
+	ready atomic.Bool
+
+	// verifyMu serializes the verifications of the archives, lastVerify is
+	// the report of the last one.
+	verifyMu   sync.Mutex
+	lastVerify atomic.Pointer[VerifyReport]
+}
+
+// SetReady marks the index as ready to be cloned.
+func (r *Repo) SetReady() {
+	r.ready.Store(true)
+}
+
+// Ready reports whether the index is ready to be cloned.
+func (r *Repo) Ready() bool {
+	return r.ready.Load()
+}
+
+// ReconcileError is the error the last reconcile of a plugin failed with.
+type ReconcileError struct {
+	Message string      `json:"message"`
+	Time    metav1.Time `json:"time"`
+}
+
+// RecordError records the result of the last reconcile of the plugin,
+// a nil err clears the error previously recorded.
+func (r *Repo) RecordError(name string, err error) {
+	r.errorsMu.Lock()
+	defer r.errorsMu.Unlock()
+	if err == nil {
+		delete(r.lastErrors, name)
+		return
+	}
+	if r.lastErrors == nil {
+		r.lastErrors = map[string]ReconcileError{}
+	}
+	r.lastErrors[name] = ReconcileError{
+		Message: err.Error(),
+		Time:    metav1.Now(),
+	}
+}
+
+// LastError returns the error the last reconcile of the plugin failed with,
+// or nil if it succeeded.
+func (r *Repo) LastError(name string) *ReconcileError {
+	r.errorsMu.Lock()
+	defer r.errorsMu.Unlock()
+	lastError, ok := r.lastErrors[name]
+	if !ok {
+		return nil
+	}
+	return &lastError
+}
+
+// IndexMetadataFile is the file at the root of the index describing it,
+// for the Krew index tooling expecting more than the plugin manifests.
+const IndexMetadataFile = "index.yaml"
+
+// IndexMetadata is the content of IndexMetadataFile.
+type IndexMetadata struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Name is the name of the index, which is the one
+	// suggested to add it to Krew with.
+	Name string `json:"name"`
+	// PluginAPIVersion is the schema version of the plugin manifests.
+	PluginAPIVersion string `json:"pluginAPIVersion"`
+}
+
+// DefaultIndexMetadata is the metadata of the index seeded by PrepareLocalGit.
+var DefaultIndexMetadata = IndexMetadata{
+	APIVersion:       "cli-manager.openshift.io/v1alpha1",
+	Kind:             "Index",
+	Name:             "cli-manager",
+	PluginAPIVersion: "krew.googlecontainertools.github.com/v1alpha2",
+}
+
+// safePluginRegexp matches the plugin names which are safe to use in file names.
+var safePluginRegexp = regexp.MustCompile(`^[\w-]+$`)
+
+// signature returns the commit signature of the configured author.
+func (r *Repo) signature() *object.Signature {
+	return &object.Signature{
+		Name:  r.author.Name,
+		Email: r.author.Email,
+		When:  time.Now(),
+	}
 }
 
 // Delete deletes the plugin yaml from the git repository
 // and commits.
 func (r *Repo) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	fileName := fmt.Sprintf("plugins/%s.yaml", name)
 	tree, err := r.repo.Worktree()
 	if err != nil {
@@ -74,31 +242,45 @@ func (r *Repo) Delete(name string) error {
 	if err != nil {
 		return err
 	}
+	if _, err := tree.Filesystem.Stat(signatureFileName(name)); err == nil {
+		tree.Filesystem.Remove(signatureFileName(name))
+		if _, err := tree.Add(signatureFileName(name)); err != nil {
+			return err
+		}
+	}
 	_, err = tree.Commit(fmt.Sprintf("remove plugin %s", name), &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "OpenShift CLI Manager",
-			Email: "info@redhat.com",
-			When:  time.Now(),
-		}})
+		Author: r.signature(),
+	})
 	if err != nil {
 		return err
 	}
 
+	if i, found := slices.BinarySearch(r.names, name); found {
+		r.names = slices.Delete(r.names, i, i+1)
+	}
 	return nil
 }
 
 // Upsert adds new plugin yaml if currently it doesn't exist,
-// updates if it does and commits this to git repository.
+// updates if it does and commits this to git repository in a
+// single commit. Nothing is committed if the yaml is unchanged.
 func (r *Repo) Upsert(name string, plugin *krew.Plugin) error {
 	if plugin == nil {
 		return nil
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	fileName := fmt.Sprintf("plugins/%s.yaml", name)
 	tree, err := r.repo.Worktree()
 	if err != nil {
 		return err
 	}
 
+	message := fmt.Sprintf("add plugin %s", name)
+	if _, err := tree.Filesystem.Stat(fileName); err == nil {
+		message = fmt.Sprintf("update plugin %s", name)
+	}
+
 	f, err := tree.Filesystem.Create(fileName)
 	if err != nil {
 		return err
@@ -121,25 +303,135 @@ func (r *Repo) Upsert(name string, plugin *krew.Plugin) error {
 	if err != nil {
 		return err
 	}
+	if err := r.writeSignature(tree, name, k); err != nil {
+		return err
+	}
+	status, err := tree.Status()
+	if err != nil {
+		return err
+	}
+	if status.IsClean() {
+		return nil
+	}
 
-	_, err = tree.Commit(fmt.Sprintf("add plugin %s", name), &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "OpenShift CLI Manager",
-			Email: "info@redhat.com",
-			When:  time.Now(),
-		}})
+	_, err = tree.Commit(message, &git.CommitOptions{
+		Author: r.signature(),
+	})
 	if err != nil {
 		return err
 	}
 
+	if i, found := slices.BinarySearch(r.names, name); !found {
+		r.names = slices.Insert(r.names, i, name)
+	}
 	return nil
 }
 
-// PrepareLocalGit creates a git directory and applies first commit
-// to make it ready consumed by Krew.
-func PrepareLocalGit() (*Repo, error) {
-	os.RemoveAll(GitRepoPath)
-	r, err := git.PlainInit(GitRepoPath, false)
+// writeSignature writes and stages the detached signature of the manifest
+// of the plugin, if the manifests are signed.
+func (r *Repo) writeSignature(tree *git.Worktree, name string, manifest []byte) error {
+	if SigningKey == nil {
+		return nil
+	}
+	f, err := tree.Filesystem.Create(signatureFileName(name))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(SignManifest(SigningKey, manifest)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_, err = tree.Add(signatureFileName(name))
+	return err
+}
+
+// List returns the names of the plugins committed in the git repository.
+func (r *Repo) List() ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.list()
+}
+
+// Complete returns the names of the plugins of the index starting with
+// prefix in sorted order, up to limit names.
+func (r *Repo) Complete(prefix string, limit int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := []string{}
+	i, _ := slices.BinarySearch(r.names, prefix)
+	for ; i < len(r.names) && len(names) < limit; i++ {
+		if !strings.HasPrefix(r.names[i], prefix) {
+			break
+		}
+		names = append(names, r.names[i])
+	}
+	return names
+}
+
+func (r *Repo) list() ([]string, error) {
+	tree, err := r.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := tree.Filesystem.ReadDir("plugins")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".yaml") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+	}
+	return names, nil
+}
+
+// Manifest returns the Krew manifest of the plugin committed in the
+// git repository. An error satisfying os.IsNotExist is returned
+// if the plugin is not in the index.
+func (r *Repo) Manifest(name string) ([]byte, error) {
+	return r.readFile(fmt.Sprintf("plugins/%s.yaml", name))
+}
+
+// readFile returns the content of the file committed in the worktree.
+func (r *Repo) readFile(fileName string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tree, err := r.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := tree.Filesystem.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// PrepareLocalGit creates a git directory at path and applies first commit
+// seeding the IndexMetadataFile to make it ready consumed by Krew. Commits are
+// authored by author, empty fields default to DefaultAuthor.
+func PrepareLocalGit(path string, author Author) (*Repo, error) {
+	if len(author.Name) == 0 {
+		author.Name = DefaultAuthor.Name
+	}
+	if len(author.Email) == 0 {
+		author.Email = DefaultAuthor.Email
+	}
+	repo := &Repo{
+		path:   path,
+		author: author,
+	}
+
+	os.RemoveAll(path)
+	r, err := git.PlainInit(path, false)
 	if err != nil {
 		return nil, err
 	}
@@ -164,17 +456,31 @@ func PrepareLocalGit() (*Repo, error) {
 		return nil, err
 	}
 
+	metadata, err := yaml.Marshal(DefaultIndexMetadata)
+	if err != nil {
+		return nil, err
+	}
+	f, err = tree.Filesystem.Create(IndexMetadataFile)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(metadata)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
 	err = tree.AddGlob(".")
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = tree.Commit("Add README.md", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "OpenShift CLI Manager",
-			Email: "info@redhat.com",
-			When:  time.Now(),
-		}})
+	_, err = tree.Commit(fmt.Sprintf("Add README.md and %s", IndexMetadataFile), &git.CommitOptions{
+		Author: repo.signature(),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -185,58 +491,284 @@ func PrepareLocalGit() (*Repo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Repo{
-		repo: r,
-	}, nil
+	repo.repo = r
+	return repo, nil
+}
+
+// OpenLocalGit opens the git directory at path prepared by PrepareLocalGit,
+// so that commits are added to the existing index. Commits are authored by
+// author, empty fields default to DefaultAuthor.
+func OpenLocalGit(path string, author Author) (*Repo, error) {
+	if len(author.Name) == 0 {
+		author.Name = DefaultAuthor.Name
+	}
+	if len(author.Email) == 0 {
+		author.Email = DefaultAuthor.Email
+	}
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repo{
+		repo:   r,
+		path:   path,
+		author: author,
+	}
+	names, err := repo.list()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	repo.names = names
+	return repo, nil
+}
+
+// Timeouts are the deadlines of reading the request and writing the
+// response of the git server endpoints. Zero means no deadline.
+type Timeouts struct {
+	// Request bounds the small requests, i.e. the git advertisement and the plugin metadata.
+	Request time.Duration
+	// Transfer bounds the requests transferring the index or plugin archives,
+	// which may take long for large clones over slow links.
+	Transfer time.Duration
 }
 
 // PrepareGitServer creates a http server mux to support git compatible
-// endpoints in addition to plugin download mechanism.
-func PrepareGitServer() *http.ServeMux {
+// endpoints in addition to plugin download mechanism. Plugin list and info
+// endpoints are served from the same Plugin resources the controller reconciles,
+// manifest endpoint from the Krew manifests committed in repo.
+func PrepareGitServer(repo *Repo, lister cache.GenericLister, timeouts Timeouts) *http.ServeMux {
 	mux := http.NewServeMux()
+	// the endpoints transferring the index and the plugin archives are the
+	// expensive ones, they are rate limited for each client.
+	limiter := newClientLimiter(ClientRateLimit)
+	mux.HandleFunc("/cli-manager/plugins/manifest/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/manifest/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginManifest(writer, request, repo)
+	})
+	mux.HandleFunc("/cli-manager/plugins/list/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/list/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginList(writer, request, lister)
+	})
+	mux.HandleFunc("/cli-manager/plugins/info/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/info/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginInfo(writer, request, lister)
+	})
+	mux.HandleFunc("/cli-manager/plugins/platforms/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/platforms/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginPlatforms(writer, request, lister)
+	})
+	mux.HandleFunc("/cli-manager/plugins/status/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/status/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginStatus(writer, request, lister)
+	})
+	mux.HandleFunc("/cli-manager/plugins/diagnostics/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/diagnostics/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginDiagnostics(writer, request, repo, lister)
+	})
+	mux.HandleFunc("/cli-manager/plugins/complete/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/complete/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginComplete(writer, request, repo)
+	})
+	mux.HandleFunc("/cli-manager/plugins/signature/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/signature/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginSignature(writer, request, repo)
+	})
+	mux.HandleFunc("/cli-manager/plugins/verify/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/verify/").Inc()
+		// every archive is read again, which is as expensive as transferring them
+		setDeadline(writer, timeouts.Transfer)
+		if !limiter.allow(writer, request) {
+			return
+		}
+		HandlePluginVerify(writer, request, repo)
+	})
+	mux.HandleFunc("/cli-manager/signing-key", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/signing-key").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandleSigningKey(writer, request)
+	})
+	mux.HandleFunc("/cli-manager/version", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues("/cli-manager/version").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandleVersion(writer, request)
+	})
 	mux.HandleFunc("/cli-manager/plugins/download/", func(writer http.ResponseWriter, request *http.Request) {
 		gitAPIRequestCounts.WithLabelValues("/cli-manager/plugins/download/").Inc()
+		setDeadline(writer, timeouts.Transfer)
+		if !limiter.allow(writer, request) {
+			return
+		}
 		HandleDownloadPlugin(writer, request)
 	})
 	mux.HandleFunc("/cli-manager/info/refs", func(writer http.ResponseWriter, request *http.Request) {
 		gitAPIRequestCounts.WithLabelValues("/cli-manager/info/refs").Inc()
-		HandleGitAdversitement(writer, request)
+		setDeadline(writer, timeouts.Request)
+		if !limiter.allow(writer, request) {
+			return
+		}
+		HandleGitAdversitement(writer, request, repo)
 	})
 	mux.HandleFunc("/cli-manager/git-upload-pack", func(writer http.ResponseWriter, request *http.Request) {
 		gitAPIRequestCounts.WithLabelValues("/cli-manager/git-upload-pack").Inc()
-		HandleGitUploadPack(writer, request)
+		setDeadline(writer, timeouts.Transfer)
+		if !limiter.allow(writer, request) {
+			return
+		}
+		HandleGitUploadPack(writer, request, repo)
 	})
+	prepareAggregatedAPI(mux, lister, timeouts, limiter)
 	mux.HandleFunc("/healthz", func(writer http.ResponseWriter, request *http.Request) {
+		setDeadline(writer, timeouts.Request)
+		writer.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(writer http.ResponseWriter, request *http.Request) {
+		setDeadline(writer, timeouts.Request)
+		if !repo.Ready() {
+			respondError(writer, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, "the plugins are not published in the index yet")
+			return
+		}
 		writer.WriteHeader(http.StatusOK)
 	})
 	return mux
 }
 
+// APIHandler serves the download and JSON API endpoints of handler, i.e. the
+// mux of PrepareGitServer, without the git protocol endpoints. It is meant for
+// a listener serving HTTP/2, whereas Krew clones the index over HTTP/1.1.
+// The X-Forwarded-For header is ignored, as no router appends it in front of
+// the passthrough route of the listener.
+func APIHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request.Header.Del("X-Forwarded-For")
+		switch path.Clean(request.URL.Path) {
+		case "/cli-manager/info/refs", "/cli-manager/git-upload-pack":
+			respondError(writer, http.StatusNotFound, metav1.StatusReasonNotFound, "the index is only cloned from the git listener")
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// AggregatedGroupVersion is the API group the list, info and download endpoints
+// are additionally served under, so that they can be reached through the API
+// server by registering an APIService for it instead of through the Route.
+var AggregatedGroupVersion = schema.GroupVersion{Group: "index.cli-manager.openshift.io", Version: "v1alpha1"}
+
+// AggregatedPrefix is the path prefix of the endpoints served under AggregatedGroupVersion.
+var AggregatedPrefix = "/apis/" + AggregatedGroupVersion.String()
+
+func prepareAggregatedAPI(mux *http.ServeMux, lister cache.GenericLister, timeouts Timeouts, limiter *clientLimiter) {
+	// the API server checks the availability of the APIService on its discovery document
+	mux.HandleFunc(AggregatedPrefix, func(writer http.ResponseWriter, request *http.Request) {
+		setDeadline(writer, timeouts.Request)
+		HandleAggregatedDiscovery(writer, request)
+	})
+	mux.HandleFunc(AggregatedPrefix+"/plugins/list/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues(AggregatedPrefix + "/plugins/list/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginList(writer, request, lister)
+	})
+	mux.HandleFunc(AggregatedPrefix+"/plugins/info/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues(AggregatedPrefix + "/plugins/info/").Inc()
+		setDeadline(writer, timeouts.Request)
+		HandlePluginInfo(writer, request, lister)
+	})
+	mux.HandleFunc(AggregatedPrefix+"/plugins/download/", func(writer http.ResponseWriter, request *http.Request) {
+		gitAPIRequestCounts.WithLabelValues(AggregatedPrefix + "/plugins/download/").Inc()
+		setDeadline(writer, timeouts.Transfer)
+		if !limiter.allow(writer, request) {
+			return
+		}
+		HandleDownloadPlugin(writer, request)
+	})
+}
+
+// HandleAggregatedDiscovery returns the discovery document of AggregatedGroupVersion.
+// It has no resources, the endpoints are served as non-resource paths.
+func HandleAggregatedDiscovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+	respondJSON(w, r, http.StatusOK, metav1.APIResourceList{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "APIResourceList",
+			APIVersion: "v1",
+		},
+		GroupVersion: AggregatedGroupVersion.String(),
+		APIResources: []metav1.APIResource{},
+	})
+}
+
+// setDeadline overrides the read and write deadlines of the connection
+// serving the request, so that each endpoint is bounded by its own timeout.
+func setDeadline(w http.ResponseWriter, timeout time.Duration) {
+	if timeout == 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		klog.V(2).Infof("setting read deadline err: %v", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		klog.V(2).Infof("setting write deadline err: %v", err)
+	}
+}
+
+// CheckGitBinary ensures that the git binary the git endpoints execute is
+// found in PATH, so that the server fails on start instead of on every clone.
+func CheckGitBinary() error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git binary is required to serve the index to Krew, it should be installed in the PATH of the server: %w", err)
+	}
+	return nil
+}
+
+// respondGitError writes the error of the git command of a git endpoint.
+// A missing git binary is a failure of the server, not of the request.
+func respondGitError(w http.ResponseWriter, err error) {
+	if errors.Is(err, exec.ErrNotFound) {
+		klog.ErrorS(err, "Git binary is not found")
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, "git binary is not found in the PATH of the server, the index can not be served")
+		return
+	}
+	respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("endpoint failure: %s", err))
+}
+
 // HandleGitAdversitement handles the git advertisement requests done by client tools
 // relying on git compatibility. This function only supports upload-pack requests to limit
 // the supported functionality only to git fetch and git clone.
-func HandleGitAdversitement(w http.ResponseWriter, r *http.Request) {
+func HandleGitAdversitement(w http.ResponseWriter, r *http.Request, repo *Repo) {
 	klog.Infof("plugin git advertisement request")
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	vals := r.URL.Query()
 	if len(vals) == 0 {
-		http.Error(w, "too few query parameters", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "too few query parameters")
 		return
 	}
 
 	if len(vals) > 1 {
-		http.Error(w, "too many query parameters", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "too many query parameters")
 		return
 	}
 
 	name := vals.Get("service")
 	if name != transport.UploadPackServiceName {
-		http.Error(w, "invalid service name", http.StatusForbidden)
-
+		respondError(w, http.StatusForbidden, metav1.StatusReasonForbidden, "invalid service name")
 		return
 	}
 
@@ -244,11 +776,16 @@ func HandleGitAdversitement(w http.ResponseWriter, r *http.Request) {
 	// Because go-git does not properly work on some git requests (especially git fetch).
 	// Besides, relying on git tool for such a simple but crucial functionality for our case
 	// would be better for long term.
-	cmd := exec.CommandContext(context.TODO(), "git", "upload-pack", "--stateless-rpc", "--advertise-refs", GitRepoPath)
+	// git is killed once the client disconnects or the deadline of the request is reached.
+	cmd := exec.CommandContext(r.Context(), "git", "upload-pack", "--stateless-rpc", "--advertise-refs", repo.path)
 	errbuf, outbuf := &bytes.Buffer{}, &bytes.Buffer{}
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = r.Body, outbuf, io.MultiWriter(errbuf, os.Stderr)
 	if err := cmd.Run(); err != nil {
-		http.Error(w, fmt.Sprintf("endpoint failure: %s", err), http.StatusBadRequest)
+		if r.Context().Err() != nil {
+			klog.V(2).Infof("plugin git request is cancelled: %v", r.Context().Err())
+			return
+		}
+		respondGitError(w, err)
 		return
 	}
 
@@ -267,10 +804,10 @@ func HandleGitAdversitement(w http.ResponseWriter, r *http.Request) {
 	w.Write(outbuf.Bytes())
 }
 
-func HandleGitUploadPack(w http.ResponseWriter, r *http.Request) {
+func HandleGitUploadPack(w http.ResponseWriter, r *http.Request, repo *Repo) {
 	klog.Infof("plugin git upload pack request")
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
 		return
 	}
 
@@ -278,11 +815,16 @@ func HandleGitUploadPack(w http.ResponseWriter, r *http.Request) {
 	// Because go-git does not properly work on some git requests (especially git fetch).
 	// Besides, relying on git tool for such a simple but crucial functionality for our case
 	// would be better for long term.
-	cmd := exec.CommandContext(context.TODO(), "git", "upload-pack", "--stateless-rpc", GitRepoPath)
+	// git is killed once the client disconnects or the deadline of the request is reached.
+	cmd := exec.CommandContext(r.Context(), "git", "upload-pack", "--stateless-rpc", repo.path)
 	errbuf, outbuf := &bytes.Buffer{}, &bytes.Buffer{}
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = r.Body, outbuf, io.MultiWriter(errbuf, os.Stderr)
 	if err := cmd.Run(); err != nil {
-		http.Error(w, fmt.Sprintf("endpoint failure: %s", err), http.StatusBadRequest)
+		if r.Context().Err() != nil {
+			klog.V(2).Infof("plugin git request is cancelled: %v", r.Context().Err())
+			return
+		}
+		respondGitError(w, err)
 		return
 	}
 
@@ -292,53 +834,166 @@ func HandleGitUploadPack(w http.ResponseWriter, r *http.Request) {
 	w.Write(outbuf.Bytes())
 }
 
+// HandlePluginManifest returns the Krew manifest generated for the
+// plugin given in name query, as it is served in the index.
+func HandlePluginManifest(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "missing name in query")
+		return
+	}
+
+	if !safePluginRegexp.MatchString(name) {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid name %s", name))
+		return
+	}
+
+	manifest, err := repo.Manifest(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("plugin %s not found in the index", name))
+			return
+		}
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting manifest of plugin %s err: %v", name, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(manifest)
+}
+
 func HandleDownloadPlugin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	name := r.URL.Query().Get("name")
 	if len(name) == 0 {
-		http.Error(w, "missing name in query", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "missing name in query")
 		return
 	}
 
 	if len(name) > 100 {
-		http.Error(w, fmt.Sprintf("name %s too large", name), http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("name %s too large", name))
 		return
 	}
 
-	platform := r.URL.Query().Get("platform")
-	if len(platform) == 0 {
-		http.Error(w, "missing platform in query", http.StatusBadRequest)
+	platformQuery := r.URL.Query().Get("platform")
+	if len(platformQuery) == 0 {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "missing platform in query")
 		return
 	}
 
-	if len(platform) > 20 {
-		http.Error(w, "invalid platform", http.StatusBadRequest)
+	p, err := platform.Parse(platformQuery)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "invalid platform")
 		return
 	}
-
-	fileName := fmt.Sprintf("%s_%s.tar.gz", name, platform)
+	platformName := p.FileName()
+
+	fileName := image.ArchiveName(name, p)
+	var contentEncoding string
+	if !p.IsWindows() {
+		w.Header().Set("Vary", "Accept-Encoding")
+		// the zstd tarball is only served to the clients opting in,
+		// Krew downloads the tar.gz archive.
+		zstdName := image.ZstdArchiveName(name, p)
+		if _, err := os.Stat(filepath.Join(image.TarballPath, zstdName)); err == nil && acceptsEncoding(r, "zstd") {
+			fileName = zstdName
+			contentEncoding = "zstd"
+		}
+	}
 	filePath := fmt.Sprintf("%s/%s", image.TarballPath, fileName)
 	f, err := os.Open(filepath.Clean(filePath))
 	if err != nil {
 		if os.IsNotExist(err) {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("plugin %s for platform %s not found", name, platformName))
 			return
 		}
-		http.Error(w, fmt.Errorf("getting Plugin: name: %s, platform: %s err: %w", name, platform, err).Error(), http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting Plugin: name: %s, platform: %s err: %v", name, platformName, err))
 		return
 	}
 	defer f.Close()
 
-	w.Header().Set("Content-Type", "application/octet-stream")
+	stat, err := f.Stat()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting Plugin: name: %s, platform: %s err: %v", name, platformName, err))
+		return
+	}
+
+	// the sha256 of the tarball is used as ETag, so that clients
+	// re-downloading unchanged plugins receive 304 Not Modified.
+	checksum, err := archiveChecksum(filePath, f, stat)
+	if err != nil {
+		klog.Errorf("hashing Plugin: name: %s, platform: %s err: %v", name, platformName, err)
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting Plugin: name: %s, platform: %s err: %v", name, platformName, err))
+		return
+	}
+
+	if len(contentEncoding) > 0 {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Encoding", contentEncoding)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
 	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
 	w.Header().Set("Content-Transfer-Encoding", "binary")
+	w.Header().Set("ETag", fmt.Sprintf("%q", checksum))
 
-	if _, err = io.Copy(w, f); err != nil {
-		http.Error(w, fmt.Errorf("getting Plugin: name: %s, platform: %s err: %w", name, platform, err).Error(), http.StatusInternalServerError)
-		return
+	// ServeContent honors If-None-Match against the ETag and
+	// If-Modified-Since against the modification time of the tarball.
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, fileName, stat.ModTime(), f)
+	if cw.code == http.StatusOK || cw.code == http.StatusPartialContent {
+		pluginDownloadCounts.WithLabelValues(name, platformName).Inc()
+		pluginDownloadBytes.WithLabelValues(name, platformName).Add(float64(cw.bytes))
+		auditDownload(r, name, platformName, cw.code, cw.bytes)
 	}
 }
+
+// cachedChecksum is the sha256 of an archive as of its modification time and size.
+type cachedChecksum struct {
+	modTime  time.Time
+	size     int64
+	checksum string
+}
+
+// archiveChecksums caches the sha256 of the archives which are not linked to
+// a blob by their path, i.e. the zstd tarballs, so that they are only read
+// once per modification instead of on every download.
+var archiveChecksums sync.Map
+
+// archiveChecksum returns the sha256 of the archive f opened at path. It is
+// the name of the blob the archive links to, or its cached checksum if it is
+// unchanged since it was last read. f is rewound once it is read.
+func archiveChecksum(path string, f *os.File, stat os.FileInfo) (string, error) {
+	if checksum, ok := image.LinkedChecksum(path); ok {
+		return checksum, nil
+	}
+	if cached, ok := archiveChecksums.Load(path); ok {
+		if c := cached.(cachedChecksum); c.modTime.Equal(stat.ModTime()) && c.size == stat.Size() {
+			return c.checksum, nil
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	archiveChecksums.Store(path, cachedChecksum{
+		modTime:  stat.ModTime(),
+		size:     stat.Size(),
+		checksum: checksum,
+	})
+	return checksum, nil
+}
@@ -0,0 +1,1032 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/klauspost/compress/zstd"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics/testutil"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/pkg/image"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+)
+
+func TestHandleDownloadPluginError(t *testing.T) {
+	mux := PrepareGitServer(nil, newTestLister(t), Timeouts{})
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		expectedCode   int
+		expectedReason metav1.StatusReason
+	}{
+		{
+			name:           "missing plugin",
+			method:         http.MethodGet,
+			url:            "/cli-manager/plugins/download/?name=unknown&platform=linux_amd64",
+			expectedCode:   http.StatusNotFound,
+			expectedReason: metav1.StatusReasonNotFound,
+		},
+		{
+			name:           "missing platform",
+			method:         http.MethodGet,
+			url:            "/cli-manager/plugins/download/?name=oc",
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: metav1.StatusReasonBadRequest,
+		},
+		{
+			name:           "method not allowed",
+			method:         http.MethodPost,
+			url:            "/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+			expectedCode:   http.StatusMethodNotAllowed,
+			expectedReason: metav1.StatusReasonMethodNotAllowed,
+		},
+		{
+			name:           "invalid git service",
+			method:         http.MethodGet,
+			url:            "/cli-manager/info/refs?service=git-receive-pack",
+			expectedCode:   http.StatusForbidden,
+			expectedReason: metav1.StatusReasonForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, nil))
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("expected status code %d, got %d body %s", tc.expectedCode, rec.Code, rec.Body.String())
+			}
+			if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Fatalf("unexpected content type %s", contentType)
+			}
+			resp := ErrorResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unexpected decoding error %v body %s", err, rec.Body.String())
+			}
+			if resp.Code != tc.expectedCode || resp.Reason != tc.expectedReason || len(resp.Message) == 0 {
+				t.Fatalf("unexpected error response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestHandleDownloadPluginCopyError(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	// a directory can be opened but not read, failing the copy
+	if err := os.Mkdir(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), 0755); err != nil {
+		t.Fatalf("unexpected mkdir error %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	PrepareGitServer(nil, newTestLister(t), Timeouts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/?name=oc&platform=linux_amd64", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status code %d, got %d body %s", http.StatusInternalServerError, rec.Code, rec.Body.String())
+	}
+	resp := ErrorResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unexpected decoding error %v body %s", err, rec.Body.String())
+	}
+	if strings.Contains(resp.Message, "%!") {
+		t.Fatalf("unexpected formatting artifact in message %s", resp.Message)
+	}
+	if !strings.Contains(resp.Message, "name: oc, platform: linux_amd64") {
+		t.Fatalf("unexpected message %s", resp.Message)
+	}
+}
+
+func TestHandleDownloadPluginETag(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	content := []byte("oc tarball")
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), content, 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	mux := PrepareGitServer(nil, newTestLister(t), Timeouts{})
+	url := "/cli-manager/plugins/download/?name=oc&platform=linux_amd64"
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d body %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if rec.Body.String() != string(content) {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+	sum := sha256.Sum256(content)
+	etag := fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+	if rec.Header().Get("ETag") != etag {
+		t.Fatalf("expected ETag %s, got %s", etag, rec.Header().Get("ETag"))
+	}
+	if len(rec.Header().Get("Last-Modified")) == 0 {
+		t.Fatalf("expected Last-Modified to be set")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotModified, rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("expected empty body, got %s", rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-None-Match", `"outdated"`)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d for a stale ETag, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestHandleDownloadPluginETagLinked(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	archive := filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz")
+	if err := os.WriteFile(archive, []byte("oc tarball"), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	// the ETag is the name of the blob, the archive is not hashed again
+	checksum := strings.Repeat("ab", 32)
+	if err := image.Deduplicate(archive, checksum); err != nil {
+		t.Fatalf("unexpected deduplicate error %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	PrepareGitServer(nil, newTestLister(t), Timeouts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/?name=oc&platform=linux_amd64", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "oc tarball" {
+		t.Fatalf("expected status code %d, got %d body %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if etag := fmt.Sprintf("%q", checksum); rec.Header().Get("ETag") != etag {
+		t.Fatalf("expected ETag %s, got %s", etag, rec.Header().Get("ETag"))
+	}
+}
+
+func TestHandleDownloadPluginZstd(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), []byte("oc tarball"), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	tarball := []byte("oc zstd tarball")
+	ze, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("unexpected zstd error %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.zst"), ze.EncodeAll(tarball, nil), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	mux := PrepareGitServer(nil, newTestLister(t), Timeouts{})
+	url := "/cli-manager/plugins/download/?name=oc&platform=linux_amd64"
+
+	for encoding, expectZstd := range map[string]bool{
+		"":             false,
+		"gzip":         false,
+		"gzip, zstd":   true,
+		"zstd;q=0":     false,
+		"zstd;q=0.5":   true,
+		"br, zstd, *":  true,
+		"deflate, br ": false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d body %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("expected Vary Accept-Encoding, got %q", rec.Header().Get("Vary"))
+		}
+		if !expectZstd {
+			if len(rec.Header().Get("Content-Encoding")) > 0 || rec.Body.String() != "oc tarball" {
+				t.Fatalf("expected the tar.gz archive for %q, got encoding %q body %q", encoding, rec.Header().Get("Content-Encoding"), rec.Body.String())
+			}
+			continue
+		}
+		if rec.Header().Get("Content-Encoding") != "zstd" {
+			t.Fatalf("expected zstd Content-Encoding for %q, got %q", encoding, rec.Header().Get("Content-Encoding"))
+		}
+		zr, err := zstd.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("unexpected zstd error %v", err)
+		}
+		data, err := io.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			t.Fatalf("unexpected read error %v", err)
+		}
+		if string(data) != string(tarball) {
+			t.Fatalf("unexpected tarball %q", data)
+		}
+	}
+
+	// Windows platforms are only archived in zip
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_windows_amd64.zip"), []byte("oc zip"), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/?name=oc&platform=windows_amd64", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "oc zip" || len(rec.Header().Get("Content-Encoding")) > 0 {
+		t.Fatalf("expected the zip archive, got status code %d encoding %q body %q", rec.Code, rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+}
+
+func TestHandleDownloadPluginAudit(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	content := []byte("oc tarball")
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), content, 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	buf := &bytes.Buffer{}
+	AuditLog = buf
+	defer func() {
+		AuditLog = nil
+	}()
+	// the router
+	TrustedProxies = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(32, 32)}}
+	defer func() {
+		TrustedProxies = nil
+	}()
+	mux := PrepareGitServer(nil, newTestLister(t), Timeouts{})
+
+	req := httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/?name=oc&platform=linux_amd64", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	req.Header.Set("X-Forwarded-For", "spoofed, 192.168.1.10")
+	// only the aggregated API is authenticated by the API server
+	req.Header.Set("X-Remote-User", "spoofed")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, AggregatedPrefix+"/plugins/download/?name=oc&platform=linux_amd64", nil)
+	req.RemoteAddr = "10.0.0.3:40000"
+	req.Header.Set("X-Remote-User", "alice")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	// unknown plugins are not audited
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/?name=unknown&platform=linux_amd64", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 audit records, got %q", buf.String())
+	}
+	for i, expected := range []DownloadAuditRecord{
+		{RemoteAddr: "192.168.1.10", Name: "oc", Platform: "linux_amd64", Code: http.StatusOK, Bytes: int64(len(content))},
+		{User: "alice", RemoteAddr: "10.0.0.3", Name: "oc", Platform: "linux_amd64", Code: http.StatusOK, Bytes: int64(len(content))},
+	} {
+		record := DownloadAuditRecord{}
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("unexpected unmarshal error %v", err)
+		}
+		if record.Time.IsZero() {
+			t.Fatalf("expected the time of the download to be recorded, got %s", lines[i])
+		}
+		record.Time = time.Time{}
+		if record != expected {
+			t.Fatalf("expected audit record %+v, got %+v", expected, record)
+		}
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), []byte("oc tarball"), 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	ClientRateLimit = RateLimit{QPS: 0.001, Burst: 2}
+	defer func() {
+		ClientRateLimit = RateLimit{}
+	}()
+	mux := PrepareGitServer(nil, newTestLister(t), Timeouts{})
+	request := func(url, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = remoteAddr
+		// only trusted from the proxies
+		req.Header.Set("X-Forwarded-For", "10.0.0.9")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	download := "/cli-manager/plugins/download/?name=oc&platform=linux_amd64"
+
+	for i := 0; i < 2; i++ {
+		if rec := request(download, "10.0.0.1:40000"); rec.Code != http.StatusOK {
+			t.Fatalf("expected status code %d within the burst, got %d body %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+	for _, url := range []string{download, AggregatedPrefix + "/plugins/download/?name=oc&platform=linux_amd64", "/cli-manager/git-upload-pack", "/cli-manager/info/refs?service=git-upload-pack"} {
+		rec := request(url, "10.0.0.1:40001")
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status code %d for %s, got %d body %s", http.StatusTooManyRequests, url, rec.Code, rec.Body.String())
+		}
+		if retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+			t.Fatalf("expected a Retry-After header in seconds, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+
+	// the metadata endpoints and the other clients are not limited
+	if rec := request("/cli-manager/plugins/list/", "10.0.0.1:40002"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d for the plugin list, got %d", http.StatusOK, rec.Code)
+	}
+	if rec := request(download, "10.0.0.2:40000"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d for another client, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	_, router, _ := net.ParseCIDR("10.128.0.0/14")
+	TrustedProxies = []*net.IPNet{router}
+	defer func() {
+		TrustedProxies = nil
+	}()
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{name: "direct", remoteAddr: "10.0.0.1:40000", expected: "10.0.0.1"},
+		{name: "direct spoofed", remoteAddr: "10.0.0.1:40000", forwarded: []string{"192.168.1.10"}, expected: "10.0.0.1"},
+		{name: "router", remoteAddr: "10.128.0.5:40000", forwarded: []string{"spoofed, 192.168.1.10"}, expected: "192.168.1.10"},
+		{name: "routers", remoteAddr: "10.128.0.5:40000", forwarded: []string{"spoofed, 192.168.1.10", "10.129.0.7"}, expected: "192.168.1.10"},
+		{name: "router without header", remoteAddr: "10.128.0.5:40000", expected: "10.128.0.5"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if addr := remoteAddr(req); addr != tc.expected {
+				t.Fatalf("expected remote address %s, got %s", tc.expected, addr)
+			}
+		})
+	}
+
+	// no router appends the header in front of the API listener
+	var addr string
+	handler := APIHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		addr = remoteAddr(request)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/", nil)
+	req.RemoteAddr = "10.128.0.5:40000"
+	req.Header.Set("X-Forwarded-For", "192.168.1.10")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if addr != "10.128.0.5" {
+		t.Fatalf("expected the X-Forwarded-For header to be ignored by the API listener, got remote address %s", addr)
+	}
+}
+
+func TestClientLimiterRefill(t *testing.T) {
+	l := newClientLimiter(RateLimit{QPS: 1, Burst: 1})
+	now := time.Now()
+	if delay := l.reserve("10.0.0.1", now); delay != 0 {
+		t.Fatalf("expected the first request to be allowed, got delay %s", delay)
+	}
+	if delay := l.reserve("10.0.0.1", now); delay <= 0 || delay > time.Second {
+		t.Fatalf("expected the second request to wait up to a second, got delay %s", delay)
+	}
+	// the rejected request did not consume the refilled token
+	if delay := l.reserve("10.0.0.1", now.Add(time.Second)); delay != 0 {
+		t.Fatalf("expected the request to be allowed once refilled, got delay %s", delay)
+	}
+
+	// idle clients are forgotten
+	l.reserve("10.0.0.2", now.Add(2*clientIdleTimeout))
+	if _, ok := l.clients["10.0.0.1"]; ok {
+		t.Fatalf("expected the idle client to be pruned")
+	}
+}
+
+func TestHandleDownloadPluginMetrics(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	pluginDownloadCounts.Reset()
+	pluginDownloadBytes.Reset()
+	content := []byte("kubectl tarball")
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "kubectl_linux_arm64.tar.gz"), content, 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	mux := PrepareGitServer(nil, newTestLister(t), Timeouts{})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/?name=kubectl&platform=linux_arm64", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d body %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+	}
+	// unknown plugins are not counted
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/download/?name=unknown&platform=linux_arm64", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	count, err := testutil.GetCounterMetricValue(pluginDownloadCounts.WithLabelValues("kubectl", "linux_arm64"))
+	if err != nil {
+		t.Fatalf("unexpected metric error %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 downloads, got %v", count)
+	}
+	bytes, err := testutil.GetCounterMetricValue(pluginDownloadBytes.WithLabelValues("kubectl", "linux_arm64"))
+	if err != nil {
+		t.Fatalf("unexpected metric error %v", err)
+	}
+	if bytes != float64(2*len(content)) {
+		t.Fatalf("expected %d bytes, got %v", 2*len(content), bytes)
+	}
+	unknown, err := testutil.GetCounterMetricValue(pluginDownloadCounts.WithLabelValues("unknown", "linux_arm64"))
+	if err != nil {
+		t.Fatalf("unexpected metric error %v", err)
+	}
+	if unknown != 0 {
+		t.Fatalf("expected unknown plugin not to be counted, got %v", unknown)
+	}
+}
+
+func TestHandlePluginVerify(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	for name, platforms := range map[string][]string{
+		"oc":      {"linux_amd64", "darwin_arm64"},
+		"kubectl": {"linux_amd64"},
+	} {
+		k := &krew.Plugin{}
+		for _, p := range platforms {
+			content := []byte(name + " " + p + " tarball")
+			if err := os.WriteFile(filepath.Join(image.TarballPath, name+"_"+p+".tar.gz"), content, 0644); err != nil {
+				t.Fatalf("unexpected write error %v", err)
+			}
+			sum := sha256.Sum256(content)
+			k.Spec.Platforms = append(k.Spec.Platforms, krew.Platform{
+				URI:    fmt.Sprintf("https://cli-manager.apps.example.com/cli-manager/plugins/download/?name=%s&platform=%s", name, p),
+				Sha256: hex.EncodeToString(sum[:]),
+			})
+		}
+		if err := repo.Upsert(name, k); err != nil {
+			t.Fatalf("unexpected upsert error %v", err)
+		}
+	}
+	mux := PrepareGitServer(repo, newTestLister(t), Timeouts{})
+	verify := func() VerifyReport {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/verify/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d body %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		report := VerifyReport{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("unexpected decoding error %v", err)
+		}
+		return report
+	}
+
+	// nothing is verified yet while another verification is running
+	repo.verifyMu.Lock()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/verify/", nil))
+	repo.verifyMu.Unlock()
+	if rec.Code != http.StatusServiceUnavailable || len(rec.Header().Get("Retry-After")) == 0 {
+		t.Fatalf("expected status code %d with Retry-After, got %d body %s", http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	}
+
+	if report := verify(); report.Verified != 3 || len(report.Mismatches) != 0 {
+		t.Fatalf("expected the 3 archives to match, got %+v", report)
+	}
+	// the verification on demand is the last one
+	if last := repo.LastVerifyReport(); last == nil || last.Verified != 3 {
+		t.Fatalf("expected the verification on demand to be recorded, got %+v", last)
+	}
+
+	corrupted := []byte("corrupted tarball")
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_darwin_arm64.tar.gz"), corrupted, 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	// a request during another verification returns the last report
+	repo.verifyMu.Lock()
+	if report := verify(); len(report.Mismatches) != 0 {
+		t.Fatalf("expected the report of the last verification, got %+v", report)
+	}
+	repo.verifyMu.Unlock()
+	report := verify()
+	sum := sha256.Sum256(corrupted)
+	if report.Verified != 3 || len(report.Mismatches) != 1 {
+		t.Fatalf("expected a single mismatch of the 3 archives, got %+v", report)
+	}
+	if mismatch := report.Mismatches[0]; mismatch.Name != "oc" || mismatch.Platform != "darwin/arm64" || mismatch.Archive != "oc_darwin_arm64.tar.gz" || mismatch.Actual != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expected the corrupted archive to be reported, got %+v", mismatch)
+	}
+	mismatches, err := testutil.GetGaugeMetricValue(archiveMismatches)
+	if err != nil {
+		t.Fatalf("unexpected metric error %v", err)
+	}
+	if mismatches != 1 {
+		t.Fatalf("expected 1 mismatch to be reported by the metric, got %v", mismatches)
+	}
+
+	// a missing archive is reported as well
+	if err := os.Remove(filepath.Join(image.TarballPath, "kubectl_linux_amd64.tar.gz")); err != nil {
+		t.Fatalf("unexpected remove error %v", err)
+	}
+	report = verify()
+	if len(report.Mismatches) != 2 || report.Mismatches[0].Name != "kubectl" || len(report.Mismatches[0].Actual) != 0 {
+		t.Fatalf("expected the missing archive to be reported, got %+v", report)
+	}
+}
+
+func TestRepoAuthor(t *testing.T) {
+	tests := []struct {
+		name          string
+		author        Author
+		expectedName  string
+		expectedEmail string
+	}{
+		{
+			name:          "default author",
+			expectedName:  DefaultAuthor.Name,
+			expectedEmail: DefaultAuthor.Email,
+		},
+		{
+			name: "custom author",
+			author: Author{
+				Name:  "Example CLI Manager",
+				Email: "cli-manager@example.com",
+			},
+			expectedName:  "Example CLI Manager",
+			expectedEmail: "cli-manager@example.com",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), tc.author)
+			if err != nil {
+				t.Fatalf("unexpected prepare error %v", err)
+			}
+			if err := repo.Upsert("oc", &krew.Plugin{}); err != nil {
+				t.Fatalf("unexpected upsert error %v", err)
+			}
+
+			head, err := repo.repo.Head()
+			if err != nil {
+				t.Fatalf("unexpected head error %v", err)
+			}
+			commit, err := repo.repo.CommitObject(head.Hash())
+			if err != nil {
+				t.Fatalf("unexpected commit error %v", err)
+			}
+			if commit.Message != "add plugin oc" {
+				t.Fatalf("unexpected commit message %s", commit.Message)
+			}
+			if commit.Author.Name != tc.expectedName || commit.Author.Email != tc.expectedEmail {
+				t.Fatalf("unexpected commit author %s <%s>", commit.Author.Name, commit.Author.Email)
+			}
+		})
+	}
+}
+
+func TestRepoUpsert(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	headMessage := func() string {
+		head, err := repo.repo.Head()
+		if err != nil {
+			t.Fatalf("unexpected head error %v", err)
+		}
+		commit, err := repo.repo.CommitObject(head.Hash())
+		if err != nil {
+			t.Fatalf("unexpected commit error %v", err)
+		}
+		return commit.Message
+	}
+	upsert := func(version string) {
+		if err := repo.Upsert("oc", &krew.Plugin{Spec: krew.PluginSpec{Version: version}}); err != nil {
+			t.Fatalf("unexpected upsert error %v", err)
+		}
+	}
+
+	upsert("v4.15.0")
+	if message := headMessage(); message != "add plugin oc" {
+		t.Fatalf("unexpected commit message %s", message)
+	}
+	upsert("v4.16.0")
+	if message := headMessage(); message != "update plugin oc" {
+		t.Fatalf("unexpected commit message %s", message)
+	}
+	head, _ := repo.repo.Head()
+	upsert("v4.16.0")
+	if unchanged, _ := repo.repo.Head(); unchanged.Hash() != head.Hash() {
+		t.Fatalf("expected unchanged plugin not to be committed")
+	}
+}
+
+func TestHandlePluginManifest(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	err = repo.Upsert("oc", &krew.Plugin{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "krew.googlecontainertools.github.com/v1alpha2",
+			Kind:       "Plugin",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "oc",
+		},
+		Spec: krew.PluginSpec{
+			Version: "v4.15.0",
+			Platforms: []krew.Platform{
+				{
+					URI:    "https://cli-manager.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+					Sha256: strings.Repeat("a", 64),
+					Bin:    "oc",
+					Files: []krew.FileOperation{
+						{From: "usr/bin/oc", To: "."},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+	mux := PrepareGitServer(repo, newTestLister(t), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/manifest/?name=oc", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d body %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "text/yaml" {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+	plugin := krew.Plugin{}
+	if err := yaml.UnmarshalStrict(rec.Body.Bytes(), &plugin); err != nil {
+		t.Fatalf("unexpected decoding error %v body %s", err, rec.Body.String())
+	}
+	if plugin.Name != "oc" || len(plugin.Spec.Platforms) != 1 || plugin.Spec.Platforms[0].Bin != "oc" {
+		t.Fatalf("unexpected manifest %+v", plugin)
+	}
+
+	for url, code := range map[string]int{
+		"/cli-manager/plugins/manifest/?name=kubectl":   http.StatusNotFound,
+		"/cli-manager/plugins/manifest/?name=../README": http.StatusBadRequest,
+		"/cli-manager/plugins/manifest/":                http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != code {
+			t.Fatalf("expected status code %d for %s, got %d body %s", code, url, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestManifestSignature(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected key error %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected key marshal error %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "signing.key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	signingKey := SigningKey
+	defer func() {
+		SigningKey = signingKey
+	}()
+	if SigningKey, err = LoadSigningKey(keyFile); err != nil {
+		t.Fatalf("unexpected load error %v", err)
+	}
+
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	err = repo.Upsert("oc", &krew.Plugin{
+		ObjectMeta: metav1.ObjectMeta{Name: "oc"},
+		Spec: krew.PluginSpec{
+			Version: "v4.15.0",
+			Platforms: []krew.Platform{
+				{
+					URI:    "https://cli-manager.example.com/cli-manager/plugins/download/?name=oc&platform=linux_amd64",
+					Sha256: strings.Repeat("a", 64),
+					Bin:    "oc",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+	mux := PrepareGitServer(repo, newTestLister(t), Timeouts{})
+	get := func(url string) []byte {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status code %d for %s, got %d body %s", http.StatusOK, url, rec.Code, rec.Body.String())
+		}
+		return rec.Body.Bytes()
+	}
+	manifest := get("/cli-manager/plugins/manifest/?name=oc")
+	signature := get("/cli-manager/plugins/signature/?name=oc")
+
+	block, _ := pem.Decode(get("/cli-manager/signing-key"))
+	if block == nil {
+		t.Fatalf("expected a PEM encoded public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("unexpected public key error %v", err)
+	}
+	if err := VerifyManifest(publicKey.(ed25519.PublicKey), manifest, signature); err != nil {
+		t.Fatalf("unexpected verify error %v", err)
+	}
+	tampered := bytes.Replace(manifest, []byte(strings.Repeat("a", 64)), []byte(strings.Repeat("b", 64)), 1)
+	if err := VerifyManifest(publicKey.(ed25519.PublicKey), tampered, signature); err == nil {
+		t.Fatalf("expected the tampered manifest to be rejected")
+	}
+
+	// the signature is committed next to the manifest, so that clones can be verified
+	committed, err := os.ReadFile(filepath.Join(repo.path, "plugins", "oc.yaml.sig"))
+	if err != nil || !bytes.Equal(committed, signature) {
+		t.Fatalf("expected the signature to be committed, got %q err %v", committed, err)
+	}
+	if err := repo.Delete("oc"); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	if _, err := repo.Signature("oc"); !os.IsNotExist(err) {
+		t.Fatalf("expected the signature to be removed with the manifest, got %v", err)
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	timeouts := Timeouts{
+		Request:  100 * time.Millisecond,
+		Transfer: 5 * time.Second,
+	}
+	mux := http.NewServeMux()
+	// a stalled advertisement only responds after its deadline
+	mux.HandleFunc("/cli-manager/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		setDeadline(w, timeouts.Request)
+		time.Sleep(5 * timeouts.Request)
+		w.Write([]byte("refs"))
+	})
+	// a long-running upload-pack streams for longer than the request timeout
+	mux.HandleFunc("/cli-manager/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		setDeadline(w, timeouts.Transfer)
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("pack"))
+			http.NewResponseController(w).Flush()
+			time.Sleep(timeouts.Request)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/cli-manager/git-upload-pack")
+	if err != nil {
+		t.Fatalf("unexpected upload-pack error %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected upload-pack read error %v", err)
+	}
+	if string(body) != strings.Repeat("pack", 5) {
+		t.Fatalf("expected upload-pack not to be cut, got %s", body)
+	}
+
+	resp, err = http.Get(server.URL + "/cli-manager/info/refs")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatalf("expected stalled advertisement to time out")
+	}
+}
+
+func TestCloneIndexMetadata(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	if err := repo.Upsert("oc", &krew.Plugin{Spec: krew.PluginSpec{Version: "v4.15.0"}}); err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+	server := httptest.NewServer(PrepareGitServer(repo, newTestLister(t), Timeouts{}))
+	defer server.Close()
+
+	clonePath := filepath.Join(t.TempDir(), "index")
+	if _, err := git.PlainClone(clonePath, false, &git.CloneOptions{URL: server.URL + "/cli-manager"}); err != nil {
+		t.Fatalf("unexpected clone error %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(clonePath, IndexMetadataFile))
+	if err != nil {
+		t.Fatalf("expected %s in the cloned index, got error %v", IndexMetadataFile, err)
+	}
+	metadata := IndexMetadata{}
+	if err := yaml.UnmarshalStrict(data, &metadata); err != nil {
+		t.Fatalf("malformed %s: %v", IndexMetadataFile, err)
+	}
+	if metadata != DefaultIndexMetadata {
+		t.Fatalf("unexpected index metadata %+v", metadata)
+	}
+	if _, err := os.Stat(filepath.Join(clonePath, "plugins", "oc.yaml")); err != nil {
+		t.Fatalf("expected plugin manifest in the cloned index, got error %v", err)
+	}
+}
+
+// blockingBody blocks reads until ctx is done, like the body of a request
+// whose client stopped sending it.
+type blockingBody struct {
+	ctx context.Context
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+func TestHandleGitUploadPackCancel(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/git-upload-pack", &blockingBody{ctx: ctx}).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleGitUploadPack(rec, req, repo)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("upload-pack is not abandoned once the request is cancelled")
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("expected no response for a cancelled request, got %s", rec.Body.String())
+	}
+}
+
+func TestGitBinaryMissing(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	if err := CheckGitBinary(); err != nil {
+		t.Fatalf("unexpected check error with git installed %v", err)
+	}
+
+	// git is not found in an empty PATH
+	t.Setenv("PATH", t.TempDir())
+	if err := CheckGitBinary(); err == nil || !strings.Contains(err.Error(), "git binary is required") {
+		t.Fatalf("expected missing git binary error, got %v", err)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/cli-manager/info/refs?service=git-upload-pack", nil),
+		httptest.NewRequest(http.MethodPost, "/cli-manager/git-upload-pack", strings.NewReader("")),
+	} {
+		rec := httptest.NewRecorder()
+		PrepareGitServer(repo, nil, Timeouts{}).ServeHTTP(rec, req)
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code %d, got %d body %s", http.StatusInternalServerError, rec.Code, rec.Body.String())
+		}
+		if body := rec.Body.String(); !strings.Contains(body, "git binary is not found") || strings.Contains(body, "exec:") {
+			t.Fatalf("expected a clear error without the exec error, got %s", body)
+		}
+	}
+}
+
+func TestAggregatedAPI(t *testing.T) {
+	tarballPath := image.TarballPath
+	image.TarballPath = t.TempDir()
+	defer func() {
+		image.TarballPath = tarballPath
+	}()
+	content := []byte("oc tarball")
+	if err := os.WriteFile(filepath.Join(image.TarballPath, "oc_linux_amd64.tar.gz"), content, 0644); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	mux := PrepareGitServer(nil, newTestLister(t, newTestPlugin("oc", "linux/amd64")), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/apis/index.cli-manager.openshift.io/v1alpha1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected discovery status code %d body %s", rec.Code, rec.Body.String())
+	}
+	discovery := metav1.APIResourceList{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &discovery); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if discovery.GroupVersion != "index.cli-manager.openshift.io/v1alpha1" {
+		t.Fatalf("unexpected discovery group version %s", discovery.GroupVersion)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, AggregatedPrefix+"/plugins/list/", nil))
+	list := PluginList{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unexpected decoding error %v body %s", err, rec.Body.String())
+	}
+	if len(list.Items) != 1 || list.Items[0].Name != "oc" {
+		t.Fatalf("unexpected plugin list %+v", list.Items)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, AggregatedPrefix+"/plugins/info/?name=oc", nil))
+	info := PluginInfo{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("unexpected decoding error %v body %s", err, rec.Body.String())
+	}
+	if info.Name != "oc" {
+		t.Fatalf("unexpected plugin info %+v", info)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, AggregatedPrefix+"/plugins/download/?name=oc&platform=linux_amd64", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != string(content) {
+		t.Fatalf("unexpected download status code %d body %s", rec.Code, rec.Body.String())
+	}
+
+	// only the list, info and download endpoints are aggregated
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, AggregatedPrefix+"/plugins/manifest/?name=oc", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
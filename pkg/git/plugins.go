@@ -0,0 +1,586 @@
+package git
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/version"
+)
+
+// PluginListItem is the summary of a Plugin returned by the list endpoint.
+type PluginListItem struct {
+	Name             string   `json:"name"`
+	ShortDescription string   `json:"shortDescription"`
+	Version          string   `json:"version"`
+	Platforms        []string `json:"platforms"`
+	// Deprecated and DeprecationMessage let clients badge deprecated plugins.
+	Deprecated         bool   `json:"deprecated,omitempty"`
+	DeprecationMessage string `json:"deprecationMessage,omitempty"`
+}
+
+// PluginList is the response of the list endpoint.
+type PluginList struct {
+	Items []PluginListItem `json:"items"`
+}
+
+// PluginInfo is the response of the info endpoint. Status reports
+// whether the plugin is successfully reconciled and why.
+type PluginInfo struct {
+	Name   string                `json:"name"`
+	Spec   v1alpha1.PluginSpec   `json:"spec"`
+	Status v1alpha1.PluginStatus `json:"status"`
+}
+
+// PluginDiagnostics is the response of the diagnostics endpoint, gathering
+// why a plugin failed to be published in a single place.
+type PluginDiagnostics struct {
+	Name string `json:"name"`
+	// Status is the status of the Plugin, if it still exists.
+	Status *v1alpha1.PluginStatus `json:"status,omitempty"`
+	// LastError is the error the last reconcile failed with, if any.
+	LastError *ReconcileError `json:"lastError,omitempty"`
+	// Manifest is the Krew manifest published in the index, if any.
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// PluginStatusSummary is the health of a Plugin returned by the status endpoint.
+type PluginStatusSummary struct {
+	Name string `json:"name"`
+	// Ready reports whether the Ready condition of the Plugin is True.
+	Ready bool `json:"ready"`
+	// Reason is the reason of the Ready condition, empty if the Plugin
+	// is not reconciled yet.
+	Reason    string                  `json:"reason,omitempty"`
+	Platforms []PlatformStatusSummary `json:"platforms"`
+}
+
+// PlatformStatusSummary is the health of a platform of a Plugin, as reported
+// by its PlatformInstalled condition.
+type PlatformStatusSummary struct {
+	Platform string `json:"platform"`
+	Ready    bool   `json:"ready"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ErrorResponse is the body of every error returned by the plugin and git
+// endpoints, so that clients can handle them in a single way.
+type ErrorResponse struct {
+	Code    int                 `json:"code"`
+	Reason  metav1.StatusReason `json:"reason"`
+	Message string              `json:"message"`
+}
+
+// HandlePluginList lists the Plugin resources reconciled by the controller,
+// only the ones matching the labelSelector query if it is given. The lister
+// should be restricted to the Plugins published in the index by SelectedLister.
+func HandlePluginList(w http.ResponseWriter, r *http.Request, lister cache.GenericLister) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	selector := labels.Everything()
+	if query := r.URL.Query().Get("labelSelector"); len(query) > 0 {
+		var err error
+		selector, err = labels.Parse(query)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid labelSelector %s err: %v", query, err))
+			return
+		}
+	}
+
+	objs, err := lister.List(selector)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("listing plugins err: %v", err))
+		return
+	}
+
+	list := PluginList{
+		Items: []PluginListItem{},
+	}
+	for _, obj := range objs {
+		plugin, err := pluginFromObject(obj)
+		if err != nil {
+			klog.V(2).Infof("invalid object %v is ignored", obj)
+			continue
+		}
+		item := PluginListItem{
+			Name:               plugin.Name,
+			ShortDescription:   plugin.Spec.ShortDescription,
+			Version:            plugin.Spec.Version,
+			Platforms:          pluginPlatforms(plugin),
+			Deprecated:         plugin.Spec.Deprecated,
+			DeprecationMessage: plugin.Spec.DeprecationMessage,
+		}
+		list.Items = append(list.Items, item)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+
+	respondJSON(w, r, http.StatusOK, list)
+}
+
+// HandlePluginStatus summarizes the health of every Plugin reconciled by the
+// controller from their status, as a JSON array of PluginStatusSummary sorted
+// by name, so that dashboards do not need to get each Plugin.
+func HandlePluginStatus(w http.ResponseWriter, r *http.Request, lister cache.GenericLister) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	objs, err := lister.List(labels.Everything())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("listing plugins err: %v", err))
+		return
+	}
+
+	summaries := []PluginStatusSummary{}
+	for _, obj := range objs {
+		plugin, err := pluginFromObject(obj)
+		if err != nil {
+			klog.V(2).Infof("invalid object %v is ignored", obj)
+			continue
+		}
+		summary := PluginStatusSummary{
+			Name:      plugin.Name,
+			Platforms: []PlatformStatusSummary{},
+		}
+		if ready := meta.FindStatusCondition(plugin.Status.Conditions, "Ready"); ready != nil {
+			summary.Ready = ready.Status == metav1.ConditionTrue
+			summary.Reason = ready.Reason
+		}
+		for _, p := range plugin.Status.Platforms {
+			platform := PlatformStatusSummary{
+				Platform: p.Platform,
+			}
+			if installed := meta.FindStatusCondition(p.Conditions, "PlatformInstalled"); installed != nil {
+				platform.Ready = installed.Status == metav1.ConditionTrue
+				platform.Reason = installed.Reason
+			}
+			summary.Platforms = append(summary.Platforms, platform)
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	respondJSON(w, r, http.StatusOK, summaries)
+}
+
+// HandlePluginInfo returns the specification and the status conditions
+// of the Plugin given in name query. It is returned in YAML if the format
+// query is yaml or the Accept header prefers YAML, and JSON otherwise.
+func HandlePluginInfo(w http.ResponseWriter, r *http.Request, lister cache.GenericLister) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if len(format) > 0 && format != "json" && format != "yaml" {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid format %s, should be json or yaml", format))
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "missing name in query")
+		return
+	}
+
+	plugin, err := getPlugin(lister, name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("plugin %s not found", name))
+			return
+		}
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting plugin %s err: %v", name, err))
+		return
+	}
+
+	info := PluginInfo{
+		Name:   plugin.Name,
+		Spec:   plugin.Spec,
+		Status: plugin.Status,
+	}
+	if format == "yaml" || (len(format) == 0 && acceptsYAML(r)) {
+		respondYAML(w, r, http.StatusOK, info)
+		return
+	}
+	respondJSON(w, r, http.StatusOK, info)
+}
+
+// HandlePluginPlatforms returns the platforms supported by the Plugin given in
+// name query, as a JSON array of os/arch[/variant] strings. The all platform
+// is reported as the platforms published from it.
+func HandlePluginPlatforms(w http.ResponseWriter, r *http.Request, lister cache.GenericLister) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "missing name in query")
+		return
+	}
+
+	plugin, err := getPlugin(lister, name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("plugin %s not found", name))
+			return
+		}
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting plugin %s err: %v", name, err))
+		return
+	}
+
+	respondJSON(w, r, http.StatusOK, pluginPlatforms(plugin))
+}
+
+// allPlatforms is the platform of the PluginPlatforms the controller expands
+// into each of its default platforms.
+const allPlatforms = "all"
+
+// pluginPlatforms returns the platforms of the plugin. The platforms the all
+// platform expands into are the ones published from it according to the
+// status of the plugin, which are listed after the explicit platforms.
+func pluginPlatforms(plugin *v1alpha1.Plugin) []string {
+	platforms := []string{}
+	listed := map[string]bool{}
+	all := false
+	for _, p := range plugin.Spec.Platforms {
+		if p.Platform == allPlatforms {
+			all = true
+			continue
+		}
+		platforms = append(platforms, p.Platform)
+		listed[p.Platform] = true
+	}
+	if !all {
+		return platforms
+	}
+	for _, p := range plugin.Status.Platforms {
+		if listed[p.Platform] || !meta.IsStatusConditionTrue(p.Conditions, "PlatformInstalled") {
+			continue
+		}
+		platforms = append(platforms, p.Platform)
+		listed[p.Platform] = true
+	}
+	return platforms
+}
+
+// HandlePluginDiagnostics returns the PluginDiagnostics of the Plugin given in
+// name query, so that failures can be investigated without the cluster logs.
+// Its manifest is the one published under its spec.krewName, if it is set.
+func HandlePluginDiagnostics(w http.ResponseWriter, r *http.Request, repo *Repo, lister cache.GenericLister) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "missing name in query")
+		return
+	}
+
+	if !safePluginRegexp.MatchString(name) {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid name %s", name))
+		return
+	}
+
+	diagnostics := PluginDiagnostics{
+		Name:      name,
+		LastError: repo.LastError(name),
+	}
+	plugin, err := getPlugin(lister, name)
+	if err != nil && !errors.IsNotFound(err) {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting plugin %s err: %v", name, err))
+		return
+	}
+	// the manifest of a deleted Plugin is the one left under its name
+	publishedName := name
+	if err == nil {
+		diagnostics.Status = &plugin.Status
+		if len(plugin.Spec.KrewName) > 0 {
+			publishedName = plugin.Spec.KrewName
+		}
+	}
+	manifest, err := repo.Manifest(publishedName)
+	if err != nil && !os.IsNotExist(err) {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting manifest of plugin %s err: %v", publishedName, err))
+		return
+	}
+	diagnostics.Manifest = string(manifest)
+
+	if diagnostics.Status == nil && diagnostics.LastError == nil && len(diagnostics.Manifest) == 0 {
+		respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("plugin %s not found", name))
+		return
+	}
+	respondJSON(w, r, http.StatusOK, diagnostics)
+}
+
+// MaxCompletions is the maximum number of names returned by the complete endpoint.
+const MaxCompletions = 50
+
+// HandlePluginComplete returns the names of the plugins of the index starting
+// with the prefix query, as a sorted JSON array, i.e. for autocompletion. At
+// most MaxCompletions names are returned, fewer if the limit query is lower.
+func HandlePluginComplete(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := MaxCompletions
+	if query := r.URL.Query().Get("limit"); len(query) > 0 {
+		parsed, err := strconv.Atoi(query)
+		if err != nil || parsed < 1 {
+			respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid limit %s, should be a positive number", query))
+			return
+		}
+		limit = min(parsed, MaxCompletions)
+	}
+
+	respondJSON(w, r, http.StatusOK, repo.Complete(r.URL.Query().Get("prefix"), limit))
+}
+
+// HandleVersion returns the version of the build serving the index,
+// i.e. its git commit and build date.
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+	respondJSON(w, r, http.StatusOK, version.Get())
+}
+
+// SelectedLister returns the lister of the Plugins of lister matching selector,
+// the others are neither listed nor found, so that the endpoints do not serve
+// the Plugins which are not published in the index.
+func SelectedLister(lister cache.GenericLister, selector labels.Selector) cache.GenericLister {
+	return &selectedLister{
+		selectedNamespaceLister: selectedNamespaceLister{lister: lister, selector: selector},
+		lister:                  lister,
+	}
+}
+
+type selectedLister struct {
+	selectedNamespaceLister
+	lister cache.GenericLister
+}
+
+func (s *selectedLister) ByNamespace(namespace string) cache.GenericNamespaceLister {
+	return &selectedNamespaceLister{lister: s.lister.ByNamespace(namespace), selector: s.selector}
+}
+
+type selectedNamespaceLister struct {
+	lister   cache.GenericNamespaceLister
+	selector labels.Selector
+}
+
+// List returns the objects matching both selector and the selector of the lister.
+func (s *selectedNamespaceLister) List(selector labels.Selector) ([]runtime.Object, error) {
+	objs, err := s.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	var selected []runtime.Object
+	for _, obj := range objs {
+		if s.matches(obj) {
+			selected = append(selected, obj)
+		}
+	}
+	return selected, nil
+}
+
+// Get returns the object named name, which is not found if it does not
+// match the selector of the lister.
+func (s *selectedNamespaceLister) Get(name string) (runtime.Object, error) {
+	obj, err := s.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !s.matches(obj) {
+		return nil, errors.NewNotFound(v1alpha1.GroupVersion.WithResource("plugins").GroupResource(), name)
+	}
+	return obj, nil
+}
+
+func (s *selectedNamespaceLister) matches(obj runtime.Object) bool {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	return s.selector.Matches(labels.Set(accessor.GetLabels()))
+}
+
+func getPlugin(lister cache.GenericLister, name string) (*v1alpha1.Plugin, error) {
+	obj, err := lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return pluginFromObject(obj)
+}
+
+func pluginFromObject(obj runtime.Object) (*v1alpha1.Plugin, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	plugin := &v1alpha1.Plugin{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(u, plugin)
+	if err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+func respondJSON(w http.ResponseWriter, r *http.Request, code int, obj interface{}) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("encoding response err: %v", err))
+		return
+	}
+	respond(w, r, code, "application/json", data)
+}
+
+// gzipMinSize is the size from which the responses are compressed, smaller
+// responses do not shrink enough to be worth it.
+const gzipMinSize = 1024
+
+// respond writes the data of the response. Successful responses have the
+// sha256 of the data as ETag, so that polling clients revalidate them with
+// If-None-Match and receive 304 Not Modified while they are unchanged.
+// Responses of at least gzipMinSize are compressed for the clients accepting gzip.
+func respond(w http.ResponseWriter, r *http.Request, code int, contentType string, data []byte) {
+	compress := len(data) >= gzipMinSize
+	if compress {
+		w.Header().Set("Vary", "Accept-Encoding")
+		compress = acceptsEncoding(r, "gzip")
+	}
+	if code == http.StatusOK {
+		sum := sha256.Sum256(data)
+		etag := hex.EncodeToString(sum[:])
+		if compress {
+			// each encoding of the response is a distinct representation
+			etag += "-gzip"
+		}
+		etag = strconv.Quote(etag)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if compress {
+		buf := &bytes.Buffer{}
+		gw := gzip.NewWriter(buf)
+		gw.Write(data)
+		if err := gw.Close(); err != nil {
+			respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("compressing response err: %v", err))
+			return
+		}
+		data = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// accepts the encoding, i.e. gzip without a zero quality value.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if strings.TrimSpace(name) != encoding {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+	return false
+}
+
+// etagMatches reports whether the If-None-Match header matches the etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsYAML reports whether the first media type of the Accept header
+// which is either YAML or JSON is YAML.
+func acceptsYAML(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+func respondYAML(w http.ResponseWriter, r *http.Request, code int, obj interface{}) {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("encoding response err: %v", err))
+		return
+	}
+	respond(w, r, code, "application/yaml", data)
+}
+
+// respondError writes the error as an ErrorResponse.
+func respondError(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	klog.V(4).Infof("responding %d %s: %s", code, reason, message)
+	data, _ := json.Marshal(ErrorResponse{
+		Code:    code,
+		Reason:  reason,
+		Message: message,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,905 @@
+package git
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+	"github.com/openshift/cli-manager/pkg/version"
+)
+
+func newTestLister(t *testing.T, plugins ...*v1alpha1.Plugin) cache.GenericLister {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, p := range plugins {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+		if err != nil {
+			t.Fatalf("unexpected conversion error %v", err)
+		}
+		if err := indexer.Add(&unstructured.Unstructured{Object: u}); err != nil {
+			t.Fatalf("unexpected indexer error %v", err)
+		}
+	}
+	return cache.NewGenericLister(indexer, v1alpha1.GroupVersion.WithResource("plugins").GroupResource())
+}
+
+func newTestPlugin(name string, platforms ...string) *v1alpha1.Plugin {
+	p := &v1alpha1.Plugin{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "Plugin",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1alpha1.PluginSpec{
+			ShortDescription: "Binary for " + name,
+			Version:          "v4.15.0",
+		},
+	}
+	for _, platform := range platforms {
+		p.Spec.Platforms = append(p.Spec.Platforms, v1alpha1.PluginPlatform{
+			Platform: platform,
+			Image:    "quay.io/openshift/origin-cli",
+			Files: []v1alpha1.FileLocation{
+				{From: "/usr/bin/" + name, To: "."},
+			},
+		})
+	}
+	return p
+}
+
+func TestHandlePluginList(t *testing.T) {
+	lister := newTestLister(t, newTestPlugin("oc", "linux/amd64", "darwin/arm64"), newTestPlugin("kubectl", "linux/amd64"))
+	mux := PrepareGitServer(nil, lister, Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/list/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+
+	list := PluginList{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if len(list.Items) != 2 {
+		t.Fatalf("expected 2 plugins, got %d", len(list.Items))
+	}
+	if list.Items[0].Name != "kubectl" || list.Items[1].Name != "oc" {
+		t.Fatalf("unexpected plugin order %v", list.Items)
+	}
+	if len(list.Items[1].Platforms) != 2 || list.Items[1].Platforms[1] != "darwin/arm64" {
+		t.Fatalf("unexpected platforms %v", list.Items[1].Platforms)
+	}
+}
+
+func TestHandlePluginStatus(t *testing.T) {
+	oc := newTestPlugin("oc", "linux/amd64", "darwin/arm64")
+	oc.Status = v1alpha1.PluginStatus{
+		Conditions: []metav1.Condition{{Type: "Ready", Status: metav1.ConditionTrue, Reason: "Published"}},
+		Platforms: []v1alpha1.PluginPlatformStatus{
+			{Platform: "linux/amd64", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionTrue, Reason: "Installed"}}},
+			{Platform: "darwin/arm64", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionTrue, Reason: "Installed"}}},
+		},
+	}
+	kubectl := newTestPlugin("kubectl", "linux/amd64", "windows/amd64")
+	kubectl.Status = v1alpha1.PluginStatus{
+		Conditions: []metav1.Condition{{Type: "Ready", Status: metav1.ConditionFalse, Reason: "PartiallyInstalled"}},
+		Platforms: []v1alpha1.PluginPlatformStatus{
+			{Platform: "linux/amd64", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionTrue, Reason: "Installed"}}},
+			{Platform: "windows/amd64", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionFalse, Reason: "ImagePullError"}}},
+		},
+	}
+	bash := newTestPlugin("bash", "linux/amd64")
+	bash.Status = v1alpha1.PluginStatus{
+		Conditions: []metav1.Condition{{Type: "Ready", Status: metav1.ConditionFalse, Reason: "InvalidField"}},
+	}
+	// not reconciled yet
+	helm := newTestPlugin("helm", "linux/amd64")
+	mux := PrepareGitServer(nil, newTestLister(t, oc, kubectl, bash, helm), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/status/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	summaries := []PluginStatusSummary{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	expected := []PluginStatusSummary{
+		{Name: "bash", Reason: "InvalidField", Platforms: []PlatformStatusSummary{}},
+		{Name: "helm", Platforms: []PlatformStatusSummary{}},
+		{Name: "kubectl", Reason: "PartiallyInstalled", Platforms: []PlatformStatusSummary{
+			{Platform: "linux/amd64", Ready: true, Reason: "Installed"},
+			{Platform: "windows/amd64", Reason: "ImagePullError"},
+		}},
+		{Name: "oc", Ready: true, Reason: "Published", Platforms: []PlatformStatusSummary{
+			{Platform: "linux/amd64", Ready: true, Reason: "Installed"},
+			{Platform: "darwin/arm64", Ready: true, Reason: "Installed"},
+		}},
+	}
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Fatalf("expected summaries %+v, got %+v", expected, summaries)
+	}
+}
+
+func TestHandlePluginDeprecated(t *testing.T) {
+	oc := newTestPlugin("oc", "linux/amd64")
+	oc.Spec.Deprecated = true
+	oc.Spec.DeprecationMessage = "use kubectl instead"
+	lister := newTestLister(t, oc, newTestPlugin("kubectl", "linux/amd64"))
+	mux := PrepareGitServer(nil, lister, Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/list/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	list := PluginList{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if list.Items[0].Deprecated || len(list.Items[0].DeprecationMessage) > 0 {
+		t.Fatalf("expected kubectl not to be deprecated, got %+v", list.Items[0])
+	}
+	if !list.Items[1].Deprecated || list.Items[1].DeprecationMessage != "use kubectl instead" {
+		t.Fatalf("expected oc to be deprecated, got %+v", list.Items[1])
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/info/?name=oc", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	info := PluginInfo{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if !info.Spec.Deprecated || info.Spec.DeprecationMessage != "use kubectl instead" {
+		t.Fatalf("expected oc to be deprecated, got %+v", info.Spec)
+	}
+}
+
+func TestHandlePluginListLabelSelector(t *testing.T) {
+	oc := newTestPlugin("oc", "linux/amd64")
+	oc.Labels = map[string]string{"team": "cli", "tier": "core"}
+	kubectl := newTestPlugin("kubectl", "linux/amd64")
+	kubectl.Labels = map[string]string{"team": "cli"}
+	bash := newTestPlugin("bash", "linux/amd64")
+	lister := newTestLister(t, oc, kubectl, bash)
+	mux := PrepareGitServer(nil, lister, Timeouts{})
+
+	tests := []struct {
+		name          string
+		selector      string
+		expectedCode  int
+		expectedNames []string
+	}{
+		{
+			name:          "selector matching a subset",
+			selector:      "team=cli",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"kubectl", "oc"},
+		},
+		{
+			name:          "set based selector",
+			selector:      "team in (cli),tier notin (core)",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"kubectl"},
+		},
+		{
+			name:          "selector matching nothing",
+			selector:      "team=storage",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{},
+		},
+		{
+			name:         "invalid selector",
+			selector:     "team in (cli",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/list/?labelSelector="+url.QueryEscape(tc.selector), nil))
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("expected status code %d, got %d body %s", tc.expectedCode, rec.Code, rec.Body.String())
+			}
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+			list := PluginList{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+				t.Fatalf("unexpected decoding error %v", err)
+			}
+			names := []string{}
+			for _, item := range list.Items {
+				names = append(names, item.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Fatalf("expected plugins %v, got %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestSelectedLister(t *testing.T) {
+	oc := newTestPlugin("oc", "linux/amd64")
+	oc.Labels = map[string]string{"team": "cli", "tier": "core"}
+	kubectl := newTestPlugin("kubectl", "linux/amd64")
+	kubectl.Labels = map[string]string{"team": "cli"}
+	// bash is not published, as it does not match the selector of the controller
+	bash := newTestPlugin("bash", "linux/amd64")
+	bash.Labels = map[string]string{"team": "shell"}
+	selector, err := labels.Parse("team=cli")
+	if err != nil {
+		t.Fatalf("unexpected selector error %v", err)
+	}
+	mux := PrepareGitServer(nil, SelectedLister(newTestLister(t, oc, kubectl, bash), selector), Timeouts{})
+
+	for query, expectedNames := range map[string][]string{
+		"":                           {"kubectl", "oc"},
+		"?labelSelector=tier%3Dcore": {"oc"},
+		"?labelSelector=" + url.QueryEscape("!tier"): {"kubectl"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/list/"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+		}
+		list := PluginList{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("unexpected decoding error %v", err)
+		}
+		names := []string{}
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+		if !reflect.DeepEqual(names, expectedNames) {
+			t.Fatalf("expected plugins %v for query %q, got %v", expectedNames, query, names)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/status/", nil))
+	summaries := []PluginStatusSummary{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if len(summaries) != 2 || summaries[0].Name != "kubectl" || summaries[1].Name != "oc" {
+		t.Fatalf("expected the status of the selected plugins, got %+v", summaries)
+	}
+
+	for _, endpoint := range []string{"info", "platforms"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/"+endpoint+"/?name=bash", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected status code %d for the %s of an unselected plugin, got %d body %s", http.StatusNotFound, endpoint, rec.Code, rec.Body.String())
+		}
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/"+endpoint+"/?name=oc", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status code %d for the %s of a selected plugin, got %d body %s", http.StatusOK, endpoint, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestHandlePluginInfo(t *testing.T) {
+	installed := newTestPlugin("oc", "linux/amd64")
+	installed.Status.Conditions = []metav1.Condition{
+		{
+			Type:    "PluginInstalled",
+			Status:  metav1.ConditionTrue,
+			Reason:  "Installed",
+			Message: "plugin oc is ready to be served",
+		},
+	}
+	failed := newTestPlugin("broken", "linux/amd64")
+	failed.Status.Conditions = []metav1.Condition{
+		{
+			Type:    "PluginInstalled",
+			Status:  metav1.ConditionFalse,
+			Reason:  "ImagePullError",
+			Message: "failed to pull the image error unauthorized",
+		},
+	}
+	lister := newTestLister(t, installed, failed)
+	mux := PrepareGitServer(nil, lister, Timeouts{})
+
+	tests := []struct {
+		name           string
+		url            string
+		expectedCode   int
+		expectedName   string
+		expectedStatus metav1.ConditionStatus
+		expectedReason string
+	}{
+		{
+			name:           "installed plugin",
+			url:            "/cli-manager/plugins/info/?name=oc",
+			expectedCode:   http.StatusOK,
+			expectedName:   "oc",
+			expectedStatus: metav1.ConditionTrue,
+			expectedReason: "Installed",
+		},
+		{
+			name:           "plugin failed to pull image",
+			url:            "/cli-manager/plugins/info/?name=broken",
+			expectedCode:   http.StatusOK,
+			expectedName:   "broken",
+			expectedStatus: metav1.ConditionFalse,
+			expectedReason: "ImagePullError",
+		},
+		{
+			name:         "unknown plugin",
+			url:          "/cli-manager/plugins/info/?name=unknown",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "missing name",
+			url:          "/cli-manager/plugins/info/",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("expected status code %d, got %d body %s", tc.expectedCode, rec.Code, rec.Body.String())
+			}
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+			info := PluginInfo{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+				t.Fatalf("unexpected decoding error %v", err)
+			}
+			if info.Name != tc.expectedName || info.Spec.Platforms[0].Platform != "linux/amd64" {
+				t.Fatalf("unexpected plugin info %+v", info)
+			}
+			if len(info.Status.Conditions) != 1 {
+				t.Fatalf("expected 1 condition, got %d", len(info.Status.Conditions))
+			}
+			if info.Status.Conditions[0].Status != tc.expectedStatus || info.Status.Conditions[0].Reason != tc.expectedReason {
+				t.Fatalf("unexpected condition %+v", info.Status.Conditions[0])
+			}
+		})
+	}
+}
+
+func TestHandlePluginInfoFormat(t *testing.T) {
+	lister := newTestLister(t, newTestPlugin("oc", "linux/amd64"))
+	mux := PrepareGitServer(nil, lister, Timeouts{})
+
+	tests := []struct {
+		name                string
+		url                 string
+		accept              string
+		expectedCode        int
+		expectedContentType string
+	}{
+		{
+			name:                "json by default",
+			url:                 "/cli-manager/plugins/info/?name=oc",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		{
+			name:                "yaml accept header",
+			url:                 "/cli-manager/plugins/info/?name=oc",
+			accept:              "application/yaml",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "application/yaml",
+		},
+		{
+			name:                "json preferred in accept header",
+			url:                 "/cli-manager/plugins/info/?name=oc",
+			accept:              "application/json, application/yaml;q=0.9",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		{
+			name:                "yaml format query",
+			url:                 "/cli-manager/plugins/info/?name=oc&format=yaml",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "application/yaml",
+		},
+		{
+			name:                "format query takes precedence over accept header",
+			url:                 "/cli-manager/plugins/info/?name=oc&format=json",
+			accept:              "application/yaml",
+			expectedCode:        http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		{
+			name:         "invalid format query",
+			url:          "/cli-manager/plugins/info/?name=oc&format=xml",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if len(tc.accept) > 0 {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("expected status code %d, got %d body %s", tc.expectedCode, rec.Code, rec.Body.String())
+			}
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+			if contentType := rec.Header().Get("Content-Type"); contentType != tc.expectedContentType {
+				t.Fatalf("expected content type %s, got %s", tc.expectedContentType, contentType)
+			}
+			info := PluginInfo{}
+			if tc.expectedContentType == "application/yaml" {
+				if json.Valid(rec.Body.Bytes()) {
+					t.Fatalf("expected a YAML body, got %s", rec.Body.String())
+				}
+				if err := yaml.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+					t.Fatalf("unexpected decoding error %v", err)
+				}
+			} else if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+				t.Fatalf("unexpected decoding error %v", err)
+			}
+			if info.Name != "oc" || info.Spec.Platforms[0].Platform != "linux/amd64" {
+				t.Fatalf("unexpected plugin info %+v", info)
+			}
+		})
+	}
+}
+
+func TestHandlePluginPlatforms(t *testing.T) {
+	lister := newTestLister(t, newTestPlugin("oc", "linux/amd64", "darwin/arm64", "windows/amd64"))
+	mux := PrepareGitServer(nil, lister, Timeouts{})
+
+	tests := []struct {
+		name              string
+		url               string
+		expectedCode      int
+		expectedPlatforms []string
+	}{
+		{
+			name:              "known plugin",
+			url:               "/cli-manager/plugins/platforms/?name=oc",
+			expectedCode:      http.StatusOK,
+			expectedPlatforms: []string{"linux/amd64", "darwin/arm64", "windows/amd64"},
+		},
+		{
+			name:         "unknown plugin",
+			url:          "/cli-manager/plugins/platforms/?name=unknown",
+			expectedCode: http.StatusNotFound,
+		},
+		{
+			name:         "missing name",
+			url:          "/cli-manager/plugins/platforms/",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("expected status code %d, got %d body %s", tc.expectedCode, rec.Code, rec.Body.String())
+			}
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+			platforms := []string{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &platforms); err != nil {
+				t.Fatalf("unexpected decoding error %v", err)
+			}
+			if !reflect.DeepEqual(platforms, tc.expectedPlatforms) {
+				t.Fatalf("expected platforms %v, got %v", tc.expectedPlatforms, platforms)
+			}
+		})
+	}
+}
+
+func TestHandlePluginAllPlatforms(t *testing.T) {
+	oc := newTestPlugin("oc", "all", "linux/arm/v7")
+	// the status lists the platforms all expands into, the ones which
+	// failed to be installed are not published
+	oc.Status.Platforms = []v1alpha1.PluginPlatformStatus{
+		{Platform: "linux/arm/v7", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionTrue, Reason: "Installed"}}},
+		{Platform: "linux/amd64", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionTrue, Reason: "Installed"}}},
+		{Platform: "darwin/arm64", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionTrue, Reason: "Installed"}}},
+		{Platform: "windows/amd64", Conditions: []metav1.Condition{{Type: "PlatformInstalled", Status: metav1.ConditionFalse, Reason: "ImagePullError"}}},
+	}
+	// not reconciled yet
+	kubectl := newTestPlugin("kubectl", "all")
+	mux := PrepareGitServer(nil, newTestLister(t, oc, kubectl), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/list/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	list := PluginList{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	expected := []string{"linux/arm/v7", "linux/amd64", "darwin/arm64"}
+	if len(list.Items) != 2 || !reflect.DeepEqual(list.Items[1].Platforms, expected) {
+		t.Fatalf("expected oc platforms %v, got %+v", expected, list.Items)
+	}
+	if len(list.Items[0].Platforms) != 0 {
+		t.Fatalf("expected no platforms before kubectl is reconciled, got %v", list.Items[0].Platforms)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/platforms/?name=oc", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	platforms := []string{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &platforms); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if !reflect.DeepEqual(platforms, expected) {
+		t.Fatalf("expected platforms %v, got %v", expected, platforms)
+	}
+}
+
+func TestHandlePluginDiagnostics(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	failed := newTestPlugin("broken", "linux/amd64")
+	failed.Status.Conditions = []metav1.Condition{
+		{
+			Type:    "PluginInstalled",
+			Status:  metav1.ConditionFalse,
+			Reason:  "ImagePullError",
+			Message: "failed to pull the image quay.io/openshift/origin-cli error unauthorized",
+		},
+	}
+	repo.RecordError("broken", fmt.Errorf("updating status of plugin broken: conflict"))
+	mux := PrepareGitServer(repo, newTestLister(t, failed), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/diagnostics/?name=broken", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	diagnostics := PluginDiagnostics{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &diagnostics); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if diagnostics.Status == nil || len(diagnostics.Status.Conditions) != 1 || diagnostics.Status.Conditions[0].Reason != "ImagePullError" {
+		t.Fatalf("expected the failure reason in the diagnostics, got %+v", diagnostics.Status)
+	}
+	if diagnostics.LastError == nil || diagnostics.LastError.Message != "updating status of plugin broken: conflict" {
+		t.Fatalf("unexpected last error %+v", diagnostics.LastError)
+	}
+	if len(diagnostics.Manifest) != 0 {
+		t.Fatalf("expected no manifest for a plugin not in the index, got %s", diagnostics.Manifest)
+	}
+
+	repo.RecordError("broken", nil)
+	if lastError := repo.LastError("broken"); lastError != nil {
+		t.Fatalf("expected the last error to be cleared, got %+v", lastError)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/diagnostics/?name=unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d body %s", http.StatusNotFound, rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlePluginDiagnosticsKrewName(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	plugin := newTestPlugin("team-oc", "linux/amd64")
+	plugin.Spec.KrewName = "oc"
+	plugin.Status.Conditions = []metav1.Condition{{Type: "PluginInstalled", Status: metav1.ConditionTrue, Reason: "Installed"}}
+	// the manifest is published under the Krew name
+	if err := repo.Upsert("oc", &krew.Plugin{ObjectMeta: metav1.ObjectMeta{Name: "oc"}}); err != nil {
+		t.Fatalf("unexpected upsert error %v", err)
+	}
+	repo.RecordError("team-oc", fmt.Errorf("updating status of plugin team-oc: conflict"))
+	mux := PrepareGitServer(repo, newTestLister(t, plugin), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/diagnostics/?name=team-oc", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	diagnostics := PluginDiagnostics{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &diagnostics); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	if diagnostics.Status == nil || len(diagnostics.Status.Conditions) != 1 {
+		t.Fatalf("expected the status of the Plugin, got %+v", diagnostics.Status)
+	}
+	if diagnostics.LastError == nil {
+		t.Fatal("expected the last error of the Plugin")
+	}
+	if !strings.Contains(diagnostics.Manifest, "name: oc") {
+		t.Fatalf("expected the manifest published under the Krew name, got %q", diagnostics.Manifest)
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	mux := PrepareGitServer(nil, newTestLister(t), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+	fields := map[string]string{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("unexpected decoding error %v", err)
+	}
+	expected := version.Get()
+	for field, value := range map[string]string{
+		"major":      expected.Major,
+		"minor":      expected.Minor,
+		"gitCommit":  expected.GitCommit,
+		"gitVersion": expected.GitVersion,
+		"buildDate":  expected.BuildDate,
+	} {
+		if actual, ok := fields[field]; !ok || actual != value {
+			t.Fatalf("expected %s %q, got %q in %v", field, value, actual, fields)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cli-manager/version", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status code %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	mux := PrepareGitServer(repo, newTestLister(t), Timeouts{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d before the initial reconcile, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	repo.SetReady()
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlePluginComplete(t *testing.T) {
+	repo, err := PrepareLocalGit(filepath.Join(t.TempDir(), "cli-manager"), Author{})
+	if err != nil {
+		t.Fatalf("unexpected prepare error %v", err)
+	}
+	for _, name := range []string{"oc", "kubectl", "odo", "opm", "oc-mirror", "helm"} {
+		if err := repo.Upsert(name, &krew.Plugin{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+			t.Fatalf("unexpected upsert error %v", err)
+		}
+	}
+	if err := repo.Delete("opm"); err != nil {
+		t.Fatalf("unexpected delete error %v", err)
+	}
+	mux := PrepareGitServer(repo, newTestLister(t), Timeouts{})
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedNames []string
+	}{
+		{
+			name:          "prefix",
+			query:         "prefix=o",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"oc", "oc-mirror", "odo"},
+		},
+		{
+			name:          "full name prefix",
+			query:         "prefix=oc",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"oc", "oc-mirror"},
+		},
+		{
+			name:          "limit",
+			query:         "prefix=o&limit=2",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"oc", "oc-mirror"},
+		},
+		{
+			name:          "no prefix",
+			query:         "",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{"helm", "kubectl", "oc", "oc-mirror", "odo"},
+		},
+		{
+			name:          "no match",
+			query:         "prefix=z",
+			expectedCode:  http.StatusOK,
+			expectedNames: []string{},
+		},
+		{
+			name:         "invalid limit",
+			query:        "prefix=o&limit=0",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cli-manager/plugins/complete/?"+tc.query, nil))
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("expected status code %d, got %d body %s", tc.expectedCode, rec.Code, rec.Body.String())
+			}
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+			names := []string{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &names); err != nil {
+				t.Fatalf("unexpected decoding error %v", err)
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Fatalf("expected names %v, got %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestPluginResponseETag(t *testing.T) {
+	modified := newTestPlugin("oc", "linux/amd64")
+	modified.Spec.Version = "v4.16.0"
+	original := PrepareGitServer(nil, newTestLister(t, newTestPlugin("oc", "linux/amd64")), Timeouts{})
+	updated := PrepareGitServer(nil, newTestLister(t, modified), Timeouts{})
+
+	for _, url := range []string{"/cli-manager/plugins/list/", "/cli-manager/plugins/info/?name=oc", "/cli-manager/plugins/info/?name=oc&format=yaml"} {
+		t.Run(url, func(t *testing.T) {
+			get := func(mux *http.ServeMux, ifNoneMatch string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, url, nil)
+				if len(ifNoneMatch) > 0 {
+					req.Header.Set("If-None-Match", ifNoneMatch)
+				}
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, req)
+				return rec
+			}
+
+			first := get(original, "")
+			etag := first.Header().Get("ETag")
+			if first.Code != http.StatusOK || len(etag) == 0 {
+				t.Fatalf("expected an ETag, got status code %d headers %v", first.Code, first.Header())
+			}
+			if cacheControl := first.Header().Get("Cache-Control"); cacheControl != "no-cache" {
+				t.Fatalf("expected responses to be revalidated, got Cache-Control %q", cacheControl)
+			}
+			if second := get(original, "").Header().Get("ETag"); second != etag {
+				t.Fatalf("expected the ETag to be stable, got %s then %s", etag, second)
+			}
+
+			rec := get(original, etag)
+			if rec.Code != http.StatusNotModified || rec.Body.Len() > 0 {
+				t.Fatalf("expected %d without body, got %d body %s", http.StatusNotModified, rec.Code, rec.Body.String())
+			}
+
+			rec = get(updated, etag)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected modified plugin to be returned, got status code %d", rec.Code)
+			}
+			if rec.Header().Get("ETag") == etag {
+				t.Fatalf("expected the ETag to change when the plugin is modified")
+			}
+		})
+	}
+}
+
+func TestPluginResponseGzip(t *testing.T) {
+	plugins := []*v1alpha1.Plugin{}
+	for i := 0; i < 50; i++ {
+		plugins = append(plugins, newTestPlugin(fmt.Sprintf("plugin-%d", i), "linux/amd64", "darwin/arm64", "windows/amd64"))
+	}
+	mux := PrepareGitServer(nil, newTestLister(t, plugins...), Timeouts{})
+
+	tests := []struct {
+		name           string
+		url            string
+		acceptEncoding string
+		expectedGzip   bool
+	}{
+		{
+			name:           "large list accepting gzip",
+			url:            "/cli-manager/plugins/list/",
+			acceptEncoding: "br, gzip;q=0.8",
+			expectedGzip:   true,
+		},
+		{
+			name: "large list without accept encoding",
+			url:  "/cli-manager/plugins/list/",
+		},
+		{
+			name:           "large list refusing gzip",
+			url:            "/cli-manager/plugins/list/",
+			acceptEncoding: "gzip;q=0",
+		},
+		{
+			name:           "small response",
+			url:            "/cli-manager/version",
+			acceptEncoding: "gzip",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if len(tc.acceptEncoding) > 0 {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected status code %d body %s", rec.Code, rec.Body.String())
+			}
+			if contentLength := rec.Header().Get("Content-Length"); contentLength != strconv.Itoa(rec.Body.Len()) {
+				t.Fatalf("expected Content-Length %d, got %s", rec.Body.Len(), contentLength)
+			}
+			if gzipped := rec.Header().Get("Content-Encoding") == "gzip"; gzipped != tc.expectedGzip {
+				t.Fatalf("expected gzip %t, got headers %v", tc.expectedGzip, rec.Header())
+			}
+			if !tc.expectedGzip {
+				return
+			}
+			if !strings.HasSuffix(rec.Header().Get("ETag"), `-gzip"`) {
+				t.Fatalf("expected a distinct ETag of the compressed response, got %s", rec.Header().Get("ETag"))
+			}
+			gr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("unexpected gzip error %v", err)
+			}
+			list := PluginList{}
+			if err := json.NewDecoder(gr).Decode(&list); err != nil {
+				t.Fatalf("unexpected decoding error %v", err)
+			}
+			if len(list.Items) != len(plugins) {
+				t.Fatalf("expected %d plugins, got %d", len(plugins), len(list.Items))
+			}
+		})
+	}
+}
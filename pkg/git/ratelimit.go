@@ -0,0 +1,100 @@
+package git
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RateLimit bounds the git and download requests of each client IP with a
+// token bucket refilled at QPS requests per second and holding up to Burst
+// requests. Zero QPS disables it.
+type RateLimit struct {
+	QPS   float64
+	Burst int
+}
+
+// ClientRateLimit is the rate limit of the git and download endpoints of
+// the servers prepared by PrepareGitServer.
+var ClientRateLimit = RateLimit{}
+
+// clientIdleTimeout is how long the bucket of a client is kept after its
+// last request, a full bucket is the same as a new one.
+const clientIdleTimeout = 10 * time.Minute
+
+// clientLimiter holds the token bucket of each client IP.
+type clientLimiter struct {
+	limit RateLimit
+
+	lock      sync.Mutex
+	clients   map[string]*clientBucket
+	lastPrune time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiter(limit RateLimit) *clientLimiter {
+	return &clientLimiter{
+		limit:   limit,
+		clients: map[string]*clientBucket{},
+	}
+}
+
+// reserve takes a token of the bucket of the client and returns zero if it
+// is allowed, or how long it should wait before retrying otherwise.
+func (l *clientLimiter) reserve(client string, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastPrune) > clientIdleTimeout {
+		for ip, bucket := range l.clients {
+			if now.Sub(bucket.lastSeen) > clientIdleTimeout {
+				delete(l.clients, ip)
+			}
+		}
+		l.lastPrune = now
+	}
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &clientBucket{limiter: rate.NewLimiter(rate.Limit(l.limit.QPS), l.limit.Burst)}
+		l.clients[client] = bucket
+	}
+	bucket.lastSeen = now
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		// the burst is zero, a single request never fits
+		return time.Second
+	}
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		// the rejected request does not consume the token
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// allow reports whether the request is within the rate limit of its client.
+// Rejected requests are answered with 429 Too Many Requests and Retry-After.
+func (l *clientLimiter) allow(w http.ResponseWriter, r *http.Request) bool {
+	if l.limit.QPS <= 0 {
+		return true
+	}
+	client := remoteAddr(r)
+	delay := l.reserve(client, time.Now())
+	if delay == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	respondError(w, http.StatusTooManyRequests, metav1.StatusReasonTooManyRequests, fmt.Sprintf("too many requests from %s, retry later", client))
+	return false
+}
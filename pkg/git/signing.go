@@ -0,0 +1,132 @@
+package git
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SigningKey signs the Krew manifests committed in the index if it is set.
+// The detached signature of each manifest is committed next to it, so that
+// the index can be verified after it is cloned. Manifests are not signed by default.
+var SigningKey ed25519.PrivateKey
+
+// signatureFileName returns the path of the detached signature of the
+// manifest of the plugin in the index.
+func signatureFileName(name string) string {
+	return fmt.Sprintf("plugins/%s.yaml.sig", name)
+}
+
+// SignManifest returns the base64 encoded Ed25519 signature of the manifest,
+// as it is committed in the index.
+func SignManifest(key ed25519.PrivateKey, manifest []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)) + "\n")
+}
+
+// VerifyManifest verifies the signature of the manifest returned by SignManifest.
+func VerifyManifest(key ed25519.PublicKey, manifest, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid manifest signature: %w", err)
+	}
+	if !ed25519.Verify(key, manifest, sig) {
+		return errors.New("manifest signature does not match the manifest")
+	}
+	return nil
+}
+
+// LoadSigningKey reads the PEM encoded PKCS #8 Ed25519 private key at path,
+// i.e. generated with openssl genpkey -algorithm ed25519.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid signing key %s, should be PEM encoded", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", path, err)
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid signing key %s, should be an Ed25519 key", path)
+	}
+	return signingKey, nil
+}
+
+// Signature returns the detached signature of the Krew manifest of the plugin
+// committed in the git repository. An error satisfying os.IsNotExist is
+// returned if the plugin is not in the index or its manifest is not signed.
+func (r *Repo) Signature(name string) ([]byte, error) {
+	return r.readFile(signatureFileName(name))
+}
+
+// HandlePluginSignature returns the detached signature of the Krew manifest
+// of the plugin given in name query, as it is committed in the index.
+func HandlePluginSignature(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+	if SigningKey == nil {
+		respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, "the manifests of the index are not signed")
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "missing name in query")
+		return
+	}
+	if !safePluginRegexp.MatchString(name) {
+		respondError(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid name %s", name))
+		return
+	}
+
+	signature, err := repo.Signature(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("plugin %s not found in the index", name))
+			return
+		}
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("getting signature of plugin %s err: %v", name, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(signature)
+}
+
+// HandleSigningKey returns the PEM encoded public key verifying the
+// signatures of the manifests. It should be distributed to the clients
+// out of band as well, a tampered index could serve another key.
+func HandleSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+	if SigningKey == nil {
+		respondError(w, http.StatusNotFound, metav1.StatusReasonNotFound, "the manifests of the index are not signed")
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(SigningKey.Public())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("encoding the signing key err: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusOK)
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
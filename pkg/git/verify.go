@@ -0,0 +1,192 @@
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/metrics"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/cli-manager/pkg/image"
+	krew "github.com/openshift/cli-manager/pkg/krew/v1alpha2"
+	"github.com/openshift/cli-manager/pkg/platform"
+)
+
+// archiveMismatches is set by each verification of the archives.
+var archiveMismatches = metrics.NewGauge(
+	&metrics.GaugeOpts{
+		Name:           "cli_manager_plugin_archive_mismatches",
+		Help:           "Number of served plugin archives whose sha256 does not match the manifest of the index at the last verification",
+		StabilityLevel: metrics.ALPHA,
+	},
+)
+
+// VerifyReport is the result of verifying the archives served for the
+// platforms of the manifests committed in the index.
+type VerifyReport struct {
+	// Time is when the archives were verified.
+	Time metav1.Time `json:"time"`
+	// Verified is the number of archives verified.
+	Verified int `json:"verified"`
+	// Mismatches are the archives which do not match their manifest.
+	Mismatches []ArchiveMismatch `json:"mismatches"`
+}
+
+// ArchiveMismatch is an archive whose sha256 differs from the one
+// advertised in the manifest of its plugin, or which is missing.
+type ArchiveMismatch struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+	Archive  string `json:"archive"`
+	Expected string `json:"expected"`
+	// Actual is the sha256 of the archive, empty if it can not be read.
+	Actual  string `json:"actual,omitempty"`
+	Message string `json:"message"`
+}
+
+// Verify recomputes the sha256 of the archives served for every platform
+// of the manifests committed in the index, and reports the ones which do
+// not match the sha256 advertised to Krew, i.e. corrupted on disk. The
+// report is retained as the last verification of the repo. Concurrent
+// verifications are serialized.
+func (r *Repo) Verify() (VerifyReport, error) {
+	r.verifyMu.Lock()
+	defer r.verifyMu.Unlock()
+	return r.verify()
+}
+
+// verify verifies the archives, r.verifyMu must be held.
+func (r *Repo) verify() (VerifyReport, error) {
+	report := VerifyReport{
+		Time:       metav1.Now(),
+		Mismatches: []ArchiveMismatch{},
+	}
+	names, err := r.List()
+	if err != nil {
+		return report, err
+	}
+	for _, name := range names {
+		data, err := r.Manifest(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// the plugin was deleted meanwhile
+				continue
+			}
+			return report, err
+		}
+		k := &krew.Plugin{}
+		if err := yaml.Unmarshal(data, k); err != nil {
+			return report, fmt.Errorf("invalid manifest of plugin %s: %w", name, err)
+		}
+		for _, p := range k.Spec.Platforms {
+			report.Verified++
+			if mismatch := verifyArchive(name, p); mismatch != nil {
+				report.Mismatches = append(report.Mismatches, *mismatch)
+			}
+		}
+	}
+	archiveMismatches.Set(float64(len(report.Mismatches)))
+	r.lastVerify.Store(&report)
+	return report, nil
+}
+
+// LastVerifyReport returns the report of the last verification of the
+// archives, or nil if they were not verified yet.
+func (r *Repo) LastVerifyReport() *VerifyReport {
+	return r.lastVerify.Load()
+}
+
+// verifyArchive returns the mismatch of the archive served for the
+// platform of the manifest of the plugin, or nil if it matches.
+func verifyArchive(name string, p krew.Platform) *ArchiveMismatch {
+	mismatch := &ArchiveMismatch{
+		Name:     name,
+		Expected: p.Sha256,
+	}
+	// the archive is the one downloaded from the uri of the platform
+	uri, err := url.Parse(p.URI)
+	if err != nil {
+		mismatch.Message = fmt.Sprintf("invalid uri %s: %v", p.URI, err)
+		return mismatch
+	}
+	parsed, err := platform.Parse(uri.Query().Get("platform"))
+	if err != nil {
+		mismatch.Message = fmt.Sprintf("invalid uri %s: %v", p.URI, err)
+		return mismatch
+	}
+	mismatch.Platform = parsed.String()
+	mismatch.Archive = image.ArchiveName(uri.Query().Get("name"), parsed)
+
+	f, err := os.Open(filepath.Join(image.TarballPath, mismatch.Archive))
+	if err != nil {
+		mismatch.Message = fmt.Sprintf("archive can not be read: %v", err)
+		return mismatch
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		mismatch.Message = fmt.Sprintf("archive can not be read: %v", err)
+		return mismatch
+	}
+	mismatch.Actual = hex.EncodeToString(h.Sum(nil))
+	if mismatch.Actual == p.Sha256 {
+		return nil
+	}
+	mismatch.Message = "sha256 of the archive does not match the manifest"
+	return mismatch
+}
+
+// RunVerifier verifies the archives every interval until ctx is done,
+// updating the cli_manager_plugin_archive_mismatches metric.
+func (r *Repo) RunVerifier(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		report, err := r.Verify()
+		if err != nil {
+			klog.ErrorS(err, "Archive verification failed")
+			return
+		}
+		for _, mismatch := range report.Mismatches {
+			klog.InfoS("Served archive does not match the manifest", "plugin", mismatch.Name, "platform", mismatch.Platform, "archive", mismatch.Archive, "message", mismatch.Message)
+		}
+	}, interval)
+}
+
+// HandlePluginVerify verifies the archives served for the manifests of the
+// index on demand, and returns the VerifyReport listing the mismatches. While
+// another verification is running, its archives are not read again and the
+// report of the last verification is returned instead, so that concurrent
+// requests do not read every archive at once.
+func HandlePluginVerify(w http.ResponseWriter, r *http.Request, repo *Repo) {
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !repo.verifyMu.TryLock() {
+		report := repo.LastVerifyReport()
+		if report == nil {
+			w.Header().Set("Retry-After", "10")
+			respondError(w, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, "archives are being verified, retry later")
+			return
+		}
+		respondJSON(w, r, http.StatusOK, report)
+		return
+	}
+	report, err := repo.verify()
+	repo.verifyMu.Unlock()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("verifying archives err: %v", err))
+		return
+	}
+	respondJSON(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,452 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/platform"
+)
+
+// ArchiveName returns the file name of the archive of the plugin for the platform.
+// Windows platforms are archived in zip which Krew and Windows extract natively,
+// other platforms in tar.gz.
+func ArchiveName(name string, p platform.Platform) string {
+	if p.IsWindows() {
+		return fmt.Sprintf("%s_%s.zip", name, p.FileName())
+	}
+	return fmt.Sprintf("%s_%s.tar.gz", name, p.FileName())
+}
+
+// ZstdArchiveName returns the file name of the zstd compressed tarball of the
+// plugin for the platform, served instead of the tar.gz archive to the
+// clients accepting the zstd encoding. Windows platforms have none.
+func ZstdArchiveName(name string, p platform.Platform) string {
+	return fmt.Sprintf("%s_%s.tar.zst", name, p.FileName())
+}
+
+// archivePluginName returns the name of the plugin whose archive for the
+// platform is at path, as named by ArchiveName.
+func archivePluginName(path string, p platform.Platform) string {
+	return strings.TrimSuffix(filepath.Base(path), ArchiveName("", p))
+}
+
+// zstdArchivePath returns the path of the zstd compressed tarball written
+// along the tar.gz archive at path.
+func zstdArchivePath(path string) string {
+	return strings.TrimSuffix(path, ".tar.gz") + ".tar.zst"
+}
+
+// blobsDir is the directory of TarballPath storing the archives by their sha256,
+// the archives of the plugins are symlinks to them.
+const blobsDir = "blobs"
+
+// blobsMu guards the blobs against being pruned while they are linked.
+var blobsMu sync.Mutex
+
+// Deduplicate moves the archive at path whose sha256 is checksum into the
+// blobs of TarballPath and replaces it with a symlink to the blob, so that
+// identical archives of different plugins or platforms are stored once.
+// The blobs which are no longer linked are removed.
+func Deduplicate(path, checksum string) error {
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+
+	dir := filepath.Join(TarballPath, blobsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	blob := filepath.Join(dir, checksum)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.Link(path, blob); err != nil {
+			return fmt.Errorf("storing blob of %s: %v", path, err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	target, err := filepath.Rel(filepath.Dir(path), blob)
+	if err != nil {
+		return err
+	}
+	// the archive is replaced by renaming the symlink over it,
+	// so that it can be downloaded at any time.
+	link := path + ".link"
+	os.Remove(link)
+	if err := os.Symlink(target, link); err != nil {
+		return fmt.Errorf("linking %s to blob %s: %v", path, checksum, err)
+	}
+	if err := os.Rename(link, path); err != nil {
+		os.Remove(link)
+		return fmt.Errorf("linking %s to blob %s: %v", path, checksum, err)
+	}
+	return pruneBlobs()
+}
+
+// LinkedChecksum returns the sha256 of the archive at path from the name of
+// the blob it links to, without reading it. ok is false if it is not a link
+// to a blob, i.e. an archive written before it could be deduplicated.
+func LinkedChecksum(path string) (checksum string, ok bool) {
+	target, err := os.Readlink(path)
+	if err != nil || filepath.Base(filepath.Dir(target)) != blobsDir {
+		return "", false
+	}
+	return filepath.Base(target), true
+}
+
+// PruneBlobs removes the blobs of TarballPath no archive links to.
+func PruneBlobs() error {
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+	return pruneBlobs()
+}
+
+func pruneBlobs() error {
+	entries, err := os.ReadDir(TarballPath)
+	if err != nil {
+		return err
+	}
+	linked := map[string]struct{}{}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(TarballPath, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(target) == blobsDir {
+			linked[filepath.Base(target)] = struct{}{}
+		}
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(TarballPath, blobsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, blob := range blobs {
+		if _, ok := linked[blob.Name()]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(TarballPath, blobsDir, blob.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return pruneExtractions(linked)
+}
+
+// pruneExtractions removes the extraction records whose archive is no longer linked.
+func pruneExtractions(linked map[string]struct{}) error {
+	records, err := os.ReadDir(filepath.Join(TarballPath, extractionsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, record := range records {
+		path := filepath.Join(TarballPath, extractionsDir, record.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		e := extraction{}
+		if err := json.Unmarshal(data, &e); err == nil {
+			if _, ok := linked[e.Checksum]; ok {
+				continue
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractionsDir is the directory of TarballPath recording the archive and
+// the files extracted for each extraction key, see CachedExtraction.
+const extractionsDir = "extractions"
+
+// extraction is the outcome of an extraction recorded in extractionsDir.
+type extraction struct {
+	Checksum string                  `json:"checksum"`
+	Files    []v1alpha1.FileLocation `json:"files"`
+}
+
+// RecordExtraction records that the archive whose sha256 is checksum holds
+// the files extracted for key, which should identify the resolved image
+// digests and everything else the archive is built from.
+func RecordExtraction(key, checksum string, files []v1alpha1.FileLocation) error {
+	dir := filepath.Join(TarballPath, extractionsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(extraction{Checksum: checksum, Files: files})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, key), data, 0644)
+}
+
+// CachedExtraction returns the files and the checksum recorded for key if the
+// archive at path still links to the blob of that checksum, so that extracting
+// the same images again can be skipped. ok is false otherwise.
+func CachedExtraction(key, path string) (files []v1alpha1.FileLocation, checksum string, ok bool) {
+	data, err := os.ReadFile(filepath.Join(TarballPath, extractionsDir, key))
+	if err != nil {
+		return nil, "", false
+	}
+	e := extraction{}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, "", false
+	}
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+	if linked, ok := LinkedChecksum(path); !ok || linked != e.Checksum {
+		return nil, "", false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, "", false
+	}
+	return e.Files, e.Checksum, true
+}
+
+// archiveWriter writes the extracted files of a platform into its archive.
+type archiveWriter interface {
+	// WriteFile writes the file described by the tar header with its content.
+	WriteFile(header *tar.Header, content io.Reader) error
+	// Close flushes the archive, it does not close the underlying writer.
+	Close() error
+}
+
+// ExtractOptions configures how the archives are written.
+type ExtractOptions struct {
+	// CompressionLevel is the compress/flate level of the archives, from
+	// gzip.NoCompression storing the files as is to gzip.BestCompression.
+	CompressionLevel int
+	// Zstd writes a zstd compressed tarball along the tar.gz archive
+	// of the platforms other than Windows.
+	Zstd bool
+	// Layout is how the files are named in the archives, one of ArchiveLayouts.
+	// The Krew manifests refer to the files by their name in the archives, their
+	// installation paths do not depend on the layout.
+	Layout string
+}
+
+// DefaultExtractOptions are the options the archives are written with by default.
+var DefaultExtractOptions = ExtractOptions{
+	CompressionLevel: gzip.DefaultCompression,
+	Layout:           ArchiveLayoutImage,
+}
+
+// Validate ensures that the archives can be written with the options.
+func (o ExtractOptions) Validate() error {
+	if o.CompressionLevel < gzip.HuffmanOnly || o.CompressionLevel > gzip.BestCompression {
+		return fmt.Errorf("invalid compression level %d, should be from %d to %d", o.CompressionLevel, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	if !slices.Contains(ArchiveLayouts, o.Layout) {
+		return fmt.Errorf("invalid archive layout %s, should be one of %s", o.Layout, strings.Join(ArchiveLayouts, ", "))
+	}
+	return nil
+}
+
+const (
+	// ArchiveLayoutImage names the entries of the archives after the paths
+	// of the files in the image, i.e. usr/bin/oc.
+	ArchiveLayoutImage = "image"
+	// ArchiveLayoutFlat names the entries of the archives after the base
+	// names of the files, i.e. oc, the entries of a directory being under
+	// its base name.
+	ArchiveLayoutFlat = "flat"
+	// ArchiveLayoutPrefixed names the entries of the archives after the paths
+	// of the files in the image under the name of the plugin, i.e. oc/usr/bin/oc,
+	// so that the archives of several plugins can be extracted in the same directory.
+	ArchiveLayoutPrefixed = "prefixed"
+)
+
+// ArchiveLayouts are the supported layouts of the archives.
+var ArchiveLayouts = []string{ArchiveLayoutImage, ArchiveLayoutFlat, ArchiveLayoutPrefixed}
+
+// EntryName returns the path of the file, or of the directory, in the
+// archive of the plugin name according to the Layout of the options.
+func (o ExtractOptions) EntryName(name string, f v1alpha1.FileLocation) string {
+	switch o.Layout {
+	case ArchiveLayoutFlat:
+		return path.Base(SourcePath(f))
+	case ArchiveLayoutPrefixed:
+		return path.Join(name, SourcePath(f))
+	default:
+		return SourcePath(f)
+	}
+}
+
+// newArchiveWriter returns the writer of the archive of the platform into w
+// compressed at level. The tarball is also written zstd compressed into zw
+// if it is not nil.
+func newArchiveWriter(w, zw io.Writer, p platform.Platform, level int) (archiveWriter, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", level)
+	}
+	if p.IsWindows() {
+		zw := zip.NewWriter(w)
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+		method := zip.Deflate
+		if level == gzip.NoCompression {
+			method = zip.Store
+		}
+		return &zipArchiveWriter{zw: zw, method: method, dirs: map[string]struct{}{}}, nil
+	}
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if zw == nil {
+		return &tarGzArchiveWriter{gw: gw, tw: tar.NewWriter(gw), dirs: map[string]struct{}{}}, nil
+	}
+	ze, err := zstd.NewWriter(zw)
+	if err != nil {
+		return nil, err
+	}
+	return &tarGzArchiveWriter{gw: gw, ze: ze, tw: tar.NewWriter(io.MultiWriter(gw, ze)), dirs: map[string]struct{}{}}, nil
+}
+
+// validEntryName ensures that the name of an archive entry is relative and
+// can not escape the installation directory when Krew extracts the archive.
+func validEntryName(name string) error {
+	// Windows paths are rooted by a backslash or a drive letter
+	if len(name) == 0 || path.IsAbs(name) || strings.HasPrefix(name, `\`) || (len(name) > 1 && name[1] == ':') {
+		return fmt.Errorf("invalid archive entry %q, it must be a relative path", name)
+	}
+	for _, element := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element == ".." {
+			return fmt.Errorf("invalid archive entry %q, it must not contain .. elements", name)
+		}
+	}
+	return nil
+}
+
+// parentDirs returns the intermediate directories of the archive entry name,
+// from the outermost one, i.e. usr/ and usr/bin/ for usr/bin/oc.
+func parentDirs(name string) []string {
+	var dirs []string
+	for i, r := range name {
+		if r == '/' {
+			dirs = append(dirs, name[:i+1])
+		}
+	}
+	return dirs
+}
+
+type tarGzArchiveWriter struct {
+	gw *gzip.Writer
+	// ze compresses the same tarball with zstd, if enabled
+	ze *zstd.Encoder
+	tw *tar.Writer
+	// dirs are the directory entries already written
+	dirs map[string]struct{}
+}
+
+func (a *tarGzArchiveWriter) WriteFile(header *tar.Header, content io.Reader) error {
+	if err := validEntryName(header.Name); err != nil {
+		return err
+	}
+	// strict extractors do not create the directories of the files on their own
+	for _, dir := range parentDirs(header.Name) {
+		if _, ok := a.dirs[dir]; ok {
+			continue
+		}
+		err := a.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir,
+			Mode:     0755,
+			ModTime:  header.ModTime,
+		})
+		if err != nil {
+			return fmt.Errorf("writing tar header of %s: %v", dir, err)
+		}
+		a.dirs[dir] = struct{}{}
+	}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("writing tar header of %s: %v", header.Name, err)
+	}
+	if _, err := io.Copy(a.tw, content); err != nil {
+		return fmt.Errorf("writing tar contents of %s: %v", header.Name, err)
+	}
+	return nil
+}
+
+func (a *tarGzArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.ze != nil {
+		if err := a.ze.Close(); err != nil {
+			return err
+		}
+	}
+	return a.gw.Close()
+}
+
+type zipArchiveWriter struct {
+	zw     *zip.Writer
+	method uint16
+	// dirs are the directory entries already written
+	dirs map[string]struct{}
+}
+
+func (a *zipArchiveWriter) WriteFile(header *tar.Header, content io.Reader) error {
+	if err := validEntryName(header.Name); err != nil {
+		return err
+	}
+	for _, dir := range parentDirs(header.Name) {
+		if _, ok := a.dirs[dir]; ok {
+			continue
+		}
+		dh := &zip.FileHeader{
+			Name:     dir,
+			Method:   zip.Store,
+			Modified: header.ModTime,
+		}
+		dh.SetMode(os.ModeDir | 0755)
+		if _, err := a.zw.CreateHeader(dh); err != nil {
+			return fmt.Errorf("writing zip header of %s: %v", dir, err)
+		}
+		a.dirs[dir] = struct{}{}
+	}
+	zh, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return fmt.Errorf("creating zip header of %s: %v", header.Name, err)
+	}
+	zh.Name = header.Name
+	zh.Method = a.method
+	w, err := a.zw.CreateHeader(zh)
+	if err != nil {
+		return fmt.Errorf("writing zip header of %s: %v", header.Name, err)
+	}
+	if _, err := io.Copy(w, content); err != nil {
+		return fmt.Errorf("writing zip contents of %s: %v", header.Name, err)
+	}
+	return nil
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
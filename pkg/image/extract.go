@@ -2,45 +2,136 @@ package image
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/klog/v2"
 
 	"github.com/openshift/cli-manager/api/v1alpha1"
+	"github.com/openshift/cli-manager/pkg/platform"
 )
 
-const TarballPath = "/var/run/plugins/"
+// TarballPath is the directory the plugin tarballs are extracted into and served from.
+var TarballPath = "/var/run/plugins/"
 
-// Pull an image down to the local filesystem.
-func Pull(src string, auth string, platform *v1.Platform, ca string, proxy *url.URL) (v1.Image, error) {
-	craneOptions := []crane.Option{}
-	if len(auth) > 0 {
+// MaxFileSize is the maximum size in bytes of a single extracted file and
+// MaxExtractSize the maximum size of all the files extracted for a platform,
+// so that a misconfigured or malicious image can not fill the disk.
+var (
+	MaxFileSize    int64 = 2 << 30
+	MaxExtractSize int64 = 4 << 30
+)
+
+// ErrTooLarge is returned by Extract when the extracted files exceed
+// MaxFileSize or MaxExtractSize.
+var ErrTooLarge = errors.New("extracted files are too large")
+
+// ErrChecksumMismatch is returned by Extract when the sha256 checksum of the
+// extracted Bin does not match the one specified in the platform.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+const (
+	// annotationTitle is the OCI annotation for the file name of a layer blob.
+	annotationTitle = "org.opencontainers.image.title"
+)
+
+// PullOptions configures how an image is pulled.
+type PullOptions struct {
+	// Auth is the base64 encoded auth of the registry in docker config format.
+	// If it is empty, the credentials of the docker config file are used.
+	Auth string
+	// Platform selects the image from an image index.
+	Platform *v1.Platform
+	// CABundle is the base64 encoded PEM CA bundle trusted to access the registry.
+	CABundle string
+	// Proxy is the URL of the proxy the registry is accessed through. If it
+	// is not set, the proxy of the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	// environment variables is used.
+	Proxy *url.URL
+	// NoProxy are the registries accessed directly instead of through Proxy,
+	// as host names, domains matching their subdomains (i.e. .example.com),
+	// IP addresses or CIDRs, or * for every registry.
+	NoProxy []string
+	// Mirrors maps source registries or repositories (i.e. quay.io or quay.io/openshift)
+	// to the mirrors that are contacted instead of them.
+	Mirrors map[string]string
+}
+
+// Pull an image down to the local filesystem. Layers of the returned
+// image are fetched lazily by using ctx.
+func Pull(ctx context.Context, src string, opts PullOptions) (v1.Image, error) {
+	src, err := MirrorReference(src, opts.Mirrors)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).InfoS("Pulling image", "image", src)
+
+	craneOptions, err := newCraneOptions(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return crane.Pull(src, craneOptions...)
+}
+
+// Digest resolves the digest of the image Pull would return, by only fetching
+// its manifests instead of pulling it.
+func Digest(ctx context.Context, src string, opts PullOptions) (string, error) {
+	src, err := MirrorReference(src, opts.Mirrors)
+	if err != nil {
+		return "", err
+	}
+	klog.V(4).InfoS("Resolving image digest", "image", src)
+
+	craneOptions, err := newCraneOptions(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+	return crane.Digest(src, craneOptions...)
+}
+
+func newCraneOptions(ctx context.Context, opts PullOptions) ([]crane.Option, error) {
+	craneOptions := []crane.Option{crane.WithContext(ctx)}
+	if len(opts.Auth) > 0 {
 		auth := authn.FromConfig(authn.AuthConfig{
-			Auth: auth,
+			Auth: opts.Auth,
 		})
 		craneOptions = append(craneOptions, crane.WithAuth(auth))
+	} else {
+		// fall back to the ambient credentials of $HOME/.docker/config.json
+		// or $DOCKER_CONFIG, i.e. the node credentials mounted in the pod.
+		craneOptions = append(craneOptions, crane.WithAuthFromKeychain(authn.DefaultKeychain))
 	}
 
-	if platform != nil {
-		craneOptions = append(craneOptions, crane.WithPlatform(platform))
+	if opts.Platform != nil {
+		craneOptions = append(craneOptions, crane.WithPlatform(opts.Platform))
 	}
 
 	transport := remote.DefaultTransport.(*http.Transport).Clone()
-	if ca != "" {
-		caBytes, err := base64.StdEncoding.DecodeString(ca)
+	if opts.CABundle != "" {
+		caBytes, err := base64.StdEncoding.DecodeString(opts.CABundle)
 		if err != nil {
 			return nil, fmt.Errorf("error decoding CA certificate: %w", err)
 		}
@@ -56,48 +147,402 @@ func Pull(src string, auth string, platform *v1.Platform, ca string, proxy *url.
 		}
 	}
 
-	if proxy != nil {
-		transport.Proxy = http.ProxyURL(proxy)
+	transport.Proxy = http.ProxyFromEnvironment
+	if opts.Proxy != nil {
+		transport.Proxy = proxyFunc(opts.Proxy, opts.NoProxy)
 	}
 
 	var rt http.RoundTripper = transport
-	craneOptions = append(craneOptions, crane.WithTransport(rt))
-	return crane.Pull(src, craneOptions...)
+	return append(craneOptions, crane.WithTransport(rt)), nil
 }
 
-// Extract an image's filesystem as a tarball, or individual files from the image.
-func Extract(img v1.Image, platform v1alpha1.PluginPlatform, destinationName string) ([]v1alpha1.FileLocation, error) {
-	layers, err := img.Layers()
+// proxyFunc returns the proxy function of the transport accessing the
+// registries through proxy, except for the ones matching noProxy.
+func proxyFunc(proxy *url.URL, noProxy []string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+}
+
+// bypassProxy reports whether the host matches one of the noProxy entries.
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if len(domain) > 0 && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorReference returns the reference of the image in the mirror configured
+// for its repository. When multiple mirror sources match the repository, the
+// most specific (longest) one takes precedence. Tags and digests are kept,
+// so that digests are still verified against the mirrored content.
+func MirrorReference(src string, mirrors map[string]string) (string, error) {
+	if len(mirrors) == 0 {
+		return src, nil
+	}
+
+	ref, err := name.ParseReference(src)
 	if err != nil {
-		return nil, fmt.Errorf("retrieving image layers: %v", err)
+		return "", fmt.Errorf("parsing image reference %s: %w", src, err)
+	}
+
+	repository := ref.Context().Name()
+	source, target := "", ""
+	for s, m := range mirrors {
+		s = strings.TrimSuffix(s, "/")
+		// docker.io references are resolved to index.docker.io
+		if s == "docker.io" || strings.HasPrefix(s, "docker.io/") {
+			s = "index." + s
+		}
+		if repository != s && !strings.HasPrefix(repository, s+"/") {
+			continue
+		}
+		if len(s) > len(source) {
+			source, target = s, m
+		}
+	}
+	if len(source) == 0 {
+		return src, nil
 	}
 
-	processedTargets := make(map[string]struct{})
+	mirror := strings.TrimSuffix(target, "/") + strings.TrimPrefix(repository, source)
+	switch r := ref.(type) {
+	case name.Digest:
+		return mirror + "@" + r.DigestStr(), nil
+	case name.Tag:
+		return mirror + ":" + r.TagStr(), nil
+	}
+	return mirror, nil
+}
+
+// Extract individual files from the image into an archive written with opts,
+// a zip for Windows platforms and a tarball for the others.
+func Extract(ctx context.Context, img v1.Image, pluginPlatform v1alpha1.PluginPlatform, destinationName string, opts ExtractOptions) ([]v1alpha1.FileLocation, error) {
+	images := map[string]v1.Image{pluginPlatform.Image: img}
+	for _, ref := range FileImages(pluginPlatform) {
+		images[ref] = img
+	}
+	return ExtractImages(ctx, images, pluginPlatform, destinationName, opts)
+}
 
-	file, err := os.Create(destinationName)
+// ExtractImages extracts individual files from multiple images into a single
+// archive like Extract. images are keyed by their reference, each file is
+// extracted from its Image, or from the Image of the platform if not set.
+// The archive is written aside and only replaces the previous one once the
+// extraction succeeds, so that the previous archive is served meanwhile and
+// kept if it fails.
+func ExtractImages(ctx context.Context, images map[string]v1.Image, pluginPlatform v1alpha1.PluginPlatform, destinationName string, opts ExtractOptions) (_ []v1alpha1.FileLocation, err error) {
+	p, err := platform.Parse(pluginPlatform.Platform)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	file, err := createTemp(destinationName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		file.Close()
+		// a partial archive must not be served
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
 
-	foundLen := 0
+	zstdName := zstdArchivePath(destinationName)
+	var zstdFile *os.File
+	if opts.Zstd && !p.IsWindows() {
+		if zstdFile, err = createTemp(zstdName); err != nil {
+			return nil, err
+		}
+		defer func() {
+			zstdFile.Close()
+			if err != nil {
+				os.Remove(zstdFile.Name())
+			}
+		}()
+	}
+
+	var zw io.Writer
+	if zstdFile != nil {
+		zw = zstdFile
+	}
+	aw, err := newArchiveWriter(file, zw, p, opts.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	var binHash hash.Hash
+	if len(pluginPlatform.Sha256) > 0 {
+		binHash = sha256.New()
+	}
+	found := map[string]struct{}{}
+	var written int64
+	entries := map[string]string{}
+	// the files searched by name are replaced with the ones resolved in their image
+	files := slices.Clone(pluginPlatform.Files)
+	for _, ref := range FileImages(pluginPlatform) {
+		img, ok := images[ref]
+		if !ok {
+			return nil, fmt.Errorf("image %s is not pulled", ref)
+		}
+		// each image is walked for its own files only
+		imagePlatform := pluginPlatform
+		imagePlatform.Files = nil
+		var indexes []int
+		for i, f := range files {
+			if FileImage(pluginPlatform, f) == ref {
+				imagePlatform.Files = append(imagePlatform.Files, f)
+				indexes = append(indexes, i)
+			}
+		}
+		if ref != pluginPlatform.Image {
+			imagePlatform.LayerDigest = ""
+		}
+		if len(pluginPlatform.ArtifactType) == 0 {
+			if err := resolveFileNames(ctx, img, imagePlatform.Files); err != nil {
+				return nil, fmt.Errorf("searching files in image %s: %w", ref, err)
+			}
+			for j, i := range indexes {
+				files[i] = imagePlatform.Files[j]
+			}
+		}
+
+		e := &extractor{
+			platform: imagePlatform,
+			aw:       aw,
+			files:    indexFiles(imagePlatform.Files),
+			dirs:     indexDirs(imagePlatform.Files),
+			binHash:  binHash,
+			written:  &written,
+			name:     archivePluginName(destinationName, p),
+			opts:     opts,
+			entries:  entries,
+
+			processed:    make(map[string]struct{}),
+			found:        make(map[string]struct{}),
+			pendingLinks: make(map[string][]extractTarget),
+		}
+		var fileLocation []v1alpha1.FileLocation
+		if len(pluginPlatform.ArtifactType) > 0 {
+			fileLocation, err = extractArtifact(ctx, img, e)
+		} else {
+			fileLocation, err = extractImage(ctx, img, e)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("extracting from image %s: %w", ref, err)
+		}
+		for _, f := range fileLocation {
+			found[SourcePath(f)] = struct{}{}
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return nil, fmt.Errorf("writing archive %s: %v", destinationName, err)
+	}
+	if binHash != nil {
+		if checksum := hex.EncodeToString(binHash.Sum(nil)); checksum != strings.ToLower(pluginPlatform.Sha256) {
+			return nil, fmt.Errorf("%w: expected sha256 %s of %s, got %s", ErrChecksumMismatch, pluginPlatform.Sha256, pluginPlatform.Bin, checksum)
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("writing archive %s: %v", destinationName, err)
+	}
+	if zstdFile != nil {
+		if err := zstdFile.Close(); err != nil {
+			return nil, fmt.Errorf("writing archive %s: %v", zstdName, err)
+		}
+		if err := os.Rename(zstdFile.Name(), zstdName); err != nil {
+			return nil, fmt.Errorf("replacing archive %s: %v", zstdName, err)
+		}
+	} else if err := os.Remove(zstdName); err != nil && !os.IsNotExist(err) {
+		// a stale zstd tarball must not be served in place of the new archive
+		return nil, err
+	}
+	// the archive may be a link to a blob shared with other archives, the
+	// link is replaced instead of the blob being written through.
+	if err := os.Rename(file.Name(), destinationName); err != nil {
+		return nil, fmt.Errorf("replacing archive %s: %v", destinationName, err)
+	}
+
+	var fileLocation []v1alpha1.FileLocation
+	for _, f := range files {
+		if _, ok := found[SourcePath(f)]; ok {
+			fileLocation = append(fileLocation, f)
+		}
+	}
+	return fileLocation, nil
+}
+
+// createTemp creates the file an archive is written into before it is renamed
+// to name. It is hidden in the same directory, so that the rename is atomic
+// and it is not mistaken for the archive of a plugin.
+func createTemp(name string) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return nil, err
+	}
+	// the archives are served like the ones os.Create used to write
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// FileImage returns the image the file is extracted from,
+// which is the Image of the platform if the file does not set it.
+func FileImage(pluginPlatform v1alpha1.PluginPlatform, f v1alpha1.FileLocation) string {
+	if len(f.Image) > 0 {
+		return f.Image
+	}
+	return pluginPlatform.Image
+}
+
+// FileImages returns the distinct images the files of the platform are
+// extracted from, in the order of the files.
+func FileImages(pluginPlatform v1alpha1.PluginPlatform) []string {
+	var refs []string
+	for _, f := range pluginPlatform.Files {
+		ref := FileImage(pluginPlatform, f)
+		if !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// extractImage writes the files of the platform found in the filesystem of the image.
+func extractImage(ctx context.Context, img v1.Image, e *extractor) ([]v1alpha1.FileLocation, error) {
+	platform := e.platform
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving image layers: %v", err)
+	}
+
+	if len(platform.LayerDigest) > 0 {
+		hinted, err := layerByDigest(layers, platform.LayerDigest)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.extractLayer(hinted); err != nil {
+			return nil, err
+		}
+		if e.linksAdded && !e.done() {
+			if err := e.extractLayer(hinted); err != nil {
+				return nil, err
+			}
+		}
+		if !e.done() {
+			klog.V(4).InfoS("Files are not all found in the layer hint, walking every layer", "platform", platform.Platform, "layer", platform.LayerDigest)
+		}
+	}
 	// we iterate through the layers in reverse order because it makes handling
 	// whiteout layers more efficient, since we can just keep track of the removed
 	// files as we see .wh. layers and ignore those in previous layers.
 	for i := len(layers) - 1; i >= 0; i-- {
-		if foundLen == len(platform.Files) {
+		if e.done() {
 			break
 		}
-		layer := layers[i]
-		layerReader, err := layer.Uncompressed()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		e.linksAdded = false
+		if err := e.extractLayer(layers[i]); err != nil {
+			return nil, err
+		}
+		// hardlinks generally point to a file preceding them in the same layer,
+		// so the layer is walked once more to resolve their contents.
+		if e.linksAdded && !e.done() {
+			if err := e.extractLayer(layers[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var fileLocation []v1alpha1.FileLocation
+	for _, f := range platform.Files {
+		if _, ok := e.found[SourcePath(f)]; ok {
+			fileLocation = append(fileLocation, f)
+		}
+	}
+
+	return fileLocation, nil
+}
+
+// layerByDigest returns the layer of the image whose digest is digest.
+func layerByDigest(layers []v1.Layer, digest string) (v1.Layer, error) {
+	for _, layer := range layers {
+		d, err := layer.Digest()
 		if err != nil {
-			return nil, fmt.Errorf("reading layer contents: %v", err)
+			return nil, fmt.Errorf("retrieving layer digest: %v", err)
+		}
+		if d.String() == digest {
+			return layer, nil
 		}
+	}
+	return nil, fmt.Errorf("layer %s is not found in the image", digest)
+}
+
+// searchDirs are the directories whose files are preferred, in this order,
+// when a file is searched by name.
+var searchDirs = []string{"usr/local/bin", "usr/bin", "bin"}
+
+// resolveFileNames replaces the From of the files searched by name with the
+// absolute path of the file of that name found in the filesystem of the
+// image. Every layer is walked, as a file in a preferred directory may be in
+// any of them. The files which are not found are left unchanged.
+func resolveFileNames(ctx context.Context, img v1.Image, files []v1alpha1.FileLocation) error {
+	names := map[string]struct{}{}
+	for _, f := range files {
+		if f.FindByName {
+			names[f.From] = struct{}{}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("retrieving image layers: %v", err)
+	}
 
+	// first keeps the first match of each name, preferred its match in
+	// each search directory.
+	first := map[string]string{}
+	preferred := map[string]map[string]string{}
+	processed := map[string]struct{}{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		layerReader, err := layers[i].Uncompressed()
+		if err != nil {
+			return fmt.Errorf("reading layer contents: %v", err)
+		}
 		tarReader := tar.NewReader(layerReader)
 		for {
 			header, err := tarReader.Next()
@@ -106,62 +551,390 @@ func Extract(img v1.Image, platform v1alpha1.PluginPlatform, destinationName str
 			}
 			if err != nil {
 				layerReader.Close()
-				return nil, fmt.Errorf("reading tar: %v", err)
+				return fmt.Errorf("reading tar: %v", err)
 			}
-
-			// skip directories
-			if header.Typeflag == tar.TypeDir {
+			// only the files which can be extracted are matched
+			if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeLink {
 				continue
 			}
-
-			// skip empty file contents
-			if header.Size == 0 {
+			if header.Size == 0 && header.Typeflag != tar.TypeLink {
+				continue
+			}
+			name := filepath.Clean(header.Name)
+			if _, ok := processed[name]; ok {
+				continue
+			}
+			processed[name] = struct{}{}
+			base := filepath.Base(name)
+			if _, ok := names[base]; !ok {
 				continue
 			}
+			if _, ok := first[base]; !ok {
+				first[base] = name
+			}
+			if dir := filepath.Dir(name); slices.Contains(searchDirs, dir) {
+				if preferred[dir] == nil {
+					preferred[dir] = map[string]string{}
+				}
+				if _, ok := preferred[dir][base]; !ok {
+					preferred[dir][base] = name
+				}
+			}
+		}
+		layerReader.Close()
+	}
+
+	for i, f := range files {
+		if !f.FindByName {
+			continue
+		}
+		resolved, ok := first[f.From]
+		if !ok {
+			klog.V(2).InfoS("File searched by name is not found in the image", "file", f.From)
+			continue
+		}
+		for _, dir := range searchDirs {
+			if name, ok := preferred[dir][f.From]; ok {
+				resolved = name
+				break
+			}
+		}
+		klog.V(4).InfoS("File searched by name is resolved", "file", f.From, "path", "/"+resolved)
+		files[i].From = "/" + resolved
+	}
+	return nil
+}
 
-			// some tools prepend everything with "./", so if we don't Clean the
-			// name, we may have duplicate entries, which angers tar-split.
-			header.Name = filepath.Clean(header.Name)
+// extractArtifact writes the layer blobs of an OCI artifact whose media type is
+// the artifact type of the platform as the files of the platform.
+func extractArtifact(ctx context.Context, img v1.Image, e *extractor) ([]v1alpha1.FileLocation, error) {
+	platform := e.platform
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving image manifest: %v", err)
+	}
+
+	for _, desc := range manifest.Layers {
+		if e.done() {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if string(desc.MediaType) != platform.ArtifactType {
+			continue
+		}
 
-			// skip empty file names
-			if len(header.Name) == 0 {
+		title := desc.Annotations[annotationTitle]
+		for _, f := range platform.Files {
+			if _, ok := e.found[f.From]; ok {
 				continue
 			}
-
-			// skip the file if it was already found and processed in a previous/more recent layer
-			if _, ok := processedTargets[header.Name]; ok {
+			if title != filepath.Base(f.From) && (len(title) > 0 || len(platform.Files) > 1) {
 				continue
 			}
 
-			// determine if we care about the given file
-			for _, target := range platform.Files {
-				if header.Name == strings.TrimPrefix(target.From, "/") {
-					processedTargets[target.From] = struct{}{}
-					// TODO: Should we write it to target.To?
-					if err := tw.WriteHeader(header); err != nil {
-						continue
-					}
-
-					if _, err := io.Copy(tw, tarReader); err != nil {
-						continue
-					}
-					foundLen++
-					break
-				}
+			layer, err := img.LayerByDigest(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("retrieving layer %s: %v", desc.Digest, err)
 			}
-			if foundLen == len(platform.Files) {
-				break
+			// artifact blobs are the files themselves, they are not decompressed
+			blob, err := layer.Compressed()
+			if err != nil {
+				return nil, fmt.Errorf("reading layer contents: %v", err)
 			}
+			header := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Clean(strings.TrimPrefix(f.From, "/")),
+				Size:     desc.Size,
+				Mode:     0644,
+			}
+			err = e.write(extractTarget{header: header, file: f}, blob)
+			blob.Close()
+			if err != nil {
+				return nil, err
+			}
+			break
 		}
-		layerReader.Close()
 	}
 
 	var fileLocation []v1alpha1.FileLocation
 	for _, f := range platform.Files {
-		if _, ok := processedTargets[f.From]; ok {
+		if _, ok := e.found[f.From]; ok {
 			fileLocation = append(fileLocation, f)
 		}
 	}
-
 	return fileLocation, nil
 }
+
+// extractTarget is an entry to be written in the archive for the file operation.
+type extractTarget struct {
+	header *tar.Header
+	file   v1alpha1.FileLocation
+}
+
+// extractor writes the files of the platform found in image layers into an archive.
+type extractor struct {
+	platform v1alpha1.PluginPlatform
+	aw       archiveWriter
+	// files indexes the file operations of the platform by the name of
+	// their tar entry, the first operation of a name taking precedence.
+	files map[string]v1alpha1.FileLocation
+	// dirs indexes the directory operations of the platform by the name
+	// of their tar entry, every entry under them is extracted.
+	dirs map[string]v1alpha1.FileLocation
+
+	// processed keeps the names of the files already seen in a more recent layer.
+	processed map[string]struct{}
+	// found keeps the file operations whose contents are written.
+	found map[string]struct{}
+	// pendingLinks keeps the hardlinks waiting for the contents of their
+	// target, keyed by the name of the target.
+	pendingLinks map[string][]extractTarget
+	// linksAdded reports whether a hardlink is found in the current layer.
+	linksAdded bool
+	// binHash computes the sha256 checksum of the Bin while it is written,
+	// it is only set when the platform specifies the expected one.
+	binHash hash.Hash
+	// written is the size of the files written in the archive, which is
+	// shared by the extractors of the images of the platform.
+	written *int64
+	// name is the name of the plugin the archive is written for.
+	name string
+	// opts are the options the archive is written with.
+	opts ExtractOptions
+	// entries keeps the source paths of the entries written in the archive
+	// by their name, which is shared by the extractors of the images.
+	entries map[string]string
+}
+
+func indexFiles(files []v1alpha1.FileLocation) map[string]v1alpha1.FileLocation {
+	index := make(map[string]v1alpha1.FileLocation, len(files))
+	for _, f := range files {
+		if len(f.FromDir) > 0 {
+			continue
+		}
+		// the names of the tar entries are cleaned, so is the path of the file
+		name := filepath.Clean(strings.TrimPrefix(f.From, "/"))
+		if _, ok := index[name]; !ok {
+			index[name] = f
+		}
+	}
+	return index
+}
+
+func indexDirs(files []v1alpha1.FileLocation) map[string]v1alpha1.FileLocation {
+	index := map[string]v1alpha1.FileLocation{}
+	for _, f := range files {
+		if len(f.FromDir) == 0 {
+			continue
+		}
+		name := filepath.Clean(strings.TrimPrefix(f.FromDir, "/"))
+		if _, ok := index[name]; !ok {
+			index[name] = f
+		}
+	}
+	return index
+}
+
+// dirFile returns the directory operation the tar entry is under,
+// the deepest directory taking precedence.
+func (e *extractor) dirFile(name string) (v1alpha1.FileLocation, bool) {
+	for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if f, ok := e.dirs[dir]; ok {
+			return f, true
+		}
+	}
+	return v1alpha1.FileLocation{}, false
+}
+
+func (e *extractor) done() bool {
+	// the files of a directory may be in any layer
+	if len(e.dirs) > 0 {
+		return false
+	}
+	return len(e.found) == len(e.platform.Files) && len(e.pendingLinks) == 0
+}
+
+func (e *extractor) extractLayer(layer v1.Layer) error {
+	layerReader, err := layer.Uncompressed()
+	if err != nil {
+		return fmt.Errorf("reading layer contents: %v", err)
+	}
+	defer layerReader.Close()
+
+	tarReader := tar.NewReader(layerReader)
+	for {
+		if e.done() {
+			return nil
+		}
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %v", err)
+		}
+
+		// skip directories
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		// skip empty file contents, hardlinks have no contents on their own
+		if header.Size == 0 && header.Typeflag != tar.TypeLink {
+			continue
+		}
+
+		// some tools prepend everything with "./", so if we don't Clean the
+		// name, we may have duplicate entries, which angers tar-split.
+		header.Name = filepath.Clean(header.Name)
+
+		// skip empty file names
+		if len(header.Name) == 0 {
+			continue
+		}
+
+		var targets []extractTarget
+		// skip the file if it was already found and processed in a previous/more recent layer
+		if _, ok := e.processed[header.Name]; !ok {
+			// determine if we care about the given file
+			f, ok := e.files[header.Name]
+			if !ok && len(e.dirs) > 0 {
+				f, ok = e.dirFile(header.Name)
+			}
+			if ok {
+				e.processed[header.Name] = struct{}{}
+				if header.Typeflag == tar.TypeLink {
+					linkName := filepath.Clean(header.Linkname)
+					e.pendingLinks[linkName] = append(e.pendingLinks[linkName], extractTarget{header: header, file: f})
+					e.linksAdded = true
+				} else {
+					targets = append(targets, extractTarget{header: header, file: f})
+				}
+			}
+		}
+
+		// resolve the hardlinks pointing to this file
+		if links, ok := e.pendingLinks[header.Name]; ok && header.Typeflag != tar.TypeLink {
+			for _, link := range links {
+				h := *header
+				h.Name = link.header.Name
+				targets = append(targets, extractTarget{header: &h, file: link.file})
+			}
+			delete(e.pendingLinks, header.Name)
+		}
+
+		if len(targets) == 0 {
+			continue
+		}
+
+		var content io.Reader = tarReader
+		if len(targets) > 1 {
+			data, err := io.ReadAll(tarReader)
+			if err != nil {
+				return fmt.Errorf("reading tar: %v", err)
+			}
+			content = bytes.NewReader(data)
+		}
+		for _, target := range targets {
+			if err := e.write(target, content); err != nil {
+				return err
+			}
+			if r, ok := content.(*bytes.Reader); ok {
+				r.Seek(0, io.SeekStart)
+			}
+		}
+	}
+}
+
+func (e *extractor) write(target extractTarget, content io.Reader) error {
+	header := target.header
+	if header.Size > MaxFileSize {
+		return fmt.Errorf("%w: file %s of %d bytes exceeds the maximum file size %d", ErrTooLarge, "/"+header.Name, header.Size, MaxFileSize)
+	}
+	if *e.written+header.Size > MaxExtractSize {
+		return fmt.Errorf("%w: files exceed the maximum extract size %d", ErrTooLarge, MaxExtractSize)
+	}
+	*e.written += header.Size
+	if len(target.file.Mode) > 0 {
+		mode, err := ParseMode(target.file.Mode)
+		if err != nil {
+			return err
+		}
+		// the setuid, setgid and sticky bits of the image are dropped as well
+		header.Mode = header.Mode&^07777 | mode
+	}
+	// Krew links the Bin after installation, it must be executable
+	// regardless of the mode it is stored in the image.
+	if len(e.platform.Bin) > 0 && target.installPath() == filepath.Clean(e.platform.Bin) {
+		header.Mode |= 0111
+		if e.binHash != nil {
+			content = io.TeeReader(content, e.binHash)
+		}
+	}
+	source := "/" + header.Name
+	// the entries are named according to the layout of the archive, Krew
+	// moves them to target.To once it is extracted.
+	header.Name = target.entryName(e.name, e.opts)
+	// files of the same base name collide once the archive is flat
+	if previous, ok := e.entries[header.Name]; ok && previous != source {
+		return fmt.Errorf("files %s and %s are both written as %s in the %s archive", previous, source, header.Name, e.opts.Layout)
+	}
+	e.entries[header.Name] = source
+	if err := e.aw.WriteFile(header, content); err != nil {
+		return err
+	}
+	e.found[SourcePath(target.file)] = struct{}{}
+	klog.V(4).InfoS("File is extracted", "platform", e.platform.Platform, "file", source, "entry", header.Name)
+	return nil
+}
+
+// ParseMode parses the octal Mode of a file, which must only set permission bits.
+func ParseMode(mode string) (int64, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, should be octal permissions like 0755", mode)
+	}
+	return int64(m), nil
+}
+
+// InstallPath returns the path of the file relative to the root of the
+// installation folder after Krew executes the file operation.
+func InstallPath(f v1alpha1.FileLocation) string {
+	if f.To == "" || f.To == "." || strings.HasSuffix(f.To, "/") {
+		return filepath.Join(f.To, filepath.Base(SourcePath(f)))
+	}
+	return filepath.Clean(f.To)
+}
+
+// installPath returns the path of the extracted entry relative to the root of
+// the installation folder, which is under the InstallPath of its directory
+// operation for the entries of a directory.
+func (t extractTarget) installPath() string {
+	if len(t.file.FromDir) == 0 {
+		return InstallPath(t.file)
+	}
+	rel, _ := filepath.Rel(filepath.Clean(strings.TrimPrefix(t.file.FromDir, "/")), t.header.Name)
+	return filepath.Join(InstallPath(t.file), rel)
+}
+
+// entryName returns the name of the extracted entry in the archive of the
+// plugin name written with opts, which is under the EntryName of its directory
+// operation for the entries of a directory.
+func (t extractTarget) entryName(name string, opts ExtractOptions) string {
+	entry := path.Clean(strings.TrimPrefix(opts.EntryName(name, t.file), "/"))
+	if len(t.file.FromDir) == 0 {
+		return entry
+	}
+	rel, _ := filepath.Rel(filepath.Clean(strings.TrimPrefix(t.file.FromDir, "/")), t.header.Name)
+	return path.Join(entry, filepath.ToSlash(rel))
+}
+
+// SourcePath returns the path of the file, or of the directory, in the image.
+func SourcePath(f v1alpha1.FileLocation) string {
+	if len(f.FromDir) > 0 {
+		return f.FromDir
+	}
+	return f.From
+}
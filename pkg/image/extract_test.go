@@ -0,0 +1,1610 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/openshift/cli-manager/api/v1alpha1"
+	pluginplatform "github.com/openshift/cli-manager/pkg/platform"
+)
+
+type testFile struct {
+	name     string
+	content  string
+	mode     int64
+	typeflag byte
+	linkname string
+}
+
+// newTestImage builds an image whose layers contain the given files,
+// the first layer being the base one.
+func newTestImage(t testing.TB, layers ...[]testFile) v1.Image {
+	t.Helper()
+	img := empty.Image
+	for _, files := range layers {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, f := range files {
+			hdr := &tar.Header{
+				Name:     f.name,
+				Mode:     f.mode,
+				Size:     int64(len(f.content)),
+				Typeflag: f.typeflag,
+				Linkname: f.linkname,
+			}
+			if hdr.Typeflag == 0 {
+				hdr.Typeflag = tar.TypeReg
+			}
+			if hdr.Mode == 0 {
+				hdr.Mode = 0644
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("unexpected tar header error %v", err)
+			}
+			if _, err := tw.Write([]byte(f.content)); err != nil {
+				t.Fatalf("unexpected tar write error %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("unexpected tar close error %v", err)
+		}
+		data := buf.Bytes()
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected layer error %v", err)
+		}
+		img, err = mutate.AppendLayers(img, layer)
+		if err != nil {
+			t.Fatalf("unexpected append layer error %v", err)
+		}
+	}
+	return img
+}
+
+// blobLayer is an OCI artifact layer whose blob is stored as is.
+type blobLayer struct {
+	content   []byte
+	mediaType types.MediaType
+}
+
+func (l *blobLayer) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(l.content))
+	return h, err
+}
+
+func (l *blobLayer) DiffID() (v1.Hash, error) {
+	return l.Digest()
+}
+
+func (l *blobLayer) Compressed() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(l.content)), nil
+}
+
+func (l *blobLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.Compressed()
+}
+
+func (l *blobLayer) Size() (int64, error) {
+	return int64(len(l.content)), nil
+}
+
+func (l *blobLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+// readTarball returns the headers and the contents of the files in the tar.gz archive.
+func readTarball(t *testing.T, path string) (map[string]*tar.Header, map[string]string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected open error %v", err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("unexpected gzip error %v", err)
+	}
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected tar error %v", err)
+		}
+		// only the files are returned, not their parent directories
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected read error %v", err)
+		}
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = string(data)
+	}
+	return headers, contents
+}
+
+func TestExtractExecutableBin(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0644},
+		{name: "usr/share/oc/config", content: "config", mode: 0640},
+	})
+
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr/bin/oc", To: "."},
+			{From: "/usr/share/oc/config", To: "."},
+		},
+	}
+	dest := filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz")
+	files, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+	if err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	headers, contents := readTarball(t, dest)
+	if headers["usr/bin/oc"].Mode&0111 != 0111 {
+		t.Fatalf("expected bin to be executable, got mode %o", headers["usr/bin/oc"].Mode)
+	}
+	if headers["usr/share/oc/config"].Mode != 0640 {
+		t.Fatalf("expected mode of other files to be preserved, got mode %o", headers["usr/share/oc/config"].Mode)
+	}
+	if contents["usr/bin/oc"] != "oc binary" {
+		t.Fatalf("unexpected content %q", contents["usr/bin/oc"])
+	}
+}
+
+func TestExtractMode(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0644},
+		{name: "usr/bin/helper", content: "helper binary", mode: 04750},
+		{name: "usr/share/oc/config", content: "config", mode: 0600},
+		{name: "usr/share/oc/LICENSE", content: "license", mode: 0640},
+	})
+
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files: []v1alpha1.FileLocation{
+			// the bin stays executable even if its mode does not say so
+			{From: "/usr/bin/oc", To: ".", Mode: "0600"},
+			{From: "/usr/bin/helper", To: ".", Mode: "755"},
+			{From: "/usr/share/oc/config", To: ".", Mode: "0644"},
+			{From: "/usr/share/oc/LICENSE", To: "."},
+		},
+	}
+	dest := filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz")
+	if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+
+	headers, _ := readTarball(t, dest)
+	for name, expected := range map[string]int64{
+		"usr/bin/oc":           0711,
+		"usr/bin/helper":       0755,
+		"usr/share/oc/config":  0644,
+		"usr/share/oc/LICENSE": 0640,
+	} {
+		if headers[name].Mode != expected {
+			t.Fatalf("expected mode %o of %s, got %o", expected, name, headers[name].Mode)
+		}
+	}
+}
+
+func TestExtractZstd(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0755},
+	})
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files:    []v1alpha1.FileLocation{{From: "/usr/bin/oc", To: "."}},
+	}
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "oc_linux_amd64.tar.gz")
+	zstdDest := filepath.Join(dir, "oc_linux_amd64.tar.zst")
+
+	opts := DefaultExtractOptions
+	opts.Zstd = true
+	if _, err := Extract(context.Background(), img, platform, dest, opts); err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+
+	gz, err := os.Open(dest)
+	if err != nil {
+		t.Fatalf("unexpected open error %v", err)
+	}
+	defer gz.Close()
+	gr, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatalf("unexpected gzip error %v", err)
+	}
+	tarball, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	zf, err := os.Open(zstdDest)
+	if err != nil {
+		t.Fatalf("unexpected open error %v", err)
+	}
+	defer zf.Close()
+	zr, err := zstd.NewReader(zf)
+	if err != nil {
+		t.Fatalf("unexpected zstd error %v", err)
+	}
+	defer zr.Close()
+	zstdTarball, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	if !bytes.Equal(tarball, zstdTarball) {
+		t.Fatalf("expected the zstd tarball to match the tar.gz one")
+	}
+
+	// the zstd tarball of a previous extraction is removed once disabled
+	if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if _, err := os.Stat(zstdDest); !os.IsNotExist(err) {
+		t.Fatalf("expected the zstd tarball to be removed, got %v", err)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for mode, valid := range map[string]bool{
+		"0755":  true,
+		"644":   true,
+		"0":     true,
+		"0778":  false,
+		"4755":  false,
+		"rwx":   false,
+		"-0644": false,
+	} {
+		if _, err := ParseMode(mode); (err == nil) != valid {
+			t.Fatalf("expected mode %s to be valid %t, got %v", mode, valid, err)
+		}
+	}
+}
+
+func TestExtractNormalizedFrom(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "./usr/bin/oc", content: "oc binary", mode: 0755},
+	})
+
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr//bin/./oc", To: "."},
+		},
+	}
+	dest := filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz")
+	if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	_, contents := readTarball(t, dest)
+	if contents["usr/bin/oc"] != "oc binary" {
+		t.Fatalf("expected the file to be found by its cleaned path, got %v", contents)
+	}
+}
+
+func TestExtractSha256(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0755},
+		{name: "usr/share/oc/config", content: "config", mode: 0644},
+	})
+	sum := sha256.Sum256([]byte("oc binary"))
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name          string
+		sha256        string
+		expectedError bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:   "matching",
+			sha256: checksum,
+		},
+		{
+			name:   "matching in upper case",
+			sha256: strings.ToUpper(checksum),
+		},
+		{
+			name:          "mismatching",
+			sha256:        strings.Repeat("0", 64),
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			platform := v1alpha1.PluginPlatform{
+				Platform: "linux/amd64",
+				Bin:      "oc",
+				Sha256:   tc.sha256,
+				Files: []v1alpha1.FileLocation{
+					{From: "/usr/share/oc/config", To: "."},
+					{From: "/usr/bin/oc", To: "."},
+				},
+			}
+			files, err := Extract(context.Background(), img, platform, filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz"), DefaultExtractOptions)
+			if tc.expectedError {
+				if !errors.Is(err, ErrChecksumMismatch) {
+					t.Fatalf("expected checksum mismatch error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected extract error %v", err)
+			}
+			if len(files) != 2 {
+				t.Fatalf("expected 2 files, got %d", len(files))
+			}
+		})
+	}
+}
+
+func TestExtractKeepsPreviousArchive(t *testing.T) {
+	tarballPath := TarballPath
+	TarballPath = t.TempDir()
+	defer func() {
+		TarballPath = tarballPath
+	}()
+	img := newTestImage(t, []testFile{{name: "usr/bin/oc", content: "oc binary", mode: 0755}})
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files:    []v1alpha1.FileLocation{{From: "/usr/bin/oc", To: "."}},
+	}
+	dest := filepath.Join(TarballPath, "oc_linux_amd64.tar.gz")
+	if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	previous, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	sum := sha256.Sum256(previous)
+	checksum := hex.EncodeToString(sum[:])
+	if err := Deduplicate(dest, checksum); err != nil {
+		t.Fatalf("unexpected deduplicate error %v", err)
+	}
+
+	// the previous archive is still linked once extracting it again fails
+	platform.Sha256 = strings.Repeat("0", 64)
+	if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+	if linked, ok := LinkedChecksum(dest); !ok || linked != checksum {
+		t.Fatalf("expected archive to still link to blob %s, got %s", checksum, linked)
+	}
+	if data, err := os.ReadFile(dest); err != nil || !bytes.Equal(data, previous) {
+		t.Fatalf("expected the previous archive to be served, got error %v", err)
+	}
+	entries, err := os.ReadDir(TarballPath)
+	if err != nil {
+		t.Fatalf("unexpected read error %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Fatalf("expected the partial archive %s to be removed", entry.Name())
+		}
+	}
+
+	// a successful extraction replaces the link with the new archive
+	platform.Sha256 = ""
+	platform.Files = append(platform.Files, v1alpha1.FileLocation{From: "/usr/bin/oc", To: "bin/"})
+	if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if _, ok := LinkedChecksum(dest); ok {
+		t.Fatalf("expected the archive to be replaced")
+	}
+	if _, contents := readTarball(t, dest); contents["usr/bin/oc"] != "oc binary" {
+		t.Fatalf("unexpected contents %v", contents)
+	}
+}
+
+func TestExtractTooLarge(t *testing.T) {
+	maxFileSize, maxExtractSize := MaxFileSize, MaxExtractSize
+	defer func() {
+		MaxFileSize, MaxExtractSize = maxFileSize, maxExtractSize
+	}()
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: strings.Repeat("o", 64), mode: 0755},
+		{name: "usr/share/oc/config", content: strings.Repeat("c", 32), mode: 0644},
+	})
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr/bin/oc", To: "."},
+			{From: "/usr/share/oc/config", To: "."},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		maxFileSize    int64
+		maxExtractSize int64
+		expectedErr    error
+	}{
+		{
+			name:           "within limits",
+			maxFileSize:    64,
+			maxExtractSize: 96,
+		},
+		{
+			name:           "file exceeds the maximum file size",
+			maxFileSize:    63,
+			maxExtractSize: 96,
+			expectedErr:    ErrTooLarge,
+		},
+		{
+			name:           "files exceed the maximum extract size",
+			maxFileSize:    64,
+			maxExtractSize: 95,
+			expectedErr:    ErrTooLarge,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			MaxFileSize, MaxExtractSize = tc.maxFileSize, tc.maxExtractSize
+			dest := filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz")
+			_, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			_, statErr := os.Stat(dest)
+			if tc.expectedErr != nil && !os.IsNotExist(statErr) {
+				t.Fatalf("expected partial archive to be removed, got %v", statErr)
+			}
+			if tc.expectedErr == nil && statErr != nil {
+				t.Fatalf("expected archive to be written, got %v", statErr)
+			}
+		})
+	}
+}
+
+func TestExtractFromDir(t *testing.T) {
+	maxExtractSize := MaxExtractSize
+	defer func() {
+		MaxExtractSize = maxExtractSize
+	}()
+	img := newTestImage(t, []testFile{
+		{name: "opt/tool/bin/tool", content: "tool binary", mode: 0644},
+		{name: "opt/tool/templates/default.tmpl", content: "old template", mode: 0644},
+		{name: "opt/toolbox/other", content: "other", mode: 0644},
+		{name: "usr/bin/oc", content: "oc binary", mode: 0755},
+	}, []testFile{
+		{name: "opt/tool/templates/default.tmpl", content: "new template", mode: 0644},
+		{name: "opt/tool/assets/logo.png", content: "logo", mode: 0644},
+	})
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "tool/bin/tool",
+		Files: []v1alpha1.FileLocation{
+			{FromDir: "/opt/tool", To: "."},
+		},
+	}
+
+	dest := filepath.Join(t.TempDir(), "tool_linux_amd64.tar.gz")
+	files, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+	if err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if !reflect.DeepEqual(files, platform.Files) {
+		t.Fatalf("unexpected files %+v", files)
+	}
+	headers, contents := readTarball(t, dest)
+	expected := map[string]string{
+		"opt/tool/bin/tool":               "tool binary",
+		"opt/tool/templates/default.tmpl": "new template",
+		"opt/tool/assets/logo.png":        "logo",
+	}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Fatalf("expected the tree of the directory only, got %v", contents)
+	}
+	if headers["opt/tool/bin/tool"].Mode&0111 != 0111 {
+		t.Fatalf("expected bin to be executable, got mode %o", headers["opt/tool/bin/tool"].Mode)
+	}
+	if headers["opt/tool/assets/logo.png"].Mode != 0644 {
+		t.Fatalf("expected mode of other files to be preserved, got mode %o", headers["opt/tool/assets/logo.png"].Mode)
+	}
+	if path := InstallPath(platform.Files[0]); path != "tool" {
+		t.Fatalf("expected the directory to be installed as tool, got %s", path)
+	}
+
+	// the whole tree counts towards the maximum extract size
+	MaxExtractSize = int64(len("tool binary") + len("new template"))
+	if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected error %v, got %v", ErrTooLarge, err)
+	}
+}
+
+func TestExtractFindByName(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "opt/vendor/kubectl", content: "vendored kubectl", mode: 0755},
+		{name: "usr/bin/kubectl", content: "kubectl", mode: 0755},
+		{name: "opt/tool/lib/tool", content: "tool binary", mode: 0755},
+	}, []testFile{
+		{name: "opt/other/kubectl", content: "other kubectl", mode: 0755},
+		{name: "opt/tool/bin/tool", content: "tool", mode: 0755},
+		{name: "usr/share/doc/tool", typeflag: tar.TypeDir},
+	})
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "kubectl",
+		Files: []v1alpha1.FileLocation{
+			{From: "kubectl", FindByName: true, To: "."},
+			{From: "tool", FindByName: true, To: "."},
+			{From: "missing", FindByName: true, To: "."},
+		},
+	}
+
+	dest := filepath.Join(t.TempDir(), "kubectl_linux_amd64.tar.gz")
+	files, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+	if err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	// the preferred directories win over the most recent layer,
+	// which wins otherwise
+	expected := []v1alpha1.FileLocation{
+		{From: "/usr/bin/kubectl", FindByName: true, To: "."},
+		{From: "/opt/tool/bin/tool", FindByName: true, To: "."},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected files %+v, got %+v", expected, files)
+	}
+	_, contents := readTarball(t, dest)
+	if !reflect.DeepEqual(contents, map[string]string{"usr/bin/kubectl": "kubectl", "opt/tool/bin/tool": "tool"}) {
+		t.Fatalf("unexpected contents %v", contents)
+	}
+	if platform.Files[0].From != "kubectl" {
+		t.Fatalf("expected the files of the platform to be left unchanged, got %+v", platform.Files)
+	}
+}
+
+func TestExtractArchiveLayout(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/tool", content: "tool binary", mode: 0644},
+		{name: "opt/tool/templates/default.tmpl", content: "template", mode: 0644},
+		{name: "etc/tool/config", content: "config", mode: 0644},
+		{name: "usr/share/tool/config", content: "other config", mode: 0644},
+	})
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "bin/tool",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr/bin/tool", To: "bin/"},
+			{FromDir: "/opt/tool", To: "."},
+			{From: "/etc/tool/config", To: "tool.conf"},
+		},
+	}
+
+	tests := []struct {
+		layout           string
+		expectedEntries  map[string]string
+		expectedFileFrom []string
+	}{
+		{
+			layout: ArchiveLayoutImage,
+			expectedEntries: map[string]string{
+				"usr/bin/tool":                    "tool binary",
+				"opt/tool/templates/default.tmpl": "template",
+				"etc/tool/config":                 "config",
+			},
+			expectedFileFrom: []string{"/usr/bin/tool", "/opt/tool", "/etc/tool/config"},
+		},
+		{
+			layout: ArchiveLayoutFlat,
+			expectedEntries: map[string]string{
+				"tool":                        "tool binary",
+				"tool/templates/default.tmpl": "template",
+				"config":                      "config",
+			},
+			expectedFileFrom: []string{"tool", "tool", "config"},
+		},
+		{
+			layout: ArchiveLayoutPrefixed,
+			expectedEntries: map[string]string{
+				"mytool/usr/bin/tool":                    "tool binary",
+				"mytool/opt/tool/templates/default.tmpl": "template",
+				"mytool/etc/tool/config":                 "config",
+			},
+			expectedFileFrom: []string{"mytool/usr/bin/tool", "mytool/opt/tool", "mytool/etc/tool/config"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.layout, func(t *testing.T) {
+			opts := DefaultExtractOptions
+			opts.Layout = tc.layout
+			dest := filepath.Join(t.TempDir(), "mytool_linux_amd64.tar.gz")
+			files, err := Extract(context.Background(), img, platform, dest, opts)
+			if err != nil {
+				t.Fatalf("unexpected extract error %v", err)
+			}
+			if !reflect.DeepEqual(files, platform.Files) {
+				t.Fatalf("unexpected files %+v", files)
+			}
+			headers, contents := readTarball(t, dest)
+			if !reflect.DeepEqual(contents, tc.expectedEntries) {
+				t.Fatalf("expected entries %v, got %v", tc.expectedEntries, contents)
+			}
+			// the manifest refers to the entries of the archive, which
+			// are installed in the same paths in every layout
+			for i, f := range platform.Files {
+				if from := opts.EntryName("mytool", f); from != tc.expectedFileFrom[i] {
+					t.Fatalf("expected file %s to be %s in the archive, got %s", SourcePath(f), tc.expectedFileFrom[i], from)
+				}
+			}
+			if path := InstallPath(platform.Files[0]); path != platform.Bin {
+				t.Fatalf("expected the bin to be installed as %s, got %s", platform.Bin, path)
+			}
+			bin := strings.TrimPrefix(opts.EntryName("mytool", platform.Files[0]), "/")
+			if headers[bin].Mode&0111 != 0111 {
+				t.Fatalf("expected bin %s to be executable, got mode %o", bin, headers[bin].Mode)
+			}
+		})
+	}
+
+	// files of the same base name can not be flattened
+	opts := DefaultExtractOptions
+	opts.Layout = ArchiveLayoutFlat
+	platform.Files = append(platform.Files, v1alpha1.FileLocation{From: "/usr/share/tool/config", To: "other.conf"})
+	if _, err := Extract(context.Background(), img, platform, filepath.Join(t.TempDir(), "mytool_linux_amd64.tar.gz"), opts); err == nil || !strings.Contains(err.Error(), "are both written as config") {
+		t.Fatalf("expected the colliding entries to fail, got %v", err)
+	}
+}
+
+func TestExtractOptionsValidate(t *testing.T) {
+	for _, layout := range ArchiveLayouts {
+		opts := DefaultExtractOptions
+		opts.Layout = layout
+		if err := opts.Validate(); err != nil {
+			t.Fatalf("unexpected error for layout %s: %v", layout, err)
+		}
+	}
+	opts := DefaultExtractOptions
+	opts.Layout = "nested"
+	if err := opts.Validate(); err == nil {
+		t.Fatal("expected the invalid layout to fail")
+	}
+	opts = DefaultExtractOptions
+	opts.CompressionLevel = gzip.BestCompression + 1
+	if err := opts.Validate(); err == nil {
+		t.Fatal("expected the invalid compression level to fail")
+	}
+}
+
+func TestExtractImages(t *testing.T) {
+	wrapper := newTestImage(t, []testFile{{name: "usr/bin/tool", content: "tool wrapper", mode: 0755}})
+	runtime := newTestImage(t, []testFile{{name: "opt/runtime/lib.so", content: "embedded runtime", mode: 0644}})
+
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Image:    "quay.io/example/tool:latest",
+		Bin:      "tool",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr/bin/tool", To: "."},
+			{From: "/opt/runtime/lib.so", To: "lib", Image: "quay.io/example/runtime:latest"},
+		},
+	}
+	dest := filepath.Join(t.TempDir(), "tool_linux_amd64.tar.gz")
+	images := map[string]v1.Image{
+		"quay.io/example/tool:latest":    wrapper,
+		"quay.io/example/runtime:latest": runtime,
+	}
+	if refs := FileImages(platform); len(refs) != 2 || refs[0] != platform.Image {
+		t.Fatalf("unexpected file images %v", refs)
+	}
+
+	files, err := ExtractImages(context.Background(), images, platform, dest, DefaultExtractOptions)
+	if err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if len(files) != 2 || files[0].From != "/usr/bin/tool" || files[1].From != "/opt/runtime/lib.so" {
+		t.Fatalf("unexpected files %+v", files)
+	}
+	headers, contents := readTarball(t, dest)
+	if len(headers) != 2 {
+		t.Fatalf("expected both files in a single archive, got %v", headers)
+	}
+	if contents["usr/bin/tool"] != "tool wrapper" || contents["opt/runtime/lib.so"] != "embedded runtime" {
+		t.Fatalf("unexpected contents %v", contents)
+	}
+
+	// every image of the files must be pulled
+	delete(images, "quay.io/example/runtime:latest")
+	if _, err := ExtractImages(context.Background(), images, platform, dest, DefaultExtractOptions); err == nil {
+		t.Fatalf("expected error for the image which is not pulled")
+	}
+}
+
+func TestExtractHardlink(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]testFile
+	}{
+		{
+			name: "target in the same layer",
+			layers: [][]testFile{
+				{
+					{name: "usr/libexec/kubectl", content: "kubectl binary", mode: 0755},
+					{name: "usr/bin/kubectl", typeflag: tar.TypeLink, linkname: "usr/libexec/kubectl"},
+				},
+			},
+		},
+		{
+			name: "target in a lower layer",
+			layers: [][]testFile{
+				{
+					{name: "usr/libexec/kubectl", content: "kubectl binary", mode: 0755},
+				},
+				{
+					{name: "usr/bin/kubectl", typeflag: tar.TypeLink, linkname: "./usr/libexec/kubectl"},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := newTestImage(t, tc.layers...)
+			platform := v1alpha1.PluginPlatform{
+				Platform: "linux/amd64",
+				Bin:      "kubectl",
+				Files: []v1alpha1.FileLocation{
+					{From: "/usr/bin/kubectl", To: "."},
+				},
+			}
+			dest := filepath.Join(t.TempDir(), "kubectl_linux_amd64.tar.gz")
+			files, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+			if err != nil {
+				t.Fatalf("unexpected extract error %v", err)
+			}
+			if len(files) != 1 {
+				t.Fatalf("expected 1 file, got %d", len(files))
+			}
+
+			headers, contents := readTarball(t, dest)
+			if len(headers) != 1 {
+				t.Fatalf("expected only the link to be archived, got %v", headers)
+			}
+			if headers["usr/bin/kubectl"].Typeflag != tar.TypeReg {
+				t.Fatalf("expected regular file, got type %v", headers["usr/bin/kubectl"].Typeflag)
+			}
+			if contents["usr/bin/kubectl"] != "kubectl binary" {
+				t.Fatalf("unexpected content %q", contents["usr/bin/kubectl"])
+			}
+		})
+	}
+}
+
+func TestExtractArtifact(t *testing.T) {
+	const artifactType = "application/vnd.example.cli.binary"
+	img, err := mutate.Append(empty.Image,
+		mutate.Addendum{
+			Layer:       &blobLayer{content: []byte("oc binary"), mediaType: artifactType},
+			Annotations: map[string]string{"org.opencontainers.image.title": "oc"},
+		},
+		mutate.Addendum{
+			Layer:       &blobLayer{content: []byte("README"), mediaType: "text/plain"},
+			Annotations: map[string]string{"org.opencontainers.image.title": "README"},
+		},
+		mutate.Addendum{
+			Layer:       &blobLayer{content: []byte("kubectl binary"), mediaType: artifactType},
+			Annotations: map[string]string{"org.opencontainers.image.title": "kubectl"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected append error %v", err)
+	}
+
+	platform := v1alpha1.PluginPlatform{
+		Platform:     "linux/amd64",
+		Bin:          "oc",
+		ArtifactType: artifactType,
+		Files: []v1alpha1.FileLocation{
+			{From: "/oc", To: "."},
+			{From: "/bin/kubectl", To: "."},
+		},
+	}
+	dest := filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz")
+	files, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+	if err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	headers, contents := readTarball(t, dest)
+	if contents["oc"] != "oc binary" || contents["bin/kubectl"] != "kubectl binary" {
+		t.Fatalf("unexpected contents %v", contents)
+	}
+	if headers["oc"].Mode&0111 != 0111 {
+		t.Fatalf("expected bin to be executable, got mode %o", headers["oc"].Mode)
+	}
+}
+
+func TestMirrorReference(t *testing.T) {
+	mirrors := map[string]string{
+		"quay.io":                   "mirror.example.com",
+		"quay.io/openshift":         "mirror.example.com:5000/ocp/",
+		"docker.io/library":         "mirror.example.com/hub",
+		"registry.example.com/team": "mirror.example.com/team",
+	}
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{
+			name:     "registry mirror",
+			src:      "quay.io/foo/bar:v1",
+			expected: "mirror.example.com/foo/bar:v1",
+		},
+		{
+			name:     "most specific mirror takes precedence",
+			src:      "quay.io/openshift/origin-cli:latest",
+			expected: "mirror.example.com:5000/ocp/origin-cli:latest",
+		},
+		{
+			name:     "digest is kept",
+			src:      "quay.io/openshift/origin-cli@" + digest,
+			expected: "mirror.example.com:5000/ocp/origin-cli@" + digest,
+		},
+		{
+			name:     "docker hub short name",
+			src:      "busybox",
+			expected: "mirror.example.com/hub/busybox:latest",
+		},
+		{
+			name:     "repository prefix matches path segments only",
+			src:      "registry.example.com/teamfoo/bar:v1",
+			expected: "registry.example.com/teamfoo/bar:v1",
+		},
+		{
+			name:     "no mirror",
+			src:      "ghcr.io/foo/bar:v1",
+			expected: "ghcr.io/foo/bar:v1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := MirrorReference(tc.src, mirrors)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if ref != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, ref)
+			}
+		})
+	}
+}
+
+// newTestRegistry serves img under every repository and tag of a registry
+// and records the repositories pulled.
+func newTestRegistry(t *testing.T, img v1.Image) (*httptest.Server, *[]string) {
+	t.Helper()
+	manifest, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("unexpected manifest error %v", err)
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		t.Fatalf("unexpected media type error %v", err)
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatalf("unexpected config error %v", err)
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		t.Fatalf("unexpected config name error %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("unexpected layers error %v", err)
+	}
+
+	var pulled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		if repository, _, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/"); ok {
+			pulled = append(pulled, repository)
+			w.Header().Set("Content-Type", string(mediaType))
+			w.Write(manifest)
+			return
+		}
+		_, digest, ok := strings.Cut(r.URL.Path, "/blobs/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if digest == configName.String() {
+			w.Write(config)
+			return
+		}
+		for _, l := range layers {
+			if d, _ := l.Digest(); d.String() == digest {
+				rc, err := l.Compressed()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				defer rc.Close()
+				io.Copy(w, rc)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &pulled
+}
+
+func TestPullMirror(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0755},
+	})
+	server, pulled := newTestRegistry(t, img)
+	mirror := strings.TrimPrefix(server.URL, "http://")
+
+	pulledImg, err := Pull(context.Background(), "quay.io/openshift/origin-cli:latest", PullOptions{
+		Mirrors: map[string]string{
+			"quay.io/openshift": mirror + "/ocp",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected pull error %v", err)
+	}
+	if len(*pulled) != 1 || (*pulled)[0] != "ocp/origin-cli" {
+		t.Fatalf("expected image to be pulled from the mirror, got %v", *pulled)
+	}
+
+	dest := filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz")
+	_, err = Extract(context.Background(), pulledImg, v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr/bin/oc", To: "."},
+		},
+	}, dest, DefaultExtractOptions)
+	if err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if _, contents := readTarball(t, dest); contents["usr/bin/oc"] != "oc binary" {
+		t.Fatalf("unexpected contents %v", contents)
+	}
+}
+
+func TestPullDockerConfig(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0755},
+	})
+	registry, _ := newTestRegistry(t, img)
+	target, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatalf("unexpected url error %v", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		authorizations = append(authorizations, user)
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dockerConfig := t.TempDir()
+	config := fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, host, base64.StdEncoding.EncodeToString([]byte("node:secret")))
+	if err := os.WriteFile(filepath.Join(dockerConfig, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatalf("unexpected write error %v", err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", dockerConfig)
+
+	tests := []struct {
+		name         string
+		auth         string
+		expectedUser string
+	}{
+		{
+			name:         "docker config is consulted without auth",
+			expectedUser: "node",
+		},
+		{
+			name:         "explicit auth takes precedence",
+			auth:         base64.StdEncoding.EncodeToString([]byte("plugin:secret")),
+			expectedUser: "plugin",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			authorizations = nil
+			_, err := Pull(context.Background(), host+"/openshift/origin-cli:latest", PullOptions{
+				Auth: tc.auth,
+			})
+			if err != nil {
+				t.Fatalf("unexpected pull error %v", err)
+			}
+			if len(authorizations) == 0 {
+				t.Fatalf("expected the registry to be accessed with credentials")
+			}
+			for _, user := range authorizations {
+				if user != tc.expectedUser {
+					t.Fatalf("expected credentials of %s, got %s", tc.expectedUser, user)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractCompressionLevel(t *testing.T) {
+	content := strings.Repeat("oc binary ", 1<<16)
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: content, mode: 0755},
+	})
+
+	for _, tc := range []struct {
+		name     string
+		platform string
+	}{
+		{name: "tar.gz", platform: "linux/amd64"},
+		{name: "zip", platform: "windows/amd64"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			platform := v1alpha1.PluginPlatform{
+				Platform: tc.platform,
+				Bin:      "oc",
+				Files: []v1alpha1.FileLocation{
+					{From: "/usr/bin/oc", To: "."},
+				},
+			}
+			parsed, err := pluginplatform.Parse(tc.platform)
+			if err != nil {
+				t.Fatalf("unexpected parse error %v", err)
+			}
+			sizes := map[int]int64{}
+			for _, level := range []int{gzip.DefaultCompression, gzip.NoCompression} {
+				dest := filepath.Join(t.TempDir(), ArchiveName("oc", parsed))
+				if _, err := Extract(context.Background(), img, platform, dest, ExtractOptions{CompressionLevel: level}); err != nil {
+					t.Fatalf("unexpected extract error at level %d %v", level, err)
+				}
+				info, err := os.Stat(dest)
+				if err != nil {
+					t.Fatalf("unexpected stat error %v", err)
+				}
+				sizes[level] = info.Size()
+
+				var extracted string
+				if parsed.IsWindows() {
+					zr, err := zip.OpenReader(dest)
+					if err != nil {
+						t.Fatalf("unexpected zip error %v", err)
+					}
+					// the file follows the entries of its parent directories
+					rc, err := zr.File[len(zr.File)-1].Open()
+					if err != nil {
+						t.Fatalf("unexpected zip open error %v", err)
+					}
+					data, err := io.ReadAll(rc)
+					rc.Close()
+					zr.Close()
+					if err != nil {
+						t.Fatalf("unexpected zip read error %v", err)
+					}
+					extracted = string(data)
+				} else {
+					_, contents := readTarball(t, dest)
+					extracted = contents["usr/bin/oc"]
+				}
+				if extracted != content {
+					t.Fatalf("expected identical contents at level %d", level)
+				}
+			}
+			if sizes[gzip.NoCompression] <= sizes[gzip.DefaultCompression] {
+				t.Fatalf("expected store only archive to be larger, got %d and %d bytes", sizes[gzip.NoCompression], sizes[gzip.DefaultCompression])
+			}
+		})
+	}
+
+	if _, err := Extract(context.Background(), img, v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files:    []v1alpha1.FileLocation{{From: "/usr/bin/oc", To: "."}},
+	}, filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz"), ExtractOptions{CompressionLevel: 10}); err == nil {
+		t.Fatalf("expected invalid compression level to fail")
+	}
+}
+
+func BenchmarkExtractCompressionLevel(b *testing.B) {
+	img := newTestImage(b, []testFile{
+		{name: "usr/bin/oc", content: strings.Repeat("oc binary ", 1<<20), mode: 0755},
+	})
+	dest := filepath.Join(b.TempDir(), "oc_linux_amd64.tar.gz")
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr/bin/oc", To: "."},
+		},
+	}
+
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestSpeed, gzip.NoCompression} {
+		b.Run(fmt.Sprintf("level %d", level), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Extract(context.Background(), img, platform, dest, ExtractOptions{CompressionLevel: level}); err != nil {
+					b.Fatalf("unexpected extract error %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractWindowsZip(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/share/openshift/windows/oc.exe", content: "oc windows binary", mode: 0644},
+		{name: "usr/share/openshift/windows/LICENSE", content: "license", mode: 0644},
+	})
+
+	platform := v1alpha1.PluginPlatform{
+		Platform: "windows/amd64",
+		Bin:      "oc.exe",
+		Files: []v1alpha1.FileLocation{
+			{From: "/usr/share/openshift/windows/oc.exe", To: "."},
+			{From: "/usr/share/openshift/windows/LICENSE", To: "."},
+		},
+	}
+	name := ArchiveName("oc", pluginplatform.Platform{OS: "windows", Arch: "amd64"})
+	if name != "oc_windows_amd64.zip" {
+		t.Fatalf("unexpected archive name %s", name)
+	}
+	if linuxName := ArchiveName("oc", pluginplatform.Platform{OS: "linux", Arch: "amd64"}); linuxName != "oc_linux_amd64.tar.gz" {
+		t.Fatalf("unexpected archive name %s", linuxName)
+	}
+	dest := filepath.Join(t.TempDir(), name)
+	files, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+	if err != nil {
+		t.Fatalf("unexpected extract error %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	zr, err := zip.OpenReader(dest)
+	if err != nil {
+		t.Fatalf("unexpected zip error %v", err)
+	}
+	defer zr.Close()
+	contents := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("unexpected zip open error %v", err)
+		}
+		// reading the whole file verifies its CRC-32 checksum
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("unexpected zip read error %v", err)
+		}
+		contents[f.Name] = string(data)
+		if f.Name == "usr/share/openshift/windows/oc.exe" && f.Mode()&0111 != 0111 {
+			t.Fatalf("expected bin to be executable, got mode %o", f.Mode())
+		}
+	}
+	if contents["usr/share/openshift/windows/oc.exe"] != "oc windows binary" || contents["usr/share/openshift/windows/LICENSE"] != "license" {
+		t.Fatalf("unexpected contents %v", contents)
+	}
+}
+
+// layerDigest returns the digest of the layer of the image at index.
+func layerDigest(t testing.TB, img v1.Image, index int) string {
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("unexpected layers error %v", err)
+	}
+	digest, err := layers[index].Digest()
+	if err != nil {
+		t.Fatalf("unexpected digest error %v", err)
+	}
+	return digest.String()
+}
+
+func TestExtractLayerDigest(t *testing.T) {
+	img := newTestImage(t,
+		[]testFile{{name: "usr/bin/oc", content: "oc binary", mode: 0755}},
+		[]testFile{{name: "usr/share/oc/config", content: "config", mode: 0644}},
+		[]testFile{{name: "etc/motd", content: "motd", mode: 0644}},
+	)
+
+	tests := []struct {
+		name          string
+		layerDigest   string
+		files         []v1alpha1.FileLocation
+		expectedError bool
+	}{
+		{
+			name:        "files in the layer",
+			layerDigest: layerDigest(t, img, 0),
+			files: []v1alpha1.FileLocation{
+				{From: "/usr/bin/oc", To: "."},
+			},
+		},
+		{
+			name:        "files in other layers",
+			layerDigest: layerDigest(t, img, 2),
+			files: []v1alpha1.FileLocation{
+				{From: "/usr/bin/oc", To: "."},
+				{From: "/usr/share/oc/config", To: "."},
+			},
+		},
+		{
+			name:        "layer not in the image",
+			layerDigest: "sha256:" + strings.Repeat("a", 64),
+			files: []v1alpha1.FileLocation{
+				{From: "/usr/bin/oc", To: "."},
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			platform := v1alpha1.PluginPlatform{
+				Platform:    "linux/amd64",
+				Bin:         "oc",
+				LayerDigest: tc.layerDigest,
+				Files:       tc.files,
+			}
+			dest := filepath.Join(t.TempDir(), "oc_linux_amd64.tar.gz")
+			files, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions)
+			if tc.expectedError {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected extract error %v", err)
+			}
+			if len(files) != len(tc.files) {
+				t.Fatalf("expected %d files, got %d", len(tc.files), len(files))
+			}
+			headers, _ := readTarball(t, dest)
+			if len(headers) != len(tc.files) {
+				t.Fatalf("expected each file to be archived once, got %v", headers)
+			}
+		})
+	}
+}
+
+func BenchmarkExtractLayerDigest(b *testing.B) {
+	// the binary is in the base layer of a large image
+	layers := [][]testFile{{{name: "usr/bin/oc", content: strings.Repeat("oc binary", 1024), mode: 0755}}}
+	for i := 0; i < 200; i++ {
+		layers = append(layers, []testFile{{name: fmt.Sprintf("usr/share/doc/%d", i), content: strings.Repeat("doc", 1024), mode: 0644}})
+	}
+	img := newTestImage(b, layers...)
+	dest := filepath.Join(b.TempDir(), "oc_linux_amd64.tar.gz")
+
+	for _, bc := range []struct {
+		name        string
+		layerDigest string
+	}{
+		{name: "without hint"},
+		{name: "with hint", layerDigest: layerDigest(b, img, 0)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			platform := v1alpha1.PluginPlatform{
+				Platform:    "linux/amd64",
+				Bin:         "oc",
+				LayerDigest: bc.layerDigest,
+				Files: []v1alpha1.FileLocation{
+					{From: "/usr/bin/oc", To: "."},
+				},
+			}
+			for i := 0; i < b.N; i++ {
+				if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+					b.Fatalf("unexpected extract error %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExtractSingleLayer(b *testing.B) {
+	// a distroless like image whose single layer has tens of thousands of
+	// entries, a few of them being extracted
+	var files []testFile
+	var locations []v1alpha1.FileLocation
+	for i := 0; i < 20000; i++ {
+		files = append(files, testFile{name: fmt.Sprintf("usr/lib/%d", i), content: "lib", mode: 0644})
+		if i%400 == 0 {
+			locations = append(locations, v1alpha1.FileLocation{From: fmt.Sprintf("/usr/lib/%d", i), To: "lib/"})
+		}
+	}
+	files = append(files, testFile{name: "usr/bin/oc", content: "oc binary", mode: 0755})
+	locations = append(locations, v1alpha1.FileLocation{From: "/usr/bin/oc", To: "."})
+	img := newTestImage(b, files)
+	dest := filepath.Join(b.TempDir(), "oc_linux_amd64.tar.gz")
+
+	platform := v1alpha1.PluginPlatform{
+		Platform: "linux/amd64",
+		Bin:      "oc",
+		Files:    locations,
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+			b.Fatalf("unexpected extract error %v", err)
+		}
+	}
+}
+
+func TestArchiveWriterEntryName(t *testing.T) {
+	tests := []struct {
+		name          string
+		entry         string
+		expectedError bool
+	}{
+		{
+			name:  "relative entry",
+			entry: "usr/bin/oc",
+		},
+		{
+			name:          "absolute entry",
+			entry:         "/usr/bin/oc",
+			expectedError: true,
+		},
+		{
+			name:          "traversal entry",
+			entry:         "../../usr/bin/oc",
+			expectedError: true,
+		},
+		{
+			name:          "windows traversal entry",
+			entry:         `bin\..\..\oc.exe`,
+			expectedError: true,
+		},
+		{
+			name:          "windows drive entry",
+			entry:         `C:\oc.exe`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		for _, p := range []string{"linux/amd64", "windows/amd64"} {
+			t.Run(tc.name+" "+p, func(t *testing.T) {
+				parsed, err := pluginplatform.Parse(p)
+				if err != nil {
+					t.Fatalf("unexpected platform error %v", err)
+				}
+				buf := &bytes.Buffer{}
+				aw, err := newArchiveWriter(buf, nil, parsed, gzip.DefaultCompression)
+				if err != nil {
+					t.Fatalf("unexpected archive writer error %v", err)
+				}
+				err = aw.WriteFile(&tar.Header{Name: tc.entry, Mode: 0755, Size: 2, Typeflag: tar.TypeReg}, strings.NewReader("oc"))
+				if (err != nil) != tc.expectedError {
+					t.Fatalf("expected error %t, got %v", tc.expectedError, err)
+				}
+			})
+		}
+	}
+}
+
+func TestExtractDirectoryEntries(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0755},
+		{name: "usr/share/oc/config", content: "config", mode: 0644},
+	})
+
+	for _, p := range []string{"linux/amd64", "windows/amd64"} {
+		t.Run(p, func(t *testing.T) {
+			platform := v1alpha1.PluginPlatform{
+				Platform: p,
+				Bin:      "bin/sub/tool",
+				Files: []v1alpha1.FileLocation{
+					{From: "/usr/bin/oc", To: "bin/sub/tool"},
+					{From: "/usr/share/oc/config", To: "etc/"},
+				},
+			}
+			parsed, err := pluginplatform.Parse(p)
+			if err != nil {
+				t.Fatalf("unexpected platform error %v", err)
+			}
+			dest := filepath.Join(t.TempDir(), ArchiveName("oc", parsed))
+			if _, err := Extract(context.Background(), img, platform, dest, DefaultExtractOptions); err != nil {
+				t.Fatalf("unexpected extract error %v", err)
+			}
+
+			var entries []string
+			if parsed.IsWindows() {
+				zr, err := zip.OpenReader(dest)
+				if err != nil {
+					t.Fatalf("unexpected zip error %v", err)
+				}
+				defer zr.Close()
+				for _, f := range zr.File {
+					if strings.HasSuffix(f.Name, "/") != f.Mode().IsDir() {
+						t.Fatalf("unexpected mode %v of entry %s", f.Mode(), f.Name)
+					}
+					entries = append(entries, f.Name)
+				}
+			} else {
+				f, err := os.Open(dest)
+				if err != nil {
+					t.Fatalf("unexpected open error %v", err)
+				}
+				defer f.Close()
+				gr, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatalf("unexpected gzip error %v", err)
+				}
+				tr := tar.NewReader(gr)
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("unexpected tar error %v", err)
+					}
+					if strings.HasSuffix(hdr.Name, "/") != (hdr.Typeflag == tar.TypeDir) {
+						t.Fatalf("unexpected type %c of entry %s", hdr.Typeflag, hdr.Name)
+					}
+					entries = append(entries, hdr.Name)
+				}
+			}
+			// each directory is written once, before the files it contains
+			expected := []string{"usr/", "usr/bin/", "usr/bin/oc", "usr/share/", "usr/share/oc/", "usr/share/oc/config"}
+			if !reflect.DeepEqual(entries, expected) {
+				t.Fatalf("expected entries %v, got %v", expected, entries)
+			}
+		})
+	}
+}
+
+func TestPullProxy(t *testing.T) {
+	img := newTestImage(t, []testFile{
+		{name: "usr/bin/oc", content: "oc binary", mode: 0755},
+	})
+	registry, pulled := newTestRegistry(t, img)
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	// the stub proxy forwards the absolute URLs of the requests to the
+	// registry, which is pinged over https first
+	var proxied []string
+	forward := &httputil.ReverseProxy{Director: func(r *http.Request) {}}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Host)
+		if r.Method == http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		forward.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("unexpected url error %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		noProxy []string
+		proxied bool
+	}{
+		{name: "proxy", proxied: true},
+		{name: "no proxy for other hosts", noProxy: []string{"quay.io", ".example.com"}, proxied: true},
+		{name: "no proxy for the registry", noProxy: []string{"quay.io", "127.0.0.0/8"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxied, *pulled = nil, nil
+			_, err := Pull(context.Background(), host+"/ocp/origin-cli:latest", PullOptions{
+				Proxy:   proxyURL,
+				NoProxy: test.noProxy,
+			})
+			if err != nil {
+				t.Fatalf("unexpected pull error %v", err)
+			}
+			if len(*pulled) != 1 {
+				t.Fatalf("expected image to be pulled, got %v", *pulled)
+			}
+			if test.proxied != (len(proxied) > 0) {
+				t.Fatalf("expected requests to be proxied %t, got %v", test.proxied, proxied)
+			}
+			for _, h := range proxied {
+				if h != host {
+					t.Fatalf("expected requests to %s to be proxied, got %s", host, h)
+				}
+			}
+		})
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := []string{"registry.example.com", ".internal", "10.0.0.0/8", "192.168.1.1"}
+	tests := []struct {
+		host   string
+		bypass bool
+	}{
+		{host: "registry.example.com", bypass: true},
+		{host: "quay.registry.example.com", bypass: true},
+		{host: "example.com"},
+		{host: "mirror.internal", bypass: true},
+		{host: "internal", bypass: true},
+		{host: "10.1.2.3", bypass: true},
+		{host: "11.1.2.3"},
+		{host: "192.168.1.1", bypass: true},
+		{host: "192.168.1.2"},
+		{host: "quay.io"},
+	}
+	for _, test := range tests {
+		if bypass := bypassProxy(test.host, noProxy); bypass != test.bypass {
+			t.Errorf("expected %s to bypass the proxy %t, got %t", test.host, test.bypass, bypass)
+		}
+	}
+	if !bypassProxy("quay.io", []string{"*"}) {
+		t.Errorf("expected * to bypass the proxy for every host")
+	}
+}
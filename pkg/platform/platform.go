@@ -0,0 +1,60 @@
+// Package platform parses, validates and serializes the platforms of plugins,
+// given either in os/arch[/variant] format or in the os_arch[_variant] format
+// of the archive file names and download URLs.
+package platform
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var platformRegexp = regexp.MustCompile("^(linux|darwin|windows)/(arm64|amd64|ppc64le|s390x|arm)(/v[5-8])?$")
+
+// Platform is a supported os, arch and optional variant of a plugin.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// Parse parses and validates the platform in os/arch[/variant] or
+// os_arch[_variant] format.
+func Parse(s string) (Platform, error) {
+	normalized := strings.ReplaceAll(s, "_", "/")
+	if !platformRegexp.MatchString(normalized) {
+		return Platform{}, fmt.Errorf("invalid platform %s, please ensure that OS (linux/darwin/windows) and arch (arm64/amd64/ppc64le/s390x/arm) are supported and in linux/amd64 or linux/arm/v7 format", s)
+	}
+	fields := strings.SplitN(normalized, "/", 3)
+	p := Platform{
+		OS:   fields[0],
+		Arch: fields[1],
+	}
+	if len(fields) == 3 {
+		p.Variant = fields[2]
+	}
+	return p, nil
+}
+
+// String returns the platform in os/arch[/variant] format.
+func (p Platform) String() string {
+	return p.join("/")
+}
+
+// FileName returns the platform in os_arch[_variant] format, which is
+// used in the archive file names and the download URLs.
+func (p Platform) FileName() string {
+	return p.join("_")
+}
+
+// IsWindows reports whether the os of the platform is windows.
+func (p Platform) IsWindows() bool {
+	return p.OS == "windows"
+}
+
+func (p Platform) join(sep string) string {
+	if len(p.Variant) > 0 {
+		return strings.Join([]string{p.OS, p.Arch, p.Variant}, sep)
+	}
+	return strings.Join([]string{p.OS, p.Arch}, sep)
+}
@@ -0,0 +1,83 @@
+package platform
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		platform         string
+		expected         Platform
+		expectedString   string
+		expectedFileName string
+	}{
+		{
+			platform:         "linux/amd64",
+			expected:         Platform{OS: "linux", Arch: "amd64"},
+			expectedString:   "linux/amd64",
+			expectedFileName: "linux_amd64",
+		},
+		{
+			platform:         "darwin_arm64",
+			expected:         Platform{OS: "darwin", Arch: "arm64"},
+			expectedString:   "darwin/arm64",
+			expectedFileName: "darwin_arm64",
+		},
+		{
+			platform:         "linux/arm/v7",
+			expected:         Platform{OS: "linux", Arch: "arm", Variant: "v7"},
+			expectedString:   "linux/arm/v7",
+			expectedFileName: "linux_arm_v7",
+		},
+		{
+			platform:         "windows_amd64",
+			expected:         Platform{OS: "windows", Arch: "amd64"},
+			expectedString:   "windows/amd64",
+			expectedFileName: "windows_amd64",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.platform, func(t *testing.T) {
+			p, err := Parse(tc.platform)
+			if err != nil {
+				t.Fatalf("unexpected parse error %v", err)
+			}
+			if p != tc.expected {
+				t.Fatalf("expected %+v, got %+v", tc.expected, p)
+			}
+			if p.String() != tc.expectedString || p.FileName() != tc.expectedFileName {
+				t.Fatalf("unexpected serialization %s %s", p.String(), p.FileName())
+			}
+			// both formats round-trip to the same platform
+			for _, s := range []string{p.String(), p.FileName()} {
+				if roundTrip, err := Parse(s); err != nil || roundTrip != p {
+					t.Fatalf("expected %s to round-trip to %+v, got %+v error %v", s, p, roundTrip, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, platform := range []string{
+		"",
+		"linux",
+		"linux/",
+		"/amd64",
+		"Linux/amd64",
+		"linux/x86_64",
+		"freebsd/amd64",
+		"linux/arm/v9",
+		"linux/amd64/v7/extra",
+		"linux/amd64/",
+		"linux//amd64",
+		"../linux/amd64",
+	} {
+		t.Run(platform, func(t *testing.T) {
+			if p, err := Parse(platform); err == nil {
+				t.Fatalf("expected parse error, got %+v", p)
+			}
+		})
+	}
+}